@@ -2,139 +2,72 @@ package main
 
 import (
 	"context"
-	"errors"
-	"io"
 	"net"
+	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/eternalApril/moonlight"
 	"github.com/eternalApril/moonlight/internal/config"
 	"github.com/eternalApril/moonlight/internal/logger"
-	"github.com/eternalApril/moonlight/internal/resp"
 	"github.com/eternalApril/moonlight/internal/server"
-	"github.com/eternalApril/moonlight/internal/storage"
 	"go.uber.org/zap"
 )
 
-// handleConnection handles a connection for a single user
-func handleConnection(conn net.Conn, engine *server.Engine, log *zap.Logger) {
-	if log.Core().Enabled(zap.DebugLevel) {
-		log.Debug("client connected", zap.String("addr", conn.RemoteAddr().String()))
-	}
-
-	peer := server.NewPeer(conn)
-	defer func() {
-		peer.Close() //nolint:errcheck
-		// log connection close
-		if log.Core().Enabled(zap.DebugLevel) {
-			log.Debug("client disconnected", zap.String("addr", conn.RemoteAddr().String()))
-		}
-	}()
-
-	for {
-		cmdValue, err := peer.ReadCommand()
-		if err != nil {
-			if err != io.EOF {
-				log.Warn("read command failed", zap.Error(err))
-			}
-			return
-		}
-
-		if cmdValue.Type != resp.TypeArray {
-			log.Error("invalid request type")
-			continue
-		}
-
-		if len(cmdValue.Array) == 0 {
-			continue
-		}
-
-		commandName := strings.ToUpper(string(cmdValue.Array[0].String))
-
-		args := cmdValue.Array[1:]
-
-		result := engine.Execute(peer, commandName, args)
-
-		if err = peer.Send(result); err != nil {
-			log.Error("error writing response:", zap.Error(err))
-			return
-		}
-
-		if peer.InputBuffered() == 0 {
-			if err := peer.Flush(); err != nil {
-				return
-			}
-		}
-	}
-}
-
 func main() {
 	cfg, err := config.Load(".")
 	if err != nil {
 		panic(err)
 	}
 
-	log := logger.New(cfg.Log.Level, cfg.Log.Format)
+	log, level := logger.NewLeveled(cfg.Log.Level, cfg.Log.Format)
 	defer log.Sync() //nolint:errcheck
 
 	log.Info("Moonlight starting",
 		zap.String("port", cfg.Server.Port),
-		zap.Uint("shards", cfg.Storage.Shards),
+		zap.Uint("shards", cfg.Storage.ShardCount),
 	)
 
-	db, err := storage.NewShardedMapStorage(cfg.Storage.Shards)
-	if err != nil {
-		log.Error("cant initialize storage", zap.Error(err))
-		return
-	}
-
-	engine, err := server.NewEngine(db, cfg, log)
+	db, err := moonlight.Open(cfg, log)
 	if err != nil {
 		log.Error("cant initialize storage", zap.Error(err))
 		return
 	}
 
-	address := net.JoinHostPort(cfg.Server.Host, cfg.Server.Port)
-	listener, err := net.Listen("tcp", address)
+	listeners, err := server.ListenAll(bindAddresses(cfg), cfg.Server.ReusePort, cfg.Server.BindFailFast, log)
 	if err != nil {
 		log.Error("listener error", zap.Error(err))
 		return
 	}
-	log.Info("listening on", zap.String("address", address))
+	for _, listener := range listeners {
+		log.Info("listening on", zap.String("address", listener.Addr().String()))
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	var wg sync.WaitGroup
-
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
-				}
-				log.Error("Accept error", zap.Error(err))
-				continue
-			}
-
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				handleConnection(conn, engine, log)
-			}()
+		for range hup {
+			reload(log, level, db)
 		}
 	}()
 
+	var wg sync.WaitGroup
+
+	go server.Serve(listeners, &wg, db.HandleConnection, log)
+
 	<-ctx.Done()
 
 	log.Info("Shutting down...")
 
-	listener.Close() //nolint:errcheck
-	engine.Shutdown()
+	for _, listener := range listeners {
+		listener.Close() //nolint:errcheck
+	}
+	db.Close()
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -154,3 +87,33 @@ func main() {
 
 	log.Info("Moonlight stopped")
 }
+
+// bindAddresses returns the addresses to listen on: every server.bind address, or server.host if the list is empty
+func bindAddresses(cfg *config.Config) []string {
+	hosts := cfg.Server.Bind
+	if len(hosts) == 0 {
+		hosts = []string{cfg.Server.Host}
+	}
+
+	addresses := make([]string, len(hosts))
+	for i, host := range hosts {
+		addresses[i] = net.JoinHostPort(host, cfg.Server.Port)
+	}
+	return addresses
+}
+
+// reload re-reads the config file on SIGHUP and applies the settings that can change at runtime
+func reload(log *zap.Logger, level zap.AtomicLevel, db *moonlight.DB) {
+	cfg, err := config.Load(".")
+	if err != nil {
+		log.Error("config reload failed, keeping the current settings", zap.Error(err))
+		return
+	}
+
+	if err := logger.SetLevel(level, cfg.Log.Level); err != nil {
+		log.Warn("invalid log.level, keeping the current level", zap.String("level", cfg.Log.Level))
+	}
+	db.Reload(cfg)
+
+	log.Info("config reloaded", zap.String("log_level", level.String()))
+}
@@ -49,3 +49,58 @@ func TestPipelining(t *testing.T) {
 		assert.Equal(t, expected, val, "Key %d mismatch", i)
 	}
 }
+
+// connect returns a client of the database on localhost:6380, the test is skipped when it does not answer
+func connect(tb testing.TB) *redis.Client {
+	tb.Helper()
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6380",
+	})
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		rdb.Close() //nolint:errcheck
+		tb.Skipf("database is not running on 127.0.0.1:6380: %v", err)
+	}
+	tb.Cleanup(func() {
+		rdb.Close() //nolint:errcheck
+	})
+
+	return rdb
+}
+
+// BenchmarkPipeline measures the throughput of a pipeline of SET and GET, compare the runs with
+// server.batch_flush enabled and disabled
+func BenchmarkPipeline(b *testing.B) {
+	rdb := connect(b)
+	ctx := context.Background()
+
+	const count = 1000
+	for i := 0; i < b.N; i++ {
+		pipe := rdb.Pipeline()
+		for j := 0; j < count; j++ {
+			key := fmt.Sprintf("bench_pipe_key_%d", j)
+			pipe.Set(ctx, key, "val", 0)
+			pipe.Get(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			b.Fatalf("pipeline execution failed: %v", err)
+		}
+	}
+	b.ReportMetric(float64(2*count*b.N)/b.Elapsed().Seconds(), "commands/s")
+}
+
+// TestSingleCommandLatency checks that the reply of a lone command is flushed right away,
+// batch flushing must not hold it until more input arrives
+func TestSingleCommandLatency(t *testing.T) {
+	rdb := connect(t)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+		err := rdb.Set(ctx, "latency_key", "val", 0).Err()
+		elapsed := time.Since(start)
+
+		assert.NoError(t, err)
+		assert.Less(t, elapsed, 50*time.Millisecond, "SET took %v", elapsed)
+	}
+}
@@ -2,12 +2,19 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
+// maxAutoShards is the upper bound of the shard count chosen by storage.shards: "auto"
+const maxAutoShards = 64
+
 // Config represents the root configuration structure for the application
 type Config struct {
 	Server      ServerConfig      `mapstructure:"server"`
@@ -19,10 +26,12 @@ type Config struct {
 
 // GCConfig defines the parameters for the background active expiration
 type GCConfig struct {
-	Enabled         bool          `mapstructure:"enabled"`
-	Interval        time.Duration `mapstructure:"interval"`          // how often to run the background check
-	SamplesPerCheck int           `mapstructure:"samples_per_check"` // how many keys to check per loop
-	MatchThreshold  float64       `mapstructure:"match_threshold"`   // 0.0-1.0. if expired/scanned > threshold, repeat immediately
+	Enabled          bool          `mapstructure:"enabled"`
+	Interval         time.Duration `mapstructure:"interval"`           // how often to run the background check
+	SamplesPerCheck  int           `mapstructure:"samples_per_check"`  // how many keys to check per loop
+	MatchThreshold   float64       `mapstructure:"match_threshold"`    // 0.0-1.0. if expired/scanned > threshold, repeat immediately
+	MaxRepeats       int           `mapstructure:"max_repeats"`        // limit of immediate repeats per tick, so the GC does not starve clients
+	BusyWarningRatio float64       `mapstructure:"busy_warning_ratio"` // 0.0-1.0. warn when the GC spends more of the wall time expiring keys, 0 disables
 }
 
 // ServerConfig holds the network settings
@@ -30,21 +39,61 @@ type ServerConfig struct {
 	Host        string `mapstructure:"host"`
 	Port        string `mapstructure:"port"`
 	RequirePass string `mapstructure:"requirepass"`
+	BatchFlush  bool   `mapstructure:"batch_flush"` // flush pipelined replies once the input buffer is drained
+
+	// refuse non-loopback clients when no password is set and the server listens on a non-loopback address
+	ProtectedMode bool `mapstructure:"protected_mode"`
+
+	Bind         []string `mapstructure:"bind"`           // hosts to listen on without a port, server.port is appended to each, overrides host
+	BindFailFast bool     `mapstructure:"bind_fail_fast"` // refuse to start when an address cannot be bound instead of skipping it
+
+	EnableDebugCommand bool `mapstructure:"enable_debug_command"` // allow the DEBUG command
+	ReusePort          bool `mapstructure:"reuse_port"`           // bind with SO_REUSEPORT (linux only)
+	ReadOnly           bool `mapstructure:"read_only"`            // reject write commands, can be toggled with CONFIG SET read-only
+	ProtoLenientCRLF   bool `mapstructure:"proto_lenient_crlf"`   // accept requests with lines terminated by a bare \n
+
+	ProtoMaxMultiBulkLen int64 `mapstructure:"proto_max_multibulk_len"` // maximum number of elements of a request array
+	ProtoMaxBulkLen      int64 `mapstructure:"proto_max_bulk_len"`      // maximum length of a request argument in bytes
+	KeysMaxResults       int   `mapstructure:"keys_max_results"`        // truncate KEYS replies to this many keys, 0 means unlimited
+
+	ClientMaxCommandsPerSec int `mapstructure:"client_max_commands_per_sec"` // reject the commands of a connection over this rate, 0 means unlimited
+
+	DebugQuicksaveMaxSize int64 `mapstructure:"debug_quicksave_max_size"` // largest RDB payload returned by DEBUG QUICKSAVE, in bytes
+
+	ReapIdleAfter time.Duration `mapstructure:"reap_idle_after"` // close connections idle for longer, 0 disables the reaper
+	ReapInterval  time.Duration `mapstructure:"reap_interval"`   // how often the reaper checks the connections
 }
 
 // StorageConfig defines the internal structure of the storage engine
 type StorageConfig struct {
-	Shards uint `mapstructure:"shards"`
+	Shards     string `mapstructure:"shards"`    // number of shards (power of 2) or "auto"
+	ShardCount uint   `mapstructure:"-"`         // resolved number of shards
+	HashFunc   string `mapstructure:"hash_func"` // hash selecting the shard of a key: fnv, maphash, xxhash
+
+	HashMaxListpackEntries int `mapstructure:"hash_max_listpack_entries"` // hashes with more fields are reported as hashtable
+	HashMaxListpackValue   int `mapstructure:"hash_max_listpack_value"`   // hashes with a longer field or value are reported as hashtable
+
+	ExpireJitter float64 `mapstructure:"expire_jitter"` // percentage by which relative TTLs are randomized
+
+	ProtoMaxStringLen int64 `mapstructure:"proto_max_string_len"` // maximum length of a string value in bytes
+
+	ListMaxLen int64 `mapstructure:"list_max_len"` // LPUSH/RPUSH trim lists to this length, 0 means unlimited
+
+	ExpireIndex bool `mapstructure:"expire_index"` // the GC pops due keys from a per-shard deadline heap instead of sampling
 }
 
 // LogConfig defines logging verbosity and output style
 type LogConfig struct {
-	Level  string `mapstructure:"level"`  // debug, info, warn, error
-	Format string `mapstructure:"format"` // json, console
+	Level         string `mapstructure:"level"`           // debug, info, warn, error
+	Format        string `mapstructure:"format"`          // json, console
+	AccessLog     bool   `mapstructure:"access_log"`      // log every executed command
+	AccessLogPath string `mapstructure:"access_log_path"` // file for the access log, empty means stdout
+	AccessLogArgs bool   `mapstructure:"access_log_args"` // include arguments in the access log, secrets are redacted
 }
 
 // PersistenceConfig defines settings of AOF and RDB methods
 type PersistenceConfig struct {
+	Dir string    `mapstructure:"dir"` // directory of the AOF and RDB files, created at startup. Empty means the working directory
 	AOF AOFConfig `mapstructure:"aof"`
 	RDB RDBConfig `mapstructure:"rdb"`
 }
@@ -54,6 +103,9 @@ type AOFConfig struct {
 	Enabled  bool   `mapstructure:"enabled"`
 	Filename string `mapstructure:"filename"`
 	Fsync    string `mapstructure:"fsync"` // always, everysec, no
+
+	SlowFsync    time.Duration `mapstructure:"slow_fsync"`     // fsyncs taking longer are logged and counted as delayed, 0 disables
+	OnWriteError string        `mapstructure:"on_write_error"` // stop, ignore
 }
 
 // RDBConfig defines settings of RDB method
@@ -61,6 +113,7 @@ type RDBConfig struct {
 	Enabled  bool   `mapstructure:"enabled"`
 	Filename string `mapstructure:"filename"`
 	Interval string `mapstructure:"interval"`
+	Mode     string `mapstructure:"mode"` // "low-latency" copies each shard before writing it, "low-memory" writes under the shard lock
 }
 
 // Load reads the configuration from a file and overrides it with environment variables
@@ -88,35 +141,156 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.GC.SamplesPerCheck <= 0 {
+		return nil, fmt.Errorf("gc.samples_per_check must be positive, got %d", cfg.GC.SamplesPerCheck)
+	}
+
+	if cfg.GC.MaxRepeats < 0 {
+		return nil, fmt.Errorf("gc.max_repeats must not be negative, got %d", cfg.GC.MaxRepeats)
+	}
+
+	if cfg.GC.BusyWarningRatio < 0 || cfg.GC.BusyWarningRatio > 1 {
+		return nil, fmt.Errorf("gc.busy_warning_ratio must be in [0, 1], got %v", cfg.GC.BusyWarningRatio)
+	}
+
+	if cfg.Server.ProtoMaxMultiBulkLen <= 0 {
+		return nil, fmt.Errorf("server.proto_max_multibulk_len must be positive, got %d", cfg.Server.ProtoMaxMultiBulkLen)
+	}
+
+	if cfg.Server.ProtoMaxBulkLen <= 0 {
+		return nil, fmt.Errorf("server.proto_max_bulk_len must be positive, got %d", cfg.Server.ProtoMaxBulkLen)
+	}
+
+	if cfg.Server.DebugQuicksaveMaxSize <= 0 {
+		return nil, fmt.Errorf("server.debug_quicksave_max_size must be positive, got %d", cfg.Server.DebugQuicksaveMaxSize)
+	}
+
+	if cfg.Server.ClientMaxCommandsPerSec < 0 {
+		return nil, fmt.Errorf("server.client_max_commands_per_sec must not be negative, got %d", cfg.Server.ClientMaxCommandsPerSec)
+	}
+
+	if cfg.Server.KeysMaxResults < 0 {
+		return nil, fmt.Errorf("server.keys_max_results must not be negative, got %d", cfg.Server.KeysMaxResults)
+	}
+
+	if cfg.Server.ReapIdleAfter < 0 {
+		return nil, fmt.Errorf("server.reap_idle_after must not be negative, got %v", cfg.Server.ReapIdleAfter)
+	}
+
+	if cfg.Server.ReapIdleAfter > 0 && cfg.Server.ReapInterval <= 0 {
+		return nil, fmt.Errorf("server.reap_interval must be positive, got %v", cfg.Server.ReapInterval)
+	}
+
+	for _, address := range cfg.Server.Bind {
+		if address == "" {
+			return nil, errors.New("server.bind must not contain empty addresses")
+		}
+		if _, _, err := net.SplitHostPort(address); err == nil {
+			return nil, fmt.Errorf("server.bind takes hosts only, server.port is used for all of them, got %q", address)
+		}
+	}
+
+	if cfg.Storage.ExpireJitter < 0 || cfg.Storage.ExpireJitter >= 100 {
+		return nil, fmt.Errorf("storage.expire_jitter must be in [0, 100), got %v", cfg.Storage.ExpireJitter)
+	}
+
+	if cfg.Storage.ProtoMaxStringLen <= 0 {
+		return nil, fmt.Errorf("storage.proto_max_string_len must be positive, got %d", cfg.Storage.ProtoMaxStringLen)
+	}
+
+	if cfg.Storage.ListMaxLen < 0 {
+		return nil, fmt.Errorf("storage.list_max_len must not be negative, got %d", cfg.Storage.ListMaxLen)
+	}
+
+	if p := cfg.Persistence.AOF.OnWriteError; p != "stop" && p != "ignore" {
+		return nil, fmt.Errorf("persistence.aof.on_write_error must be stop or ignore, got %q", p)
+	}
+
+	shards, err := resolveShards(cfg.Storage.Shards, runtime.GOMAXPROCS(0))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Storage.ShardCount = shards
+
 	return &cfg, nil
 }
 
+// resolveShards converts the storage.shards value into a shard count.
+// "auto" picks the next power of two >= procs, capped at maxAutoShards
+func resolveShards(value string, procs int) (uint, error) {
+	if !strings.EqualFold(value, "auto") {
+		n, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			return 0, fmt.Errorf("storage.shards must be a number or \"auto\", got %q", value)
+		}
+		return uint(n), nil
+	}
+
+	shards := uint(1)
+	for shards < uint(procs) && shards < maxAutoShards {
+		shards <<= 1
+	}
+
+	return shards, nil
+}
+
 // setDefaults populates viper with fallback values if they are not provided via file or ENV
 func setDefaults() {
 	// Server
 	viper.SetDefault("server.host", "0.0.0.0")
 	viper.SetDefault("server.port", "6380")
+	viper.SetDefault("server.bind", []string{})
+	viper.SetDefault("server.bind_fail_fast", true)
 	viper.SetDefault("server.requirepass", "")
+	viper.SetDefault("server.protected_mode", true)
+	viper.SetDefault("server.batch_flush", true)
+	viper.SetDefault("server.enable_debug_command", false)
+	viper.SetDefault("server.reuse_port", false)
+	viper.SetDefault("server.read_only", false)
+	viper.SetDefault("server.proto_lenient_crlf", false)
+	viper.SetDefault("server.proto_max_multibulk_len", 1024*1024)
+	viper.SetDefault("server.proto_max_bulk_len", 512*1024*1024)
+	viper.SetDefault("server.keys_max_results", 0)
+	viper.SetDefault("server.client_max_commands_per_sec", 0)
+	viper.SetDefault("server.debug_quicksave_max_size", 64*1024*1024)
+	viper.SetDefault("server.reap_idle_after", "0s")
+	viper.SetDefault("server.reap_interval", "10s")
 
 	// Storage
 	viper.SetDefault("storage.shards", 32)
+	viper.SetDefault("storage.hash_func", "fnv")
+	viper.SetDefault("storage.hash_max_listpack_entries", 128)
+	viper.SetDefault("storage.hash_max_listpack_value", 64)
+	viper.SetDefault("storage.expire_jitter", 0)
+	viper.SetDefault("storage.proto_max_string_len", 512*1024*1024)
+	viper.SetDefault("storage.list_max_len", 0)
+	viper.SetDefault("storage.expire_index", false)
 
 	// GC
 	viper.SetDefault("gc.enabled", true)
 	viper.SetDefault("gc.interval", "100ms")
-	viper.SetDefault("gc.sample_per_shard", 20)
-	viper.SetDefault("gc.expand_threshold", 0.25)
+	viper.SetDefault("gc.samples_per_check", 20)
+	viper.SetDefault("gc.match_threshold", 0.25)
+	viper.SetDefault("gc.max_repeats", 16)
+	viper.SetDefault("gc.busy_warning_ratio", 0.25)
 
 	// Logger
 	viper.SetDefault("log.level", "debug")
 	viper.SetDefault("log.format", "json")
+	viper.SetDefault("log.access_log", false)
+	viper.SetDefault("log.access_log_path", "")
+	viper.SetDefault("log.access_log_args", false)
 
 	// Persistence
+	viper.SetDefault("persistence.dir", "")
 	viper.SetDefault("persistence.aof.enabled", false)
 	viper.SetDefault("persistence.aof.filename", "appendonly.aof")
 	viper.SetDefault("persistence.aof.fsync", "everysec")
+	viper.SetDefault("persistence.aof.slow_fsync", "2s")
+	viper.SetDefault("persistence.aof.on_write_error", "stop")
 
 	viper.SetDefault("persistence.rdb.enabled", false)
 	viper.SetDefault("persistence.rdb.filename", "dump.rdb")
 	viper.SetDefault("persistence.rdb.interval", "60s")
+	viper.SetDefault("persistence.rdb.mode", "low-latency")
 }
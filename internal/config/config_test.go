@@ -0,0 +1,117 @@
+package config
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestResolveShards(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		procs   int
+		want    uint
+		wantErr bool
+	}{
+		{"Explicit", "32", 8, 32, false},
+		{"Explicit ignores procs", "4", 64, 4, false},
+		{"Auto 1 CPU", "auto", 1, 1, false},
+		{"Auto power of two", "auto", 8, 8, false},
+		{"Auto rounds up", "auto", 6, 8, false},
+		{"Auto case insensitive", "AUTO", 3, 4, false},
+		{"Auto capped", "auto", 200, 64, false},
+		{"Invalid", "many", 8, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveShards(tt.value, tt.procs)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error for %q", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d shards, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveShards_GOMAXPROCS(t *testing.T) {
+	prev := runtime.GOMAXPROCS(5)
+	defer runtime.GOMAXPROCS(prev)
+
+	got, err := resolveShards("auto", runtime.GOMAXPROCS(0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != 8 {
+		t.Errorf("got %d shards for 5 CPUs, want 8", got)
+	}
+}
+
+func TestLoad_GCDefaults(t *testing.T) {
+	cfg, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.GC.SamplesPerCheck != 20 {
+		t.Errorf("got SamplesPerCheck %d, want 20", cfg.GC.SamplesPerCheck)
+	}
+	if cfg.GC.MatchThreshold != 0.25 {
+		t.Errorf("got MatchThreshold %v, want 0.25", cfg.GC.MatchThreshold)
+	}
+	if cfg.GC.Interval != 100*time.Millisecond {
+		t.Errorf("got Interval %v, want 100ms", cfg.GC.Interval)
+	}
+	if cfg.GC.MaxRepeats != 16 {
+		t.Errorf("got MaxRepeats %d, want 16", cfg.GC.MaxRepeats)
+	}
+	if cfg.GC.BusyWarningRatio != 0.25 {
+		t.Errorf("got BusyWarningRatio %v, want 0.25", cfg.GC.BusyWarningRatio)
+	}
+}
+
+func TestLoad_RejectsBusyWarningRatio(t *testing.T) {
+	t.Setenv("MOONLIGHT_GC_BUSY_WARNING_RATIO", "1.5")
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("expected error for gc.busy_warning_ratio above 1")
+	}
+}
+
+func TestLoad_RejectsZeroSamples(t *testing.T) {
+	t.Setenv("MOONLIGHT_GC_SAMPLES_PER_CHECK", "0")
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("expected error for zero gc.samples_per_check")
+	}
+}
+
+func TestLoad_RejectsExpireJitter(t *testing.T) {
+	t.Setenv("MOONLIGHT_STORAGE_EXPIRE_JITTER", "100")
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("expected error for storage.expire_jitter out of range")
+	}
+}
+
+func TestLoad_RejectsBindWithPort(t *testing.T) {
+	t.Setenv("MOONLIGHT_SERVER_BIND", "127.0.0.1:6380")
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("expected error for a server.bind address with a port")
+	}
+
+	t.Setenv("MOONLIGHT_SERVER_BIND", "127.0.0.1,::1")
+	if _, err := Load(t.TempDir()); err != nil {
+		t.Errorf("hosts without a port must be accepted: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package glob
+
+// Match reports whether s matches the Redis-style glob pattern.
+// Supported syntax: '*' any sequence, '?' any single byte, '[abc]', '[^abc]', '[a-z]' and '\' escaping
+func Match(pattern, s string) bool {
+	p, i := 0, 0
+	// position to return to after a failed match behind '*'
+	starP, starI := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starI = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if next, ok := matchClass(pattern, p, s[i]); ok {
+					p = next
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+
+		if starP == -1 {
+			return false
+		}
+
+		// let the last '*' consume one more byte
+		starI++
+		p, i = starP+1, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// matchClass matches c against the character class starting at pattern[p] == '['.
+// Returns the index after the class and whether c belongs to it
+func matchClass(pattern string, p int, c byte) (int, bool) {
+	p++
+	negate := false
+	if p < len(pattern) && pattern[p] == '^' {
+		negate = true
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		lo := pattern[p]
+		if lo == '\\' && p+1 < len(pattern) {
+			p++
+			lo = pattern[p]
+		}
+
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			hi := pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			p += 3
+			continue
+		}
+
+		if lo == c {
+			matched = true
+		}
+		p++
+	}
+
+	// unterminated class is treated as a literal mismatch
+	if p >= len(pattern) {
+		return p, false
+	}
+
+	return p + 1, matched != negate
+}
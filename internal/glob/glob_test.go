@@ -0,0 +1,43 @@
+package glob_test
+
+import (
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/glob"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		input   string
+		want    bool
+	}{
+		{"Exact", "news", "news", true},
+		{"Exact mismatch", "news", "new", false},
+		{"Star any", "*", "anything", true},
+		{"Star empty", "*", "", true},
+		{"Star suffix", "news.*", "news.tech", true},
+		{"Star crosses slash", "a*", "a/b/c", true},
+		{"Star middle", "h*llo", "heeello", true},
+		{"Star mismatch", "h*llo", "hello!", false},
+		{"Question", "h?llo", "hallo", true},
+		{"Question needs byte", "h?llo", "hllo", false},
+		{"Class", "h[ae]llo", "hello", true},
+		{"Class mismatch", "h[ae]llo", "hillo", false},
+		{"Negated class", "h[^e]llo", "hallo", true},
+		{"Negated class mismatch", "h[^e]llo", "hello", false},
+		{"Range", "key[0-9]", "key5", true},
+		{"Range mismatch", "key[0-9]", "keyx", false},
+		{"Escape", `h\*llo`, "h*llo", true},
+		{"Escape mismatch", `h\*llo`, "hello", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := glob.Match(tt.pattern, tt.input); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.input, got, tt.want)
+			}
+		})
+	}
+}
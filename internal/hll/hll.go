@@ -0,0 +1,195 @@
+// Package hll implements the dense HyperLogLog of PFADD, PFCOUNT and PFMERGE.
+// Sketches are serialized in the dense format of Redis, hashed with the same function,
+// so a value can be moved between Moonlight and Redis with DUMP/RESTORE or GET/SET
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	precision = 14                   // bits of the hash selecting the register
+	registers = 1 << precision       // number of registers
+	q         = 64 - precision       // bits of the hash left to count the run of zeros
+	bits      = 6                    // bits of a packed register
+	headerLen = 16                   // "HYLL", encoding, 3 unused bytes, 8 bytes of cached cardinality
+	denseLen  = registers * bits / 8 // bytes of the packed registers
+	encDense  = 0                    // encoding byte of the dense representation
+
+	hashSeed = 0xadc83b19
+)
+
+// ErrInvalid is returned by Parse for a string that is not a dense HyperLogLog
+var ErrInvalid = errors.New("invalid HyperLogLog")
+
+// Sketch holds one counter of the longest run of zeros per register, packed in the serialized form,
+// so adding an element or serializing the sketch does not unpack all the registers
+type Sketch struct {
+	b []byte // header followed by the packed registers
+}
+
+// New returns an empty sketch
+func New() *Sketch {
+	sk := &Sketch{b: make([]byte, headerLen+denseLen)}
+	copy(sk.b, "HYLL")
+	sk.b[4] = encDense
+	return sk
+}
+
+// Parse decodes a sketch serialized by Bytes, or by Redis with the dense encoding
+func Parse(s string) (*Sketch, error) {
+	if len(s) != headerLen+denseLen || s[:4] != "HYLL" || s[4] != encDense {
+		return nil, ErrInvalid
+	}
+	return &Sketch{b: []byte(s)}, nil
+}
+
+// Bytes serializes the sketch in the dense format
+func (sk *Sketch) Bytes() string {
+	return string(sk.b)
+}
+
+// register returns the value of the i-th register
+func (sk *Sketch) register(i int) uint8 {
+	packed := sk.b[headerLen:]
+	bit := i * bits
+	v := uint16(packed[bit/8])
+	if bit/8+1 < len(packed) {
+		v |= uint16(packed[bit/8+1]) << 8
+	}
+	return uint8(v>>(bit%8)) & (1<<bits - 1)
+}
+
+// setRegister sets the i-th register. The cardinality cache of the header is flagged as invalid,
+// so Redis computes the cardinality of the value instead of trusting it
+func (sk *Sketch) setRegister(i int, r uint8) {
+	packed := sk.b[headerLen:]
+	bit := i * bits
+	mask := uint16(1<<bits-1) << (bit % 8)
+	v := uint16(r) << (bit % 8)
+
+	packed[bit/8] = packed[bit/8]&^uint8(mask) | uint8(v)
+	if bit/8+1 < len(packed) {
+		packed[bit/8+1] = packed[bit/8+1]&^uint8(mask>>8) | uint8(v>>8)
+	}
+	sk.b[headerLen-1] |= 1 << 7
+}
+
+// Add counts the element. Returns true if a register changed, i.e. the estimate may have changed
+func (sk *Sketch) Add(element string) bool {
+	hash := murmurHash64A([]byte(element), hashSeed)
+	index := int(hash & (registers - 1))
+
+	// the run of zeros is counted on the remaining bits, with a sentinel bit so it is at most q+1
+	run := uint8(1)
+	for rest := hash>>precision | 1<<q; rest&1 == 0; rest >>= 1 {
+		run++
+	}
+
+	if run > sk.register(index) {
+		sk.setRegister(index, run)
+		return true
+	}
+	return false
+}
+
+// Merge keeps the maximum of each register of sk and other, the sketch of the union of both sets
+func (sk *Sketch) Merge(other *Sketch) {
+	for i := range registers {
+		if r := other.register(i); r > sk.register(i) {
+			sk.setRegister(i, r)
+		}
+	}
+}
+
+// Count returns the estimated number of distinct elements, using the estimator of Otmar Ertl
+// "New cardinality estimation algorithms for HyperLogLog sketches" that Redis uses as well
+func (sk *Sketch) Count() int64 {
+	// sized for any 6-bit value, a register of a corrupted value may exceed q+1
+	var histogram [1 << bits]int
+	for i := range registers {
+		histogram[sk.register(i)]++
+	}
+
+	const m = float64(registers)
+	z := m * tau((m-float64(histogram[q+1]))/m)
+	for j := q; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * sigma(float64(histogram[0])/m)
+
+	const alphaInf = 0.5 / math.Ln2
+	return int64(math.Round(alphaInf * m * m / z))
+}
+
+// sigma is the correction of the registers that were never set
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+// tau is the correction of the registers that saturated
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64-bit MurmurHash2 by Austin Appleby, the hash of the Redis HyperLogLog
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const (
+		mul   = 0xc6a4a7935bd1e995
+		shift = 47
+	)
+
+	h := seed ^ uint64(len(data))*mul
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= mul
+		k ^= k >> shift
+		k *= mul
+
+		h ^= k
+		h *= mul
+		data = data[8:]
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= mul
+	}
+
+	h ^= h >> shift
+	h *= mul
+	h ^= h >> shift
+	return h
+}
@@ -0,0 +1,82 @@
+package hll_test
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/hll"
+)
+
+func TestCount(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 20000, 50000, 100000, 1000000} {
+		sk := hll.New()
+		for i := range n {
+			sk.Add("element:" + strconv.Itoa(i))
+		}
+
+		got := sk.Count()
+		// the standard error with 16384 registers is 0.81%, allow a few times that
+		if diff := math.Abs(float64(got - int64(n))); diff > math.Max(1, 0.03*float64(n)) {
+			t.Errorf("%d distinct elements: estimated %d", n, got)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	sk := hll.New()
+	if !sk.Add("a") {
+		t.Error("the first element must change a register")
+	}
+	if sk.Add("a") {
+		t.Error("adding an element twice must not change a register")
+	}
+
+	for range 3 {
+		for i := range 1000 {
+			sk.Add(strconv.Itoa(i))
+		}
+	}
+	if got := sk.Count(); got < 970 || got > 1030 {
+		t.Errorf("repeated elements must be counted once, estimated %d", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := hll.New(), hll.New()
+	for i := range 30000 {
+		a.Add(strconv.Itoa(i))
+	}
+	for i := 20000; i < 50000; i++ {
+		b.Add(strconv.Itoa(i))
+	}
+
+	a.Merge(b)
+	if got := a.Count(); math.Abs(float64(got-50000)) > 1500 {
+		t.Errorf("union of 50000 elements: estimated %d", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	sk := hll.New()
+	for i := range 5000 {
+		sk.Add(strconv.Itoa(i))
+	}
+
+	parsed, err := hll.Parse(sk.Bytes())
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if parsed.Count() != sk.Count() {
+		t.Errorf("estimate changed by the round trip: %d != %d", parsed.Count(), sk.Count())
+	}
+	if parsed.Bytes() != sk.Bytes() {
+		t.Error("serialization changed by the round trip")
+	}
+
+	for _, s := range []string{"", "HYLL", "not a sketch", sk.Bytes()[:100], "HYLL\x01" + sk.Bytes()[5:]} {
+		if _, err := hll.Parse(s); err == nil {
+			t.Errorf("%.20q: expected an error", s)
+		}
+	}
+}
@@ -11,13 +11,57 @@ import (
 // level: "debug", "info", "warn", "error"
 // encoding: "json" (production) or "console" (development)
 func New(level string, encoding string) *zap.Logger {
+	logger, _ := NewLeveled(level, encoding)
+	return logger
+}
+
+// NewLeveled creates a configured logger like New and returns its level, which can be changed at runtime with SetLevel
+func NewLeveled(level string, encoding string) (*zap.Logger, zap.AtomicLevel) {
 	// Parse level
 	lvl, err := zapcore.ParseLevel(level)
 	if err != nil {
 		lvl = zapcore.InfoLevel
 	}
 
-	cfg := zap.Config{
+	cfg := newConfig(lvl, encoding, "stdout")
+	logger, err := cfg.Build()
+	if err != nil {
+		// if logger fails, fallback to basic stdout and exit
+		os.Stdout.WriteString("FAILED TO INIT LOGGER: " + err.Error())
+		os.Exit(1)
+	}
+
+	return logger, cfg.Level
+}
+
+// SetLevel changes the level of a logger created with NewLeveled. An unknown level is an error and keeps the current one
+func SetLevel(atom zap.AtomicLevel, level string) error {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	atom.SetLevel(lvl)
+	return nil
+}
+
+// NewAccess creates the logger of the access log.
+// path: file to append records to, empty means stdout
+func NewAccess(path string, encoding string) (*zap.Logger, error) {
+	if path == "" {
+		path = "stdout"
+	}
+
+	logger, err := newConfig(zapcore.InfoLevel, encoding, path).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return logger.Named("access"), nil
+}
+
+// newConfig returns the common zap configuration writing to output
+func newConfig(lvl zapcore.Level, encoding string, output string) zap.Config {
+	return zap.Config{
 		Level:       zap.NewAtomicLevelAt(lvl),
 		Development: encoding == "console",
 		Encoding:    encoding,
@@ -34,16 +78,7 @@ func New(level string, encoding string) *zap.Logger {
 			EncodeDuration: zapcore.SecondsDurationEncoder,
 			EncodeCaller:   zapcore.ShortCallerEncoder,
 		},
-		OutputPaths:      []string{"stdout"},
+		OutputPaths:      []string{output},
 		ErrorOutputPaths: []string{"stderr"},
 	}
-
-	logger, err := cfg.Build()
-	if err != nil {
-		// if logger fails, fallback to basic stdout and exit
-		os.Stdout.WriteString("FAILED TO INIT LOGGER: " + err.Error())
-		os.Exit(1)
-	}
-
-	return logger
 }
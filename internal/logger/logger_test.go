@@ -0,0 +1,52 @@
+package logger_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/config"
+	"github.com/eternalApril/moonlight/internal/logger"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSetLevel_ConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yml")
+
+	if err := os.WriteFile(file, []byte("log:\n  level: warn\n  format: json\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.Load(dir)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	log, level := logger.NewLeveled(cfg.Log.Level, cfg.Log.Format)
+	if log.Core().Enabled(zapcore.DebugLevel) {
+		t.Fatal("debug must be disabled at the warn level")
+	}
+
+	// the file is edited and the server receives SIGHUP
+	if err := os.WriteFile(file, []byte("log:\n  level: debug\n  format: json\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err = config.Load(dir)
+	if err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+	if err := logger.SetLevel(level, cfg.Log.Level); err != nil {
+		t.Fatalf("SetLevel failed: %v", err)
+	}
+
+	if !log.Core().Enabled(zapcore.DebugLevel) {
+		t.Errorf("debug must be enabled after the reload, level is %s", level)
+	}
+
+	if err := logger.SetLevel(level, "verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if level.Level() != zapcore.DebugLevel {
+		t.Errorf("an invalid level must keep the current one, got %s", level)
+	}
+}
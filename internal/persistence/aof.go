@@ -1,9 +1,10 @@
 package persistence
 
 import (
-	"bufio"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -17,13 +18,30 @@ const (
 	fsyncNo
 )
 
+// bufferSize is the number of buffered bytes after which a payload is written to the target right away
+const bufferSize = 4096
+
+// WriteSyncer is the target of the AOF. *os.File implements it
+type WriteSyncer interface {
+	io.Writer
+	Sync() error
+}
+
 // AOF Append Only File persistence
 type AOF struct {
 	file     *os.File
-	writer   *bufio.Writer
+	target   WriteSyncer // file unless created with NewAOFWriter
+	buf      []byte      // payloads waiting to be written to target
+	ends     []int       // offset in buf after every payload, so a failed write is undone to a command boundary
 	filename string
 	strategy fsyncStrategy
 
+	slowFsync       time.Duration // fsyncs taking longer are logged and counted as delayed
+	stopOnError     bool          // on a write error stop writing instead of skipping the payload
+	writeErr        atomic.Pointer[error]
+	lastFsyncMicros atomic.Int64
+	delayedFsyncs   atomic.Int64
+
 	commandsChan chan []byte
 
 	stopChan chan struct{}
@@ -31,21 +49,37 @@ type AOF struct {
 	logger   *zap.Logger
 }
 
-// NewAOF construct AOF structure
-func NewAOF(filename string, strategyStr string, logger *zap.Logger) (*AOF, error) {
-	strategy := parseStrategy(strategyStr)
-
+// NewAOF construct AOF structure. Fsyncs taking longer than slowFsync are logged with a warning.
+// onWriteError is "stop" to stop writing after the first write error or "ignore" to skip the failed payload
+func NewAOF(filename, strategyStr string, slowFsync time.Duration, onWriteError string, logger *zap.Logger) (*AOF, error) {
 	// open file in Append mode, Create if not exists, Read/Write
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	aof := newAOF(f, filename, parseStrategy(strategyStr), slowFsync, onWriteError == "stop", logger)
+	aof.file = f
+
+	return aof, nil
+}
+
+// NewAOFWriter construct AOF structure writing to an arbitrary target.
+// Such AOF has no file to Load from and does not close the target
+func NewAOFWriter(target WriteSyncer, strategyStr string, slowFsync time.Duration, onWriteError string, logger *zap.Logger) *AOF {
+	return newAOF(target, "", parseStrategy(strategyStr), slowFsync, onWriteError == "stop", logger)
+}
+
+// newAOF starts the background writer of the target
+func newAOF(target WriteSyncer, filename string, strategy fsyncStrategy, slowFsync time.Duration, stopOnError bool,
+	logger *zap.Logger) *AOF {
 	aof := &AOF{
-		file:         f,
-		writer:       bufio.NewWriter(f), // default 4KB buffer
+		target:       target,
+		buf:          make([]byte, 0, bufferSize),
 		filename:     filename,
 		strategy:     strategy,
+		slowFsync:    slowFsync,
+		stopOnError:  stopOnError,
 		commandsChan: make(chan []byte, 10000), // buffer for burst writes
 		stopChan:     make(chan struct{}),
 		logger:       logger,
@@ -55,27 +89,36 @@ func NewAOF(filename string, strategyStr string, logger *zap.Logger) (*AOF, erro
 	aof.wg.Add(1)
 	go aof.listen()
 
-	return aof, nil
+	return aof
 }
 
-// Write send command in channel
+// Write send command in channel. The command is dropped once writing stopped after an error
 func (a *AOF) Write(payload []byte) {
+	if a.WriteError() != nil {
+		return
+	}
+
 	// if channel is full, this WILL block, providing backpressure
 	a.commandsChan <- payload
 }
 
+// WriteError returns the error that stopped the AOF under the "stop" policy, nil while the AOF is healthy
+func (a *AOF) WriteError() error {
+	if err := a.writeErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
 func (a *AOF) listen() {
 	defer a.wg.Done()
 
 	var ticker = time.NewTicker(1 * time.Second)
 
-	switch a.strategy {
-	case fsyncAlways:
+	// everysec and no flush the buffer every second, only everysec fsyncs it
+	if a.strategy == fsyncAlways {
 		ticker.Stop()
-	case fsyncNo:
-		ticker.Stop()
-		return
-	default:
+	} else {
 		defer ticker.Stop()
 	}
 
@@ -85,34 +128,153 @@ func (a *AOF) listen() {
 			if !ok {
 				return
 			}
-			if _, err := a.writer.Write(p); err != nil {
-				a.logger.Error("AOF write error", zap.Error(err))
+			if !a.write(p) {
 				continue
 			}
 
 			if a.strategy == fsyncAlways {
 				a.flush()
-				a.file.Sync() //nolint:errcheck
+				a.sync()
 			}
 
 		case <-ticker.C:
+			a.flush()
 			if a.strategy == fsyncEverySec {
-				a.flush()
-				a.file.Sync() //nolint:errcheck
+				a.sync()
 			}
 
 		case <-a.stopChan:
+			a.drain()
 			a.flush()
-			a.file.Sync() //nolint:errcheck
+			if a.strategy != fsyncNo {
+				a.sync()
+			}
+			return
+		}
+	}
+}
+
+// drain writes the commands that are still waiting in the channel
+func (a *AOF) drain() {
+	for {
+		select {
+		case p := <-a.commandsChan:
+			a.write(p)
+		default:
 			return
 		}
 	}
 }
 
-func (a *AOF) flush() {
-	if err := a.writer.Flush(); err != nil {
-		a.logger.Error("AOF flush error", zap.Error(err))
+// write buffers the payload and writes the buffer to the target once it holds bufferSize bytes.
+// Returns false if the payload was not written
+func (a *AOF) write(p []byte) bool {
+	if a.WriteError() != nil {
+		return false // stopped, the channel is only drained
 	}
+
+	a.buf = append(a.buf, p...)
+	a.ends = append(a.ends, len(a.buf))
+	if len(a.buf) < bufferSize {
+		return true
+	}
+	return a.flush()
+}
+
+// flush writes the buffered payloads to the target. Returns false if they were not written
+func (a *AOF) flush() bool {
+	if a.WriteError() != nil {
+		return false
+	}
+	if len(a.buf) == 0 {
+		return true
+	}
+
+	n, err := a.target.Write(a.buf)
+	if err == nil && n < len(a.buf) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		a.writeFailed(err)
+		if !a.stopOnError {
+			a.discard(n)
+		}
+		return false
+	}
+
+	a.buf = a.buf[:0]
+	a.ends = a.ends[:0]
+	return true
+}
+
+// writeFailed applies the write error policy to a failed write or fsync. With "stop" all following payloads
+// are dropped, otherwise the error is only logged and flush discards the payloads that were not written
+func (a *AOF) writeFailed(err error) {
+	if !a.stopOnError {
+		a.logger.Error("AOF write error, the commands that were not written are lost", zap.Error(err))
+		return
+	}
+
+	if a.writeErr.CompareAndSwap(nil, &err) {
+		a.logger.Error("AOF write error, write commands are rejected until restart", zap.Error(err))
+	}
+}
+
+// discard empties the buffer after written bytes of it reached the target. The rest of a payload the target
+// received only partly is kept and written first next time, so the file always ends on a command boundary
+func (a *AOF) discard(written int) {
+	var rest []byte
+	if written > 0 {
+		for _, end := range a.ends {
+			if end >= written {
+				rest = a.buf[written:end]
+				break
+			}
+		}
+	}
+
+	a.buf = append(a.buf[:0], rest...)
+	a.ends = a.ends[:0]
+	if len(a.buf) > 0 {
+		a.ends = append(a.ends, len(a.buf))
+	}
+}
+
+// sync fsyncs the target and records how long it took. A failed fsync is a write error
+func (a *AOF) sync() {
+	if a.WriteError() != nil {
+		return
+	}
+
+	start := time.Now()
+	if err := a.target.Sync(); err != nil {
+		a.writeFailed(err)
+	}
+	elapsed := time.Since(start)
+
+	a.lastFsyncMicros.Store(elapsed.Microseconds())
+	if a.slowFsync > 0 && elapsed > a.slowFsync {
+		a.delayedFsyncs.Add(1)
+		a.logger.Warn("AOF fsync is taking too long (disk is busy?)",
+			zap.Duration("duration", elapsed),
+			zap.Duration("threshold", a.slowFsync),
+		)
+	}
+}
+
+// LastFsyncMicroseconds returns the duration of the last fsync in microseconds
+func (a *AOF) LastFsyncMicroseconds() int64 {
+	return a.lastFsyncMicros.Load()
+}
+
+// DelayedFsyncs returns the number of fsyncs that took longer than the slow fsync threshold
+func (a *AOF) DelayedFsyncs() int64 {
+	return a.delayedFsyncs.Load()
+}
+
+// ResetStats zeroes the delayed fsync counter
+func (a *AOF) ResetStats() {
+	a.delayedFsyncs.Store(0)
 }
 
 // Close AOF persistence
@@ -120,6 +282,9 @@ func (a *AOF) Close() error {
 	close(a.stopChan)
 
 	a.wg.Wait() // wait for background routine to finish last flush
+	if a.file == nil {
+		return nil
+	}
 	return a.file.Close()
 }
 
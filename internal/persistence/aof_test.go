@@ -0,0 +1,307 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const pingCommand = "*1\r\n$4\r\nPING\r\n"
+
+// mockWriter is an in-memory AOF target counting fsyncs, each Sync takes delay.
+// While fail is set every Write returns an error, while failSync is set every Sync does.
+// A positive short makes the next Write keep only that many bytes and fail
+type mockWriter struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	delay    time.Duration
+	syncs    atomic.Int64
+	fail     atomic.Bool
+	failSync atomic.Bool
+	short    atomic.Int64
+}
+
+func (w *mockWriter) Write(p []byte) (int, error) {
+	if w.fail.Load() {
+		return 0, errors.New("disk full")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := int(w.short.Swap(0)); n > 0 && n < len(p) {
+		w.buf.Write(p[:n])
+		return n, errors.New("disk full")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *mockWriter) Sync() error {
+	time.Sleep(w.delay)
+	if w.failSync.Load() {
+		return errors.New("input/output error")
+	}
+	w.syncs.Add(1)
+	return nil
+}
+
+func (w *mockWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestAOF_FsyncAlways(t *testing.T) {
+	target := &mockWriter{}
+	aof := NewAOFWriter(target, "always", 0, "stop", zap.NewNop())
+	defer aof.Close() //nolint:errcheck
+
+	for i := 0; i < 3; i++ {
+		aof.Write([]byte(pingCommand))
+	}
+
+	// every command is flushed and fsynced right away
+	if !waitFor(200*time.Millisecond, func() bool { return target.syncs.Load() == 3 }) {
+		t.Fatalf("expected 3 fsyncs, got %d", target.syncs.Load())
+	}
+	if target.String() != pingCommand+pingCommand+pingCommand {
+		t.Errorf("commands were not written, got %q", target.String())
+	}
+}
+
+func TestAOF_FsyncEverySec(t *testing.T) {
+	target := &mockWriter{}
+	aof := NewAOFWriter(target, "everysec", 0, "stop", zap.NewNop())
+	defer aof.Close() //nolint:errcheck
+
+	for i := 0; i < 3; i++ {
+		aof.Write([]byte(pingCommand))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := target.syncs.Load(); got != 0 {
+		t.Errorf("everysec must not fsync before the tick, got %d fsyncs", got)
+	}
+	if target.String() != "" {
+		t.Errorf("everysec must buffer until the tick, got %q", target.String())
+	}
+
+	// a single fsync covers all commands of the second
+	if !waitFor(1500*time.Millisecond, func() bool { return target.syncs.Load() == 1 }) {
+		t.Fatalf("expected one fsync after the tick, got %d", target.syncs.Load())
+	}
+	if target.String() != pingCommand+pingCommand+pingCommand {
+		t.Errorf("commands were not written, got %q", target.String())
+	}
+}
+
+func TestAOF_FsyncNo(t *testing.T) {
+	target := &mockWriter{}
+	aof := NewAOFWriter(target, "no", 0, "stop", zap.NewNop())
+
+	aof.Write([]byte(pingCommand))
+
+	if !waitFor(1500*time.Millisecond, func() bool { return target.String() == pingCommand }) {
+		t.Fatalf("command was not written, got %q", target.String())
+	}
+
+	if err := aof.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if got := target.syncs.Load(); got != 0 {
+		t.Errorf("fsync no must never fsync, got %d", got)
+	}
+}
+
+func TestAOF_SlowFsync(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	target := &mockWriter{delay: 20 * time.Millisecond}
+
+	aof := NewAOFWriter(target, "always", 5*time.Millisecond, "stop", zap.New(core))
+	aof.Write([]byte(pingCommand))
+	if err := aof.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if got := aof.DelayedFsyncs(); got < 1 {
+		t.Errorf("DelayedFsyncs = %d, want at least 1", got)
+	}
+	if got := aof.LastFsyncMicroseconds(); got < 20000 {
+		t.Errorf("LastFsyncMicroseconds = %d, want at least 20000", got)
+	}
+	if logs.FilterMessage("AOF fsync is taking too long (disk is busy?)").Len() == 0 {
+		t.Errorf("slow fsync warning was not logged")
+	}
+}
+
+func TestAOF_FastFsync(t *testing.T) {
+	aof := NewAOFWriter(&mockWriter{}, "always", time.Second, "stop", zap.NewNop())
+	aof.Write([]byte(pingCommand))
+	if err := aof.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if got := aof.DelayedFsyncs(); got != 0 {
+		t.Errorf("DelayedFsyncs = %d, want 0", got)
+	}
+}
+
+func TestAOF_WriteErrorStop(t *testing.T) {
+	target := &mockWriter{}
+	target.fail.Store(true)
+
+	aof := NewAOFWriter(target, "always", 0, "stop", zap.NewNop())
+	defer aof.Close() //nolint:errcheck
+
+	aof.Write([]byte(pingCommand))
+	if !waitFor(200*time.Millisecond, func() bool { return aof.WriteError() != nil }) {
+		t.Fatalf("write error was not recorded")
+	}
+
+	// the disk recovered, but the AOF must stay stopped to not desync the file
+	target.fail.Store(false)
+	aof.Write([]byte(pingCommand))
+	time.Sleep(50 * time.Millisecond)
+
+	if target.String() != "" {
+		t.Errorf("nothing must be written after the error, got %q", target.String())
+	}
+}
+
+func TestAOF_WriteErrorIgnore(t *testing.T) {
+	target := &mockWriter{}
+	target.fail.Store(true)
+
+	aof := NewAOFWriter(target, "always", 0, "ignore", zap.NewNop())
+	defer aof.Close() //nolint:errcheck
+
+	aof.Write([]byte(pingCommand))
+	time.Sleep(50 * time.Millisecond)
+
+	target.fail.Store(false)
+	aof.Write([]byte(pingCommand))
+
+	if !waitFor(200*time.Millisecond, func() bool { return target.String() == pingCommand }) {
+		t.Errorf("the next command must be written after the error, got %q", target.String())
+	}
+	if aof.WriteError() != nil {
+		t.Errorf("ignore policy must not stop the AOF")
+	}
+}
+
+func TestAOF_SyncErrorStop(t *testing.T) {
+	target := &mockWriter{}
+	target.failSync.Store(true)
+
+	aof := NewAOFWriter(target, "always", 0, "stop", zap.NewNop())
+	defer aof.Close() //nolint:errcheck
+
+	aof.Write([]byte(pingCommand))
+	if !waitFor(200*time.Millisecond, func() bool { return aof.WriteError() != nil }) {
+		t.Fatalf("fsync error was not recorded")
+	}
+}
+
+func TestAOF_WriteErrorIgnorePartialPayload(t *testing.T) {
+	target := &mockWriter{}
+	target.short.Store(5)
+
+	aof := NewAOFWriter(target, "always", 0, "ignore", zap.NewNop())
+	defer aof.Close() //nolint:errcheck
+
+	aof.Write([]byte(pingCommand))
+	if !waitFor(200*time.Millisecond, func() bool { return target.String() == pingCommand[:5] }) {
+		t.Fatalf("expected the first 5 bytes to be written, got %q", target.String())
+	}
+
+	// the rest of the partly written command comes before the next one
+	aof.Write([]byte(pingCommand))
+	if !waitFor(200*time.Millisecond, func() bool { return target.String() == pingCommand+pingCommand }) {
+		t.Errorf("the file must end on a command boundary, got %q", target.String())
+	}
+}
+
+func TestLoad_Truncated(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(filename, []byte(pingCommand+pingCommand+"*1\r\n$4\r\nPI"), 0644); err != nil {
+		t.Fatalf("failed to write AOF: %v", err)
+	}
+
+	aof, err := NewAOF(filename, "no", 0, "ignore", zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewAOF: %v", err)
+	}
+	defer aof.Close() //nolint:errcheck
+
+	cmds, offsets, err := aof.Load()
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+	if len(cmds) != 2 {
+		t.Errorf("expected the 2 complete commands, got %d", len(cmds))
+	}
+	if want := []int64{int64(len(pingCommand)), int64(2 * len(pingCommand))}; !slices.Equal(offsets, want) {
+		t.Errorf("expected the offsets %v, got %v", want, offsets)
+	}
+
+	if err := aof.Truncate(offsets[1]); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != pingCommand+pingCommand { //nolint:errcheck
+		t.Errorf("the incomplete tail was not cut, got %q", data)
+	}
+}
+
+func TestLoad_LargeCommand(t *testing.T) {
+	// more elements than the default proto_max_multibulk_len
+	const size = resp.DefaultMaxMultiBulkLen + 1
+
+	var data bytes.Buffer
+	data.WriteString("*" + strconv.Itoa(size+2) + "\r\n$5\r\nRPUSH\r\n$1\r\nl\r\n")
+	for range size {
+		data.WriteString("$1\r\nx\r\n")
+	}
+	data.WriteString(pingCommand)
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(filename, data.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write AOF: %v", err)
+	}
+
+	aof, err := NewAOF(filename, "no", 0, "ignore", zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewAOF: %v", err)
+	}
+	defer aof.Close() //nolint:errcheck
+
+	cmds, _, err := aof.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cmds) != 2 || len(cmds[0].Array) != size+2 {
+		t.Fatalf("expected the large command and PING, got %d commands", len(cmds))
+	}
+}
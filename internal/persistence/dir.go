@@ -0,0 +1,31 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PrepareDir creates the persistence directory if it does not exist and checks that files can be created in it,
+// so a misconfigured volume is reported at startup instead of on the first save
+func PrepareDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("persistence.dir %q: %w", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, ".moonlight-write-check-*")
+	if err != nil {
+		return fmt.Errorf("persistence.dir %q is not writable: %w", dir, err)
+	}
+	f.Close() //nolint:errcheck
+
+	return os.Remove(f.Name())
+}
+
+// Path resolves the filename against the persistence directory. Absolute filenames and an empty dir are left as is
+func Path(dir, filename string) string {
+	if dir == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(dir, filename)
+}
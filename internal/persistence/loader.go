@@ -1,25 +1,42 @@
 package persistence
 
 import (
+	"errors"
 	"io"
+	"math"
 	"os"
 
 	"github.com/eternalApril/moonlight/internal/resp"
 )
 
-// Load reads the AOF file and returns a channel of commands to be replayed
-func (a *AOF) Load() ([]resp.Value, error) {
+// ErrTruncated is returned by Load together with the commands read so far when the AOF ends
+// with an incomplete command, e.g. after a crash in the middle of a write
+var ErrTruncated = errors.New("AOF ends with an incomplete command")
+
+// Load reads the AOF file and returns the commands to be replayed with their offsets:
+// offsets[i] is the position in the file right after commands[i]
+func (a *AOF) Load() ([]resp.Value, []int64, error) {
+	if a.filename == "" {
+		return nil, nil, nil // created with NewAOFWriter
+	}
+
 	file, err := os.Open(a.filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil // Fresh start
+			return nil, nil, nil // Fresh start
 		}
-		return nil, err
+		return nil, nil, err
 	}
 	defer file.Close() //nolint:errcheck
 
-	reader := resp.NewDecoder(file)
+	counter := &countingReader{r: file}
+	reader := resp.NewDecoder(counter)
+	// the AOF holds only commands the server accepted, whatever proto_max_multibulk_len and proto_max_bulk_len
+	// were at the time
+	reader.SetMaxMultiBulkLen(math.MaxInt64)
+	reader.SetMaxBulkLen(math.MaxInt64)
 	var commands []resp.Value
+	var offsets []int64
 
 	for {
 		val, err := reader.Read()
@@ -27,10 +44,34 @@ func (a *AOF) Load() ([]resp.Value, error) {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			if errors.Is(err, resp.ErrInvalidEnding) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return commands, offsets, ErrTruncated
+			}
+			return nil, nil, err
 		}
 		commands = append(commands, val)
+		offsets = append(offsets, counter.n-int64(reader.Buffered()))
 	}
 
-	return commands, nil
+	return commands, offsets, nil
+}
+
+// Truncate cuts the AOF file to size, so an incomplete tail is not followed by the commands appended next
+func (a *AOF) Truncate(size int64) error {
+	if a.file == nil {
+		return nil // created with NewAOFWriter
+	}
+	return a.file.Truncate(size)
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
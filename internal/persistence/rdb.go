@@ -2,6 +2,8 @@ package persistence
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"time"
@@ -10,6 +12,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// rdbHeader starts every RDB stream, it is followed by the snapshot of the storage
+const rdbHeader = "MOONRES1"
+
+// ErrInvalidHeader is returned by LoadFrom when the stream does not start with the RDB header
+var ErrInvalidHeader = errors.New("invalid RDB header")
+
 type RDB struct {
 	filename string
 	logger   *zap.Logger
@@ -34,11 +42,7 @@ func (r *RDB) Save(db storage.Storage) error {
 	defer f.Close()
 	writer := bufio.NewWriterSize(f, 4*1024*1024)
 
-	if _, err := writer.WriteString("MOONRES1"); err != nil {
-		return err
-	}
-
-	if err := db.Snapshot(writer); err != nil {
+	if err := SaveTo(writer, db); err != nil {
 		return err
 	}
 
@@ -72,22 +76,36 @@ func (r *RDB) Load(db storage.Storage) error {
 	}
 	defer f.Close()
 
-	reader := bufio.NewReader(f)
-
-	header := make([]byte, 8)
-	if _, err := io.ReadFull(reader, header); err != nil {
+	start := time.Now()
+	if err := LoadFrom(bufio.NewReader(f), db); err != nil {
+		if errors.Is(err, ErrInvalidHeader) {
+			r.logger.Warn("Invalid RDB header, assuming empty or incompatible", zap.Error(err))
+			return nil
+		}
 		return err
 	}
-	if string(header) != "MOONRES1" {
-		r.logger.Warn("Invalid RDB header, assuming empty or incompatible", zap.String("header", string(header)))
-		return nil
+
+	r.logger.Info("RDB loaded", zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// SaveTo writes the RDB header and a snapshot of db to w
+func SaveTo(w io.Writer, db storage.Storage) error {
+	if _, err := io.WriteString(w, rdbHeader); err != nil {
+		return err
 	}
+	return db.Snapshot(w)
+}
 
-	start := time.Now()
-	if err := db.Restore(reader); err != nil {
+// LoadFrom reads an RDB stream written by SaveTo into db
+func LoadFrom(r io.Reader, db storage.Storage) error {
+	header := make([]byte, len(rdbHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
 		return err
 	}
+	if string(header) != rdbHeader {
+		return fmt.Errorf("%w %q", ErrInvalidHeader, header)
+	}
 
-	r.logger.Info("RDB loaded", zap.Duration("duration", time.Since(start)))
-	return nil
+	return db.Restore(r)
 }
@@ -23,6 +23,11 @@ func MakeErrorWrongNumberOfArguments(cmd string) Value {
 	return MakeError(fmt.Sprintf("ERR wrong number of arguments for %s command", cmd))
 }
 
+// MakeErrorWrongType construct Error Value that command was executed against a key holding the wrong kind of value
+func MakeErrorWrongType() Value {
+	return MakeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
 // MakeBulkString construct BulkString Value from string
 func MakeBulkString(s string) Value {
 	return Value{
@@ -68,3 +73,11 @@ func MakeMap(input map[string]string) Value {
 	}
 	return val
 }
+
+// MakeMapValues helper creates a Value of type Map holding arbitrary values
+func MakeMapValues(input map[string]Value) Value {
+	return Value{
+		Type: TypeMap,
+		Map:  input,
+	}
+}
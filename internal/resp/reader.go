@@ -2,6 +2,7 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"strconv"
@@ -10,16 +11,60 @@ import (
 var (
 	// ErrInvalidEnding is returned when a RESP element does not end with "\r\n"
 	ErrInvalidEnding = errors.New("invalid line ending")
+	// ErrMultiBulkLength is returned when an array or a map declares a negative or too large number of elements
+	ErrMultiBulkLength = errors.New("invalid multibulk length")
+	// ErrBulkLength is returned when a bulk string declares a negative or too large length
+	ErrBulkLength = errors.New("invalid bulk length")
 )
 
+// DefaultMaxMultiBulkLen is the default limit of the number of elements of an array or a map
+const DefaultMaxMultiBulkLen = 1024 * 1024
+
+// DefaultMaxBulkLen is the default limit of the length of a bulk string in bytes
+const DefaultMaxBulkLen = 512 * 1024 * 1024
+
+// maxPrealloc caps the capacity allocated up front for an array or a map, larger ones grow as the elements arrive,
+// so a header declaring many elements costs nothing until they are actually sent
+const maxPrealloc = 1024
+
+// maxBulkPrealloc caps the buffer allocated up front for a bulk string, longer ones grow as the bytes arrive
+const maxBulkPrealloc = 1024 * 1024
+
 // Decoder provides a high-level API for reading RESP values from an input stream
 type Decoder struct {
-	rd *bufio.Reader
+	rd              *bufio.Reader
+	lenient         bool  // accept lines terminated by a bare \n
+	maxMultiBulkLen int64 // maximum number of elements of an array or a map
+	maxBulkLen      int64 // maximum length of a bulk string
 }
 
 // NewDecoder creates a new Decoder with an internal buffer for efficient reading
 func NewDecoder(rd io.Reader) *Decoder {
-	return &Decoder{rd: bufio.NewReader(rd)}
+	return &Decoder{rd: bufio.NewReader(rd), maxMultiBulkLen: DefaultMaxMultiBulkLen, maxBulkLen: DefaultMaxBulkLen}
+}
+
+// SetMaxMultiBulkLen limits the number of elements of an array or a map, larger ones fail with ErrMultiBulkLength
+func (d *Decoder) SetMaxMultiBulkLen(n int64) {
+	d.maxMultiBulkLen = n
+}
+
+// checkMultiBulkLen validates the element count declared by an array or a map header, -1 is the null value
+func (d *Decoder) checkMultiBulkLen(size int64) error {
+	if size < -1 || size > d.maxMultiBulkLen {
+		return ErrMultiBulkLength
+	}
+	return nil
+}
+
+// SetMaxBulkLen limits the length of a bulk string, longer ones fail with ErrBulkLength
+func (d *Decoder) SetMaxBulkLen(n int64) {
+	d.maxBulkLen = n
+}
+
+// SetLenientCRLF makes the decoder accept lines and bulk strings terminated by a bare "\n", for clients that
+// do not send "\r\n". A "\r" before the "\n" is still stripped. Strict spec compliance is the default
+func (d *Decoder) SetLenientCRLF(lenient bool) {
+	d.lenient = lenient
 }
 
 // Read parses the next complete RESP Value from the stream
@@ -40,7 +85,8 @@ func (d *Decoder) Read() (Value, error) {
 			return Value{}, err
 		}
 
-		val.String = str
+		// the line points into the read buffer and is overwritten by the next read
+		val.String = bytes.Clone(str)
 		return val, nil
 
 	case TypeArray:
@@ -95,7 +141,7 @@ func (d *Decoder) Read() (Value, error) {
 	return Value{}, errors.New("unexpected type")
 }
 
-// readLine reads bytes until \n and validates the \r\n sequence
+// readLine reads bytes until \n and validates the \r\n sequence, in lenient mode the \r is optional
 func (d *Decoder) readLine() ([]byte, error) {
 	line, err := d.rd.ReadSlice('\n')
 	if err != nil {
@@ -105,11 +151,15 @@ func (d *Decoder) readLine() ([]byte, error) {
 		return nil, err
 	}
 
-	if len(line) < 2 || line[len(line)-2] != '\r' {
-		return nil, ErrInvalidEnding
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1], nil
+	}
+	if d.lenient {
+		return line, nil
 	}
 
-	return line[:len(line)-2], nil
+	return nil, ErrInvalidEnding
 }
 
 // readInteger parses a RESP integer
@@ -137,9 +187,11 @@ func (d *Decoder) readBulkString() ([]byte, error) {
 	if size == -1 {
 		return nil, nil
 	}
+	if size < -1 || size > d.maxBulkLen {
+		return nil, ErrBulkLength
+	}
 
-	buf := make([]byte, size)
-	_, err = io.ReadFull(d.rd, buf)
+	buf, err := d.readBulkBody(size)
 	if err != nil {
 		if errors.Is(err, io.ErrUnexpectedEOF) {
 			return nil, ErrInvalidEnding
@@ -147,6 +199,13 @@ func (d *Decoder) readBulkString() ([]byte, error) {
 		return nil, err
 	}
 
+	if d.lenient {
+		if ending, err := d.rd.Peek(1); err == nil && ending[0] == '\n' {
+			d.rd.Discard(1) //nolint:errcheck
+			return buf, nil
+		}
+	}
+
 	ending, err := d.rd.Peek(2)
 	if err != nil || ending[0] != '\r' || ending[1] != '\n' {
 		return nil, ErrInvalidEnding
@@ -156,6 +215,28 @@ func (d *Decoder) readBulkString() ([]byte, error) {
 	return buf, nil
 }
 
+// readBulkBody reads the size bytes of a bulk string. A length over maxBulkPrealloc is not allocated up front,
+// so a header declaring a large string costs nothing until the bytes are actually sent
+func (d *Decoder) readBulkBody(size int64) ([]byte, error) {
+	if size <= maxBulkPrealloc {
+		buf := make([]byte, size)
+		_, err := io.ReadFull(d.rd, buf)
+		return buf, err
+	}
+
+	var b bytes.Buffer
+	b.Grow(maxBulkPrealloc)
+	n, err := io.CopyN(&b, d.rd, size)
+	if err != nil && n < size {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
 // readArray parses a RESP array recursively
 func (d *Decoder) readArray() ([]Value, error) {
 	size, err := d.readInteger()
@@ -166,6 +247,10 @@ func (d *Decoder) readArray() ([]Value, error) {
 		return nil, err
 	}
 
+	if err := d.checkMultiBulkLen(size); err != nil {
+		return nil, err
+	}
+
 	if size == -1 {
 		return nil, nil
 	}
@@ -174,7 +259,7 @@ func (d *Decoder) readArray() ([]Value, error) {
 		return []Value{}, nil
 	}
 
-	buf := make([]Value, 0, size)
+	buf := make([]Value, 0, min(size, maxPrealloc))
 
 	for range size {
 		el, err := d.Read()
@@ -197,11 +282,15 @@ func (d *Decoder) readMap() (map[string]Value, error) {
 		return nil, err
 	}
 
+	if err := d.checkMultiBulkLen(size); err != nil {
+		return nil, err
+	}
+
 	if size == -1 {
 		return nil, nil
 	}
 
-	m := make(map[string]Value, size)
+	m := make(map[string]Value, min(size, maxPrealloc))
 
 	for i := 0; i < int(size); i++ {
 		keyVal, err := d.Read()
@@ -235,3 +324,10 @@ func (d *Decoder) readMap() (map[string]Value, error) {
 func (d *Decoder) Buffered() int {
 	return d.rd.Buffered()
 }
+
+// Peek waits until n bytes are buffered without consuming them, see bufio.Reader.Peek.
+// Fails with bufio.ErrBufferFull when n is larger than the buffer
+func (d *Decoder) Peek(n int) error {
+	_, err := d.rd.Peek(n)
+	return err
+}
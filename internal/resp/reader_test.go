@@ -2,8 +2,10 @@ package resp_test
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -32,7 +34,7 @@ func runTest(t *testing.T, name string, input string, want resp.Value, wantErr e
 		}
 
 		if got.Integer != want.Integer {
-			t.Errorf("got num %v, want %v", got.Integer, want.Integer)
+			t.Errorf("got integer %v, want %v", got.Integer, want.Integer)
 		}
 
 		if !reflect.DeepEqual(got.String, want.String) {
@@ -96,6 +98,8 @@ func TestDecoder_ReadBulkString(t *testing.T) {
 		{name: "Mismatched length", input: "$10\r\nshort\r\n", wantErr: resp.ErrInvalidEnding},
 		{name: "Missing trailing CRLF", input: "$6\r\nfoobar", wantErr: resp.ErrInvalidEnding},
 		{name: "Unexpected EOF in header", input: "$6", wantErr: resp.ErrInvalidEnding},
+		{name: "Negative length", input: "$-5\r\n", wantErr: resp.ErrBulkLength},
+		{name: "Oversized length", input: "$99999999999999\r\n", wantErr: resp.ErrBulkLength},
 	}
 
 	for _, tt := range tests {
@@ -103,6 +107,57 @@ func TestDecoder_ReadBulkString(t *testing.T) {
 	}
 }
 
+func TestDecoder_LenientCRLF(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  resp.Value
+	}{
+		{"Simple string", "+OK", resp.MakeSimpleString("OK")},
+		{"Integer", ":42", resp.MakeInteger(42)},
+		{"Bulk string", "$3{nl}foo", resp.MakeBulkString("foo")},
+		{"Array", "*2{nl}$3{nl}GET{nl}$1{nl}k", resp.MakeArray([]resp.Value{resp.MakeBulkString("GET"), resp.MakeBulkString("k")})},
+	}
+
+	for _, tt := range tests {
+		for _, lenient := range []bool{false, true} {
+			for _, nl := range []string{"\r\n", "\n"} {
+				input := strings.ReplaceAll(tt.input, "{nl}", nl) + nl
+				name := fmt.Sprintf("%s/lenient=%v/%q", tt.name, lenient, nl)
+
+				t.Run(name, func(t *testing.T) {
+					d := resp.NewDecoder(strings.NewReader(input))
+					d.SetLenientCRLF(lenient)
+					got, err := d.Read()
+
+					if !lenient && nl == "\n" {
+						if !errors.Is(err, resp.ErrInvalidEnding) {
+							t.Fatalf("strict mode must reject a bare \\n, got %v, %v", got, err)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if !reflect.DeepEqual(got, tt.want) {
+						t.Errorf("got %v, want %v", got, tt.want)
+					}
+				})
+			}
+		}
+	}
+
+	// the \r is stripped, it never becomes part of the value
+	d := resp.NewDecoder(strings.NewReader("+OK\r\n$2\nab\r\n"))
+	d.SetLenientCRLF(true)
+	for _, want := range []string{"OK", "ab"} {
+		got, err := d.Read()
+		if err != nil || string(got.String) != want {
+			t.Errorf("got %q, %v, want %q", got.String, err, want)
+		}
+	}
+}
+
 func TestDecoder_ReadError(t *testing.T) {
 	runTest(t, "Basic Error", "-Err msg\r\n", resp.Value{Type: resp.TypeError, String: []byte("Err msg")}, nil)
 }
@@ -182,6 +237,21 @@ func TestDecoder_ReadArray(t *testing.T) {
 			input:   "*1\r\n+MissingCR\n",
 			wantErr: resp.ErrInvalidEnding,
 		},
+		{
+			name:    "Oversized multibulk",
+			input:   "*1000000000\r\n",
+			wantErr: resp.ErrMultiBulkLength,
+		},
+		{
+			name:    "Oversized map",
+			input:   "%1000000000\r\n",
+			wantErr: resp.ErrMultiBulkLength,
+		},
+		{
+			name:    "Negative multibulk",
+			input:   "*-2\r\n",
+			wantErr: resp.ErrMultiBulkLength,
+		},
 	}
 
 	for _, tt := range tests {
@@ -189,6 +259,48 @@ func TestDecoder_ReadArray(t *testing.T) {
 	}
 }
 
+func TestDecoder_MaxMultiBulkLen(t *testing.T) {
+	d := resp.NewDecoder(strings.NewReader("*2\r\n$1\r\na\r\n$1\r\nb\r\n*3\r\n"))
+	d.SetMaxMultiBulkLen(2)
+
+	v, err := d.Read()
+	if err != nil || len(v.Array) != 2 {
+		t.Fatalf("array at the limit: got %v, %v", v, err)
+	}
+
+	if _, err := d.Read(); !errors.Is(err, resp.ErrMultiBulkLength) {
+		t.Errorf("array over the limit: got %v, want %v", err, resp.ErrMultiBulkLength)
+	}
+}
+
+func TestDecoder_MaxBulkLen(t *testing.T) {
+	d := resp.NewDecoder(strings.NewReader("$3\r\nabc\r\n$4\r\n"))
+	d.SetMaxBulkLen(3)
+
+	v, err := d.Read()
+	if err != nil || string(v.String) != "abc" {
+		t.Fatalf("bulk string at the limit: got %v, %v", v, err)
+	}
+
+	if _, err := d.Read(); !errors.Is(err, resp.ErrBulkLength) {
+		t.Errorf("bulk string over the limit: got %v, want %v", err, resp.ErrBulkLength)
+	}
+}
+
+func TestDecoder_LargeBulkString(t *testing.T) {
+	payload := strings.Repeat("x", 3*1024*1024)
+	d := resp.NewDecoder(strings.NewReader("$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n$4000000\r\nshort"))
+
+	v, err := d.Read()
+	if err != nil || string(v.String) != payload {
+		t.Fatalf("large bulk string: got %d bytes, %v", len(v.String), err)
+	}
+
+	if _, err := d.Read(); !errors.Is(err, resp.ErrInvalidEnding) {
+		t.Errorf("truncated bulk string: got %v, want %v", err, resp.ErrInvalidEnding)
+	}
+}
+
 func TestDecoder_ReadMap(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -247,3 +359,94 @@ func TestDecoder_ReadMap(t *testing.T) {
 		runTest(t, tt.name, tt.input, tt.want, tt.wantErr)
 	}
 }
+
+func TestDecoder_ReadMalformedCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    resp.Value
+		wantErr error
+	}{
+		{
+			name:  "Empty command name",
+			input: "*1\r\n$0\r\n\r\n",
+			want: resp.Value{Type: resp.TypeArray, Array: []resp.Value{
+				{Type: resp.TypeBulkString, String: []byte("")},
+			}},
+		},
+		{
+			name:  "Integer argument",
+			input: "*2\r\n$3\r\nGET\r\n:1\r\n",
+			want: resp.Value{Type: resp.TypeArray, Array: []resp.Value{
+				{Type: resp.TypeBulkString, String: []byte("GET")},
+				{Type: resp.TypeInteger, Integer: 1},
+			}},
+		},
+		{
+			name:  "Nil command name",
+			input: "*1\r\n$-1\r\n",
+			want: resp.Value{Type: resp.TypeArray, Array: []resp.Value{
+				{Type: resp.TypeBulkString, IsNull: true},
+			}},
+		},
+		{
+			name:    "Truncated command",
+			input:   "*2\r\n$3\r\nGET\r\n",
+			wantErr: resp.ErrInvalidEnding,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt.name, tt.input, tt.want, tt.wantErr)
+	}
+}
+
+// dripReader returns at most one byte per Read, like a command split across many TCP segments
+type dripReader struct {
+	data []byte
+}
+
+func (r *dripReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestDecoder_PartialReads(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$12\r\nhello\r\nworld\r\n" +
+		"%1\r\n+field\r\n:42\r\n" +
+		"$-1\r\n"
+
+	want := []resp.Value{
+		{Type: resp.TypeArray, Array: []resp.Value{
+			{Type: resp.TypeBulkString, String: []byte("SET")},
+			{Type: resp.TypeBulkString, String: []byte("key")},
+			{Type: resp.TypeBulkString, String: []byte("hello\r\nworld")},
+		}},
+		{Type: resp.TypeMap, Map: map[string]resp.Value{
+			"field": {Type: resp.TypeInteger, Integer: 42},
+		}},
+		{Type: resp.TypeBulkString, IsNull: true},
+	}
+
+	d := resp.NewDecoder(&dripReader{data: []byte(input)})
+	for i, w := range want {
+		got, err := d.Read()
+		if err != nil {
+			t.Fatalf("value %d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("value %d: got %+v, want %+v", i, got, w)
+		}
+	}
+
+	if _, err := d.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF after the last value, got %v", err)
+	}
+}
@@ -21,5 +21,9 @@ func SerializeCommand(cmd string, args []Value) ([]byte, error) {
 		return nil, err
 	}
 
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
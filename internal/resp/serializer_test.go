@@ -0,0 +1,55 @@
+package resp_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+func TestSerializeCommand_RoundTrip(t *testing.T) {
+	args := []string{
+		"key",
+		"",
+		"with\r\ncrlf",
+		"\x00nul\x00inside",
+		"\r\n",
+		"$5\r\nfake*1\r\n",
+		strings.Repeat("x", 10_000), // larger than the decoder buffer
+	}
+
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.MakeBulkString(arg)
+	}
+
+	payload, err := resp.SerializeCommand("SET", values)
+	if err != nil {
+		t.Fatalf("SerializeCommand failed: %v", err)
+	}
+
+	// two commands back to back, as in the AOF
+	dec := resp.NewDecoder(bytes.NewReader(append(payload, payload...)))
+	for range 2 {
+		got, err := dec.Read()
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if got.Type != resp.TypeArray || len(got.Array) != len(args)+1 {
+			t.Fatalf("expected an array of %d elements, got %v", len(args)+1, got)
+		}
+
+		decoded := make([]string, 0, len(args)+1)
+		for _, el := range got.Array {
+			if el.Type != resp.TypeBulkString {
+				t.Fatalf("expected bulk strings, got type %q", el.Type)
+			}
+			decoded = append(decoded, string(el.String))
+		}
+		if want := append([]string{"SET"}, args...); !reflect.DeepEqual(decoded, want) {
+			t.Errorf("round trip mismatch:\ngot  %q\nwant %q", decoded, want)
+		}
+	}
+}
@@ -79,6 +79,28 @@ func (e *Encoder) Write(v Value) error {
 	return nil
 }
 
+// WriteArrayHeader writes the header of an array of n elements. The caller must write the n elements next
+func (e *Encoder) WriteArrayHeader(n int) error {
+	return e.writeHeader('*', int64(n))
+}
+
+// WriteMapHeader writes the header of a map of n entries. The caller must write the n key-value pairs next
+func (e *Encoder) WriteMapHeader(n int) error {
+	return e.writeHeader('%', int64(n))
+}
+
+// WriteBulkString writes s as a bulk string without building a Value
+func (e *Encoder) WriteBulkString(s string) error {
+	if err := e.writeHeader('$', int64(len(s))); err != nil {
+		return err
+	}
+	if _, err := e.writer.WriteString(s); err != nil {
+		return err
+	}
+	_, err := e.writer.WriteString("\r\n")
+	return err
+}
+
 // WriteHeader writes the type prefix, numeric value, and CRLF
 func (e *Encoder) writeHeader(prefix byte, n int64) error {
 	if err := e.writer.WriteByte(prefix); err != nil {
@@ -3,6 +3,7 @@ package resp_test
 import (
 	"bytes"
 	"io"
+	"math"
 	"testing"
 
 	"github.com/eternalApril/moonlight/internal/resp"
@@ -127,6 +128,64 @@ func TestEncoder_Write(t *testing.T) {
 	}
 }
 
+func TestEncoder_Streaming(t *testing.T) {
+	var buf bytes.Buffer
+	enc := resp.NewEncoder(&buf)
+
+	enc.WriteArrayHeader(2)  //nolint:errcheck
+	enc.WriteBulkString("a") //nolint:errcheck
+	enc.WriteMapHeader(1)    //nolint:errcheck
+	enc.WriteBulkString("k") //nolint:errcheck
+	enc.WriteBulkString("")  //nolint:errcheck
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	// the streamed reply must be byte-identical to the materialized one
+	var want bytes.Buffer
+	ref := resp.NewEncoder(&want)
+	ref.Write(resp.MakeArray([]resp.Value{ //nolint:errcheck
+		resp.MakeBulkString("a"),
+		resp.MakeMapValues(map[string]resp.Value{"k": resp.MakeBulkString("")}),
+	}))
+	ref.Flush() //nolint:errcheck
+
+	if buf.String() != want.String() {
+		t.Errorf("got %q, want %q", buf.String(), want.String())
+	}
+}
+
+func TestIntegerRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := resp.NewEncoder(&buf)
+
+	values := []int64{0, 1, -1, 1 << 40, math.MaxInt64, math.MinInt64}
+	for _, n := range values {
+		enc.Write(resp.MakeInteger(n)) //nolint:errcheck
+	}
+	enc.Write(resp.MakeArray([]resp.Value{resp.MakeInteger(7)})) //nolint:errcheck
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	// the decoder fills the same Integer field the encoder and the Make* helpers use
+	dec := resp.NewDecoder(&buf)
+	for _, want := range values {
+		got, err := dec.Read()
+		if err != nil {
+			t.Fatalf("Read() failed: %v", err)
+		}
+		if got.Type != resp.TypeInteger || got.Integer != want {
+			t.Errorf("got %v, want integer %d", got, want)
+		}
+	}
+
+	got, err := dec.Read()
+	if err != nil || len(got.Array) != 1 || got.Array[0].Integer != 7 {
+		t.Errorf("nested integer: got %v, %v", got, err)
+	}
+}
+
 func TestEncoder_WriteError(t *testing.T) {
 	errWriter := &errorWriter{}
 	enc := resp.NewEncoder(errWriter)
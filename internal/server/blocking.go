@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// keyWaiters tracks the clients blocked until one of their keys is written, see XREAD BLOCK.
+// A write only wakes the client, which then retries its read and decides whether to keep waiting
+type keyWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{} // key - wake-up channels of the clients blocked on it
+	blocked atomic.Int64                          // number of blocked clients, lets signal skip the lock when nobody waits
+}
+
+// newKeyWaiters creates an empty registry
+func newKeyWaiters() *keyWaiters {
+	return &keyWaiters{waiters: make(map[string]map[chan struct{}]struct{})}
+}
+
+// wait registers a client blocked on the keys. The returned channel receives a value after a write to any
+// of them, wake-ups that happen while the client is busy are coalesced. done must be called with the channel
+func (w *keyWaiters) wait(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, key := range keys {
+		if w.waiters[key] == nil {
+			w.waiters[key] = make(map[chan struct{}]struct{})
+		}
+		w.waiters[key][ch] = struct{}{}
+	}
+	w.blocked.Add(1)
+
+	return ch
+}
+
+// done unregisters the client blocked with ch
+func (w *keyWaiters) done(keys []string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, key := range keys {
+		delete(w.waiters[key], ch)
+		if len(w.waiters[key]) == 0 {
+			delete(w.waiters, key)
+		}
+	}
+	w.blocked.Add(-1)
+}
+
+// signal wakes the clients blocked on the keys
+func (w *keyWaiters) signal(keys []string) {
+	if w.blocked.Load() == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, key := range keys {
+		for ch := range w.waiters[key] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// blockingRead calls read under the shared transaction lock until it reports a reply. With a negative block
+// read is called once, otherwise the client waits for a write to one of the keys between the calls, at most
+// block or forever if it is 0. The wait also ends when the client disconnects or the engine shuts down.
+// A transaction and the AOF replay never block. Returns the null array when nothing was read
+func (e *Engine) blockingRead(ctx *context, keys []string, block time.Duration, read func() (resp.Value, bool)) resp.Value {
+	// EXEC already holds the transaction lock exclusively
+	inExec := ctx.peer != nil && ctx.peer.inExec
+	if inExec || ctx.peer == nil {
+		block = -1
+	}
+
+	var ch chan struct{}
+	var gone <-chan struct{}
+	if block >= 0 {
+		// registered before the first read, so a write between the read and the wait is not missed
+		ch = e.waiters.wait(keys)
+		defer e.waiters.done(keys, ch)
+
+		var stop func()
+		gone, stop = ctx.peer.watchDisconnect()
+		defer stop()
+
+		// the wait counts as an interaction, the client is not idle once it is woken
+		ctx.peer.blocked.Store(true)
+		defer func() {
+			ctx.peer.lastInteraction.Store(time.Now().UnixNano())
+			ctx.peer.blocked.Store(false)
+		}()
+	}
+
+	attempt := func() (resp.Value, bool) {
+		if !inExec {
+			e.txMu.RLock()
+			defer e.txMu.RUnlock()
+		}
+		return read()
+	}
+
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		if reply, ok := attempt(); ok {
+			return reply
+		}
+		if block < 0 {
+			return resp.Value{Type: resp.TypeArray, IsNull: true}
+		}
+
+		select {
+		case <-ch:
+		case <-timeout:
+			return resp.Value{Type: resp.TypeArray, IsNull: true}
+		case <-gone:
+			return resp.Value{Type: resp.TypeArray, IsNull: true}
+		case <-e.shutdown:
+			return resp.Value{Type: resp.TypeArray, IsNull: true}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// client CLIENT NO-TOUCH|NO-EVICT ON|OFF sets per-connection flags.
+// CLIENT LIST reports the connections served by HandleConnection, one line per client ordered by id
+func (e *Engine) client(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("CLIENT")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "LIST":
+		if len(ctx.args) != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("CLIENT|LIST")
+		}
+		return resp.MakeBulkString(e.clientList(time.Now()))
+	case "NO-TOUCH", "NO-EVICT":
+		if len(ctx.args) != 2 {
+			return resp.MakeErrorWrongNumberOfArguments("CLIENT|" + sub)
+		}
+
+		var on bool
+		switch strings.ToUpper(string(ctx.args[1].String)) {
+		case "ON":
+			on = true
+		case "OFF":
+			on = false
+		default:
+			return resp.MakeError("ERR syntax error")
+		}
+
+		if sub == "NO-TOUCH" {
+			ctx.peer.noTouch = on
+		} else {
+			// there is no eviction yet, the flag is only recorded
+			ctx.peer.noEvict = on
+		}
+
+		return resp.MakeSimpleString("OK")
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", strings.ToLower(sub)))
+}
+
+// clientList formats the CLIENT LIST reply. Only fields that are safe to read from another connection
+// are reported: the idle time in seconds and the commands received during the last complete second
+func (e *Engine) clientList(now time.Time) string {
+	e.clients.mu.Lock()
+	peers := make([]*Peer, 0, len(e.clients.peers))
+	for _, peer := range e.clients.peers {
+		peers = append(peers, peer)
+	}
+	e.clients.mu.Unlock()
+
+	slices.SortFunc(peers, func(a, b *Peer) int { return cmp.Compare(a.id, b.id) })
+
+	var b strings.Builder
+	for _, peer := range peers {
+		idle := time.Duration(now.UnixNano()-peer.lastInteraction.Load()) / time.Second
+		fmt.Fprintf(&b, "id=%d addr=%s idle=%d cmd-rate=%d\n", peer.id, peer.Addr(), idle, peer.rate.perSecond(now.UnixNano()))
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// clusterSlots is the number of hash slots of a Redis Cluster
+const clusterSlots = 16384
+
+// cluster CLUSTER KEYSLOT key. Moonlight runs on a single node, the slot is computed only for cluster-aware tooling
+func cluster(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("CLUSTER")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "KEYSLOT":
+		if len(ctx.args) != 2 {
+			return resp.MakeErrorWrongNumberOfArguments("CLUSTER|KEYSLOT")
+		}
+
+		return resp.MakeInteger(int64(keySlot(ctx.args[1].String)))
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", strings.ToLower(sub)))
+}
+
+// keySlot returns the hash slot of the key. If the key contains a non-empty {tag}, only the tag is hashed,
+// so keys sharing a tag land in the same slot
+func keySlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 computes the CRC16-CCITT (XMODEM) checksum used by Redis Cluster: polynomial 0x1021, initial value 0
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
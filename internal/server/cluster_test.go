@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+func TestClusterKeySlot(t *testing.T) {
+	e := setupEngine()
+
+	if got := crc16([]byte("123456789")); got != 0x31C3 {
+		t.Errorf("crc16 check value: got %#x, want 0x31c3", got)
+	}
+
+	slot := func(key string) int64 {
+		t.Helper()
+		res := e.Execute(mockPeer, "CLUSTER", makeCommand("CLUSTER", "KEYSLOT", key))
+		if res.Type != resp.TypeInteger {
+			t.Fatalf("KEYSLOT %q: expected integer, got %v", key, res)
+		}
+		return res.Integer
+	}
+
+	// slots reported by Redis
+	for key, want := range map[string]int64{
+		"foo":           12182,
+		"bar":           5061,
+		"somekey":       11058,
+		"foo{hash_tag}": 2515,
+		"bar{hash_tag}": 2515,
+	} {
+		if got := slot(key); got != want {
+			t.Errorf("KEYSLOT %q: got %d, want %d", key, got, want)
+		}
+	}
+
+	// hash tags: the key on the left hashes like the key on the right
+	for _, tt := range []struct{ key, hashedAs string }{
+		{"{user1000}.following", "user1000"},
+		{"{foo}bar", "foo"},
+		{"foo{bar}{zap}", "bar"},     // only the first tag counts
+		{"foo{{bar}}zap", "{bar"},    // the tag ends at the first closing brace
+		{"foo{}{bar}", "foo{}{bar}"}, // empty tag, the whole key is hashed
+		{"{foo", "{foo"},             // no closing brace
+	} {
+		if got, want := slot(tt.key), int64(crc16([]byte(tt.hashedAs))%clusterSlots); got != want {
+			t.Errorf("KEYSLOT %q: got %d, want the slot of %q %d", tt.key, got, tt.hashedAs, want)
+		}
+	}
+	if slot("foo{}{bar}") == slot("bar") {
+		t.Error("an empty tag must not select the next tag")
+	}
+
+	if res := e.Execute(mockPeer, "CLUSTER", makeCommand("CLUSTER", "KEYSLOT")); res.Type != resp.TypeError {
+		t.Errorf("expected wrong number of arguments error, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "CLUSTER", makeCommand("CLUSTER", "NODES")); res.Type != resp.TypeError {
+		t.Errorf("expected unknown subcommand error, got %v", res)
+	}
+}
@@ -10,6 +10,16 @@ type context struct {
 	args    []resp.Value
 	storage *storage.Storage
 	peer    *Peer
+	stats   *engineStats // nil while the AOF is replayed
+
+	propagation *propagation // set by handlers that decide per call what is written to the AOF
+}
+
+// lookup records a keyspace hit or miss of a read command
+func (ctx *context) lookup(found bool) {
+	if ctx.stats != nil {
+		ctx.stats.recordLookup(found)
+	}
 }
 
 // command defines a common interface for all executable server commands
@@ -24,3 +34,28 @@ type commandFunc func(ctx *context) resp.Value
 func (c commandFunc) execute(ctx *context) resp.Value {
 	return c(ctx)
 }
+
+// streamCommand is implemented by commands whose reply can be too large to materialize.
+// stream writes the reply straight to the peer's encoder, execute still builds the value
+// for callers that need one: EXEC, Do and the AOF replay
+type streamCommand interface {
+	command
+	stream(ctx *context, enc *resp.Encoder) error
+}
+
+// streamFunc is an adapter that pairs a regular command with its streaming writer
+type streamFunc struct {
+	commandFunc
+	writer func(ctx *context, enc *resp.Encoder) error
+}
+
+// stream implements the streamCommand interface for the streamFunc type
+func (c streamFunc) stream(ctx *context, enc *resp.Encoder) error {
+	return c.writer(ctx, enc)
+}
+
+// typeStreamed is the type of the value returned by call when the reply was already written by streamCommand
+const typeStreamed = 's'
+
+// streamedReply tells the connection loop that there is nothing left to send
+var streamedReply = resp.Value{Type: typeStreamed}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// configSetters are the parameters accepted by CONFIG SET, keyed by their lowercase name
+var configSetters = map[string]func(e *Engine, value string) error{
+	"read-only": func(e *Engine, value string) error {
+		on, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		e.readOnly.Store(on)
+		return nil
+	},
+}
+
+// parseYesNo parses the value of a boolean parameter of CONFIG SET
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+// configCmd CONFIG RESETSTAT zeroes the statistics reported by INFO stats, commandstats and persistence.
+// CONFIG SET parameter value [parameter value ...] changes the runtime parameters listed in configSetters
+func (e *Engine) configCmd(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("CONFIG")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "RESETSTAT":
+		if len(ctx.args) != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("CONFIG|RESETSTAT")
+		}
+
+		e.stats.reset()
+		e.cmdStats.reset()
+		if e.aof != nil {
+			e.aof.ResetStats()
+		}
+
+		return resp.MakeSimpleString("OK")
+
+	case "SET":
+		if len(ctx.args) < 3 || len(ctx.args)%2 != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("CONFIG|SET")
+		}
+
+		// reject unknown parameters before applying any of them
+		for i := 1; i < len(ctx.args); i += 2 {
+			name := strings.ToLower(string(ctx.args[i].String))
+			if _, ok := configSetters[name]; !ok {
+				return resp.MakeError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", name))
+			}
+		}
+
+		for i := 1; i < len(ctx.args); i += 2 {
+			name := strings.ToLower(string(ctx.args[i].String))
+			value := string(ctx.args[i+1].String)
+			if err := configSetters[name](e, value); err != nil {
+				return resp.MakeError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, err))
+			}
+		}
+
+		return resp.MakeSimpleString("OK")
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", strings.ToLower(sub)))
+}
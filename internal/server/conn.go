@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"go.uber.org/zap"
+)
+
+// HandleConnection serves a single client until it disconnects.
+//
+// Replies are written to the peer's buffer and flushed according to server.batch_flush:
+//   - enabled: while the input buffer still holds pipelined commands, replies are accumulated and
+//     a single Flush is performed once the input is drained. A lone non-pipelined command always
+//     drains the input, so its reply is flushed right away
+//   - disabled: every reply is flushed immediately
+//
+// The write buffer is bounded, so a very long pipeline may still be sent in several chunks
+func (e *Engine) HandleConnection(conn net.Conn) {
+	log := e.logger
+
+	if log.Core().Enabled(zap.DebugLevel) {
+		log.Debug("client connected", zap.String("addr", conn.RemoteAddr().String()))
+	}
+
+	if e.protected && !isLoopback(conn.RemoteAddr()) {
+		log.Warn("client refused by protected mode", zap.String("addr", conn.RemoteAddr().String()))
+		conn.Write([]byte("-" + protectedModeError + "\r\n")) //nolint:errcheck
+		conn.Close()                                          //nolint:errcheck
+		return
+	}
+
+	peer := NewPeer(conn)
+	peer.streaming = true
+	peer.reader.SetLenientCRLF(e.cfg.Server.ProtoLenientCRLF)
+	if n := e.cfg.Server.ProtoMaxMultiBulkLen; n > 0 {
+		peer.reader.SetMaxMultiBulkLen(n)
+	}
+	if n := e.cfg.Server.ProtoMaxBulkLen; n > 0 {
+		peer.reader.SetMaxBulkLen(n)
+	}
+	e.clients.add(peer)
+	defer func() {
+		e.clients.remove(peer)
+		e.Disconnect(peer)
+		peer.Close() //nolint:errcheck
+		// log connection close
+		if log.Core().Enabled(zap.DebugLevel) {
+			log.Debug("client disconnected", zap.String("addr", conn.RemoteAddr().String()))
+		}
+	}()
+
+	for {
+		cmdValue, err := peer.ReadCommand()
+		if err != nil {
+			if errors.Is(err, resp.ErrMultiBulkLength) || errors.Is(err, resp.ErrBulkLength) {
+				// the rest of the request cannot be skipped reliably, so reply and drop the client like Redis does
+				peer.Send(resp.MakeError("ERR Protocol error: " + err.Error())) //nolint:errcheck
+				peer.Flush()                                                    //nolint:errcheck
+			}
+			if !errors.Is(err, io.EOF) {
+				log.Warn("read command failed", zap.Error(err))
+			}
+			return
+		}
+
+		now := time.Now().UnixNano()
+		peer.lastInteraction.Store(now)
+		peer.rate.record(now)
+
+		if cmdValue.Type == resp.TypeArray && len(cmdValue.Array) == 0 {
+			continue
+		}
+
+		var result resp.Value
+		commandName, args, err := parseCommand(cmdValue)
+		if err != nil {
+			result = resp.MakeError(err.Error())
+		} else if limit := e.cfg.Server.ClientMaxCommandsPerSec; limit > 0 && !peer.limiter.allow(limit, now) {
+			result = resp.MakeError("ERR max number of commands per second reached for this client, see server.client_max_commands_per_sec")
+		} else {
+			result = e.Execute(peer, commandName, args)
+		}
+		peer.subscribed.Store(peer.inSubscribeMode())
+
+		if result.Type != typeStreamed {
+			err = peer.Send(result)
+		}
+		if err != nil {
+			log.Error("error writing response:", zap.Error(err))
+			return
+		}
+
+		if !e.cfg.Server.BatchFlush || peer.InputBuffered() == 0 {
+			if err := peer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// parseCommand validates a request read from the client and splits it into the command name and arguments.
+// A request must be a non-empty array of non-null strings, the name is trimmed and uppercased
+func parseCommand(v resp.Value) (string, []resp.Value, error) {
+	if v.Type != resp.TypeArray || v.IsNull || len(v.Array) == 0 {
+		return "", nil, errors.New("ERR Protocol error: expected array of bulk strings")
+	}
+
+	for _, arg := range v.Array {
+		if (arg.Type != resp.TypeBulkString && arg.Type != resp.TypeSimpleString) || arg.IsNull {
+			return "", nil, errors.New("ERR Protocol error: expected bulk string")
+		}
+	}
+
+	return strings.ToUpper(strings.TrimSpace(string(v.Array[0].String))), v.Array[1:], nil
+}
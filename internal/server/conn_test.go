@@ -0,0 +1,563 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/config"
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+	"go.uber.org/zap"
+)
+
+// startConnection serves one end of an in-memory connection and returns the client end
+func startConnection(t testing.TB, e *Engine) net.Conn {
+	t.Helper()
+
+	server, client := net.Pipe()
+	go e.HandleConnection(server)
+	t.Cleanup(func() {
+		client.Close() //nolint:errcheck
+	})
+
+	return client
+}
+
+func TestHandleConnection_SingleCommandFlush(t *testing.T) {
+	for _, batch := range []bool{true, false} {
+		e := setupEngine()
+		e.cfg.Server.BatchFlush = batch
+
+		client := startConnection(t, e)
+
+		if _, err := client.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+
+		// the reply of a lone command must not wait for more input
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) //nolint:errcheck
+		res, err := resp.NewDecoder(client).Read()
+		if err != nil {
+			t.Fatalf("batch=%v: reply was not flushed: %v", batch, err)
+		}
+		if string(res.String) != "PONG" {
+			t.Errorf("batch=%v: got %q, want PONG", batch, res.String)
+		}
+	}
+}
+
+func TestHandleConnection_Pipeline(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.BatchFlush = true
+
+	client := startConnection(t, e)
+
+	pipeline := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n" +
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n" +
+		"*1\r\n$4\r\nPING\r\n"
+
+	go client.Write([]byte(pipeline)) //nolint:errcheck
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+
+	want := []string{"OK", "v", "PONG"}
+	for _, w := range want {
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(res.String) != w {
+			t.Errorf("got %q, want %q", res.String, w)
+		}
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	const size = 100
+	pipeline := []byte(strings.Repeat("*1\r\n$4\r\nPING\r\n", size))
+
+	for _, batch := range []bool{true, false} {
+		name := "PerReplyFlush"
+		if batch {
+			name = "BatchFlush"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			e := setupEngine()
+			e.logger = zap.NewNop()
+			e.cfg.Server.BatchFlush = batch
+
+			client := startConnection(b, e)
+			dec := resp.NewDecoder(client)
+			expected := bytes.Count(pipeline, []byte("PING"))
+
+			b.ResetTimer()
+			for range b.N {
+				go client.Write(pipeline) //nolint:errcheck
+				for range expected {
+					if _, err := dec.Read(); err != nil {
+						b.Fatalf("read failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConnection_OversizedMultiBulk(t *testing.T) {
+	e := setupEngine()
+	client := startConnection(t, e)
+
+	go client.Write([]byte("*1000000000\r\n")) //nolint:errcheck
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+
+	res, err := dec.Read()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if res.Type != resp.TypeError || string(res.String) != "ERR Protocol error: invalid multibulk length" {
+		t.Errorf("got %v, want a protocol error", res)
+	}
+
+	// the connection is closed after the error
+	if _, err := dec.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestHandleConnection_InvalidBulkLength(t *testing.T) {
+	for _, header := range []string{"$-5", "$99999999999999"} {
+		t.Run(header, func(t *testing.T) {
+			e := setupEngine()
+			client := startConnection(t, e)
+
+			go client.Write([]byte("*1\r\n" + header + "\r\n")) //nolint:errcheck
+
+			client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+			dec := resp.NewDecoder(client)
+
+			res, err := dec.Read()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if res.Type != resp.TypeError || string(res.String) != "ERR Protocol error: invalid bulk length" {
+				t.Errorf("got %v, want a protocol error", res)
+			}
+
+			if _, err := dec.Read(); !errors.Is(err, io.EOF) {
+				t.Errorf("expected the connection to be closed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReapIdleConnections(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.ReapIdleAfter = time.Minute
+
+	client := startConnection(t, e)
+	dec := resp.NewDecoder(client)
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+
+	// a reply proves the connection is registered
+	go client.Write([]byte("*1\r\n$4\r\nPING\r\n")) //nolint:errcheck
+	if _, err := dec.Read(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if n := e.reapIdle(time.Now()); n != 0 {
+		t.Fatalf("reaped %d active connections", n)
+	}
+
+	if n := e.reapIdle(time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("expected 1 reaped connection, got %d", n)
+	}
+	if _, err := dec.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+
+	if got := e.stats.reapedConnections.Load(); got != 1 {
+		t.Errorf("reaped_connections = %d, want 1", got)
+	}
+	info := e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats"))
+	if !strings.Contains(string(info.String), "reaped_connections:1") {
+		t.Errorf("INFO stats does not report the reaped connection: %q", info.String)
+	}
+}
+
+func TestReapIdleKeepsWaitingClients(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.ReapIdleAfter = time.Minute
+
+	subscriber := startConnection(t, e)
+	subscriber.SetReadDeadline(time.Now().Add(time.Second))              //nolint:errcheck
+	go subscriber.Write([]byte("*2\r\n$9\r\nSUBSCRIBE\r\n$2\r\nch\r\n")) //nolint:errcheck
+	if _, err := resp.NewDecoder(subscriber).Read(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	blocked := startConnection(t, e)
+	if _, err := blocked.Write([]byte("*6\r\n$5\r\nXREAD\r\n$5\r\nBLOCK\r\n$1\r\n0\r\n$7\r\nSTREAMS\r\n$1\r\ns\r\n$1\r\n$\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	waitBlocked(t, e, 1)
+
+	if n := e.reapIdle(time.Now().Add(time.Hour)); n != 0 {
+		t.Errorf("reaped %d subscribed or blocked connections", n)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    resp.Value
+		wantName string
+		wantArgs int
+		wantErr  bool
+	}{
+		{"Valid", resp.MakeArray(makeCommand("", "get", "k")), "GET", 1, false},
+		{"Padded name", resp.MakeArray(makeCommand("", " ping ")), "PING", 0, false},
+		{"Empty name", resp.MakeArray(makeCommand("", "")), "", 0, false},
+		{"Not an array", resp.MakeBulkString("PING"), "", 0, true},
+		{"Integer argument", resp.MakeArray([]resp.Value{resp.MakeBulkString("GET"), resp.MakeInteger(1)}), "", 0, true},
+		{"Nil name", resp.MakeArray([]resp.Value{resp.MakeNilBulkString()}), "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, args, err := parseCommand(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (name != tt.wantName || len(args) != tt.wantArgs) {
+				t.Errorf("got %q with %d args, want %q with %d", name, len(args), tt.wantName, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestHandleConnection_MalformedCommands(t *testing.T) {
+	e := setupEngine()
+	client := startConnection(t, e)
+
+	input := "*1\r\n$0\r\n\r\n" +
+		"*2\r\n$3\r\nGET\r\n:1\r\n" +
+		"+PING\r\n" +
+		"*0\r\n" +
+		"*1\r\n$4\r\nPING\r\n"
+
+	go client.Write([]byte(input)) //nolint:errcheck
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+
+	want := []string{
+		"ERR unknown command '', with args beginning with: ",
+		"ERR Protocol error: expected bulk string",
+		"ERR Protocol error: expected array of bulk strings",
+		"PONG",
+	}
+	for _, w := range want {
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(res.String) != w {
+			t.Errorf("got %q, want %q", res.String, w)
+		}
+	}
+}
+
+func TestHGetAllStreamed(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "a", "1", "b", "2"))
+	(*e.storage).HSetEx("h", map[string]string{"gone": "x"}, time.Millisecond, storage.HSetExOptions{})
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "v"))
+	time.Sleep(5 * time.Millisecond)
+
+	client := startConnection(t, e)
+	client.SetDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	go client.Write([]byte(                         //nolint:errcheck
+		"*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n" +
+			"*2\r\n$7\r\nHGETALL\r\n$7\r\nmissing\r\n" +
+			"*2\r\n$7\r\nHGETALL\r\n$1\r\ns\r\n" +
+			"*1\r\n$7\r\nHGETALL\r\n" +
+			"*1\r\n$4\r\nPING\r\n"))
+
+	dec := resp.NewDecoder(client)
+	read := func() resp.Value {
+		t.Helper()
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		return res
+	}
+
+	res := read()
+	if m := pairsToMap(res); res.Type != resp.TypeArray || len(res.Array) != 4 || m["a"] != "1" || m["b"] != "2" {
+		t.Errorf("unexpected streamed HGETALL reply %v", res)
+	}
+
+	if res := read(); res.Type != resp.TypeArray || len(res.Array) != 0 {
+		t.Errorf("missing: expected an empty array, got %v", res)
+	}
+	if res := read(); string(res.String) != string(resp.MakeErrorWrongType().String) {
+		t.Errorf("s: expected WRONGTYPE, got %v", res)
+	}
+
+	if res := read(); res.Type != resp.TypeError {
+		t.Errorf("expected wrong number of arguments error, got %v", res)
+	}
+
+	// the connection stays in sync after the streamed replies
+	if res := read(); string(res.String) != "PONG" {
+		t.Errorf("expected PONG, got %v", res)
+	}
+
+	info := e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats"))
+	for _, field := range []string{"keyspace_hits:1\r\n", "keyspace_misses:1\r\n"} {
+		if !strings.Contains(string(info.String), field) {
+			t.Errorf("missing %q in %q", field, info.String)
+		}
+	}
+}
+
+func TestHGetAllSlowReader(t *testing.T) {
+	e := setupEngine()
+	fields := make(map[string]string, 10_000)
+	for i := range 10_000 {
+		fields["field:"+strconv.Itoa(i)] = "value"
+	}
+	(*e.storage).HSet("h", fields)
+
+	// the client sends HGETALL and never reads the reply, which is larger than the write buffer
+	client := startConnection(t, e)
+	if _, err := client.Write([]byte("*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "new", "v"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("HSET was blocked by the reply of HGETALL to a slow client")
+	}
+}
+
+func TestHGetAllInTransaction(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "a", "1"))
+
+	client := startConnection(t, e)
+	client.SetDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	go client.Write([]byte(                         //nolint:errcheck
+		"*1\r\n$5\r\nMULTI\r\n" +
+			"*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n" +
+			"*1\r\n$4\r\nEXEC\r\n"))
+
+	dec := resp.NewDecoder(client)
+	var res resp.Value
+	for range 3 {
+		var err error
+		if res, err = dec.Read(); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+	}
+
+	// EXEC collects the replies, so the queued HGETALL must be materialized
+	if res.Type != resp.TypeArray || len(res.Array) != 1 || pairsToMap(res.Array[0])["a"] != "1" {
+		t.Errorf("unexpected EXEC reply %v", res)
+	}
+}
+
+// BenchmarkHGetAllReply compares the allocations of a materialized and a streamed reply for a 1M-field hash
+func BenchmarkHGetAllReply(b *testing.B) {
+	const size = 1_000_000
+
+	e := setupEngine()
+	e.logger = zap.NewNop()
+	fields := make(map[string]string, size)
+	for i := range size {
+		fields["field:"+strconv.Itoa(i)] = "value"
+	}
+	(*e.storage).HSet("h", fields)
+
+	ctx := &context{args: makeCommand("", "h"), storage: e.storage, peer: mockPeer}
+	enc := resp.NewEncoder(io.Discard)
+
+	b.Run("Materialized", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			enc.Write(hgetall(ctx)) //nolint:errcheck
+			enc.Flush()             //nolint:errcheck
+		}
+	})
+
+	b.Run("Streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			hgetallStream(ctx, enc) //nolint:errcheck
+			enc.Flush()             //nolint:errcheck
+		}
+	})
+}
+
+// remoteConn overrides the remote address of a connection
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestHandleConnection_ProtectedMode(t *testing.T) {
+	e := setupEngine()
+	e.protected = true
+
+	external := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+	server, client := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	go e.HandleConnection(remoteConn{Conn: server, remote: external})
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	res, err := resp.NewDecoder(client).Read()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "DENIED") {
+		t.Errorf("got %q, want a DENIED error", res.String)
+	}
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("the connection must be closed, got %v", err)
+	}
+
+	loopback := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 50000}
+	server, client = net.Pipe()
+	defer client.Close() //nolint:errcheck
+	go e.HandleConnection(remoteConn{Conn: server, remote: loopback})
+
+	if _, err := client.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	res, err = resp.NewDecoder(client).Read()
+	if err != nil || string(res.String) != "PONG" {
+		t.Errorf("loopback client: got %q, %v, want PONG", res.String, err)
+	}
+}
+
+func TestProtectedMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		server config.ServerConfig
+		want   bool
+	}{
+		{"any address", config.ServerConfig{Host: "0.0.0.0", ProtectedMode: true}, true},
+		{"disabled", config.ServerConfig{Host: "0.0.0.0"}, false},
+		{"password", config.ServerConfig{Host: "0.0.0.0", ProtectedMode: true, RequirePass: "secret"}, false},
+		{"loopback host", config.ServerConfig{Host: "127.0.0.1", ProtectedMode: true}, false},
+		{"loopback bind", config.ServerConfig{Host: "0.0.0.0", Bind: []string{"localhost", "::1"}, ProtectedMode: true}, false},
+		{"external bind", config.ServerConfig{Bind: []string{"127.0.0.1", "10.0.0.1"}, ProtectedMode: true}, true},
+	}
+
+	for _, tt := range tests {
+		if got := protectedMode(&config.Config{Server: tt.server}); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleConnection_RateLimit(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.ClientMaxCommandsPerSec = 5
+
+	client := startConnection(t, e)
+	dec := resp.NewDecoder(client)
+
+	go client.Write([]byte(strings.Repeat("*1\r\n$4\r\nPING\r\n", 20))) //nolint:errcheck
+
+	var pongs, throttled int
+	for range 20 {
+		client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		switch {
+		case string(res.String) == "PONG":
+			pongs++
+		case res.Type == resp.TypeError && strings.Contains(string(res.String), "max number of commands per second"):
+			throttled++
+		default:
+			t.Fatalf("unexpected reply %v", res)
+		}
+	}
+
+	// the burst is one second worth of commands, a few more may be refilled while the pipeline is served
+	if pongs < 5 || pongs > 6 || throttled != 20-pongs {
+		t.Errorf("got %d PONG and %d throttled replies, want 5 PONG and the rest throttled", pongs, throttled)
+	}
+
+	time.Sleep(time.Second) // let the bucket refill so CLIENT LIST is not throttled
+	if _, err := client.Write([]byte("*2\r\n$6\r\nCLIENT\r\n$4\r\nLIST\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	res, err := dec.Read()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !strings.Contains(string(res.String), "cmd-rate=") || !strings.HasPrefix(string(res.String), "id=") {
+		t.Errorf("unexpected CLIENT LIST reply %q", res.String)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now().UnixNano()
+
+	for i := range 4 {
+		if !l.allow(4, now) {
+			t.Fatalf("command %d of the burst was throttled", i)
+		}
+	}
+	if l.allow(4, now) {
+		t.Error("the command after the burst was allowed")
+	}
+
+	// a quarter of a second refills one token at 4 commands per second
+	now += int64(time.Second / 4)
+	if !l.allow(4, now) {
+		t.Error("the refilled token was not allowed")
+	}
+	if l.allow(4, now) {
+		t.Error("only one token must have been refilled")
+	}
+
+	// the bucket never holds more than one second worth of tokens
+	now += int64(time.Hour)
+	for range 4 {
+		l.allow(4, now)
+	}
+	if l.allow(4, now) {
+		t.Error("the bucket grew past its capacity")
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/glob"
+	"github.com/eternalApril/moonlight/internal/persistence"
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// isDebugSleep reports whether the command is DEBUG SLEEP, the only command that runs without txMu
+func isDebugSleep(name string, args []resp.Value) bool {
+	return name == "DEBUG" && len(args) > 0 && strings.EqualFold(string(args[0].String), "SLEEP")
+}
+
+// debug DEBUG OBJECT key reports low-level information about a key.
+// DEBUG STRINGMATCH-LEN pattern string returns 1 if the string matches the glob pattern used by SCAN and PSUBSCRIBE, 0 otherwise.
+// DEBUG SLEEP seconds blocks only the calling connection, fractions of a second are allowed.
+// DEBUG POPULATE count [prefix [size]] creates the keys prefix:0..prefix:count-1, existing keys are kept.
+// DEBUG SHARDINFO reports the number of keys of every shard and how evenly they are spread.
+// DEBUG QUICKSAVE returns the dataset in the RDB format as a bulk string, without writing to disk.
+// Disabled unless server.enable_debug_command is set
+func (e *Engine) debug(ctx *context) resp.Value {
+	if !e.cfg.Server.EnableDebugCommand {
+		return resp.MakeError("ERR DEBUG command not allowed. Set server.enable_debug_command in the configuration file to enable it")
+	}
+
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("DEBUG")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "OBJECT":
+		if len(ctx.args) != 2 {
+			return resp.MakeErrorWrongNumberOfArguments("DEBUG|OBJECT")
+		}
+
+		var info string
+		ok := (*ctx.storage).View(string(ctx.args[1].String), func(entity storage.Entity) {
+			info = fmt.Sprintf("type:%s encoding:%s serializedlength:%d",
+				entity.Type, e.objectEncoding(entity), storage.SerializedLength(entity))
+
+			switch entity.Type {
+			case storage.TypeHash:
+				info += fmt.Sprintf(" elements:%d", len(entity.Value.(map[string]storage.HashField)))
+			case storage.TypeList:
+				info += fmt.Sprintf(" elements:%d", len(entity.Value.([]string)))
+			case storage.TypeStream:
+				info += fmt.Sprintf(" elements:%d", len(entity.Value.(*storage.Stream).Entries))
+			}
+		})
+		if !ok {
+			return resp.MakeError("ERR no such key")
+		}
+
+		return resp.MakeSimpleString(info)
+	case "STRINGMATCH-LEN":
+		if len(ctx.args) != 3 {
+			return resp.MakeErrorWrongNumberOfArguments("DEBUG|STRINGMATCH-LEN")
+		}
+
+		if glob.Match(string(ctx.args[1].String), string(ctx.args[2].String)) {
+			return resp.MakeInteger(1)
+		}
+		return resp.MakeInteger(0)
+	case "SLEEP":
+		if len(ctx.args) != 2 {
+			return resp.MakeErrorWrongNumberOfArguments("DEBUG|SLEEP")
+		}
+
+		seconds, err := strconv.ParseFloat(string(ctx.args[1].String), 64)
+		if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds < 0 {
+			return resp.MakeError("ERR value is not a valid float")
+		}
+
+		// no storage lock is held here and execute does not take txMu for DEBUG SLEEP,
+		// so other clients and transactions proceed while this connection sleeps
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		return resp.MakeSimpleString("OK")
+	case "POPULATE":
+		if len(ctx.args) < 2 || len(ctx.args) > 4 {
+			return resp.MakeErrorWrongNumberOfArguments("DEBUG|POPULATE")
+		}
+
+		// DEBUG is not a write command, so execute did not check the read-only mode
+		if e.readOnly.Load() {
+			return resp.MakeError("READONLY You can't write against a read only replica.")
+		}
+
+		count, err := strconv.ParseInt(string(ctx.args[1].String), 10, 64)
+		if err != nil || count < 0 {
+			return resp.MakeError("ERR value is out of range, must be positive")
+		}
+
+		prefix := "key"
+		if len(ctx.args) > 2 {
+			prefix = string(ctx.args[2].String)
+		}
+
+		size := int64(-1)
+		if len(ctx.args) > 3 {
+			size, err = strconv.ParseInt(string(ctx.args[3].String), 10, 64)
+			if err != nil || size < 0 {
+				return resp.MakeError("ERR value is out of range, must be positive")
+			}
+			// checked before any key is written, the padding would be allocated for every key
+			if size > (*ctx.storage).MaxStringLen() {
+				return resp.MakeError(storage.ErrStringTooLong.Error())
+			}
+		}
+
+		for i := range count {
+			n := strconv.FormatInt(i, 10)
+			set, err := (*ctx.storage).Set(prefix+":"+n, populateValue(n, size), storage.SetOptions{NX: true})
+			if err != nil {
+				return resp.MakeError(err.Error())
+			}
+			// commandKeys knows no keys of DEBUG, so call does not touch the watches of the created keys
+			if set {
+				e.watches.touch([]string{prefix + ":" + n})
+			}
+		}
+		return resp.MakeSimpleString("OK")
+	case "SHARDINFO":
+		if len(ctx.args) != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("DEBUG|SHARDINFO")
+		}
+
+		return resp.MakeBulkString(shardInfo((*ctx.storage).ShardLens()))
+	case "QUICKSAVE":
+		if len(ctx.args) != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("DEBUG|QUICKSAVE")
+		}
+
+		buf := &boundedBuffer{max: e.cfg.Server.DebugQuicksaveMaxSize}
+		if err := persistence.SaveTo(buf, *ctx.storage); err != nil {
+			if errors.Is(err, errQuicksaveTooLarge) {
+				return resp.MakeError(fmt.Sprintf("ERR the RDB payload exceeds server.debug_quicksave_max_size (%d bytes)",
+					e.cfg.Server.DebugQuicksaveMaxSize))
+			}
+			return resp.MakeError("ERR " + err.Error())
+		}
+		return resp.MakeBulkString(buf.String())
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try DEBUG HELP.", strings.ToLower(sub)))
+}
+
+// populateValue returns the DEBUG POPULATE value "value:n", truncated or padded with zero bytes to size when it is not negative
+func populateValue(n string, size int64) string {
+	value := "value:" + n
+	if size < 0 {
+		return value
+	}
+	if int64(len(value)) >= size {
+		return value[:size]
+	}
+	return value + strings.Repeat("\x00", int(size)-len(value))
+}
+
+// shardInfo formats the key counts of the shards like INFO: the summary first, then shard_<i>:<keys> lines.
+// spread is max-min and stddev the population standard deviation of the counts
+func shardInfo(lens []int64) string {
+	var sum int64
+	lo, hi := lens[0], lens[0]
+	for _, n := range lens {
+		sum += n
+		lo, hi = min(lo, n), max(hi, n)
+	}
+
+	mean := float64(sum) / float64(len(lens))
+	var variance float64
+	for _, n := range lens {
+		variance += (float64(n) - mean) * (float64(n) - mean)
+	}
+	variance /= float64(len(lens))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "shards:%d\r\nkeys:%d\r\nmin:%d\r\nmax:%d\r\nspread:%d\r\nstddev:%.2f\r\n",
+		len(lens), sum, lo, hi, hi-lo, math.Sqrt(variance))
+	for i, n := range lens {
+		fmt.Fprintf(&b, "shard_%d:%d\r\n", i, n)
+	}
+	return b.String()
+}
+
+// errQuicksaveTooLarge is returned by boundedBuffer when the payload of DEBUG QUICKSAVE outgrows its limit
+var errQuicksaveTooLarge = errors.New("payload too large")
+
+// boundedBuffer is a bytes.Buffer refusing to grow past max bytes, so DEBUG QUICKSAVE
+// stops the snapshot of a large dataset early instead of buffering all of it
+type boundedBuffer struct {
+	bytes.Buffer
+	max int64
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.max {
+		return 0, errQuicksaveTooLarge
+	}
+	return b.Buffer.Write(p)
+}
@@ -16,21 +16,97 @@ type commandMetadata struct {
 
 var (
 	commandRegistry = map[string]commandMetadata{
-		"PING":    {-1, []string{"fast", "stale"}, 0, 0, 0},
-		"GET":     {2, []string{"readonly", "fast"}, 1, 1, 1},
-		"SET":     {-3, []string{"write", "denyoom"}, 1, 1, 1},
-		"DEL":     {-2, []string{"write"}, 1, -1, 1},
-		"TTL":     {2, []string{"readonly", "fast"}, 1, 1, 1},
-		"PTTL":    {2, []string{"readonly", "fast"}, 1, 1, 1},
-		"PERSIST": {2, []string{"write", "fast"}, 1, 1, 1},
-		"COMMAND": {-1, []string{"loading", "stale", "random"}, 0, 0, 0},
-		"SAVE":    {1, []string{"admin"}, 0, 0, 0},
-		"BGSAVE":  {1, []string{"admin"}, 0, 0, 0},
-		"AUTH":    {2, []string{"no_auth", "fast", "noscript"}, 0, 0, 0},
-		"HGET":    {3, []string{"readonly", "fast"}, 1, 1, 1},
-		"HSET":    {-4, []string{"write", "fast", "denyoom"}, 1, 1, 1},
-		"HGETALL": {1, []string{"readonly"}, 1, 1, 1},
-		"HDEL":    {-3, []string{"write", "fast"}, 1, 1, 1},
+		"PING":        {-1, []string{"fast", "stale"}, 0, 0, 0},
+		"GET":         {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"GETDEL":      {2, []string{"write", "fast"}, 1, 1, 1},
+		"GETEX":       {-2, []string{"write", "fast"}, 1, 1, 1},
+		"SET":         {-3, []string{"write", "denyoom"}, 1, 1, 1},
+		"DEL":         {-2, []string{"write"}, 1, -1, 1},
+		"EXISTS":      {-2, []string{"readonly", "fast"}, 1, -1, 1},
+		"APPEND":      {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+		"INCRBYFLOAT": {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+		"SETRANGE":    {4, []string{"write", "denyoom"}, 1, 1, 1},
+		"GETRANGE":    {4, []string{"readonly"}, 1, 1, 1},
+		"BITFIELD":    {-2, []string{"write", "denyoom"}, 1, 1, 1},
+		"STRLEN":      {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"TTL":         {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"PTTL":        {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"PERSIST":     {2, []string{"write", "fast"}, 1, 1, 1},
+		"EXPIRE":      {3, []string{"write", "fast"}, 1, 1, 1},
+		"PEXPIRE":     {3, []string{"write", "fast"}, 1, 1, 1},
+		"EXPIREAT":    {3, []string{"write", "fast"}, 1, 1, 1},
+		"PEXPIREAT":   {3, []string{"write", "fast"}, 1, 1, 1},
+		"COPY":        {-3, []string{"write", "denyoom"}, 1, 2, 1},
+		"RENAME":      {3, []string{"write"}, 1, 2, 1},
+		"RENAMENX":    {3, []string{"write", "fast"}, 1, 2, 1},
+		"DUMP":        {2, []string{"readonly"}, 1, 1, 1},
+		"RESTORE":     {-4, []string{"write", "denyoom"}, 1, 1, 1},
+		"DBSIZE":      {1, []string{"readonly", "fast"}, 0, 0, 0},
+		"SCAN":        {-2, []string{"readonly"}, 0, 0, 0},
+		"KEYS":        {2, []string{"readonly"}, 0, 0, 0},
+		"DELPATTERN":  {2, []string{"write"}, 0, 0, 0},
+		"RANDOMKEY":   {1, []string{"readonly", "random"}, 0, 0, 0},
+		"COMMAND":     {-1, []string{"loading", "stale", "random"}, 0, 0, 0},
+		"SAVE":        {1, []string{"admin"}, 0, 0, 0},
+		"BGSAVE":      {1, []string{"admin"}, 0, 0, 0},
+		"AUTH":        {2, []string{"no_auth", "fast", "noscript"}, 0, 0, 0},
+		"HGET":        {3, []string{"readonly", "fast"}, 1, 1, 1},
+		"HSET":        {-4, []string{"write", "fast", "denyoom"}, 1, 1, 1},
+		"HSETNX":      {4, []string{"write", "fast", "denyoom"}, 1, 1, 1},
+		"HSETEX":      {-6, []string{"write", "fast", "denyoom"}, 1, 1, 1},
+		"HGETALL":     {2, []string{"readonly"}, 1, 1, 1},
+		"HDEL":        {-3, []string{"write", "fast"}, 1, 1, 1},
+		"HEXISTS":     {3, []string{"readonly", "fast"}, 1, 1, 1},
+		"HLEN":        {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"HKEYS":       {2, []string{"readonly"}, 1, 1, 1},
+		"HVALS":       {2, []string{"readonly"}, 1, 1, 1},
+		"HRANDFIELD":  {-2, []string{"readonly", "random"}, 1, 1, 1},
+		"HEXPIRE":     {-6, []string{"write", "fast"}, 1, 1, 1},
+		"HPEXPIREAT":  {-6, []string{"write", "fast"}, 1, 1, 1},
+		"HPTTL":       {-5, []string{"readonly", "fast"}, 1, 1, 1},
+		"LPUSH":       {-3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+		"RPUSH":       {-3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+		"LLEN":        {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"LRANGE":      {4, []string{"readonly"}, 1, 1, 1},
+		"LTRIM":       {4, []string{"write"}, 1, 1, 1},
+		"PFADD":       {-2, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+		"PFCOUNT":     {-2, []string{"readonly"}, 1, -1, 1},
+		"PFMERGE":     {-2, []string{"write", "denyoom"}, 1, -1, 1},
+		"XADD":        {-5, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+		"XLEN":        {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"XRANGE":      {-4, []string{"readonly"}, 1, 1, 1},
+		"XREAD":       {-4, []string{"readonly", "blocking", "movablekeys"}, 0, 0, 0},
+		"XGROUP":      {-2, []string{"write", "denyoom"}, 2, 2, 1},
+		"XREADGROUP":  {-7, []string{"write", "blocking", "movablekeys"}, 0, 0, 0},
+		"XACK":        {-4, []string{"write", "fast"}, 1, 1, 1},
+		"XPENDING":    {-3, []string{"readonly"}, 1, 1, 1},
+		"XCLAIM":      {-6, []string{"write", "fast"}, 1, 1, 1},
+		"OBJECT":      {-2, []string{"readonly"}, 2, 2, 1},
+		"TYPE":        {2, []string{"readonly", "fast"}, 1, 1, 1},
+		"DEBUG":       {-2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+		"HELLO":       {-1, []string{"noscript", "loading", "stale", "fast", "no_auth"}, 0, 0, 0},
+		"CLIENT":      {-2, []string{"noscript", "loading", "stale"}, 0, 0, 0},
+		"LOLWUT":      {-1, []string{"readonly", "fast"}, 0, 0, 0},
+		"MEMORY":      {-2, []string{"readonly"}, 0, 0, 0},
+		"CONFIG":      {-2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+		"CLUSTER":     {-2, []string{"loading", "stale"}, 0, 0, 0},
+		"MULTI":       {1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+		"EXEC":        {1, []string{"noscript", "loading", "stale"}, 0, 0, 0},
+		"DISCARD":     {1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+		"WATCH":       {-2, []string{"noscript", "loading", "stale", "fast"}, 1, -1, 1},
+		"UNWATCH":     {1, []string{"noscript", "loading", "stale", "fast"}, 0, 0, 0},
+		"INFO":        {-1, []string{"loading", "stale"}, 0, 0, 0},
+
+		// pub/sub commands take channels, not keys
+		"SUBSCRIBE":    {-2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+		"UNSUBSCRIBE":  {-1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+		"PSUBSCRIBE":   {-2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+		"PUNSUBSCRIBE": {-1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+		"PUBLISH":      {3, []string{"pubsub", "loading", "stale", "fast"}, 0, 0, 0},
+		"SSUBSCRIBE":   {-2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+		"SUNSUBSCRIBE": {-1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+		"SPUBLISH":     {3, []string{"pubsub", "loading", "stale", "fast"}, 0, 0, 0},
+		"PUBSUB":       {-2, []string{"pubsub", "loading", "stale"}, 0, 0, 0},
 	}
 )
 
@@ -56,18 +132,72 @@ var commandDocsRegistry = map[string]commandDoc{
 		group:      "string",
 		since:      "1.0.0",
 	},
+	"GETDEL": {
+		summary:    "Returns the string value of a key after deleting the key.",
+		complexity: "O(1)",
+		group:      "string",
+		since:      "1.0.0",
+	},
+	"GETEX": {
+		summary:    "Returns the string value of a key after setting its expiration time.",
+		complexity: "O(1)",
+		group:      "string",
+		since:      "1.0.0",
+	},
 	"SET": {
 		summary:    "Set the string value of a key.",
 		complexity: "O(1)",
 		group:      "string",
 		since:      "1.0.0",
 	},
+	"APPEND": {
+		summary:    "Appends a string to the value of a key. Creates the key if it doesn't exist.",
+		complexity: "O(1). The amortized time complexity is O(1) assuming the appended value is small and the already present value is of any size, since the dynamic string library used by Redis will double the free space available on every reallocation.",
+		group:      "string",
+		since:      "1.0.0",
+	},
+	"INCRBYFLOAT": {
+		summary:    "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.",
+		complexity: "O(1)",
+		group:      "string",
+		since:      "1.0.0",
+	},
+	"SETRANGE": {
+		summary:    "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.",
+		complexity: "O(1), not counting the time taken to copy the new string in place.",
+		group:      "string",
+		since:      "1.0.0",
+	},
+	"GETRANGE": {
+		summary:    "Returns a substring of the string stored at a key.",
+		complexity: "O(N) where N is the length of the returned string.",
+		group:      "string",
+		since:      "1.0.0",
+	},
+	"BITFIELD": {
+		summary:    "Performs arbitrary bitfield integer operations on strings.",
+		complexity: "O(1) for each subcommand specified.",
+		group:      "bitmap",
+		since:      "1.0.0",
+	},
+	"STRLEN": {
+		summary:    "Returns the length of a string value.",
+		complexity: "O(1)",
+		group:      "string",
+		since:      "1.0.0",
+	},
 	"DEL": {
 		summary:    "Delete a key.",
 		complexity: "O(N) where N is the number of keys that will be removed.",
 		group:      "generic",
 		since:      "1.0.0",
 	},
+	"EXISTS": {
+		summary:    "Determines whether one or more keys exist.",
+		complexity: "O(N) where N is the number of keys to check.",
+		group:      "generic",
+		since:      "1.0.0",
+	},
 	"TTL": {
 		summary:    "Get the time to live for a key in seconds.",
 		complexity: "O(1)",
@@ -86,6 +216,66 @@ var commandDocsRegistry = map[string]commandDoc{
 		group:      "generic",
 		since:      "1.0.0",
 	},
+	"EXPIRE": {
+		summary:    "Set a key's time to live in seconds.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"PEXPIRE": {
+		summary:    "Set a key's time to live in milliseconds.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"EXPIREAT": {
+		summary:    "Set the expiration for a key as a UNIX timestamp.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"PEXPIREAT": {
+		summary:    "Set the expiration for a key as a UNIX timestamp specified in milliseconds.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"RENAME": {
+		summary:    "Renames a key and overwrites the destination.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"RENAMENX": {
+		summary:    "Renames a key only when the target key name doesn't exist.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"DUMP": {
+		summary:    "Returns a serialized representation of the value stored at a key.",
+		complexity: "O(1) to access the key and additional O(N*M) to serialize it, where N is the number of Moonlight objects composing the value and M their average size.",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"RESTORE": {
+		summary:    "Creates a key from the serialized representation of a value.",
+		complexity: "O(1) to create the new key and additional O(N*M) to reconstruct the serialized value, where N is the number of Moonlight objects composing the value and M their average size.",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"COPY": {
+		summary:    "Copy a key.",
+		complexity: "O(N) worst case for collections, where N is the number of nested items. O(1) for string values.",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"DBSIZE": {
+		summary:    "Return the number of keys in the selected database.",
+		complexity: "O(1)",
+		group:      "server",
+		since:      "1.0.0",
+	},
 	"COMMAND": {
 		summary:    "Get array of command details.",
 		complexity: "O(N) where N is the number of commands to look up.",
@@ -110,11 +300,135 @@ var commandDocsRegistry = map[string]commandDoc{
 		group:      "server",
 		since:      "1.0.0",
 	},
+	"SCAN": {
+		summary:    "Iterates over the key names in the database.",
+		complexity: "O(1) for every call. O(N) for a complete iteration, including enough command calls for the cursor to return back to 0. N is the number of elements inside the collection.",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"KEYS": {
+		summary:    "Returns all key names that match a pattern.",
+		complexity: "O(N) with N being the number of keys in the database",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"DELPATTERN": {
+		summary:    "Deletes all keys that match a pattern.",
+		complexity: "O(N) with N being the number of keys in the database",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"RANDOMKEY": {
+		summary:    "Returns a random key name from the database.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"INFO": {
+		summary:    "Get information and statistics about the server.",
+		complexity: "O(1)",
+		group:      "server",
+		since:      "1.0.0",
+	},
+	"OBJECT": {
+		summary:    "Inspect the internals of Redis objects.",
+		complexity: "O(1) for strings and streams, O(N) for hashes and lists where N is the number of elements.",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"TYPE": {
+		summary:    "Determines the type of value stored at a key.",
+		complexity: "O(1)",
+		group:      "generic",
+		since:      "1.0.0",
+	},
+	"HELLO": {
+		summary:    "Handshakes with the Redis server.",
+		complexity: "O(1)",
+		group:      "connection",
+		since:      "1.0.0",
+	},
+	"CLIENT": {
+		summary:    "A container for client connection commands.",
+		complexity: "Depends on subcommand.",
+		group:      "connection",
+		since:      "1.0.0",
+	},
+	"DEBUG": {
+		summary:    "A container for debugging commands.",
+		complexity: "Depends on subcommand.",
+		group:      "server",
+		since:      "1.0.0",
+	},
+	"LOLWUT": {
+		summary:    "Displays computer art and the Moonlight version.",
+		complexity: "O(1)",
+		group:      "server",
+		since:      "1.0.0",
+	},
+	"CLUSTER": {
+		summary:    "A container for Redis Cluster commands. Moonlight runs on a single node.",
+		complexity: "Depends on subcommand.",
+		group:      "cluster",
+		since:      "1.0.0",
+	},
+	"MEMORY": {
+		summary:    "A container for memory diagnostics commands.",
+		complexity: "Depends on subcommand.",
+		group:      "server",
+		since:      "1.0.0",
+	},
+	"CONFIG": {
+		summary:    "A container for server configuration commands.",
+		complexity: "Depends on subcommand.",
+		group:      "server",
+		since:      "1.0.0",
+	},
+	"MULTI": {
+		summary:    "Start a transaction.",
+		complexity: "O(1)",
+		group:      "transactions",
+		since:      "1.0.0",
+	},
+	"EXEC": {
+		summary:    "Execute all commands issued after MULTI.",
+		complexity: "Depends on commands in the transaction",
+		group:      "transactions",
+		since:      "1.0.0",
+	},
+	"DISCARD": {
+		summary:    "Discard all commands issued after MULTI.",
+		complexity: "O(N), when N is the number of queued commands",
+		group:      "transactions",
+		since:      "1.0.0",
+	},
+	"WATCH": {
+		summary:    "Monitor changes to keys to determine execution of a MULTI/EXEC block.",
+		complexity: "O(1) for every key.",
+		group:      "transactions",
+		since:      "1.0.0",
+	},
+	"UNWATCH": {
+		summary:    "Forget about all watched keys.",
+		complexity: "O(1)",
+		group:      "transactions",
+		since:      "1.0.0",
+	},
 	"HSET": {
 		summary:    "Set the string value of a hash field",
 		complexity: "O(1) for each field/value pair added, so O(N) to add N field/value pairs when the command is called with multiple field/value pairs.",
 		group:      "hash",
 		since:      "1.0.0"},
+	"HSETNX": {
+		summary:    "Set the value of a field in a hash only when the field doesn't exist",
+		complexity: "O(1)",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HSETEX": {
+		summary:    "Set the value and expiration of one or more hash fields",
+		complexity: "O(N) where N is the number of fields being set.",
+		group:      "hash",
+		since:      "1.0.0"},
 	"HGET": {
 		summary:    "Get the value of a hash field",
 		complexity: "O(1)",
@@ -125,11 +439,207 @@ var commandDocsRegistry = map[string]commandDoc{
 		complexity: "O(N) where N is the size of the hash.",
 		group:      "hash",
 		since:      "1.0.0"},
+	"HRANDFIELD": {
+		summary:    "Returns one or more random fields from a hash.",
+		complexity: "O(N) where N is the number of fields returned",
+		group:      "hash",
+		since:      "1.0.0"},
 	"HDEL": {
 		summary:    "Delete one or more hash fields",
 		complexity: "O(N) where N is the number of fields to be removed.",
 		group:      "hash",
 		since:      "1.0.0"},
+	"HEXISTS": {
+		summary:    "Determine if a hash field exists",
+		complexity: "O(1)",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HLEN": {
+		summary:    "Get the number of fields in a hash",
+		complexity: "O(1)",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HKEYS": {
+		summary:    "Get all the fields in a hash",
+		complexity: "O(N) where N is the size of the hash.",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HVALS": {
+		summary:    "Get all the values in a hash",
+		complexity: "O(N) where N is the size of the hash.",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HEXPIRE": {
+		summary:    "Set the expiration of one or more hash fields in seconds",
+		complexity: "O(N) where N is the number of specified fields",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HPEXPIREAT": {
+		summary:    "Set the expiration of one or more hash fields as a Unix timestamp in milliseconds",
+		complexity: "O(N) where N is the number of specified fields",
+		group:      "hash",
+		since:      "1.0.0"},
+	"HPTTL": {
+		summary:    "Returns the TTL in milliseconds of one or more hash fields",
+		complexity: "O(N) where N is the number of specified fields",
+		group:      "hash",
+		since:      "1.0.0"},
+	"LPUSH": {
+		summary:    "Prepends one or more elements to a list. Creates the key if it doesn't exist.",
+		complexity: "O(N) where N is the length of the list.",
+		group:      "list",
+		since:      "1.0.0",
+	},
+	"RPUSH": {
+		summary:    "Appends one or more elements to a list. Creates the key if it doesn't exist.",
+		complexity: "O(1) for each element added.",
+		group:      "list",
+		since:      "1.0.0",
+	},
+	"LLEN": {
+		summary:    "Returns the length of a list.",
+		complexity: "O(1)",
+		group:      "list",
+		since:      "1.0.0",
+	},
+	"LRANGE": {
+		summary:    "Returns a range of elements from a list.",
+		complexity: "O(N) where N is the number of elements returned.",
+		group:      "list",
+		since:      "1.0.0",
+	},
+	"LTRIM": {
+		summary:    "Removes elements from both ends of a list. Deletes the list if all elements were trimmed.",
+		complexity: "O(N) where N is the number of elements kept.",
+		group:      "list",
+		since:      "1.0.0",
+	},
+	"PFADD": {
+		summary:    "Adds elements to a HyperLogLog key. Creates the key if it doesn't exist.",
+		complexity: "O(1) to add every element.",
+		group:      "hyperloglog",
+		since:      "1.0.0",
+	},
+	"PFCOUNT": {
+		summary:    "Returns the approximated cardinality of the set(s) observed by the HyperLogLog key(s).",
+		complexity: "O(N) where N is the number of keys.",
+		group:      "hyperloglog",
+		since:      "1.0.0",
+	},
+	"PFMERGE": {
+		summary:    "Merges one or more HyperLogLog values into a single key.",
+		complexity: "O(N) to merge N HyperLogLogs.",
+		group:      "hyperloglog",
+		since:      "1.0.0",
+	},
+	"XADD": {
+		summary:    "Appends a new message to a stream. Creates the key if it doesn't exist.",
+		complexity: "O(1) when adding a new entry.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XLEN": {
+		summary:    "Return the number of messages in a stream.",
+		complexity: "O(1)",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XRANGE": {
+		summary:    "Returns the messages from a stream within a range of IDs.",
+		complexity: "O(log(N)+M) with N being the number of entries in the stream and M the number of entries returned.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XREAD": {
+		summary:    "Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise.",
+		complexity: "O(log(N)+M) for every stream, with N being the number of entries in the stream and M the number of entries returned.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XGROUP": {
+		summary:    "Creates or destroys a consumer group.",
+		complexity: "O(1) for CREATE, O(N) for DESTROY where N is the number of pending entries of the group.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XREADGROUP": {
+		summary:    "Returns new or historical messages from a stream for a consumer in a group. Blocks until a message is available otherwise.",
+		complexity: "O(M) for every stream with M being the number of entries returned. O(N log(N)) when reading the history, N being the number of pending entries of the group.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XACK": {
+		summary:    "Returns the number of messages that were successfully acknowledged by the consumer group member of a stream.",
+		complexity: "O(1) for each message ID processed.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XPENDING": {
+		summary:    "Returns the information and entries from a stream consumer group's pending entries list.",
+		complexity: "O(N) with N being the number of pending entries of the group, O(N log(N)) for the extended form.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"XCLAIM": {
+		summary:    "Changes, or acquires, ownership of a message in a consumer group, as if the message was delivered to a consumer group member.",
+		complexity: "O(log N) with N being the number of messages in the stream.",
+		group:      "stream",
+		since:      "1.0.0",
+	},
+	"SUBSCRIBE": {
+		summary:    "Listen for messages published to channels.",
+		complexity: "O(N) where N is the number of channels to subscribe to.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"UNSUBSCRIBE": {
+		summary:    "Stop listening to messages posted to channels.",
+		complexity: "O(N) where N is the number of channels to unsubscribe.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"PSUBSCRIBE": {
+		summary:    "Listen for messages published to channels that match one or more patterns.",
+		complexity: "O(N) where N is the number of patterns to subscribe to.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"PUNSUBSCRIBE": {
+		summary:    "Stop listening to messages published to channels that match one or more patterns.",
+		complexity: "O(N) where N is the number of patterns to unsubscribe.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"PUBLISH": {
+		summary:    "Post a message to a channel.",
+		complexity: "O(N+M) where N is the number of clients subscribed to the receiving channel and M is the total number of subscribed patterns.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"SSUBSCRIBE": {
+		summary:    "Listen for messages published to shard channels. Sharding is a no-op on a single node.",
+		complexity: "O(N) where N is the number of shard channels to subscribe to.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"SUNSUBSCRIBE": {
+		summary:    "Stop listening to messages posted to shard channels.",
+		complexity: "O(N) where N is the number of shard channels to unsubscribe.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"SPUBLISH": {
+		summary:    "Post a message to a shard channel. Sharding is a no-op on a single node.",
+		complexity: "O(N) where N is the number of clients subscribed to the receiving shard channel.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
+	"PUBSUB": {
+		summary:    "Inspect the state of the Pub/Sub subsystem.",
+		complexity: "Depends on subcommand.",
+		group:      "pubsub",
+		since:      "1.0.0",
+	},
 }
 
 func makeFlagsArray(flags []string) resp.Value {
@@ -160,9 +670,61 @@ func getAllCommands() resp.Value {
 	return resp.MakeArray(cmdArray)
 }
 
+// getCommandNames returns the names of all commands, the reply of COMMAND LIST
+func getCommandNames() resp.Value {
+	names := make([]resp.Value, 0, len(commandRegistry))
+	for name := range commandRegistry {
+		names = append(names, resp.MakeBulkString(strings.ToLower(name)))
+	}
+	return resp.MakeArray(names)
+}
+
+// getCommandsInfo returns the details of the named commands, or of all commands without names.
+// Unknown commands get a nil entry, the reply of COMMAND INFO
+func getCommandsInfo(args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return getAllCommands()
+	}
+
+	cmdArray := make([]resp.Value, 0, len(args))
+	for _, arg := range args {
+		name := strings.ToUpper(string(arg.String))
+		if _, ok := commandRegistry[name]; !ok {
+			cmdArray = append(cmdArray, resp.Value{Type: resp.TypeArray, IsNull: true})
+			continue
+		}
+		cmdArray = append(cmdArray, resp.MakeArray(makeInfoCmdArray(name)))
+	}
+	return resp.MakeArray(cmdArray)
+}
+
+// getCommandKeys returns the keys of the command line args, the reply of COMMAND GETKEYS.
+// The number of arguments is checked against the arity of the command first
+func getCommandKeys(args []resp.Value) resp.Value {
+	name := strings.ToUpper(string(args[0].String))
+	meta, ok := commandRegistry[name]
+	if !ok {
+		return resp.MakeError("ERR Invalid command specified")
+	}
+	if (meta.arity > 0 && len(args) != meta.arity) || len(args) < -meta.arity {
+		return resp.MakeError("ERR Invalid arguments specified for command")
+	}
+
+	keys := commandKeys(name, args[1:])
+	if len(keys) == 0 {
+		return resp.MakeError("ERR The command has no key arguments")
+	}
+
+	reply := make([]resp.Value, len(keys))
+	for i, key := range keys {
+		reply[i] = resp.MakeBulkString(key)
+	}
+	return resp.MakeArray(reply)
+}
+
 // getCommandsDocs returns documentation for specified commands or all commands
 // Format: [Name, [Summary, val, Since, val...], Name, [...]]
-func getCommandsDocs(args []resp.Value) resp.Value {
+func getCommandsDocs(args []resp.Value, protocol int) resp.Value {
 	var targets []string
 
 	if len(args) == 0 {
@@ -177,7 +739,7 @@ func getCommandsDocs(args []resp.Value) resp.Value {
 		}
 	}
 
-	result := make([]resp.Value, 0, len(targets)*2)
+	docs := make([]mapEntry, 0, len(targets))
 
 	for _, name := range targets {
 		doc, ok := commandDocsRegistry[name]
@@ -185,21 +747,15 @@ func getCommandsDocs(args []resp.Value) resp.Value {
 			continue
 		}
 
-		result = append(result, resp.MakeBulkString(name))
-
-		props := []resp.Value{
-			resp.MakeBulkString("summary"),
-			resp.MakeBulkString(doc.summary),
-			resp.MakeBulkString("since"),
-			resp.MakeBulkString(doc.since),
-			resp.MakeBulkString("group"),
-			resp.MakeBulkString(doc.group),
-			resp.MakeBulkString("complexity"),
-			resp.MakeBulkString(doc.complexity),
-		}
+		props := makeProtocolMap(protocol, []mapEntry{
+			{"summary", resp.MakeBulkString(doc.summary)},
+			{"since", resp.MakeBulkString(doc.since)},
+			{"group", resp.MakeBulkString(doc.group)},
+			{"complexity", resp.MakeBulkString(doc.complexity)},
+		})
 
-		result = append(result, resp.MakeArray(props))
+		docs = append(docs, mapEntry{name, props})
 	}
 
-	return resp.MakeArray(result)
+	return makeProtocolMap(protocol, docs)
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// dump DUMP key returns the value of the key serialized for RESTORE, or a Nil Bulk String if the key does not exist
+func dump(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("DUMP")
+	}
+
+	var payload []byte
+	if !(*ctx.storage).View(string(ctx.args[0].String), func(entity storage.Entity) {
+		payload = storage.Dump(entity)
+	}) {
+		return resp.MakeNilBulkString()
+	}
+
+	return resp.MakeBulkString(string(payload))
+}
+
+// restore RESTORE key ttl serialized [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency] creates the key
+// from a DUMP payload. ttl is in milliseconds, 0 means no expiration, ABSTTL makes it a Unix timestamp.
+// There is no LFU counter, so FREQ is validated and ignored
+func restore(ctx *context) resp.Value {
+	if len(ctx.args) < 3 {
+		return resp.MakeErrorWrongNumberOfArguments("RESTORE")
+	}
+
+	ttl, err := strconv.ParseInt(string(ctx.args[1].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return resp.MakeError("ERR Invalid TTL value, must be >= 0")
+	}
+
+	var replace, absTTL bool
+	idle, freq := int64(-1), int64(-1)
+
+	for i := 3; i < len(ctx.args); i++ {
+		opt := strings.ToUpper(string(ctx.args[i].String))
+		switch {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "ABSTTL":
+			absTTL = true
+		case opt == "IDLETIME" && i+1 < len(ctx.args) && freq == -1:
+			i++
+			idle, err = strconv.ParseInt(string(ctx.args[i].String), 10, 64)
+			if err != nil {
+				return resp.MakeError("ERR value is not an integer or out of range")
+			}
+			if idle < 0 {
+				return resp.MakeError("ERR Invalid IDLETIME value, must be >= 0")
+			}
+		case opt == "FREQ" && i+1 < len(ctx.args) && idle == -1:
+			i++
+			freq, err = strconv.ParseInt(string(ctx.args[i].String), 10, 64)
+			if err != nil {
+				return resp.MakeError("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return resp.MakeError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return resp.MakeError("ERR syntax error")
+		}
+	}
+
+	entity, err := storage.ParseDump(ctx.args[2].String, (*ctx.storage).MaxStringLen())
+	if err != nil {
+		return resp.MakeError(err.Error())
+	}
+
+	var expireAt int64
+	if ttl != 0 {
+		var ok bool
+		if expireAt, ok = expireDeadline(ttl, time.Millisecond, absTTL, time.Now()); !ok {
+			return resp.MakeError("ERR invalid expire time in 'restore' command")
+		}
+	}
+
+	var idleTime time.Duration
+	if idle > 0 {
+		idleTime = time.Duration(idle) * time.Second
+	}
+
+	if !(*ctx.storage).RestoreKey(string(ctx.args[0].String), entity, expireAt, idleTime, replace) {
+		return resp.MakeError("BUSYKEY Target key name already exists.")
+	}
+	return resp.MakeSimpleString("OK")
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+func TestDumpRestore(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "hello\r\nworld"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "a", "1", "b", "2"))
+	e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "l", "x", "y"))
+
+	for _, key := range []string{"s", "h", "l"} {
+		payload := e.Execute(mockPeer, "DUMP", makeCommand("DUMP", key))
+		if payload.Type != resp.TypeBulkString || payload.IsNull {
+			t.Fatalf("DUMP %s: unexpected reply %v", key, payload)
+		}
+
+		res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", key, "0", string(payload.String)))
+		if res.Type != resp.TypeError || string(res.String) != "BUSYKEY Target key name already exists." {
+			t.Errorf("RESTORE over %s: expected BUSYKEY, got %v", key, res)
+		}
+
+		res = e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", key+":copy", "0", string(payload.String)))
+		if string(res.String) != "OK" {
+			t.Fatalf("RESTORE %s: unexpected reply %v", key, res)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "s:copy")); string(res.String) != "hello\r\nworld" {
+		t.Errorf("restored string = %q", res.String)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h:copy", "b")); string(res.String) != "2" {
+		t.Errorf("restored hash field = %q", res.String)
+	}
+	if res := e.Execute(mockPeer, "LRANGE", makeCommand("LRANGE", "l:copy", "0", "-1")); len(res.Array) != 2 || string(res.Array[1].String) != "y" {
+		t.Errorf("restored list = %v", res.Array)
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "s:copy")); res.Integer != -1 {
+		t.Errorf("ttl 0 must restore without expiration, got TTL %d", res.Integer)
+	}
+
+	payload := e.Execute(mockPeer, "DUMP", makeCommand("DUMP", "h"))
+	if res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "s", "0", string(payload.String), "REPLACE")); string(res.String) != "OK" {
+		t.Errorf("RESTORE REPLACE: unexpected reply %v", res)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "s", "a")); string(res.String) != "1" {
+		t.Errorf("REPLACE did not overwrite the string with the hash, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "DUMP", makeCommand("DUMP", "missing")); !res.IsNull {
+		t.Errorf("DUMP of a missing key: expected nil, got %v", res)
+	}
+
+	corrupted := []byte(string(payload.String))
+	corrupted[1] ^= 0xff
+	res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "bad", "0", string(corrupted)))
+	if res.Type != resp.TypeError || string(res.String) != "ERR DUMP payload version or checksum are wrong" {
+		t.Errorf("corrupted payload: unexpected reply %v", res)
+	}
+}
+
+// craftDump wraps a value encoding in a DUMP payload with a valid version and checksum
+func craftDump(valueType storage.DataType, value []byte) string {
+	payload := append([]byte{byte(valueType)}, value...)
+	payload = binary.LittleEndian.AppendUint16(payload, 1)
+	return string(binary.LittleEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload)))
+}
+
+func TestRestoreBadLengths(t *testing.T) {
+	e := setupEngine()
+	(*e.storage).(*storage.ShardedMapStorage).SetMaxStringLen(8)
+
+	huge := binary.LittleEndian.AppendUint32(nil, 0xffffffff)
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"hash count past the payload", craftDump(storage.TypeHash, huge)},
+		{"list count past the payload", craftDump(storage.TypeList, huge)},
+		{"string length past the payload", craftDump(storage.TypeString, huge)},
+		{"truncated string", craftDump(storage.TypeString, append(binary.LittleEndian.AppendUint32(nil, 5), "ab"...))},
+		{"string over the limit", craftDump(storage.TypeString, append(binary.LittleEndian.AppendUint32(nil, 9), "123456789"...))},
+		{"stream count past the payload", craftDump(storage.TypeStream, append(make([]byte, 16), huge...))},
+	}
+
+	for _, tt := range tests {
+		res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "k", "0", tt.payload))
+		if res.Type != resp.TypeError || string(res.String) != "ERR DUMP payload version or checksum are wrong" {
+			t.Errorf("%s: unexpected reply %v", tt.name, res)
+		}
+	}
+
+	valid := craftDump(storage.TypeString, append(binary.LittleEndian.AppendUint32(nil, 8), "12345678"...))
+	if res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "k", "0", valid)); string(res.String) != "OK" {
+		t.Errorf("string at the limit: unexpected reply %v", res)
+	}
+}
+
+func TestRestoreAbsTTL(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	payload := string(e.Execute(mockPeer, "DUMP", makeCommand("DUMP", "k")).String)
+
+	deadline := strconv.FormatInt(time.Now().Add(100*time.Second).UnixMilli(), 10)
+	e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "abs", deadline, payload, "ABSTTL"))
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "abs")); res.Integer != 100 {
+		t.Errorf("ABSTTL: expected TTL 100, got %d", res.Integer)
+	}
+
+	e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "rel", "100000", payload))
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "rel")); res.Integer != 100 {
+		t.Errorf("relative ttl: expected TTL 100, got %d", res.Integer)
+	}
+
+	// a deadline in the past does not create the key
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	if res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "gone", past, payload, "ABSTTL")); string(res.String) != "OK" {
+		t.Errorf("past ABSTTL: unexpected reply %v", res)
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "gone")); res.Integer != -2 {
+		t.Errorf("past ABSTTL created the key, TTL %d", res.Integer)
+	}
+}
+
+func TestRestoreIdleTime(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	payload := string(e.Execute(mockPeer, "DUMP", makeCommand("DUMP", "k")).String)
+
+	e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "idle", "0", payload, "IDLETIME", "1000"))
+	if res := e.Execute(mockPeer, "OBJECT", makeCommand("OBJECT", "IDLETIME", "idle")); res.Integer != 1000 {
+		t.Errorf("expected idle time 1000, got %v", res)
+	}
+
+	for _, args := range [][]string{
+		{"RESTORE", "x", "0", payload, "IDLETIME", "-1"},
+		{"RESTORE", "x", "0", payload, "FREQ", "256"},
+		{"RESTORE", "x", "0", payload, "IDLETIME", "1", "FREQ", "1"},
+		{"RESTORE", "x", "-1", payload},
+	} {
+		if res := e.Execute(mockPeer, "RESTORE", makeCommand(args[0], args[1:]...)); res.Type != resp.TypeError {
+			t.Errorf("%v: expected an error, got %v", args, res)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "freq", "0", payload, "FREQ", "5")); string(res.String) != "OK" {
+		t.Errorf("FREQ: unexpected reply %v", res)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// newLocalPeer returns the peer of in-process callers. It has no connection and never needs AUTH
+func newLocalPeer() *Peer {
+	peer := NewPeer(nil)
+	peer.authenticated = true
+	return peer
+}
+
+// Do executes the command for an in-process caller, bypassing RESP serialization.
+// The caller shares the engine with TCP clients, so writes are propagated to the AOF and WATCH as usual.
+// Every call runs on its own peer, so concurrent callers share no connection state and the state set by
+// MULTI, WATCH, SUBSCRIBE, CLIENT or HELLO does not outlive the call
+func (e *Engine) Do(name string, args ...string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.MakeBulkString(arg)
+	}
+
+	return e.Execute(newLocalPeer(), strings.ToUpper(name), values)
+}
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eternalApril/moonlight/internal/config"
+	"github.com/eternalApril/moonlight/internal/logger"
 	"github.com/eternalApril/moonlight/internal/persistence"
 	"github.com/eternalApril/moonlight/internal/resp"
 	"github.com/eternalApril/moonlight/internal/storage"
@@ -15,35 +19,78 @@ import (
 
 // Engine coordinates the execution of commands and manages the background tasks of the repository
 type Engine struct {
-	commands map[string]command // Registry of available commands (the key is the command name in uppercase)
-	storage  *storage.Storage   // Interface to the underlying KV storage
-	cfg      *config.Config     // Configuration engine
-	stopGC   chan struct{}      // Channel for the background GC stop signal
-	stopOnce sync.Once          // Ensures that the stop happens only once
-	aof      *persistence.AOF   // AOF instance
-	rdb      *persistence.RDB   // RDB instance
-	logger   *zap.Logger
-	password string
+	commands  map[string]command // Registry of available commands (the key is the command name in uppercase)
+	storage   *storage.Storage   // Interface to the underlying KV storage
+	cfg       *config.Config     // Configuration engine
+	stopGC    chan struct{}      // Channel for the background GC stop signal
+	stopOnce  sync.Once          // Ensures that the stop happens only once
+	stopReap  chan struct{}      // Channel for the idle connection reaper stop signal
+	shutdown  chan struct{}      // Closed by Shutdown, wakes the clients blocked by XREAD BLOCK
+	clients   *clientRegistry    // Peers served by HandleConnection, scanned by the idle connection reaper
+	autoSave  autoSaveLoop       // RDB auto-save loop, restarted when persistence.rdb.interval is reloaded
+	aof       *persistence.AOF   // AOF instance
+	rdb       *persistence.RDB   // RDB instance
+	pubsub    *broker            // Pub/Sub channels and their subscribers
+	startedAt time.Time          // Moment the engine was created, used for uptime
+	runID     string             // Random identifier of this process, reported by HELLO and INFO
+	readOnly  atomic.Bool        // Write commands are rejected, set by server.read_only and CONFIG SET read-only
+	stats     engineStats        // Counters reported by INFO
+	cmdStats  commandStats       // Per-command call counters reported by INFO commandstats and COMMAND STATS
+	watches   *watchRegistry     // Versions of the keys watched by WATCH
+	waiters   *keyWaiters        // Clients blocked until a key is written, see XREAD BLOCK
+	txMu      sync.RWMutex       // Held exclusively by EXEC, so a transaction is not interleaved with other commands
+	logger    *zap.Logger
+	accessLog *zap.Logger // Logger of executed commands, nil when log.access_log is disabled
+	password  string
+	protected bool // Refuse non-loopback clients, see server.protected_mode
 }
 
 // NewEngine initializes the engine, registers the basic commands, and
 // if enabled in the config, starts background cleanup of outdated keys
-func NewEngine(s storage.Storage, cfg *config.Config, logger *zap.Logger) (*Engine, error) {
+func NewEngine(s storage.Storage, cfg *config.Config, log *zap.Logger) (*Engine, error) {
 	engine := Engine{
-		commands: make(map[string]command),
-		storage:  &s,
-		cfg:      cfg,
-		stopGC:   make(chan struct{}),
-		logger:   logger,
-		password: cfg.Server.RequirePass,
+		commands:  make(map[string]command),
+		storage:   &s,
+		cfg:       cfg,
+		stopGC:    make(chan struct{}),
+		stopReap:  make(chan struct{}),
+		shutdown:  make(chan struct{}),
+		clients:   newClientRegistry(),
+		logger:    log,
+		password:  cfg.Server.RequirePass,
+		protected: protectedMode(cfg),
+		pubsub:    newBroker(),
+		startedAt: time.Now(),
+		runID:     newRunID(),
+		watches:   newWatchRegistry(),
+		waiters:   newKeyWaiters(),
+		cmdStats:  make(commandStats),
 	}
 	engine.registerBasicCommand()
+	engine.readOnly.Store(cfg.Server.ReadOnly)
+
+	if cfg.Log.AccessLog {
+		accessLog, err := logger.NewAccess(cfg.Log.AccessLogPath, cfg.Log.Format)
+		if err != nil {
+			return nil, err
+		}
+		engine.accessLog = accessLog
+	}
+
+	dir := cfg.Persistence.Dir
+	if dir != "" && (cfg.Persistence.AOF.Enabled || cfg.Persistence.RDB.Enabled) {
+		if err := persistence.PrepareDir(dir); err != nil {
+			return nil, err
+		}
+	}
 
 	if cfg.Persistence.AOF.Enabled {
 		aof, err := persistence.NewAOF(
-			cfg.Persistence.AOF.Filename,
+			persistence.Path(dir, cfg.Persistence.AOF.Filename),
 			cfg.Persistence.AOF.Fsync,
-			logger,
+			cfg.Persistence.AOF.SlowFsync,
+			cfg.Persistence.AOF.OnWriteError,
+			log,
 		)
 		if err != nil {
 			return nil, err
@@ -55,27 +102,60 @@ func NewEngine(s storage.Storage, cfg *config.Config, logger *zap.Logger) (*Engi
 	}
 
 	if cfg.Persistence.RDB.Enabled {
-		engine.rdb = persistence.NewRDB(cfg.Persistence.RDB.Filename, logger)
+		engine.rdb = persistence.NewRDB(persistence.Path(dir, cfg.Persistence.RDB.Filename), log)
 
 		if !cfg.Persistence.AOF.Enabled {
 			if err := engine.rdb.Load(s); err != nil {
-				logger.Error("Failed to load RDB", zap.Error(err))
+				log.Error("Failed to load RDB", zap.Error(err))
 			}
 		}
 
-		if cfg.Persistence.RDB.Interval != "" {
-			go engine.startAutoSave(cfg.Persistence.RDB.Interval)
-		}
+		engine.scheduleAutoSave(cfg.Persistence.RDB.Interval)
 	}
 
 	if cfg.GC.Enabled {
 		go engine.startGCLoop()
 	}
 
+	if cfg.Server.ReapIdleAfter > 0 {
+		go engine.startReaperLoop()
+	}
+
 	return &engine, nil
 }
 
-func (e *Engine) startAutoSave(intervalStr string) {
+// autoSaveLoop is the state of the running RDB auto-save loop
+type autoSaveLoop struct {
+	mu       sync.Mutex
+	interval string        // interval of the running loop, empty when it is not running
+	stop     chan struct{} // closed to stop the running loop
+}
+
+// scheduleAutoSave (re)starts the RDB auto-save loop with the interval, an empty interval stops it.
+// Returns false if the loop already runs with this interval
+func (e *Engine) scheduleAutoSave(interval string) bool {
+	e.autoSave.mu.Lock()
+	defer e.autoSave.mu.Unlock()
+
+	if interval == e.autoSave.interval {
+		return false
+	}
+
+	if e.autoSave.stop != nil {
+		close(e.autoSave.stop)
+		e.autoSave.stop = nil
+	}
+
+	e.autoSave.interval = interval
+	if interval != "" {
+		e.autoSave.stop = make(chan struct{})
+		go e.startAutoSave(interval, e.autoSave.stop)
+	}
+
+	return true
+}
+
+func (e *Engine) startAutoSave(intervalStr string, stop chan struct{}) {
 	interval, err := time.ParseDuration(intervalStr)
 	if err != nil {
 		e.logger.Error("Invalid RDB interval", zap.Error(err))
@@ -92,60 +172,178 @@ func (e *Engine) startAutoSave(intervalStr string) {
 					e.logger.Error("Auto-save RDB failed", zap.Error(err))
 				}
 			}()
+		case <-stop:
+			return
 		case <-e.stopGC:
 			return
 		}
 	}
 }
 
+// restoreAOF replays the AOF. The commands of a MULTI ... EXEC block are applied only once its EXEC is read,
+// so a transaction cut by a crash is skipped as a whole. A truncated last command is dropped with a warning.
+// Either tail is cut from the file before new commands are appended to it
 func (e *Engine) restoreAOF() {
-	cmds, err := e.aof.Load()
-	if err != nil {
+	cmds, offsets, err := e.aof.Load()
+	truncated := errors.Is(err, persistence.ErrTruncated)
+	if truncated {
+		e.logger.Warn("AOF is truncated, the incomplete last command is ignored", zap.Int("commands", len(cmds)))
+	} else if err != nil {
 		e.logger.Error("Failed to load AOF", zap.Error(err))
 		return
 	}
 
 	e.logger.Info("Restoring AOF...", zap.Int("commands", len(cmds)))
 
-	for _, cmdVal := range cmds {
+	var tx []resp.Value // commands of the open transaction
+	inTx := false
+	var end int64 // the end of the last command applied, or of the EXEC of the last transaction
+	for i, cmdVal := range cmds {
 		if cmdVal.Type != resp.TypeArray || len(cmdVal.Array) == 0 {
 			continue
 		}
 
-		name := string(cmdVal.Array[0].String)
-		args := cmdVal.Array[1:]
+		switch strings.ToUpper(string(cmdVal.Array[0].String)) {
+		case "MULTI":
+			tx, inTx = tx[:0], true
+		case "EXEC":
+			for _, queued := range tx {
+				e.replay(queued)
+			}
+			tx, inTx = tx[:0], false
+			end = offsets[i]
+		default:
+			if inTx {
+				tx = append(tx, cmdVal)
+			} else {
+				e.replay(cmdVal)
+				end = offsets[i]
+			}
+		}
+	}
 
-		cmd, ok := e.commands[strings.ToUpper(name)]
-		if ok {
-			ctx := &context{args: args, storage: e.storage}
-			cmd.execute(ctx)
+	if inTx {
+		e.logger.Warn("AOF ends with an incomplete transaction, it is ignored", zap.Int("commands", len(tx)))
+	}
+	// new commands are appended right after what was applied, otherwise the ignored tail would break the next load
+	if truncated || inTx {
+		if err := e.aof.Truncate(end); err != nil {
+			e.logger.Error("Failed to truncate the AOF", zap.Error(err))
 		}
 	}
 	e.logger.Info("AOF restore finished")
 }
 
+// replay executes a command read from the AOF without propagating it
+func (e *Engine) replay(cmdVal resp.Value) {
+	name := string(cmdVal.Array[0].String)
+	args := cmdVal.Array[1:]
+
+	cmd, ok := e.commands[strings.ToUpper(name)]
+	if ok {
+		ctx := &context{args: args, storage: e.storage}
+		cmd.execute(ctx)
+	}
+}
+
+const (
+	// gcBusyWindow is the wall time over which the share of time spent in GC is measured
+	gcBusyWindow = time.Second
+	// gcTimeBudgetPercent is the share of gc.interval a burst of repeated cycles may take, as in Redis active expire
+	gcTimeBudgetPercent = 25
+	// gcExpireDueBatch is the number of keys a cycle with storage.expire_index deletes per shard
+	gcExpireDueBatch = 1024
+)
+
 // startGCLoop triggers the active expiration mechanism
 func (e *Engine) startGCLoop() {
 	ticker := time.NewTicker(e.cfg.GC.Interval)
 	defer ticker.Stop()
 
+	windowStart := time.Now()
+	var busy time.Duration
+
 	for {
 		select {
 		case <-ticker.C:
-			stats := (*e.storage).DeleteExpired(e.cfg.GC.SamplesPerCheck)
+		case <-e.stopGC:
+			e.logger.Info("GC stopped")
+			return
+		}
+
+		busy += e.runGCCycles()
+
+		if elapsed := time.Since(windowStart); elapsed >= gcBusyWindow {
+			ratio := float64(busy) / float64(elapsed)
+			if e.cfg.GC.BusyWarningRatio > 0 && ratio > e.cfg.GC.BusyWarningRatio {
+				e.logger.Warn("GC is taking too much time expiring keys",
+					zap.Float64("busy_ratio", ratio), zap.Duration("window", elapsed))
+			}
+			windowStart, busy = time.Now(), 0
+		}
+	}
+}
 
-			if stats > 0 {
-				e.logger.Debug("GC delete expired", zap.Float64("expired_ratio", stats))
+// runGCCycles runs a GC cycle and repeats it immediately while the expired ratio reaches gc.match_threshold,
+// at most gc.max_repeats times and within gcTimeBudgetPercent of gc.interval. With storage.expire_index
+// the cycles delete the keys that are due instead, gcExpireDueBatch per shard, and are repeated while due keys
+// are left within the same budget. Returns the time spent expiring keys
+func (e *Engine) runGCCycles() time.Duration {
+	start := time.Now()
+	budget := e.cfg.GC.Interval * gcTimeBudgetPercent / 100
+
+	if e.cfg.Storage.ExpireIndex {
+		for {
+			expired, more := (*e.storage).ExpireDue(start, gcExpireDueBatch)
+			// no key is sampled, so there is no stale ratio to report
+			e.stats.recordGCCycle(0, expired)
+
+			if !more {
+				return time.Since(start)
+			}
+			if time.Since(start) >= budget {
+				e.logger.Debug("GC time budget exhausted")
+				return time.Since(start)
 			}
 
-			if stats < e.cfg.GC.MatchThreshold {
-				break
+			select {
+			case <-e.stopGC:
+				return time.Since(start)
+			default:
 			}
+		}
+	}
+
+	for repeat := 0; ; repeat++ {
+		stats, expired := (*e.storage).DeleteExpired(e.cfg.GC.SamplesPerCheck)
+		e.stats.recordGCCycle(stats, expired)
+
+		if stats > 0 {
+			e.logger.Debug("GC delete expired", zap.Float64("expired_ratio", stats))
+		}
+
+		if stats < e.cfg.GC.MatchThreshold {
+			break
+		}
+
+		if repeat >= e.cfg.GC.MaxRepeats {
+			e.logger.Debug("GC repeat limit reached", zap.Int("repeats", repeat))
+			break
+		}
+
+		if time.Since(start) >= budget {
+			e.logger.Debug("GC time budget exhausted", zap.Int("repeats", repeat))
+			break
+		}
+
+		select {
 		case <-e.stopGC:
-			e.logger.Info("GC stopped")
-			return
+			return time.Since(start)
+		default:
 		}
 	}
+
+	return time.Since(start)
 }
 
 // close signals background processes to shut down
@@ -153,32 +351,107 @@ func (e *Engine) close() {
 	if e.cfg.GC.Enabled {
 		close(e.stopGC)
 	}
+	if e.cfg.Server.ReapIdleAfter > 0 {
+		close(e.stopReap)
+	}
+	e.scheduleAutoSave("")
+	close(e.shutdown)
 }
 
 // register adds a new command to the engine. The command name is uppercase
 func (e *Engine) register(name string, cmd command) {
 	e.commands[strings.ToUpper(name)] = cmd
+	e.cmdStats[strings.ToUpper(name)] = &commandStat{}
 }
 
 // registerBasicCommand fills the registry with standard commands
 func (e *Engine) registerBasicCommand() {
 	e.register("GET", commandFunc(get))
+	e.register("GETDEL", commandFunc(getdel))
+	e.register("GETEX", commandFunc(getex))
+	e.register("INCRBYFLOAT", commandFunc(incrbyfloat))
 	e.register("SET", commandFunc(set))
 	e.register("DEL", commandFunc(del))
+	e.register("EXISTS", commandFunc(exists))
 	e.register("PING", commandFunc(ping))
-	e.register("COMMAND", commandFunc(cmd))
+	e.register("COMMAND", commandFunc(e.cmd))
 	e.register("TTL", commandFunc(ttl))
 	e.register("PTTL", commandFunc(pttl))
 	e.register("PERSIST", commandFunc(persist))
+	e.register("EXPIRE", commandFunc(expire))
+	e.register("PEXPIRE", commandFunc(pexpire))
+	e.register("EXPIREAT", commandFunc(expireat))
+	e.register("PEXPIREAT", commandFunc(pexpireat))
+	e.register("COPY", commandFunc(copyCmd))
+	e.register("RENAME", commandFunc(rename))
+	e.register("RENAMENX", commandFunc(renamenx))
+	e.register("DUMP", commandFunc(dump))
+	e.register("RESTORE", commandFunc(restore))
+	e.register("DBSIZE", commandFunc(dbsize))
+	e.register("APPEND", commandFunc(appendCmd))
+	e.register("SETRANGE", commandFunc(setrange))
+	e.register("GETRANGE", commandFunc(getrange))
+	e.register("BITFIELD", commandFunc(bitfield))
+	e.register("STRLEN", commandFunc(strlen))
+	e.register("SCAN", commandFunc(e.scan))
+	e.register("KEYS", commandFunc(e.keys))
+	e.register("DELPATTERN", commandFunc(e.delpattern))
+	e.register("RANDOMKEY", commandFunc(randomkey))
 	e.register("HSET", commandFunc(hset))
+	e.register("HSETNX", commandFunc(hsetnx))
+	e.register("HSETEX", commandFunc(hsetex))
 	e.register("HGET", commandFunc(hget))
-	e.register("HGETALL", commandFunc(hgetall))
+	e.register("HGETALL", streamFunc{hgetall, hgetallStream})
 	e.register("HDEL", commandFunc(hdel))
 	e.register("HEXISTS", commandFunc(hexists))
 	e.register("HLEN", commandFunc(hlen))
 	e.register("HKEYS", commandFunc(hkeys))
 	e.register("HVALS", commandFunc(hvals))
+	e.register("HRANDFIELD", commandFunc(hrandfield))
 	e.register("HEXPIRE", commandFunc(hexpire))
+	e.register("HPEXPIREAT", commandFunc(hpexpireat))
+	e.register("HPTTL", commandFunc(hpttl))
+	e.register("LPUSH", commandFunc(lpush))
+	e.register("RPUSH", commandFunc(rpush))
+	e.register("LLEN", commandFunc(llen))
+	e.register("LRANGE", commandFunc(lrange))
+	e.register("LTRIM", commandFunc(ltrim))
+	e.register("PFADD", commandFunc(pfadd))
+	e.register("PFCOUNT", commandFunc(pfcount))
+	e.register("PFMERGE", commandFunc(pfmerge))
+	e.register("XADD", commandFunc(xadd))
+	e.register("XLEN", commandFunc(xlen))
+	e.register("XRANGE", commandFunc(xrange))
+	e.register("XREAD", commandFunc(e.xread))
+	e.register("XGROUP", commandFunc(xgroup))
+	e.register("XREADGROUP", commandFunc(e.xreadgroup))
+	e.register("XACK", commandFunc(xack))
+	e.register("XPENDING", commandFunc(xpending))
+	e.register("XCLAIM", commandFunc(xclaim))
+	e.register("SUBSCRIBE", commandFunc(e.pubsub.subscribe))
+	e.register("UNSUBSCRIBE", commandFunc(e.pubsub.unsubscribe))
+	e.register("PSUBSCRIBE", commandFunc(e.pubsub.psubscribe))
+	e.register("PUNSUBSCRIBE", commandFunc(e.pubsub.punsubscribe))
+	e.register("PUBLISH", commandFunc(e.pubsub.publishCmd))
+	e.register("SSUBSCRIBE", commandFunc(e.pubsub.ssubscribe))
+	e.register("SUNSUBSCRIBE", commandFunc(e.pubsub.sunsubscribe))
+	e.register("SPUBLISH", commandFunc(e.pubsub.spublishCmd))
+	e.register("PUBSUB", commandFunc(e.pubsub.pubsubCmd))
+	e.register("INFO", commandFunc(e.info))
+	e.register("OBJECT", commandFunc(e.object))
+	e.register("TYPE", commandFunc(keyType))
+	e.register("DEBUG", commandFunc(e.debug))
+	e.register("CLIENT", commandFunc(e.client))
+	e.register("HELLO", commandFunc(e.hello))
+	e.register("LOLWUT", commandFunc(lolwut))
+	e.register("MEMORY", commandFunc(memory))
+	e.register("CLUSTER", commandFunc(cluster))
+	e.register("CONFIG", commandFunc(e.configCmd))
+	e.register("MULTI", commandFunc(e.multi))
+	e.register("EXEC", commandFunc(e.exec))
+	e.register("DISCARD", commandFunc(e.discard))
+	e.register("WATCH", commandFunc(e.watch))
+	e.register("UNWATCH", commandFunc(e.unwatch))
 
 	e.register("SAVE", commandFunc(func(ctx *context) resp.Value {
 		if e.rdb == nil {
@@ -230,6 +503,33 @@ func (e *Engine) registerBasicCommand() {
 // Execute finds the command by name and executes it with the passed arguments.
 // If the command is not found, returns an error in the RESP format
 func (e *Engine) Execute(peer *Peer, name string, args []resp.Value) resp.Value {
+	if e.accessLog == nil {
+		return e.execute(peer, name, args)
+	}
+
+	start := time.Now()
+	res := e.execute(peer, name, args)
+
+	fields := []zap.Field{
+		zap.String("addr", peer.Addr()),
+		zap.String("cmd", name),
+		zap.Int("args_count", len(args)),
+		zap.String("result", string(res.Type)),
+		zap.Duration("latency", time.Since(start)),
+	}
+
+	// argument values are logged only on demand and never with secrets
+	if e.cfg.Log.AccessLogArgs {
+		fields = append(fields, zap.Strings("args", redactArgs(name, args)))
+	}
+
+	e.accessLog.Info("command", fields...)
+
+	return res
+}
+
+// execute checks the client state and runs the command
+func (e *Engine) execute(peer *Peer, name string, args []resp.Value) resp.Value {
 	if e.logger.Core().Enabled(zap.DebugLevel) {
 		// Log the command name and number of args
 		e.logger.Debug("executing command",
@@ -238,28 +538,141 @@ func (e *Engine) Execute(peer *Peer, name string, args []resp.Value) resp.Value
 		)
 	}
 
-	if e.password != "" && !peer.authenticated && name != "AUTH" {
+	if e.password != "" && !peer.authenticated && name != "AUTH" && name != "HELLO" {
 		return resp.MakeError("NOAUTH Authentication required")
 	}
 
+	if peer.inSubscribeMode() {
+		if _, ok := subscribeAllowed[name]; !ok {
+			return resp.MakeError(fmt.Sprintf(
+				"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+				strings.ToLower(name),
+			))
+		}
+	}
+
 	cmd, ok := e.commands[name]
 	if !ok {
-		return resp.MakeError(fmt.Sprintf("wrong command: %s", name))
+		if peer.multi {
+			peer.multiErr = true
+		}
+		return unknownCommandError(name, args)
+	}
+
+	if e.readOnly.Load() && isWriteCommand(name) {
+		if peer.multi {
+			peer.multiErr = true
+		}
+		return resp.MakeError("READONLY You can't write against a read only replica.")
+	}
+
+	if peer.multi {
+		switch name {
+		case "MULTI", "EXEC", "DISCARD", "WATCH":
+		default:
+			peer.queued = append(peer.queued, queuedCommand{name: name, args: args})
+			return resp.MakeSimpleString("QUEUED")
+		}
+	}
+
+	// EXEC takes the lock exclusively by itself. DEBUG SLEEP does not take it, so it cannot hold up
+	// a pending EXEC and with it every other client. XREAD and XREADGROUP take it around every read
+	// attempt instead, a blocked read waits without it
+	if name != "EXEC" && !isDebugSleep(name, args) && name != "XREAD" && name != "XREADGROUP" {
+		e.txMu.RLock()
+		defer e.txMu.RUnlock()
+	}
+
+	return e.call(peer, cmd, name, args, peer.streaming)
+}
+
+// unknownCommandPreview limits the length of the command name and of the arguments quoted in unknownCommandError
+const unknownCommandPreview = 128
+
+// unknownCommandError builds the Redis reply for an unknown command, quoting its name and the beginning of
+// its arguments: "ERR unknown command 'foo', with args beginning with: 'a' 'b' "
+func unknownCommandError(name string, args []resp.Value) resp.Value {
+	var preview strings.Builder
+	for _, arg := range args {
+		if preview.Len() >= unknownCommandPreview {
+			break
+		}
+
+		value := string(arg.String)
+		if room := unknownCommandPreview - preview.Len(); len(value) > room {
+			value = value[:room]
+		}
+		preview.WriteString("'" + value + "' ")
 	}
 
+	if len(name) > unknownCommandPreview {
+		name = name[:unknownCommandPreview]
+	}
+
+	// the reply is a simple error, so it must stay on one line
+	msg := fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", name, preview.String())
+	return resp.MakeError(strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+// call executes the command and propagates its effects: AOF and WATCH versions.
+// If stream is true, a streamCommand writes its reply to the peer itself and streamedReply is returned
+func (e *Engine) call(peer *Peer, cmd command, name string, args []resp.Value, stream bool) resp.Value {
 	ctx := &context{
 		args:    args,
 		storage: e.storage,
 		peer:    peer,
+		stats:   &e.stats,
 	}
 
-	res := cmd.execute(ctx)
+	isWrite := isWriteCommand(name)
+	if isWrite && e.aof != nil {
+		if err := e.aof.WriteError(); err != nil {
+			return resp.MakeError("MISCONF Errors writing to the AOF file: " + err.Error())
+		}
+	}
 
-	if e.aof != nil && res.Type != resp.TypeError && isWriteCommand(name) {
-		payload, err := resp.SerializeCommand(name, args)
-		if err != nil {
-			e.logger.Error("Failed to serialize command for AOF", zap.Error(err))
-		} else {
+	now := time.Now()
+	var res resp.Value
+	if sc, ok := cmd.(streamCommand); ok && stream {
+		// a failed write surfaces on the next send or flush of the connection loop
+		peer.Stream(func(enc *resp.Encoder) error { return sc.stream(ctx, enc) }) //nolint:errcheck
+		res = streamedReply
+	} else {
+		res = cmd.execute(ctx)
+	}
+	e.cmdStats.record(name, time.Since(now))
+
+	if res.Type == resp.TypeError {
+		return res
+	}
+
+	if keys := commandKeys(name, args); len(keys) > 0 {
+		if isWrite && !ctx.unchanged() {
+			e.watches.touch(keys)
+			e.waiters.signal(keys)
+		}
+
+		if !peer.noTouch && !inspectCommands[name] {
+			(*e.storage).Touch(keys)
+		}
+	}
+
+	if e.aof != nil && isWrite {
+		var payload []byte
+		for _, cmd := range aofCommands(name, ctx, now) {
+			serialized, err := resp.SerializeCommand(cmd.name, cmd.args)
+			if err != nil {
+				e.logger.Error("Failed to serialize command for AOF", zap.Error(err))
+				payload = nil
+				break
+			}
+			payload = append(payload, serialized...)
+		}
+		// the commands of a single call are written at once, so a crash cannot persist only part of the effect.
+		// Inside EXEC they are collected and written with the rest of the transaction
+		if peer.inExec {
+			peer.execAOF = append(peer.execAOF, payload...)
+		} else if len(payload) > 0 {
 			e.aof.Write(payload)
 		}
 	}
@@ -267,6 +680,12 @@ func (e *Engine) Execute(peer *Peer, name string, args []resp.Value) resp.Value
 	return res
 }
 
+// Disconnect releases the resources held by the peer, must be called when the client goes away
+func (e *Engine) Disconnect(peer *Peer) {
+	e.pubsub.unsubscribeAll(peer)
+	e.unwatchAll(peer)
+}
+
 // Shutdown shuts down the engine and its background services correctly
 func (e *Engine) Shutdown() {
 	e.stopOnce.Do(func() {
@@ -279,11 +698,8 @@ func (e *Engine) Shutdown() {
 	})
 }
 
-// isWriteCommand helper what command change state database
+// isWriteCommand reports whether the command is registered with the "write" flag.
+// Such commands change the dataset, so they are propagated to the AOF and invalidate WATCH
 func isWriteCommand(name string) bool {
-	switch name {
-	case "SET", "DEL", "PERSIST":
-		return true
-	}
-	return false
+	return slices.Contains(commandRegistry[name].flags, "write")
 }
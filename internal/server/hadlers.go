@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -11,30 +12,60 @@ import (
 	"github.com/eternalApril/moonlight/internal/storage"
 )
 
-// cmd handles the COMMAND introspection command
-func cmd(ctx *context) resp.Value {
-	if len(ctx.args) > 0 {
-		subCmd := strings.ToUpper(string(ctx.args[0].String))
+// cmd handles the COMMAND introspection command. Without a subcommand it returns the details of every command.
+// COMMAND COUNT returns the number of commands, COMMAND LIST their names.
+// COMMAND INFO [name ...] and COMMAND DOCS [name ...] return the details and the documentation of the named commands, or of all of them.
+// COMMAND GETKEYS command [arg ...] returns the keys of a full command line.
+// COMMAND STATS returns the usage of every command called at least once
+func (e *Engine) cmd(ctx *context) resp.Value {
+	if len(ctx.args) == 0 {
+		return getAllCommands()
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "COUNT", "LIST", "STATS":
+		if len(ctx.args) != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("COMMAND|" + sub)
+		}
 
-		switch subCmd {
+		switch sub {
 		case "COUNT":
 			return resp.MakeInteger(int64(len(commandRegistry)))
-		case "DOCS":
-			return getCommandsDocs(ctx.args[1:])
+		case "LIST":
+			return getCommandNames()
+		}
+		return e.commandStatsReply(ctx.peer.protocol)
+	case "INFO":
+		return getCommandsInfo(ctx.args[1:])
+	case "DOCS":
+		return getCommandsDocs(ctx.args[1:], ctx.peer.protocol)
+	case "GETKEYS":
+		if len(ctx.args) < 2 {
+			return resp.MakeErrorWrongNumberOfArguments("COMMAND|GETKEYS")
 		}
-		return resp.MakeError("ERR wrong argument for COMMAND")
+		return getCommandKeys(ctx.args[1:])
 	}
 
-	return getAllCommands()
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", strings.ToLower(sub)))
 }
 
-// ping returns PONG if no arguments are provided, or a copy of the argument if one is given
+// ping returns PONG if no arguments are provided, or a copy of the argument if one is given.
+// A RESP2 client in subscribe mode gets the array ["pong", message] instead, so it can tell the reply from a message
 func ping(ctx *context) resp.Value {
 	// command takes zero or one arguments
 	if len(ctx.args) > 1 {
 		return resp.MakeErrorWrongNumberOfArguments("PING")
 	}
 
+	if ctx.peer.inSubscribeMode() && ctx.peer.protocol == 2 {
+		message := ""
+		if len(ctx.args) == 1 {
+			message = string(ctx.args[0].String)
+		}
+		return resp.MakeArray([]resp.Value{resp.MakeBulkString("pong"), resp.MakeBulkString(message)})
+	}
+
 	if len(ctx.args) == 1 {
 		return resp.MakeBulkString(string(ctx.args[0].String))
 	}
@@ -51,11 +82,12 @@ func get(ctx *context) resp.Value {
 	value, ok, err := (*ctx.storage).Get(string(ctx.args[0].String))
 	if err != nil {
 		if errors.Is(err, storage.ErrWrongType) {
-			return resp.MakeError("WRONGTYPE Get support only String type")
+			return resp.MakeErrorWrongType()
 		}
 		return resp.MakeError(err.Error())
 	}
 
+	ctx.lookup(ok)
 	if !ok {
 		return resp.MakeNilBulkString()
 	}
@@ -63,6 +95,97 @@ func get(ctx *context) resp.Value {
 	return resp.MakeBulkString(value)
 }
 
+// getdel GETDEL key returns the value of a key and deletes it. Propagated to the AOF as DEL
+func getdel(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("GETDEL")
+	}
+
+	key := string(ctx.args[0].String)
+	value, ok, err := (*ctx.storage).GetDel(key)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(ok)
+	if !ok {
+		ctx.noPropagate()
+		return resp.MakeNilBulkString()
+	}
+
+	ctx.propagate("DEL", ctx.args[0])
+	return resp.MakeBulkString(value)
+}
+
+// getex GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+// returns the value of a key and optionally changes its expiration. Propagated to the AOF as PEXPIREAT, PERSIST
+// or DEL, a call without options is a pure read and writes nothing
+func getex(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("GETEX")
+	}
+
+	key := string(ctx.args[0].String)
+
+	var expireAt int64
+	var persist, ok bool
+	switch len(ctx.args) {
+	case 1:
+	case 2:
+		if strings.ToUpper(string(ctx.args[1].String)) != "PERSIST" {
+			return resp.MakeError("ERR syntax error")
+		}
+		persist = true
+	case 3:
+		n, err := strconv.ParseInt(string(ctx.args[2].String), 10, 64)
+		if err != nil {
+			return resp.MakeError("ERR value is not an integer or out of range")
+		}
+		if n <= 0 {
+			return resp.MakeError("ERR invalid expire time in 'getex' command")
+		}
+
+		opt := strings.ToUpper(string(ctx.args[1].String))
+		switch opt {
+		case "EX", "PX", "EXAT", "PXAT":
+		default:
+			return resp.MakeError("ERR syntax error")
+		}
+
+		unit := time.Second
+		if opt == "PX" || opt == "PXAT" {
+			unit = time.Millisecond
+		}
+		if expireAt, ok = expireDeadline(n, unit, opt == "EXAT" || opt == "PXAT", time.Now()); !ok {
+			return resp.MakeError("ERR invalid expire time in 'getex' command")
+		}
+	default:
+		return resp.MakeError("ERR syntax error")
+	}
+
+	value, ok, err := (*ctx.storage).GetEx(key, expireAt, persist)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(ok)
+	switch {
+	case !ok || (expireAt == 0 && !persist):
+		ctx.noPropagate()
+	case persist:
+		ctx.propagate("PERSIST", ctx.args[0])
+	case time.Now().UnixNano() > expireAt:
+		ctx.propagate("DEL", ctx.args[0])
+	default:
+		ctx.propagate("PEXPIREAT", ctx.args[0], resp.MakeBulkString(strconv.FormatInt(expireAt/int64(time.Millisecond), 10)))
+	}
+
+	if !ok {
+		return resp.MakeNilBulkString()
+	}
+	return resp.MakeBulkString(value)
+}
+
 // set assigns a value to a key with optional parameters
 func set(ctx *context) resp.Value {
 	if len(ctx.args) < 2 {
@@ -115,28 +238,34 @@ func set(ctx *context) resp.Value {
 				return resp.MakeError("value TTL is not integer or out of range")
 			}
 
-			var ttlDuration time.Duration
+			unit := time.Second
+			if arg == "PX" || arg == "PXAT" {
+				unit = time.Millisecond
+			}
+			absolute := arg == "EXAT" || arg == "PXAT"
 
-			switch arg {
-			case "EX":
-				ttlDuration = time.Duration(valTTL) * time.Second
-			case "PX":
-				ttlDuration = time.Duration(valTTL) * time.Millisecond
-			case "EXAT":
-				expireAt := time.Unix(valTTL, 0)
-				ttlDuration = time.Until(expireAt)
-			case "PXAT":
-				expireAt := time.UnixMilli(valTTL)
-				ttlDuration = time.Until(expireAt)
+			now := time.Now()
+			deadline, ok := expireDeadline(valTTL, unit, absolute, now)
+			if !ok {
+				return resp.MakeError("ERR invalid expire time in 'set' command")
+			}
+
+			// a deadline far in the past would overflow the difference, it only matters that it has passed
+			var ttlDuration time.Duration
+			if !absolute || deadline > now.UnixNano() {
+				ttlDuration = time.Duration(deadline - now.UnixNano())
 			}
 
 			if ttlDuration <= 0 && (arg == "EXAT" || arg == "PXAT") {
 				options.TTL = time.Duration(1) * time.Nanosecond
-				(*ctx.storage).Set(key, value, options)
+				if _, err := (*ctx.storage).Set(key, value, options); err != nil {
+					return resp.MakeError(err.Error())
+				}
 				return resp.MakeSimpleString("OK")
 			}
 
 			options.TTL = ttlDuration
+			options.Absolute = arg == "EXAT" || arg == "PXAT"
 			hasTTL = true
 			i++
 		default:
@@ -144,15 +273,144 @@ func set(ctx *context) resp.Value {
 		}
 	}
 
-	ok := (*ctx.storage).Set(key, value, options)
+	ok, err := (*ctx.storage).Set(key, value, options)
+	if err != nil {
+		return resp.MakeError(err.Error())
+	}
 
+	// Set overwrites a value of any type, it refuses only when the NX or XX condition is not met
 	if !ok {
+		ctx.noPropagate()
 		return resp.MakeNilBulkString()
 	}
 
 	return resp.MakeSimpleString("OK")
 }
 
+// appendCmd APPEND key value appends the value to the string stored at key. Returns the new length
+func appendCmd(ctx *context) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments("APPEND")
+	}
+
+	n, err := (*ctx.storage).Append(string(ctx.args[0].String), string(ctx.args[1].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	return resp.MakeInteger(n)
+}
+
+// incrbyfloat INCRBYFLOAT key increment adds increment to the float stored at key. Returns the new value.
+// Floating point formatting may differ between builds, so the result is propagated to the AOF as SET with KEEPTTL
+func incrbyfloat(ctx *context) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments("INCRBYFLOAT")
+	}
+
+	delta, err := strconv.ParseFloat(string(ctx.args[1].String), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return resp.MakeError(storage.ErrNotFloat.Error())
+	}
+
+	value, err := (*ctx.storage).IncrByFloat(string(ctx.args[0].String), delta)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.propagate("SET", ctx.args[0], resp.MakeBulkString(value), resp.MakeBulkString("KEEPTTL"))
+	return resp.MakeBulkString(value)
+}
+
+// setrange SETRANGE key offset value overwrites part of the string stored at key. Returns the new length
+func setrange(ctx *context) resp.Value {
+	if len(ctx.args) != 3 {
+		return resp.MakeErrorWrongNumberOfArguments("SETRANGE")
+	}
+
+	offset, err := strconv.ParseInt(string(ctx.args[1].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+	if offset < 0 {
+		return resp.MakeError("ERR offset is out of range")
+	}
+
+	// checked before the sum, which overflows for offsets close to MaxInt64
+	value := string(ctx.args[2].String)
+	if len(value) > 0 && offset > (*ctx.storage).MaxStringLen()-int64(len(value)) {
+		return resp.MakeError("ERR string exceeds maximum allowed size")
+	}
+
+	n, err := (*ctx.storage).SetRange(string(ctx.args[0].String), offset, value)
+	if err != nil {
+		return stringError(err)
+	}
+
+	return resp.MakeInteger(n)
+}
+
+// getrange GETRANGE key start end returns the substring between the inclusive offsets, negative offsets count from the end
+func getrange(ctx *context) resp.Value {
+	if len(ctx.args) != 3 {
+		return resp.MakeErrorWrongNumberOfArguments("GETRANGE")
+	}
+
+	start, err := strconv.ParseInt(string(ctx.args[1].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+	end, err := strconv.ParseInt(string(ctx.args[2].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+
+	value, ok, err := (*ctx.storage).Get(string(ctx.args[0].String))
+	if err != nil {
+		return stringError(err)
+	}
+	ctx.lookup(ok)
+
+	length := int64(len(value))
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	start = max(start, 0)
+	end = min(max(end, 0), length-1)
+
+	if length == 0 || start > end {
+		return resp.MakeBulkString("")
+	}
+
+	return resp.MakeBulkString(value[start : end+1])
+}
+
+// strlen STRLEN key returns the length of the string stored at key, 0 if the key does not exist
+func strlen(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("STRLEN")
+	}
+
+	value, ok, err := (*ctx.storage).Get(string(ctx.args[0].String))
+	if err != nil {
+		return stringError(err)
+	}
+	ctx.lookup(ok)
+
+	return resp.MakeInteger(int64(len(value)))
+}
+
+// stringError converts a storage error of a string command to a RESP error
+func stringError(err error) resp.Value {
+	if errors.Is(err, storage.ErrWrongType) {
+		return resp.MakeErrorWrongType()
+	}
+	return resp.MakeError(err.Error())
+}
+
 // del removes the specified keys. Returns the number of keys that were removed
 func del(ctx *context) resp.Value {
 	if len(ctx.args) < 1 {
@@ -169,20 +427,29 @@ func del(ctx *context) resp.Value {
 	return resp.MakeInteger(wasDeleted)
 }
 
+// exists returns the number of existing keys among the arguments, a key given twice is counted twice
+func exists(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("EXISTS")
+	}
+
+	var found int64
+	for _, key := range ctx.args {
+		if (*ctx.storage).View(string(key.String), func(storage.Entity) {}) {
+			found++
+		}
+	}
+
+	return resp.MakeInteger(found)
+}
+
 // ttl returns the remaining time to live of a key in seconds
 func ttl(ctx *context) resp.Value {
 	if len(ctx.args) != 1 {
 		return resp.MakeErrorWrongNumberOfArguments("TTL")
 	}
 
-	key := string(ctx.args[0].String)
-	duration, code := (*ctx.storage).Expiry(key)
-
-	if code < 0 {
-		return resp.MakeInteger(int64(code))
-	}
-
-	return resp.MakeInteger(int64(duration.Seconds()))
+	return expiryReply(ctx, time.Second)
 }
 
 // pttl returns the remaining time to live of a key in milliseconds
@@ -191,14 +458,38 @@ func pttl(ctx *context) resp.Value {
 		return resp.MakeErrorWrongNumberOfArguments("PTTL")
 	}
 
-	key := string(ctx.args[0].String)
-	duration, code := (*ctx.storage).Expiry(key)
+	return expiryReply(ctx, time.Millisecond)
+}
 
-	if code < 0 {
-		return resp.MakeInteger(int64(code))
+// Replies of TTL and PTTL for keys without a remaining time to live, part of the wire contract
+const (
+	ttlNotFound  int64 = -2 // the key does not exist
+	ttlNoTimeout int64 = -1 // the key exists but has no expiration
+)
+
+// expiryReply maps the expiry of the key to the reply of TTL/PTTL: the remaining time rounded to the nearest unit,
+// like Redis does, or one of the ttl* codes. The codes are spelled out rather than converted from
+// storage.ExpiryStatus, so the storage is free to renumber its statuses
+func expiryReply(ctx *context, unit time.Duration) resp.Value {
+	remaining, status := (*ctx.storage).RemainingTTL(string(ctx.args[0].String))
+
+	switch status {
+	case storage.ExpNotFound:
+		return resp.MakeInteger(ttlNotFound)
+	case storage.ExpNoTimeout:
+		return resp.MakeInteger(ttlNoTimeout)
 	}
 
-	return resp.MakeInteger(duration.Milliseconds())
+	return resp.MakeInteger(roundTTL(remaining, unit))
+}
+
+// roundTTL rounds the remaining time to the nearest millisecond and then to the nearest unit, so the seconds of TTL
+// are always the rounded milliseconds of PTTL divided by 1000. Rounding straight to seconds would disagree
+// when the milliseconds round up to a half second, e.g. 1499.6ms is 1500 for PTTL but 1 for TTL
+func roundTTL(remaining, unit time.Duration) int64 {
+	ms := int64((remaining + time.Millisecond/2) / time.Millisecond)
+	perUnit := int64(unit / time.Millisecond)
+	return (ms + perUnit/2) / perUnit
 }
 
 // persist removes the expiration from a key, making it persistent
@@ -213,3 +504,137 @@ func persist(ctx *context) resp.Value {
 
 	return resp.MakeInteger(code)
 }
+
+// expireDeadline converts the argument of an expiration option to a deadline in Unix nanoseconds: n units from now,
+// or n units since the Unix epoch when absolute. Returns false when the deadline does not fit in an int64,
+// i.e. beyond the year 2262, instead of letting it wrap around into the past
+func expireDeadline(n int64, unit time.Duration, absolute bool, now time.Time) (int64, bool) {
+	perUnit := int64(unit)
+	if n > math.MaxInt64/perUnit || n < math.MinInt64/perUnit {
+		return 0, false
+	}
+
+	d := n * perUnit
+	if absolute {
+		return d, true
+	}
+
+	base := now.UnixNano()
+	if (d > 0 && base > math.MaxInt64-d) || (d < 0 && base < math.MinInt64-d) {
+		return 0, false
+	}
+	return base + d, true
+}
+
+// expireGeneric parses the integer argument of the EXPIRE family and converts it to an absolute deadline.
+// A call that changed no key is not propagated
+func expireGeneric(ctx *context, name string, unit time.Duration, absolute bool) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments(name)
+	}
+
+	key := string(ctx.args[0].String)
+
+	n, err := strconv.ParseInt(string(ctx.args[1].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+
+	deadline, ok := expireDeadline(n, unit, absolute, time.Now())
+	if !ok {
+		return resp.MakeError(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(name)))
+	}
+
+	n = (*ctx.storage).ExpireAt(key, time.Unix(0, deadline))
+	if n == 0 {
+		// no key was changed, keep it out of the AOF and leave its watches alone
+		ctx.noPropagate()
+	}
+
+	return resp.MakeInteger(n)
+}
+
+// expire sets a timeout on key in seconds
+func expire(ctx *context) resp.Value {
+	return expireGeneric(ctx, "EXPIRE", time.Second, false)
+}
+
+// pexpire sets a timeout on key in milliseconds
+func pexpire(ctx *context) resp.Value {
+	return expireGeneric(ctx, "PEXPIRE", time.Millisecond, false)
+}
+
+// expireat sets the expiration for a key as a UNIX timestamp in seconds
+func expireat(ctx *context) resp.Value {
+	return expireGeneric(ctx, "EXPIREAT", time.Second, true)
+}
+
+// pexpireat sets the expiration for a key as a UNIX timestamp in milliseconds
+func pexpireat(ctx *context) resp.Value {
+	return expireGeneric(ctx, "PEXPIREAT", time.Millisecond, true)
+}
+
+// copyCmd COPY source destination [REPLACE]. Returns 1 if source was copied, 0 otherwise
+func copyCmd(ctx *context) resp.Value {
+	if len(ctx.args) < 2 {
+		return resp.MakeErrorWrongNumberOfArguments("COPY")
+	}
+
+	var replace bool
+	for _, arg := range ctx.args[2:] {
+		switch opt := strings.ToUpper(string(arg.String)); opt {
+		case "REPLACE":
+			replace = true
+		default:
+			return resp.MakeError("ERR syntax error")
+		}
+	}
+
+	src, dst := string(ctx.args[0].String), string(ctx.args[1].String)
+	if src == dst {
+		return resp.MakeError("ERR source and destination objects are the same")
+	}
+
+	if (*ctx.storage).Copy(src, dst, replace) {
+		return resp.MakeInteger(1)
+	}
+	return resp.MakeInteger(0)
+}
+
+// rename RENAME key newkey moves the value to newkey, overwriting it
+func rename(ctx *context) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments("RENAME")
+	}
+
+	if _, err := (*ctx.storage).Rename(string(ctx.args[0].String), string(ctx.args[1].String), false); err != nil {
+		return resp.MakeError(err.Error())
+	}
+	return resp.MakeSimpleString("OK")
+}
+
+// renamenx RENAMENX key newkey moves the value to newkey only if newkey does not exist
+func renamenx(ctx *context) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments("RENAMENX")
+	}
+
+	moved, err := (*ctx.storage).Rename(string(ctx.args[0].String), string(ctx.args[1].String), true)
+	if err != nil {
+		return resp.MakeError(err.Error())
+	}
+	if moved {
+		return resp.MakeInteger(1)
+	}
+	ctx.noPropagate()
+	return resp.MakeInteger(0)
+}
+
+// dbsize returns the number of keys in the database
+func dbsize(ctx *context) resp.Value {
+	if len(ctx.args) != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("DBSIZE")
+	}
+
+	return resp.MakeInteger((*ctx.storage).Len())
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+var (
+	errBitFieldType     = errors.New("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errBitOffset        = errors.New("ERR bit offset is not an integer or out of range")
+	errBitFieldOverflow = errors.New("ERR Invalid OVERFLOW type specified")
+)
+
+// parseBitFieldType parses a field type such as i16 or u8
+func parseBitFieldType(s string) (signed bool, bits uint, err error) {
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u' && s[0] != 'I' && s[0] != 'U') {
+		return false, 0, errBitFieldType
+	}
+
+	signed = s[0] == 'i' || s[0] == 'I'
+	n, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, errBitFieldType
+	}
+
+	return signed, uint(n), nil
+}
+
+// parseBitOffset parses a bit offset, "#N" addresses the N-th field of the given width
+func parseBitOffset(s string, bits uint) (uint64, error) {
+	byField := strings.HasPrefix(s, "#")
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 10, 64)
+	if err != nil {
+		return 0, errBitOffset
+	}
+	if byField {
+		if n > math.MaxInt64/uint64(bits) {
+			return 0, errBitOffset
+		}
+		n *= uint64(bits)
+	}
+	if n > math.MaxInt64 {
+		return 0, errBitOffset
+	}
+
+	return n, nil
+}
+
+// parseBitField parses the subcommands of BITFIELD. Reports whether any of them writes
+func parseBitField(args []resp.Value) ([]storage.BitFieldOp, bool, error) {
+	var ops []storage.BitFieldOp
+	var write bool
+	overflow := storage.BitFieldWrap
+
+	for i := 0; i < len(args); {
+		sub := strings.ToUpper(string(args[i].String))
+
+		if sub == "OVERFLOW" {
+			if i+1 >= len(args) {
+				return nil, false, errSyntax
+			}
+			switch strings.ToUpper(string(args[i+1].String)) {
+			case "WRAP":
+				overflow = storage.BitFieldWrap
+			case "SAT":
+				overflow = storage.BitFieldSat
+			case "FAIL":
+				overflow = storage.BitFieldFail
+			default:
+				return nil, false, errBitFieldOverflow
+			}
+			i += 2
+			continue
+		}
+
+		op := storage.BitFieldOp{Overflow: overflow}
+		need := 3
+		switch sub {
+		case "GET":
+			op.Kind = storage.BitFieldGet
+		case "SET":
+			op.Kind = storage.BitFieldSet
+			need = 4
+		case "INCRBY":
+			op.Kind = storage.BitFieldIncrBy
+			need = 4
+		default:
+			return nil, false, errSyntax
+		}
+		if i+need > len(args) {
+			return nil, false, errSyntax
+		}
+
+		var err error
+		if op.Signed, op.Bits, err = parseBitFieldType(string(args[i+1].String)); err != nil {
+			return nil, false, err
+		}
+		if op.Offset, err = parseBitOffset(string(args[i+2].String), op.Bits); err != nil {
+			return nil, false, err
+		}
+		if need == 4 {
+			if op.Value, err = strconv.ParseInt(string(args[i+3].String), 10, 64); err != nil {
+				return nil, false, errNotInteger
+			}
+			write = true
+		}
+
+		ops = append(ops, op)
+		i += need
+	}
+
+	return ops, write, nil
+}
+
+// bitfield BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment]
+// [OVERFLOW WRAP|SAT|FAIL] treats the string stored at key as an array of integers of arbitrary width.
+// Returns an array with a reply per subcommand, nil for a SET or INCRBY rejected by OVERFLOW FAIL
+func bitfield(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("BITFIELD")
+	}
+
+	ops, write, err := parseBitField(ctx.args[1:])
+	if err != nil {
+		return resp.MakeError(err.Error())
+	}
+	if !write {
+		ctx.noPropagate()
+	}
+
+	results, err := (*ctx.storage).BitField(string(ctx.args[0].String), ops)
+	if err != nil {
+		return stringError(err)
+	}
+
+	replies := make([]resp.Value, len(results))
+	for i, result := range results {
+		if result.Failed {
+			replies[i] = resp.MakeNilBulkString()
+		} else {
+			replies[i] = resp.MakeInteger(result.Value)
+		}
+	}
+
+	return resp.MakeArray(replies)
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"strconv"
 	"strings"
 	"time"
@@ -23,31 +24,200 @@ func hset(ctx *context) resp.Value {
 	}
 
 	created := (*ctx.storage).HSet(string(ctx.args[0].String), fields)
+	if created < 0 {
+		return resp.MakeErrorWrongType()
+	}
 
 	return resp.MakeInteger(created)
 }
 
+// hsetnx HSETNX key field value sets the field only if it does not exist yet
+func hsetnx(ctx *context) resp.Value {
+	if len(ctx.args) != 3 {
+		return resp.MakeErrorWrongNumberOfArguments("HSETNX")
+	}
+
+	set := (*ctx.storage).HSetNX(string(ctx.args[0].String), string(ctx.args[1].String), string(ctx.args[2].String))
+	if set < 0 {
+		return resp.MakeErrorWrongType()
+	}
+	if set == 0 {
+		ctx.noPropagate()
+	}
+
+	return resp.MakeInteger(set)
+}
+
+// hsetex HSETEX key [FNX|FXX] seconds|PXAT unix-time-milliseconds FIELDS numfields field value [field value ...]
+// sets the fields and their TTL atomically. FNX sets them only when none exists, FXX only when all exist.
+// The PXAT form is what HSETEX is rewritten to in the AOF
+func hsetex(ctx *context) resp.Value {
+	if len(ctx.args) < 6 {
+		return resp.MakeErrorWrongNumberOfArguments("HSETEX")
+	}
+
+	key := string(ctx.args[0].String)
+	now := time.Now()
+
+	var opts storage.HSetExOptions
+	args := ctx.args[1:]
+	switch strings.ToUpper(string(args[0].String)) {
+	case "FNX":
+		opts.FNX = true
+		args = args[1:]
+	case "FXX":
+		opts.FXX = true
+		args = args[1:]
+	}
+	if len(args) < 5 {
+		return resp.MakeErrorWrongNumberOfArguments("HSETEX")
+	}
+
+	var deadline int64
+	rest := args[1:]
+	if strings.EqualFold(string(args[0].String), "PXAT") {
+		if len(args) < 6 {
+			return resp.MakeErrorWrongNumberOfArguments("HSETEX")
+		}
+		ms, err := strconv.ParseInt(string(args[1].String), 10, 64)
+		if err != nil {
+			return resp.MakeError("ERR value is not an integer or out of range")
+		}
+		var ok bool
+		if deadline, ok = expireDeadline(ms, time.Millisecond, true, now); !ok || ms <= 0 {
+			return resp.MakeError("ERR invalid expire time in 'hsetex' command")
+		}
+		rest = args[2:]
+	} else {
+		seconds, err := strconv.ParseInt(string(args[0].String), 10, 64)
+		if err != nil {
+			return resp.MakeError("value is not an integer or out of range")
+		}
+		var ok bool
+		if deadline, ok = expireDeadline(seconds, time.Second, false, now); !ok || seconds <= 0 {
+			return resp.MakeError("ERR invalid expire time in 'hsetex' command")
+		}
+	}
+
+	if strings.ToUpper(string(rest[0].String)) != "FIELDS" {
+		return resp.MakeError("ERR syntax error, missing FIELDS")
+	}
+
+	numFields, err := strconv.Atoi(string(rest[1].String))
+	if err != nil || numFields <= 0 {
+		return resp.MakeError("value is not an integer or out of range")
+	}
+
+	if len(rest) != 2+2*numFields {
+		return resp.MakeError("parameter count mismatch")
+	}
+
+	fields := make(map[string]string, numFields)
+	for i := 2; i != len(rest); i += 2 {
+		fields[string(rest[i].String)] = string(rest[i+1].String)
+	}
+
+	set := (*ctx.storage).HSetEx(key, fields, time.Unix(0, deadline).Sub(now), opts)
+	if set < 0 {
+		return resp.MakeErrorWrongType()
+	}
+	if set == 0 {
+		ctx.noPropagate()
+	}
+
+	return resp.MakeInteger(set)
+}
+
 // hget returns the value associated with field in the hash stored at key
 func hget(ctx *context) resp.Value {
 	if len(ctx.args) != 2 {
 		return resp.MakeErrorWrongNumberOfArguments("HGET")
 	}
 
-	str, ok := (*ctx.storage).HGet(string(ctx.args[0].String), string(ctx.args[1].String))
+	str, ok, err := (*ctx.storage).HGet(string(ctx.args[0].String), string(ctx.args[1].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(ok)
 	if !ok {
 		return resp.MakeNilBulkString()
 	}
 	return resp.MakeBulkString(str)
 }
 
-// hgetall returns all fields and values of the hash stored at key
+// hgetall returns all fields and values of the hash stored at key, as a map to RESP3 clients and as a flat
+// array of fields and values to RESP2 clients
 func hgetall(ctx *context) resp.Value {
 	if len(ctx.args) != 1 {
 		return resp.MakeErrorWrongNumberOfArguments("HGETALL")
 	}
 
-	mp := (*ctx.storage).HGetAll(string(ctx.args[0].String))
-	return resp.MakeMap(mp)
+	mp, err := (*ctx.storage).HGetAll(string(ctx.args[0].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(len(mp) > 0)
+	if ctx.peer.protocol >= 3 {
+		return resp.MakeMap(mp)
+	}
+
+	flat := make([]resp.Value, 0, 2*len(mp))
+	for field, value := range mp {
+		flat = append(flat, resp.MakeBulkString(field), resp.MakeBulkString(value))
+	}
+	return resp.MakeArray(flat)
+}
+
+// hgetallStream writes the reply of HGETALL straight to the encoder, without building the reply values.
+// The live fields are collected under the read lock of the shard as pairs of strings sharing their bytes with
+// the hash, and written after the lock is released, so a slow client does not delay the writers of that shard
+func hgetallStream(ctx *context, enc *resp.Encoder) error {
+	if len(ctx.args) != 1 {
+		return enc.Write(resp.MakeErrorWrongNumberOfArguments("HGETALL"))
+	}
+
+	var pairs []string // field, value, field, value...
+	wrongType := false
+	(*ctx.storage).View(string(ctx.args[0].String), func(entity storage.Entity) {
+		if entity.Type != storage.TypeHash {
+			wrongType = true
+			return
+		}
+
+		hash := entity.Value.(map[string]storage.HashField)
+		now := time.Now().UnixNano()
+
+		pairs = make([]string, 0, 2*len(hash))
+		for name, f := range hash {
+			if f.ExpireAt == 0 || now <= f.ExpireAt {
+				pairs = append(pairs, name, f.Value)
+			}
+		}
+	})
+	if wrongType {
+		return enc.Write(resp.MakeErrorWrongType())
+	}
+
+	ctx.lookup(len(pairs) > 0)
+
+	var err error
+	if ctx.peer.protocol >= 3 {
+		err = enc.WriteMapHeader(len(pairs) / 2)
+	} else {
+		err = enc.WriteArrayHeader(len(pairs))
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range pairs {
+		if err := enc.WriteBulkString(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // hdel parse arguments for storage.HDel
@@ -63,7 +233,10 @@ func hdel(ctx *context) resp.Value {
 		fields[i] = string(field.String)
 	}
 
-	deleted := (*ctx.storage).HDel(key, fields)
+	deleted, err := (*ctx.storage).HDel(key, fields)
+	if err != nil {
+		return stringError(err)
+	}
 
 	return resp.MakeInteger(deleted)
 }
@@ -77,7 +250,12 @@ func hexists(ctx *context) resp.Value {
 	key := string(ctx.args[0].String)
 	field := string(ctx.args[1].String)
 
-	exist := (*ctx.storage).HExists(key, field)
+	exist, err := (*ctx.storage).HExists(key, field)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(exist == 1)
 
 	return resp.MakeInteger(exist)
 }
@@ -90,7 +268,12 @@ func hlen(ctx *context) resp.Value {
 
 	key := string(ctx.args[0].String)
 
-	mapLen := (*ctx.storage).HLen(key)
+	mapLen, err := (*ctx.storage).HLen(key)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(mapLen > 0)
 
 	return resp.MakeInteger(mapLen)
 }
@@ -103,7 +286,12 @@ func hkeys(ctx *context) resp.Value {
 
 	key := string(ctx.args[0].String)
 
-	fields := (*ctx.storage).HKeys(key)
+	fields, err := (*ctx.storage).HKeys(key)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(len(fields) > 0)
 	response := make([]resp.Value, 0, len(fields))
 	for _, field := range fields {
 		response = append(response, resp.MakeSimpleString(field))
@@ -120,7 +308,12 @@ func hvals(ctx *context) resp.Value {
 
 	key := string(ctx.args[0].String)
 
-	vals := (*ctx.storage).HVals(key)
+	vals, err := (*ctx.storage).HVals(key)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(len(vals) > 0)
 	response := make([]resp.Value, 0, len(vals))
 	for _, val := range vals {
 		response = append(response, resp.MakeSimpleString(val))
@@ -131,18 +324,33 @@ func hvals(ctx *context) resp.Value {
 
 // hexpire HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
 func hexpire(ctx *context) resp.Value {
+	return hexpireGeneric(ctx, "HEXPIRE", time.Second, false)
+}
+
+// hpexpireat HPEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...].
+// HEXPIRE is rewritten to it in the AOF, so a replay keeps the original deadlines
+func hpexpireat(ctx *context) resp.Value {
+	return hexpireGeneric(ctx, "HPEXPIREAT", time.Millisecond, true)
+}
+
+// hexpireGeneric parses the HEXPIRE family and sets the expiration of the fields
+func hexpireGeneric(ctx *context, name string, unit time.Duration, absolute bool) resp.Value {
 	if len(ctx.args) < 4 {
-		return resp.MakeErrorWrongNumberOfArguments("HEXPIRE")
+		return resp.MakeErrorWrongNumberOfArguments(name)
 	}
 
 	key := string(ctx.args[0].String)
 
-	secStr := string(ctx.args[1].String)
-	seconds, err := strconv.ParseInt(secStr, 10, 64)
+	n, err := strconv.ParseInt(string(ctx.args[1].String), 10, 64)
 	if err != nil {
 		return resp.MakeError("value is not an integer or out of range")
 	}
-	ttl := time.Duration(seconds) * time.Second
+	now := time.Now()
+	deadline, ok := expireDeadline(n, unit, absolute, now)
+	if !ok {
+		return resp.MakeError(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(name)))
+	}
+	ttl := time.Unix(0, deadline).Sub(now)
 
 	opts := storage.ExpireOptions{}
 	fieldsIdx := -1
@@ -211,3 +419,146 @@ func hexpire(ctx *context) resp.Value {
 
 	return resp.MakeArray(respArr)
 }
+
+// hpttl HPTTL key FIELDS numfields field [field ...] returns the remaining time to live of the fields
+// in milliseconds, -1 for a field without a TTL and -2 for a missing field or key
+func hpttl(ctx *context) resp.Value {
+	if len(ctx.args) < 4 {
+		return resp.MakeErrorWrongNumberOfArguments("HPTTL")
+	}
+
+	if !strings.EqualFold(string(ctx.args[1].String), "FIELDS") {
+		return resp.MakeError("ERR syntax error, missing FIELDS")
+	}
+
+	numFields, err := strconv.Atoi(string(ctx.args[2].String))
+	if err != nil || numFields <= 0 {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+	if len(ctx.args) != 3+numFields {
+		return resp.MakeError("ERR parameter count mismatch")
+	}
+
+	fields := make([]string, numFields)
+	for i := range fields {
+		fields[i] = string(ctx.args[3+i].String)
+	}
+
+	ttls, ok := (*ctx.storage).HPTTL(string(ctx.args[0].String), fields)
+	ctx.lookup(ok)
+
+	response := make([]resp.Value, len(fields))
+	for i := range response {
+		if ok {
+			response[i] = resp.MakeInteger(ttls[i])
+		} else {
+			response[i] = resp.MakeInteger(-2)
+		}
+	}
+
+	return resp.MakeArray(response)
+}
+
+// maxRandomCount bounds the number of fields a negative HRANDFIELD count may ask for. The reply is built in
+// memory, so it is capped like a request array at the default proto_max_multibulk_len
+const maxRandomCount = 1024 * 1024
+
+// randomSample picks count indexes among n elements for the random-member commands. A positive count picks
+// distinct indexes, at most n of them. A negative count picks exactly -count indexes that may repeat
+func randomSample(n int, count int64) []int {
+	if count < 0 {
+		indexes := make([]int, -count)
+		for i := range indexes {
+			indexes[i] = rand.IntN(n)
+		}
+		return indexes
+	}
+
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	if count >= int64(n) {
+		return indexes
+	}
+
+	// partial Fisher-Yates: the first count positions end up with a uniform sample without repetition
+	for i := range int(count) {
+		j := i + rand.IntN(n-i)
+		indexes[i], indexes[j] = indexes[j], indexes[i]
+	}
+	return indexes[:count]
+}
+
+// hrandfield HRANDFIELD key [count [WITHVALUES]] returns random fields of the hash. Without count it replies
+// with a single field or nil, see randomSample for the meaning of the sign of count
+func hrandfield(ctx *context) resp.Value {
+	if len(ctx.args) < 1 || len(ctx.args) > 3 {
+		return resp.MakeErrorWrongNumberOfArguments("HRANDFIELD")
+	}
+
+	var count int64 = 1
+	if len(ctx.args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(ctx.args[1].String), 10, 64)
+		if err != nil {
+			return resp.MakeError("ERR value is not an integer or out of range")
+		}
+		if count < -maxRandomCount {
+			return resp.MakeError("ERR value is out of range")
+		}
+	}
+
+	withValues := false
+	if len(ctx.args) == 3 {
+		if !strings.EqualFold(string(ctx.args[2].String), "WITHVALUES") {
+			return resp.MakeError("ERR syntax error")
+		}
+		withValues = true
+	}
+
+	hash, err := (*ctx.storage).HGetAll(string(ctx.args[0].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(len(hash) > 0)
+
+	if len(ctx.args) == 1 {
+		if len(hash) == 0 {
+			return resp.MakeNilBulkString()
+		}
+		// map iteration order is not uniformly random, skip to a uniformly chosen field
+		skip := rand.IntN(len(hash))
+		for field := range hash {
+			if skip == 0 {
+				return resp.MakeBulkString(field)
+			}
+			skip--
+		}
+	}
+
+	if len(hash) == 0 || count == 0 {
+		return resp.MakeArray([]resp.Value{})
+	}
+
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+
+	response := make([]resp.Value, 0, len(fields))
+	for _, i := range randomSample(len(fields), count) {
+		field := resp.MakeBulkString(fields[i])
+		switch {
+		case !withValues:
+			response = append(response, field)
+		case ctx.peer.protocol >= 3:
+			response = append(response, resp.MakeArray([]resp.Value{field, resp.MakeBulkString(hash[fields[i]])}))
+		default:
+			response = append(response, field, resp.MakeBulkString(hash[fields[i]]))
+		}
+	}
+
+	return resp.MakeArray(response)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// argStrings returns the string values of the arguments
+func argStrings(args []resp.Value) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = string(arg.String)
+	}
+	return out
+}
+
+// pfadd PFADD key [element ...] adds the elements to the HyperLogLog, creating the key if needed.
+// Returns 1 if the estimated cardinality may have changed, 0 otherwise
+func pfadd(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("PFADD")
+	}
+
+	changed, err := (*ctx.storage).PFAdd(string(ctx.args[0].String), argStrings(ctx.args[1:]))
+	if err != nil {
+		return stringError(err)
+	}
+
+	if !changed {
+		ctx.noPropagate()
+		return resp.MakeInteger(0)
+	}
+	return resp.MakeInteger(1)
+}
+
+// pfcount PFCOUNT key [key ...] returns the estimated cardinality of the union of the HyperLogLogs,
+// missing keys count as empty
+func pfcount(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("PFCOUNT")
+	}
+
+	n, err := (*ctx.storage).PFCount(argStrings(ctx.args))
+	if err != nil {
+		return stringError(err)
+	}
+
+	return resp.MakeInteger(n)
+}
+
+// pfmerge PFMERGE destkey [sourcekey ...] merges the source HyperLogLogs into destkey, creating it if needed
+func pfmerge(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("PFMERGE")
+	}
+
+	if err := (*ctx.storage).PFMerge(string(ctx.args[0].String), argStrings(ctx.args[1:])); err != nil {
+		return stringError(err)
+	}
+
+	return resp.MakeSimpleString("OK")
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// pushGeneric inserts the values at the head or at the tail of the list. Lists longer than
+// storage.list_max_len are trimmed from the opposite end, the reply is the length after the trim
+func pushGeneric(ctx *context, name string, left bool) resp.Value {
+	if len(ctx.args) < 2 {
+		return resp.MakeErrorWrongNumberOfArguments(name)
+	}
+
+	values := make([]string, 0, len(ctx.args)-1)
+	for _, arg := range ctx.args[1:] {
+		values = append(values, string(arg.String))
+	}
+
+	n, err := (*ctx.storage).Push(string(ctx.args[0].String), values, left)
+	if err != nil {
+		return stringError(err)
+	}
+
+	return resp.MakeInteger(n)
+}
+
+// lpush LPUSH key element [element ...] inserts the elements at the head of the list
+func lpush(ctx *context) resp.Value {
+	return pushGeneric(ctx, "LPUSH", true)
+}
+
+// rpush RPUSH key element [element ...] inserts the elements at the tail of the list
+func rpush(ctx *context) resp.Value {
+	return pushGeneric(ctx, "RPUSH", false)
+}
+
+// llen LLEN key returns the length of the list, 0 if the key does not exist
+func llen(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("LLEN")
+	}
+
+	n, err := (*ctx.storage).LLen(string(ctx.args[0].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(n > 0)
+	return resp.MakeInteger(n)
+}
+
+// parseListRange parses the start and stop offsets of LRANGE and LTRIM
+func parseListRange(args []resp.Value) (int64, int64, bool) {
+	start, err := strconv.ParseInt(string(args[0].String), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	stop, err := strconv.ParseInt(string(args[1].String), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return start, stop, true
+}
+
+// lrange LRANGE key start stop returns the elements between start and stop inclusive,
+// negative offsets count from the end of the list
+func lrange(ctx *context) resp.Value {
+	if len(ctx.args) != 3 {
+		return resp.MakeErrorWrongNumberOfArguments("LRANGE")
+	}
+
+	start, stop, ok := parseListRange(ctx.args[1:])
+	if !ok {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+
+	elements, err := (*ctx.storage).LRange(string(ctx.args[0].String), start, stop)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(elements != nil)
+	response := make([]resp.Value, 0, len(elements))
+	for _, element := range elements {
+		response = append(response, resp.MakeBulkString(element))
+	}
+
+	return resp.MakeArray(response)
+}
+
+// ltrim LTRIM key start stop keeps only the elements between start and stop inclusive
+func ltrim(ctx *context) resp.Value {
+	if len(ctx.args) != 3 {
+		return resp.MakeErrorWrongNumberOfArguments("LTRIM")
+	}
+
+	start, stop, ok := parseListRange(ctx.args[1:])
+	if !ok {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+
+	if err := (*ctx.storage).LTrim(string(ctx.args[0].String), start, stop); err != nil {
+		return stringError(err)
+	}
+
+	return resp.MakeSimpleString("OK")
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// subscribeAllowed lists the commands a peer may run while it has active subscriptions
+var subscribeAllowed = map[string]struct{}{
+	"SUBSCRIBE":    {},
+	"UNSUBSCRIBE":  {},
+	"PSUBSCRIBE":   {},
+	"PUNSUBSCRIBE": {},
+	"SSUBSCRIBE":   {},
+	"SUNSUBSCRIBE": {},
+	"PING":         {},
+	"QUIT":         {},
+	"RESET":        {},
+}
+
+// makeSubscriptionReply builds the confirmation sent for every (un)subscribed channel
+func makeSubscriptionReply(kind string, name resp.Value, count int) resp.Value {
+	return resp.MakeArray([]resp.Value{
+		resp.MakeBulkString(kind),
+		name,
+		resp.MakeInteger(int64(count)),
+	})
+}
+
+// sendReplies writes all replies except the last one directly to the peer and returns the last one,
+// so the connection loop sends it like the reply of any other command
+func sendReplies(peer *Peer, replies []resp.Value) resp.Value {
+	for _, reply := range replies[:len(replies)-1] {
+		peer.Send(reply) //nolint:errcheck
+	}
+	return replies[len(replies)-1]
+}
+
+// sortedNames returns the names of the set in a stable order
+func sortedNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subscribe SUBSCRIBE channel [channel ...]
+func (b *broker) subscribe(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("SUBSCRIBE")
+	}
+
+	replies := make([]resp.Value, 0, len(ctx.args))
+	for _, arg := range ctx.args {
+		channel := string(arg.String)
+		if _, ok := ctx.peer.channels[channel]; !ok {
+			ctx.peer.channels[channel] = struct{}{}
+			b.addSubscriber(b.channels, channel, ctx.peer)
+		}
+		replies = append(replies, makeSubscriptionReply("subscribe", resp.MakeBulkString(channel), ctx.peer.subscriptions()))
+	}
+
+	return sendReplies(ctx.peer, replies)
+}
+
+// unsubscribe UNSUBSCRIBE [channel [channel ...]]. Without arguments unsubscribes from all channels
+func (b *broker) unsubscribe(ctx *context) resp.Value {
+	channels := make([]string, 0, len(ctx.args))
+	for _, arg := range ctx.args {
+		channels = append(channels, string(arg.String))
+	}
+	if len(channels) == 0 {
+		channels = sortedNames(ctx.peer.channels)
+	}
+
+	if len(channels) == 0 {
+		return makeSubscriptionReply("unsubscribe", resp.MakeNilBulkString(), ctx.peer.subscriptions())
+	}
+
+	replies := make([]resp.Value, 0, len(channels))
+	for _, channel := range channels {
+		if _, ok := ctx.peer.channels[channel]; ok {
+			delete(ctx.peer.channels, channel)
+			b.removeSubscriber(b.channels, channel, ctx.peer)
+		}
+		replies = append(replies, makeSubscriptionReply("unsubscribe", resp.MakeBulkString(channel), ctx.peer.subscriptions()))
+	}
+
+	return sendReplies(ctx.peer, replies)
+}
+
+// psubscribe PSUBSCRIBE pattern [pattern ...]
+func (b *broker) psubscribe(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("PSUBSCRIBE")
+	}
+
+	replies := make([]resp.Value, 0, len(ctx.args))
+	for _, arg := range ctx.args {
+		pattern := string(arg.String)
+		if _, ok := ctx.peer.patterns[pattern]; !ok {
+			ctx.peer.patterns[pattern] = struct{}{}
+			b.addSubscriber(b.patterns, pattern, ctx.peer)
+		}
+		replies = append(replies, makeSubscriptionReply("psubscribe", resp.MakeBulkString(pattern), ctx.peer.subscriptions()))
+	}
+
+	return sendReplies(ctx.peer, replies)
+}
+
+// punsubscribe PUNSUBSCRIBE [pattern [pattern ...]]. Without arguments unsubscribes from all patterns
+func (b *broker) punsubscribe(ctx *context) resp.Value {
+	patterns := make([]string, 0, len(ctx.args))
+	for _, arg := range ctx.args {
+		patterns = append(patterns, string(arg.String))
+	}
+	if len(patterns) == 0 {
+		patterns = sortedNames(ctx.peer.patterns)
+	}
+
+	if len(patterns) == 0 {
+		return makeSubscriptionReply("punsubscribe", resp.MakeNilBulkString(), ctx.peer.subscriptions())
+	}
+
+	replies := make([]resp.Value, 0, len(patterns))
+	for _, pattern := range patterns {
+		if _, ok := ctx.peer.patterns[pattern]; ok {
+			delete(ctx.peer.patterns, pattern)
+			b.removeSubscriber(b.patterns, pattern, ctx.peer)
+		}
+		replies = append(replies, makeSubscriptionReply("punsubscribe", resp.MakeBulkString(pattern), ctx.peer.subscriptions()))
+	}
+
+	return sendReplies(ctx.peer, replies)
+}
+
+// publishCmd PUBLISH channel message. Returns the number of clients that received the message
+func (b *broker) publishCmd(ctx *context) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments("PUBLISH")
+	}
+
+	return resp.MakeInteger(b.publish(string(ctx.args[0].String), string(ctx.args[1].String)))
+}
+
+// ssubscribe SSUBSCRIBE shardchannel [shardchannel ...]. On a single node it behaves like SUBSCRIBE,
+// the reply count covers only the shard channels of the peer
+func (b *broker) ssubscribe(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("SSUBSCRIBE")
+	}
+
+	replies := make([]resp.Value, 0, len(ctx.args))
+	for _, arg := range ctx.args {
+		channel := string(arg.String)
+		if _, ok := ctx.peer.shardChannels[channel]; !ok {
+			ctx.peer.shardChannels[channel] = struct{}{}
+			b.addSubscriber(b.shardChannels, channel, ctx.peer)
+		}
+		replies = append(replies, makeSubscriptionReply("ssubscribe", resp.MakeBulkString(channel), len(ctx.peer.shardChannels)))
+	}
+
+	return sendReplies(ctx.peer, replies)
+}
+
+// sunsubscribe SUNSUBSCRIBE [shardchannel [shardchannel ...]]. Without arguments unsubscribes from all shard channels
+func (b *broker) sunsubscribe(ctx *context) resp.Value {
+	channels := make([]string, 0, len(ctx.args))
+	for _, arg := range ctx.args {
+		channels = append(channels, string(arg.String))
+	}
+	if len(channels) == 0 {
+		channels = sortedNames(ctx.peer.shardChannels)
+	}
+
+	if len(channels) == 0 {
+		return makeSubscriptionReply("sunsubscribe", resp.MakeNilBulkString(), len(ctx.peer.shardChannels))
+	}
+
+	replies := make([]resp.Value, 0, len(channels))
+	for _, channel := range channels {
+		if _, ok := ctx.peer.shardChannels[channel]; ok {
+			delete(ctx.peer.shardChannels, channel)
+			b.removeSubscriber(b.shardChannels, channel, ctx.peer)
+		}
+		replies = append(replies, makeSubscriptionReply("sunsubscribe", resp.MakeBulkString(channel), len(ctx.peer.shardChannels)))
+	}
+
+	return sendReplies(ctx.peer, replies)
+}
+
+// spublishCmd SPUBLISH shardchannel message. Returns the number of clients that received the message
+func (b *broker) spublishCmd(ctx *context) resp.Value {
+	if len(ctx.args) != 2 {
+		return resp.MakeErrorWrongNumberOfArguments("SPUBLISH")
+	}
+
+	return resp.MakeInteger(b.spublish(string(ctx.args[0].String), string(ctx.args[1].String)))
+}
+
+// pubsubCmd PUBSUB SHARDCHANNELS [pattern] | SHARDNUMSUB [shardchannel ...]
+func (b *broker) pubsubCmd(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("PUBSUB")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "SHARDCHANNELS":
+		if len(ctx.args) > 2 {
+			return resp.MakeErrorWrongNumberOfArguments("PUBSUB|SHARDCHANNELS")
+		}
+
+		pattern := ""
+		if len(ctx.args) == 2 {
+			pattern = string(ctx.args[1].String)
+		}
+
+		channels := b.activeChannels(b.shardChannels, pattern)
+		values := make([]resp.Value, len(channels))
+		for i, channel := range channels {
+			values[i] = resp.MakeBulkString(channel)
+		}
+		return resp.MakeArray(values)
+
+	case "SHARDNUMSUB":
+		entries := make([]mapEntry, 0, len(ctx.args)-1)
+		for _, arg := range ctx.args[1:] {
+			channel := string(arg.String)
+			entries = append(entries, mapEntry{channel, resp.MakeInteger(int64(b.numSubscribers(b.shardChannels, channel)))})
+		}
+		return makeProtocolMap(ctx.peer.protocol, entries)
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", strings.ToLower(sub)))
+}
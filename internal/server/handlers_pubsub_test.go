@@ -0,0 +1,223 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+func TestSubscribeGating(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	res := e.Execute(peer, "SUBSCRIBE", makeCommand("SUBSCRIBE", "news"))
+	if res.Type != resp.TypeArray || string(res.Array[0].String) != "subscribe" {
+		t.Fatalf("unexpected SUBSCRIBE reply %v", res)
+	}
+
+	res = e.Execute(peer, "GET", makeCommand("GET", "k"))
+	if res.Type != resp.TypeError {
+		t.Fatalf("expected error, got %v", res.Type)
+	}
+	if !strings.Contains(string(res.String), "Can't execute 'get'") {
+		t.Errorf("unexpected error %q", res.String)
+	}
+
+	// PING is still allowed
+	res = e.Execute(peer, "PING", makeCommand("PING"))
+	if res.Type == resp.TypeError {
+		t.Errorf("PING must be allowed in subscribe mode, got %q", res.String)
+	}
+
+	// after leaving subscribe mode every command works again
+	e.Execute(peer, "UNSUBSCRIBE", makeCommand("UNSUBSCRIBE"))
+	res = e.Execute(peer, "GET", makeCommand("GET", "k"))
+	if res.Type == resp.TypeError {
+		t.Errorf("GET must be allowed after UNSUBSCRIBE, got %q", res.String)
+	}
+}
+
+func TestPingInSubscribeMode(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	e.Execute(peer, "SUBSCRIBE", makeCommand("SUBSCRIBE", "news"))
+
+	res := e.Execute(peer, "PING", makeCommand("PING"))
+	if res.Type != resp.TypeArray || len(res.Array) != 2 ||
+		string(res.Array[0].String) != "pong" || string(res.Array[1].String) != "" {
+		t.Errorf("PING: expected [pong, \"\"], got %v", res)
+	}
+
+	res = e.Execute(peer, "PING", makeCommand("PING", "hi"))
+	if res.Type != resp.TypeArray || len(res.Array) != 2 || string(res.Array[1].String) != "hi" {
+		t.Errorf("PING hi: expected [pong, hi], got %v", res)
+	}
+
+	// RESP3 clients can tell push messages from replies, so they get the usual reply
+	peer.protocol = 3
+	if res = e.Execute(peer, "PING", makeCommand("PING")); string(res.String) != "PONG" {
+		t.Errorf("RESP3 PING: expected PONG, got %v", res)
+	}
+
+	peer.protocol = 2
+	e.Execute(peer, "UNSUBSCRIBE", makeCommand("UNSUBSCRIBE"))
+	if res = e.Execute(peer, "PING", makeCommand("PING")); string(res.String) != "PONG" {
+		t.Errorf("PING after UNSUBSCRIBE: expected PONG, got %v", res)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	e := setupEngine()
+
+	server, client := net.Pipe()
+	defer server.Close() //nolint:errcheck
+	defer client.Close() //nolint:errcheck
+
+	subscriber := NewPeer(server)
+	e.Execute(subscriber, "SUBSCRIBE", makeCommand("SUBSCRIBE", "news"))
+	e.Execute(subscriber, "PSUBSCRIBE", makeCommand("PSUBSCRIBE", "n*"))
+
+	done := make(chan resp.Value)
+	go func() {
+		done <- e.Execute(mockPeer, "PUBLISH", makeCommand("PUBLISH", "news", "hello"))
+	}()
+
+	dec := resp.NewDecoder(client)
+	kinds := make(map[string]bool)
+	for range 2 {
+		msg, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		kinds[string(msg.Array[0].String)] = true
+		if payload := string(msg.Array[len(msg.Array)-1].String); payload != "hello" {
+			t.Errorf("got payload %q, want hello", payload)
+		}
+	}
+
+	if !kinds["message"] || !kinds["pmessage"] {
+		t.Errorf("expected message and pmessage, got %v", kinds)
+	}
+
+	if res := <-done; res.Integer != 2 {
+		t.Errorf("expected 2 receivers, got %d", res.Integer)
+	}
+
+	e.Disconnect(subscriber)
+	if res := e.Execute(mockPeer, "PUBLISH", makeCommand("PUBLISH", "news", "bye")); res.Integer != 0 {
+		t.Errorf("expected 0 receivers after disconnect, got %d", res.Integer)
+	}
+}
+
+func TestShardedPublish(t *testing.T) {
+	e := setupEngine()
+
+	server, client := net.Pipe()
+	defer server.Close() //nolint:errcheck
+	defer client.Close() //nolint:errcheck
+
+	subscriber := NewPeer(server)
+	res := e.Execute(subscriber, "SSUBSCRIBE", makeCommand("SSUBSCRIBE", "orders"))
+	if res.Type != resp.TypeArray || string(res.Array[0].String) != "ssubscribe" || res.Array[2].Integer != 1 {
+		t.Fatalf("unexpected SSUBSCRIBE reply %v", res)
+	}
+
+	res = e.Execute(subscriber, "GET", makeCommand("GET", "k"))
+	if res.Type != resp.TypeError {
+		t.Fatalf("expected GET to be rejected in subscribe mode, got %v", res)
+	}
+
+	// shard channels are a separate namespace, PUBLISH does not reach them
+	if res := e.Execute(mockPeer, "PUBLISH", makeCommand("PUBLISH", "orders", "x")); res.Integer != 0 {
+		t.Errorf("expected 0 receivers for PUBLISH, got %d", res.Integer)
+	}
+
+	done := make(chan resp.Value)
+	go func() {
+		done <- e.Execute(mockPeer, "SPUBLISH", makeCommand("SPUBLISH", "orders", "hello"))
+	}()
+
+	msg, err := resp.NewDecoder(client).Read()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(msg.Array) != 3 || string(msg.Array[0].String) != "smessage" ||
+		string(msg.Array[1].String) != "orders" || string(msg.Array[2].String) != "hello" {
+		t.Errorf("unexpected smessage %v", msg)
+	}
+
+	if res := <-done; res.Integer != 1 {
+		t.Errorf("expected 1 receiver, got %d", res.Integer)
+	}
+
+	res = e.Execute(mockPeer, "PUBSUB", makeCommand("PUBSUB", "SHARDCHANNELS"))
+	if len(res.Array) != 1 || string(res.Array[0].String) != "orders" {
+		t.Errorf("unexpected SHARDCHANNELS reply %v", res)
+	}
+
+	res = e.Execute(mockPeer, "PUBSUB", makeCommand("PUBSUB", "SHARDCHANNELS", "n*"))
+	if res.Type != resp.TypeArray || len(res.Array) != 0 {
+		t.Errorf("expected no shard channels matching n*, got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "PUBSUB", makeCommand("PUBSUB", "SHARDNUMSUB", "orders", "missing"))
+	if len(res.Array) != 4 || res.Array[1].Integer != 1 || res.Array[3].Integer != 0 {
+		t.Errorf("unexpected SHARDNUMSUB reply %v", res)
+	}
+
+	res = e.Execute(subscriber, "SUNSUBSCRIBE", makeCommand("SUNSUBSCRIBE"))
+	if string(res.Array[0].String) != "sunsubscribe" || res.Array[2].Integer != 0 {
+		t.Errorf("unexpected SUNSUBSCRIBE reply %v", res)
+	}
+
+	if res := e.Execute(subscriber, "GET", makeCommand("GET", "k")); res.Type == resp.TypeError {
+		t.Errorf("GET must be allowed after SUNSUBSCRIBE, got %q", res.String)
+	}
+
+	res = e.Execute(mockPeer, "PUBSUB", makeCommand("PUBSUB", "SHARDCHANNELS"))
+	if len(res.Array) != 0 {
+		t.Errorf("expected no shard channels after SUNSUBSCRIBE, got %v", res)
+	}
+}
+
+func TestSubscribeConfirmations(t *testing.T) {
+	e := setupEngine()
+	client := startConnection(t, e)
+	dec := resp.NewDecoder(client)
+
+	expect := func(kind, name string, count int64) {
+		t.Helper()
+		client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if res.Type != resp.TypeArray || len(res.Array) != 3 ||
+			string(res.Array[0].String) != kind || string(res.Array[1].String) != name || res.Array[2].Integer != count {
+			t.Errorf("got %v, want [%s %s %d]", res, kind, name, count)
+		}
+	}
+
+	if _, err := client.Write([]byte("*4\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expect("subscribe", "a", 1)
+	expect("subscribe", "b", 2)
+	expect("subscribe", "c", 3)
+
+	// the count is the running total of channels and patterns
+	if _, err := client.Write([]byte("*2\r\n$10\r\nPSUBSCRIBE\r\n$2\r\nn*\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expect("psubscribe", "n*", 4)
+
+	if _, err := client.Write([]byte("*3\r\n$11\r\nUNSUBSCRIBE\r\n$1\r\nb\r\n$1\r\na\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expect("unsubscribe", "b", 3)
+	expect("unsubscribe", "a", 2)
+}
@@ -0,0 +1,749 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// parseXAddID parses the ID argument of XADD: "*", "ms-*", "ms-seq" or "ms"
+func parseXAddID(arg string) (storage.StreamID, storage.StreamIDMode, error) {
+	if arg == "*" {
+		return storage.StreamID{}, storage.StreamIDAuto, nil
+	}
+
+	if ms, ok := strings.CutSuffix(arg, "-*"); ok {
+		id, err := storage.ParseStreamID(ms, 0)
+		if err != nil || strings.Contains(ms, "-") {
+			return storage.StreamID{}, 0, storage.ErrInvalidStreamID
+		}
+		return id, storage.StreamIDAutoSeq, nil
+	}
+
+	id, err := storage.ParseStreamID(arg, 0)
+	return id, storage.StreamIDExplicit, err
+}
+
+// xadd XADD key <* | id> field value [field value ...] appends an entry to the stream, creating it if needed.
+// Returns the ID of the entry. The AOF gets the generated ID, so a replay recreates the same entry
+func xadd(ctx *context) resp.Value {
+	if len(ctx.args) < 4 || len(ctx.args)%2 != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("XADD")
+	}
+
+	id, mode, err := parseXAddID(string(ctx.args[1].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	fields := make([]string, 0, len(ctx.args)-2)
+	for _, arg := range ctx.args[2:] {
+		fields = append(fields, string(arg.String))
+	}
+
+	id, err = (*ctx.storage).XAdd(string(ctx.args[0].String), id, mode, fields)
+	if err != nil {
+		return stringError(err)
+	}
+
+	reply := resp.MakeBulkString(id.String())
+	ctx.propagate("XADD", append([]resp.Value{ctx.args[0], reply}, ctx.args[2:]...)...)
+
+	return reply
+}
+
+// xlen XLEN key returns the number of entries of the stream, 0 if the key does not exist
+func xlen(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("XLEN")
+	}
+
+	n, err := (*ctx.storage).XLen(string(ctx.args[0].String))
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(n > 0)
+	return resp.MakeInteger(n)
+}
+
+// parseRangeID parses a bound of XRANGE: "-", "+", an ID or an exclusive "(" ID.
+// An incomplete start ID gets sequence 0 and an incomplete end ID the greatest sequence
+func parseRangeID(arg string, end bool) (storage.StreamID, error) {
+	switch arg {
+	case "-":
+		return storage.StreamID{}, nil
+	case "+":
+		return storage.MaxStreamID, nil
+	}
+
+	missingSeq := uint64(0)
+	if end {
+		missingSeq = math.MaxUint64
+	}
+
+	exclusive, ok := strings.CutPrefix(arg, "(")
+	if !ok {
+		return storage.ParseStreamID(arg, missingSeq)
+	}
+
+	id, err := storage.ParseStreamID(exclusive, missingSeq)
+	if err != nil {
+		return id, err
+	}
+
+	if end {
+		id, ok = id.Prev()
+	} else {
+		id, ok = id.Next()
+	}
+	if !ok {
+		if end {
+			return id, errInvalidEndID
+		}
+		return id, errInvalidStartID
+	}
+	return id, nil
+}
+
+var (
+	errInvalidStartID = errors.New("ERR invalid start ID for the interval")
+	errInvalidEndID   = errors.New("ERR invalid end ID for the interval")
+)
+
+// streamEntries builds the reply of a range of entries: an array of [id, [field, value, ...]]
+func streamEntries(entries []storage.StreamEntry) resp.Value {
+	reply := make([]resp.Value, len(entries))
+	for i, entry := range entries {
+		fields := make([]resp.Value, len(entry.Fields))
+		for j, field := range entry.Fields {
+			fields[j] = resp.MakeBulkString(field)
+		}
+		reply[i] = resp.MakeArray([]resp.Value{resp.MakeBulkString(entry.ID.String()), resp.MakeArray(fields)})
+	}
+	return resp.MakeArray(reply)
+}
+
+// xrange XRANGE key start end [COUNT count] returns the entries with IDs between start and end inclusive.
+// "-" and "+" are the smallest and the greatest ID, a "(" prefix makes a bound exclusive
+func xrange(ctx *context) resp.Value {
+	if len(ctx.args) != 3 && len(ctx.args) != 5 {
+		return resp.MakeErrorWrongNumberOfArguments("XRANGE")
+	}
+
+	start, err := parseRangeID(string(ctx.args[1].String), false)
+	if err != nil {
+		return stringError(err)
+	}
+	end, err := parseRangeID(string(ctx.args[2].String), true)
+	if err != nil {
+		return stringError(err)
+	}
+
+	count := -1
+	if len(ctx.args) == 5 {
+		if !strings.EqualFold(string(ctx.args[3].String), "COUNT") {
+			return resp.MakeError("ERR syntax error")
+		}
+		n, err := strconv.ParseInt(string(ctx.args[4].String), 10, 64)
+		if err != nil {
+			return resp.MakeError("ERR value is not an integer or out of range")
+		}
+		count = int(min(max(n, 0), math.MaxInt32))
+	}
+
+	entries, err := (*ctx.storage).XRange(string(ctx.args[0].String), start, end, count)
+	if err != nil {
+		return stringError(err)
+	}
+
+	ctx.lookup(entries != nil)
+	return streamEntries(entries)
+}
+
+// streamRead holds the arguments of XREAD and XREADGROUP
+type streamRead struct {
+	group    string
+	consumer string
+	count    int           // negative means no limit
+	block    time.Duration // negative means no blocking, 0 waits forever
+	noAck    bool
+	keys     []string
+	ids      []string
+}
+
+// parseStreamRead parses [GROUP group consumer] [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...]
+// id [id ...]. GROUP and NOACK are accepted only for XREADGROUP
+func parseStreamRead(args []resp.Value, name string) (streamRead, error) {
+	r := streamRead{count: -1, block: -1}
+	readGroup := name == "XREADGROUP"
+
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i].String))
+		if opt == "STREAMS" {
+			break
+		}
+
+		switch {
+		case opt == "NOACK" && readGroup:
+			r.noAck = true
+			continue
+		case opt == "GROUP" && readGroup:
+			if i+2 >= len(args) {
+				return r, errSyntax
+			}
+			r.group, r.consumer = string(args[i+1].String), string(args[i+2].String)
+			i += 2
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return r, errSyntax
+		}
+		n, err := strconv.ParseInt(string(args[i+1].String), 10, 64)
+		switch opt {
+		case "COUNT":
+			if err != nil {
+				return r, errNotInteger
+			}
+			// a count of 0 or less reads everything
+			if n > 0 {
+				r.count = int(min(n, math.MaxInt32))
+			}
+		case "BLOCK":
+			if err != nil {
+				return r, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if n < 0 {
+				return r, errors.New("ERR timeout is negative")
+			}
+			r.block = time.Duration(min(n, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+		default:
+			return r, errSyntax
+		}
+		i++
+	}
+
+	if i >= len(args)-1 {
+		return r, errSyntax
+	}
+	streams := args[i+1:]
+	if len(streams)%2 != 0 {
+		special := "$"
+		if readGroup {
+			special = ">"
+		}
+		return r, fmt.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '%s' must be specified.",
+			strings.ToLower(name), special)
+	}
+	if readGroup && r.group == "" {
+		return r, errors.New("ERR Missing GROUP option for XREADGROUP")
+	}
+
+	for _, key := range streams[:len(streams)/2] {
+		r.keys = append(r.keys, string(key.String))
+	}
+	for _, id := range streams[len(streams)/2:] {
+		r.ids = append(r.ids, string(id.String))
+	}
+
+	return r, nil
+}
+
+var (
+	errSyntax     = errors.New("ERR syntax error")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+)
+
+// xreadKeys returns the stream keys of XREAD
+func xreadKeys(args []resp.Value) []string {
+	r, _ := parseStreamRead(args, "XREAD")
+	return r.keys
+}
+
+// xreadGroupKeys returns the stream keys of XREADGROUP
+func xreadGroupKeys(args []resp.Value) []string {
+	r, _ := parseStreamRead(args, "XREADGROUP")
+	return r.keys
+}
+
+// streamsReply builds the reply of XREAD and XREADGROUP from key, entries pairs:
+// a map in RESP3, an array of [key, entries] arrays otherwise
+func streamsReply(ctx *context, found []resp.Value) resp.Value {
+	if ctx.peer != nil && ctx.peer.protocol >= 3 {
+		m := make(map[string]resp.Value, len(found)/2)
+		for j := 0; j < len(found); j += 2 {
+			m[string(found[j].String)] = found[j+1]
+		}
+		return resp.MakeMapValues(m)
+	}
+
+	pairs := make([]resp.Value, 0, len(found)/2)
+	for j := 0; j < len(found); j += 2 {
+		pairs = append(pairs, resp.MakeArray(found[j:j+2]))
+	}
+	return resp.MakeArray(pairs)
+}
+
+// xread XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...] returns the entries
+// with IDs greater than the given ones, "$" stands for the last ID of the stream. With BLOCK and no entries
+// available the client waits until one of the streams is written or the timeout expires, 0 waits forever.
+// Inside a transaction BLOCK is ignored
+func (e *Engine) xread(ctx *context) resp.Value {
+	if len(ctx.args) < 3 {
+		return resp.MakeErrorWrongNumberOfArguments("XREAD")
+	}
+
+	r, err := parseStreamRead(ctx.args, "XREAD")
+	if err != nil {
+		return stringError(err)
+	}
+	for _, id := range r.ids {
+		if id == ">" {
+			return resp.MakeError("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		}
+	}
+
+	after := make([]storage.StreamID, len(r.keys))
+	resolved := false
+
+	return e.blockingRead(ctx, r.keys, r.block, func() (resp.Value, bool) {
+		// "$" is the last ID at the time of the call, the IDs are parsed on the first read
+		if !resolved {
+			for j, id := range r.ids {
+				var err error
+				if id == "$" {
+					after[j], err = (*ctx.storage).XLastID(r.keys[j])
+				} else {
+					after[j], err = storage.ParseStreamID(id, 0)
+				}
+				if err != nil {
+					return stringError(err), true
+				}
+			}
+			resolved = true
+		}
+
+		var found []resp.Value
+		for j, key := range r.keys {
+			start, ok := after[j].Next()
+			if !ok {
+				continue
+			}
+
+			entries, err := (*ctx.storage).XRange(key, start, storage.MaxStreamID, r.count)
+			if err != nil {
+				return stringError(err), true
+			}
+			if len(entries) > 0 {
+				found = append(found, resp.MakeBulkString(key), streamEntries(entries))
+			}
+		}
+
+		if len(found) == 0 {
+			return resp.Value{}, false
+		}
+		return streamsReply(ctx, found), true
+	})
+}
+
+// noGroupError builds the reply to a command on a missing stream or consumer group
+func noGroupError(key, group, context string) resp.Value {
+	return resp.MakeError(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'%s", key, group, context))
+}
+
+// errXGroupNoKey is the reply of XGROUP on a missing stream
+const errXGroupNoKey = "ERR The XGROUP subcommand requires the key to exist. " +
+	"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+
+// xgroup XGROUP CREATE key group <id | $> [MKSTREAM] creates a consumer group that delivers the entries
+// after id, "$" being the last entry. MKSTREAM creates a missing stream.
+// XGROUP DESTROY key group deletes the group with its pending entries
+func xgroup(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("XGROUP")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "CREATE":
+		if len(ctx.args) != 4 && len(ctx.args) != 5 {
+			return resp.MakeErrorWrongNumberOfArguments("XGROUP|CREATE")
+		}
+
+		mkStream := len(ctx.args) == 5
+		if mkStream && !strings.EqualFold(string(ctx.args[4].String), "MKSTREAM") {
+			return resp.MakeError("ERR syntax error")
+		}
+
+		var id storage.StreamID
+		last := string(ctx.args[3].String) == "$"
+		if !last {
+			var err error
+			if id, err = storage.ParseStreamID(string(ctx.args[3].String), 0); err != nil {
+				return stringError(err)
+			}
+		}
+
+		err := (*ctx.storage).XGroupCreate(string(ctx.args[1].String), string(ctx.args[2].String), id, last, mkStream)
+		if errors.Is(err, storage.ErrNoSuchKey) {
+			return resp.MakeError(errXGroupNoKey)
+		}
+		if err != nil {
+			return stringError(err)
+		}
+
+		return resp.MakeSimpleString("OK")
+	case "DESTROY":
+		if len(ctx.args) != 3 {
+			return resp.MakeErrorWrongNumberOfArguments("XGROUP|DESTROY")
+		}
+
+		ok, err := (*ctx.storage).XGroupDestroy(string(ctx.args[1].String), string(ctx.args[2].String))
+		if errors.Is(err, storage.ErrNoSuchKey) {
+			return resp.MakeError(errXGroupNoKey)
+		}
+		if err != nil {
+			return stringError(err)
+		}
+
+		if !ok {
+			ctx.noPropagate()
+			return resp.MakeInteger(0)
+		}
+		return resp.MakeInteger(1)
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", strings.ToLower(sub)))
+}
+
+// xreadgroup XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...]
+// id [id ...] reads on behalf of a consumer of the group. ">" delivers the entries never delivered to the group,
+// they stay pending for the consumer until XACK unless NOACK is set. Any other ID returns the pending entries
+// of the consumer after it. BLOCK waits for new entries only when every ID is ">".
+// The AOF gets one read with the exact number of delivered entries per stream, so a replay delivers the same ones
+func (e *Engine) xreadgroup(ctx *context) resp.Value {
+	if len(ctx.args) < 6 {
+		return resp.MakeErrorWrongNumberOfArguments("XREADGROUP")
+	}
+
+	r, err := parseStreamRead(ctx.args, "XREADGROUP")
+	if err != nil {
+		return stringError(err)
+	}
+
+	after := make([]*storage.StreamID, len(r.keys))
+	history := false
+	for j, id := range r.ids {
+		switch id {
+		case ">":
+			continue
+		case "$":
+			return resp.MakeError("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the " +
+				"history of this consumer by specifying a proper ID, or use the > ID to get new messages. " +
+				"The $ ID would just return an empty result set.")
+		}
+
+		parsed, err := storage.ParseStreamID(id, 0)
+		if err != nil {
+			return stringError(err)
+		}
+		after[j], history = &parsed, true
+	}
+
+	checked := false
+	res := e.blockingRead(ctx, r.keys, r.block, func() (resp.Value, bool) {
+		// every group must exist before anything is delivered, a read of 0 entries delivers nothing
+		if !checked {
+			for _, key := range r.keys {
+				if _, err := (*ctx.storage).XReadGroup(key, r.group, r.consumer, nil, 0, false); err != nil {
+					if errors.Is(err, storage.ErrNoGroup) {
+						return noGroupError(key, r.group, " in XREADGROUP with GROUP option"), true
+					}
+					return stringError(err), true
+				}
+			}
+			checked = true
+		}
+
+		var found []resp.Value
+		for j, key := range r.keys {
+			entries, err := (*ctx.storage).XReadGroup(key, r.group, r.consumer, after[j], r.count, r.noAck)
+			if err != nil {
+				return stringError(err), true
+			}
+
+			// the history of a consumer is always returned, even when empty
+			if after[j] == nil && len(entries) == 0 {
+				continue
+			}
+			found = append(found, resp.MakeBulkString(key), streamEntries(entries))
+
+			if after[j] == nil {
+				args := []resp.Value{
+					resp.MakeBulkString("GROUP"), resp.MakeBulkString(r.group), resp.MakeBulkString(r.consumer),
+					resp.MakeBulkString("COUNT"), resp.MakeBulkString(strconv.Itoa(len(entries))),
+				}
+				if r.noAck {
+					args = append(args, resp.MakeBulkString("NOACK"))
+				}
+				args = append(args, resp.MakeBulkString("STREAMS"), resp.MakeBulkString(key), resp.MakeBulkString(">"))
+				ctx.propagate("XREADGROUP", args...)
+			}
+		}
+
+		if len(found) == 0 && !history {
+			return resp.Value{}, false
+		}
+		return streamsReply(ctx, found), true
+	})
+
+	// nothing new was delivered, the history reads are not persisted
+	if ctx.propagation == nil {
+		ctx.noPropagate()
+	}
+	return res
+}
+
+// parseStreamIDs parses the entry IDs of XACK and XCLAIM
+func parseStreamIDs(args []resp.Value) ([]storage.StreamID, error) {
+	ids := make([]storage.StreamID, 0, len(args))
+	for _, arg := range args {
+		id, err := storage.ParseStreamID(string(arg.String), 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// xack XACK key group id [id ...] removes the entries from the pending entries of the group.
+// Returns the number of acknowledged entries
+func xack(ctx *context) resp.Value {
+	if len(ctx.args) < 3 {
+		return resp.MakeErrorWrongNumberOfArguments("XACK")
+	}
+
+	ids, err := parseStreamIDs(ctx.args[2:])
+	if err != nil {
+		return stringError(err)
+	}
+
+	n, err := (*ctx.storage).XAck(string(ctx.args[0].String), string(ctx.args[1].String), ids)
+	if err != nil {
+		return stringError(err)
+	}
+
+	if n == 0 {
+		ctx.noPropagate()
+	}
+	return resp.MakeInteger(n)
+}
+
+// xpending XPENDING key group [[IDLE min-idle-time] start end count [consumer]] inspects the pending entries
+// of the group. The short form returns their number, the smallest and the greatest ID and the number of entries
+// per consumer. The extended form returns [id, consumer, idle milliseconds, deliveries] of every entry in range
+func xpending(ctx *context) resp.Value {
+	if len(ctx.args) < 2 {
+		return resp.MakeErrorWrongNumberOfArguments("XPENDING")
+	}
+
+	key, group := string(ctx.args[0].String), string(ctx.args[1].String)
+
+	if len(ctx.args) == 2 {
+		summary, err := (*ctx.storage).XPending(key, group)
+		if errors.Is(err, storage.ErrNoGroup) {
+			return noGroupError(key, group, "")
+		}
+		if err != nil {
+			return stringError(err)
+		}
+
+		if summary.Count == 0 {
+			return resp.MakeArray([]resp.Value{
+				resp.MakeInteger(0), resp.MakeNilBulkString(), resp.MakeNilBulkString(),
+				{Type: resp.TypeArray, IsNull: true},
+			})
+		}
+
+		consumers := make([]string, 0, len(summary.Consumers))
+		for consumer := range summary.Consumers {
+			consumers = append(consumers, consumer)
+		}
+		slices.Sort(consumers)
+
+		perConsumer := make([]resp.Value, len(consumers))
+		for i, consumer := range consumers {
+			perConsumer[i] = resp.MakeArray([]resp.Value{
+				resp.MakeBulkString(consumer),
+				resp.MakeBulkString(strconv.FormatInt(summary.Consumers[consumer], 10)),
+			})
+		}
+
+		return resp.MakeArray([]resp.Value{
+			resp.MakeInteger(summary.Count),
+			resp.MakeBulkString(summary.First.String()),
+			resp.MakeBulkString(summary.Last.String()),
+			resp.MakeArray(perConsumer),
+		})
+	}
+
+	args := ctx.args[2:]
+	var minIdle time.Duration
+	if strings.EqualFold(string(args[0].String), "IDLE") && len(args) > 1 {
+		ms, err := strconv.ParseInt(string(args[1].String), 10, 64)
+		if err != nil {
+			return resp.MakeError("ERR value is not an integer or out of range")
+		}
+		minIdle = time.Duration(min(max(ms, 0), math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+		args = args[2:]
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return resp.MakeError("ERR syntax error")
+	}
+
+	start, err := parseRangeID(string(args[0].String), false)
+	if err != nil {
+		return stringError(err)
+	}
+	end, err := parseRangeID(string(args[1].String), true)
+	if err != nil {
+		return stringError(err)
+	}
+	count, err := strconv.ParseInt(string(args[2].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR value is not an integer or out of range")
+	}
+	var consumer string
+	if len(args) == 4 {
+		consumer = string(args[3].String)
+	}
+
+	infos, err := (*ctx.storage).XPendingRange(key, group, start, end, int(min(max(count, 0), math.MaxInt32)), consumer, minIdle)
+	if errors.Is(err, storage.ErrNoGroup) {
+		return noGroupError(key, group, "")
+	}
+	if err != nil {
+		return stringError(err)
+	}
+
+	reply := make([]resp.Value, len(infos))
+	for i, info := range infos {
+		reply[i] = resp.MakeArray([]resp.Value{
+			resp.MakeBulkString(info.ID.String()),
+			resp.MakeBulkString(info.Consumer),
+			resp.MakeInteger(info.Idle.Milliseconds()),
+			resp.MakeInteger(info.Deliveries),
+		})
+	}
+	return resp.MakeArray(reply)
+}
+
+// xclaim XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] transfers the pending entries idle for at least min-idle-time to the
+// consumer, so the entries of a failed consumer are delivered again. Returns the claimed entries, only their
+// IDs with JUSTID. The AOF gets the claimed IDs with a min-idle-time of 0 and the delivery time
+func xclaim(ctx *context) resp.Value {
+	if len(ctx.args) < 5 {
+		return resp.MakeErrorWrongNumberOfArguments("XCLAIM")
+	}
+
+	key, group, consumer := string(ctx.args[0].String), string(ctx.args[1].String), string(ctx.args[2].String)
+
+	ms, err := strconv.ParseInt(string(ctx.args[3].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	minIdle := time.Duration(min(max(ms, 0), math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+
+	// the IDs end at the first argument that is not an ID
+	i := 4
+	var ids []storage.StreamID
+	for ; i < len(ctx.args); i++ {
+		id, err := storage.ParseStreamID(string(ctx.args[i].String), 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return stringError(storage.ErrInvalidStreamID)
+	}
+
+	now := time.Now().UnixMilli()
+	opts := storage.XClaimOptions{RetryCount: -1, DeliveredAt: now}
+	var options []resp.Value
+	for ; i < len(ctx.args); i++ {
+		opt := strings.ToUpper(string(ctx.args[i].String))
+		switch opt {
+		case "FORCE":
+			opts.Force = true
+			options = append(options, ctx.args[i])
+			continue
+		case "JUSTID":
+			opts.JustID = true
+			options = append(options, ctx.args[i])
+			continue
+		case "IDLE", "TIME", "RETRYCOUNT":
+		default:
+			return resp.MakeError(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", string(ctx.args[i].String)))
+		}
+
+		if i+1 >= len(ctx.args) {
+			return resp.MakeError("ERR syntax error")
+		}
+		n, err := strconv.ParseInt(string(ctx.args[i+1].String), 10, 64)
+		if err != nil {
+			return resp.MakeError(fmt.Sprintf("ERR Invalid %s option argument for XCLAIM", opt))
+		}
+		i++
+
+		switch opt {
+		case "IDLE":
+			opts.DeliveredAt = now - max(n, 0)
+		case "TIME":
+			opts.DeliveredAt = n
+		case "RETRYCOUNT":
+			opts.RetryCount = max(n, 0)
+			options = append(options, ctx.args[i-1], ctx.args[i])
+		}
+	}
+
+	claimed, err := (*ctx.storage).XClaim(key, group, consumer, minIdle, ids, opts)
+	if errors.Is(err, storage.ErrNoGroup) {
+		return noGroupError(key, group, "")
+	}
+	if err != nil {
+		return stringError(err)
+	}
+
+	if len(claimed) == 0 {
+		ctx.noPropagate()
+		return resp.MakeArray([]resp.Value{})
+	}
+
+	args := []resp.Value{ctx.args[0], ctx.args[1], ctx.args[2], resp.MakeBulkString("0")}
+	for _, entry := range claimed {
+		args = append(args, resp.MakeBulkString(entry.ID.String()))
+	}
+	args = append(args, resp.MakeBulkString("TIME"), resp.MakeBulkString(strconv.FormatInt(opts.DeliveredAt, 10)))
+	ctx.propagate("XCLAIM", append(args, options...)...)
+
+	if opts.JustID {
+		reply := make([]resp.Value, len(claimed))
+		for j, entry := range claimed {
+			reply[j] = resp.MakeBulkString(entry.ID.String())
+		}
+		return resp.MakeArray(reply)
+	}
+	return streamEntries(claimed)
+}
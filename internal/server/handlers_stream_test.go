@@ -0,0 +1,462 @@
+package server
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// entryIDs returns the IDs of an XRANGE reply
+func entryIDs(res resp.Value) string {
+	ids := make([]string, 0, len(res.Array))
+	for _, entry := range res.Array {
+		ids = append(ids, string(entry.Array[0].String))
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestStream(t *testing.T) {
+	e := setupEngine()
+
+	for _, tt := range []struct {
+		id, want string
+	}{
+		{"1-1", "1-1"},
+		{"1-*", "1-2"},
+		{"2", "2-0"},
+		{"5-*", "5-0"},
+	} {
+		res := e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", tt.id, "id", tt.id))
+		if string(res.String) != tt.want {
+			t.Errorf("XADD %s: expected %s, got %v", tt.id, tt.want, res)
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"s", "5-0", "f", "v"}, "ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{[]string{"new", "0-0", "f", "v"}, "ERR The ID specified in XADD must be greater than 0-0"},
+		{[]string{"s", "abc", "f", "v"}, "ERR Invalid stream ID specified as stream command argument"},
+		{[]string{"s", "1-2-*", "f", "v"}, "ERR Invalid stream ID specified as stream command argument"},
+		{[]string{"s", "*", "f"}, "ERR wrong number of arguments for XADD command"},
+	} {
+		res := e.Execute(mockPeer, "XADD", makeCommand("XADD", tt.args...))
+		if string(res.String) != tt.want {
+			t.Errorf("XADD %v: expected %q, got %v", tt.args, tt.want, res)
+		}
+	}
+
+	res := e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", "*", "f", "v"))
+	if id, err := storage.ParseStreamID(string(res.String), 0); err != nil || id.Ms <= 5 {
+		t.Fatalf("XADD *: unexpected ID %v", res)
+	}
+	if res := e.Execute(mockPeer, "XLEN", makeCommand("XLEN", "s")); res.Integer != 5 {
+		t.Errorf("XLEN: expected 5, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "OBJECT", makeCommand("OBJECT", "ENCODING", "s")); string(res.String) != "stream" {
+		t.Errorf("OBJECT ENCODING: expected stream, got %v", res)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"s", "-", "5"}, "1-1,1-2,2-0,5-0"},
+		{[]string{"s", "1", "1"}, "1-1,1-2"},
+		{[]string{"s", "(1-1", "(5-0"}, "1-2,2-0"},
+		{[]string{"s", "-", "+", "COUNT", "2"}, "1-1,1-2"},
+		{[]string{"s", "-", "+", "COUNT", "0"}, ""},
+		{[]string{"s", "3", "4"}, ""},
+		{[]string{"missing", "-", "+"}, ""},
+	} {
+		res := e.Execute(mockPeer, "XRANGE", makeCommand("XRANGE", tt.args...))
+		if res.Type != resp.TypeArray || entryIDs(res) != tt.want {
+			t.Errorf("XRANGE %v: expected %q, got %v", tt.args, tt.want, res)
+		}
+	}
+
+	res = e.Execute(mockPeer, "XRANGE", makeCommand("XRANGE", "s", "1-2", "1-2"))
+	if len(res.Array) != 1 || string(res.Array[0].Array[1].Array[0].String) != "id" || string(res.Array[0].Array[1].Array[1].String) != "1-*" {
+		t.Errorf("XRANGE: unexpected entry %v", res)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "str", "v"))
+	for _, cmd := range [][]string{{"XADD", "str", "*", "f", "v"}, {"XLEN", "str"}, {"XRANGE", "str", "-", "+"}} {
+		if res := e.Execute(mockPeer, cmd[0], makeCommand(cmd[0], cmd[1:]...)); !strings.HasPrefix(string(res.String), "WRONGTYPE") {
+			t.Errorf("%v: expected WRONGTYPE, got %v", cmd, res)
+		}
+	}
+}
+
+func TestXRead(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "XADD", makeCommand("XADD", "a", "1-1", "f", "1"))
+	e.Execute(mockPeer, "XADD", makeCommand("XADD", "a", "1-2", "f", "2"))
+	e.Execute(mockPeer, "XADD", makeCommand("XADD", "b", "2-1", "f", "3"))
+
+	res := e.Execute(mockPeer, "XREAD", makeCommand("XREAD", "STREAMS", "a", "b", "missing", "1-1", "0", "0"))
+	if len(res.Array) != 2 {
+		t.Fatalf("XREAD: expected 2 streams, got %v", res)
+	}
+	if key, ids := string(res.Array[0].Array[0].String), entryIDs(res.Array[0].Array[1]); key != "a" || ids != "1-2" {
+		t.Errorf("XREAD: expected a with 1-2, got %s with %s", key, ids)
+	}
+	if key, ids := string(res.Array[1].Array[0].String), entryIDs(res.Array[1].Array[1]); key != "b" || ids != "2-1" {
+		t.Errorf("XREAD: expected b with 2-1, got %s with %s", key, ids)
+	}
+
+	res = e.Execute(mockPeer, "XREAD", makeCommand("XREAD", "COUNT", "1", "STREAMS", "a", "0"))
+	if len(res.Array) != 1 || entryIDs(res.Array[0].Array[1]) != "1-1" {
+		t.Errorf("XREAD COUNT 1: unexpected reply %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "XREAD", makeCommand("XREAD", "STREAMS", "a", "$")); !res.IsNull {
+		t.Errorf("XREAD $ without BLOCK: expected a null reply, got %v", res)
+	}
+
+	start := time.Now()
+	if res := e.Execute(mockPeer, "XREAD", makeCommand("XREAD", "BLOCK", "50", "STREAMS", "a", "$")); !res.IsNull {
+		t.Errorf("XREAD BLOCK timeout: expected a null reply, got %v", res)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("XREAD BLOCK returned after %v, before the timeout", elapsed)
+	}
+
+	// a blocked client is woken by a write to its stream, entries older than "$" are not returned
+	done := make(chan resp.Value)
+	go func() {
+		done <- e.Execute(NewPeer(nil), "XREAD", makeCommand("XREAD", "BLOCK", "0", "STREAMS", "b", "a", "$", "$"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	e.Execute(mockPeer, "SET", makeCommand("SET", "other", "v"))
+	e.Execute(mockPeer, "XADD", makeCommand("XADD", "a", "3-0", "f", "4"))
+
+	select {
+	case res := <-done:
+		if len(res.Array) != 1 || string(res.Array[0].Array[0].String) != "a" || entryIDs(res.Array[0].Array[1]) != "3-0" {
+			t.Errorf("XREAD BLOCK: expected a with 3-0, got %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREAD BLOCK was not woken by XADD")
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"STREAMS", "a", "b", "0"}, "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."},
+		{[]string{"COUNT", "1", "a", "0"}, "ERR syntax error"},
+		{[]string{"BLOCK", "-1", "STREAMS", "a", "0"}, "ERR timeout is negative"},
+		{[]string{"STREAMS", "a", ">"}, "ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option."},
+		{[]string{"STREAMS", "a", "x"}, "ERR Invalid stream ID specified as stream command argument"},
+	} {
+		res := e.Execute(mockPeer, "XREAD", makeCommand("XREAD", tt.args...))
+		if string(res.String) != tt.want {
+			t.Errorf("XREAD %v: expected %q, got %v", tt.args, tt.want, res)
+		}
+	}
+
+	res = e.Execute(mockPeer, "COMMAND", makeCommand("COMMAND", "GETKEYS", "XREAD", "COUNT", "2", "STREAMS", "a", "b", "0", "0"))
+	if len(res.Array) != 2 || string(res.Array[0].String) != "a" || string(res.Array[1].String) != "b" {
+		t.Errorf("COMMAND GETKEYS XREAD: expected a and b, got %v", res)
+	}
+}
+
+// waitBlocked waits until n clients are blocked by XREAD
+func waitBlocked(t *testing.T, e *Engine, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for e.waiters.blocked.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d blocked clients, got %d", n, e.waiters.blocked.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestXReadBlockDisconnect(t *testing.T) {
+	e := setupEngine()
+
+	client := startConnection(t, e)
+	if _, err := client.Write([]byte("*6\r\n$5\r\nXREAD\r\n$5\r\nBLOCK\r\n$1\r\n0\r\n$7\r\nSTREAMS\r\n$1\r\ns\r\n$1\r\n$\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	waitBlocked(t, e, 1)
+
+	client.Close() //nolint:errcheck
+	waitBlocked(t, e, 0)
+}
+
+func TestXReadBlockPipelined(t *testing.T) {
+	e := setupEngine()
+
+	// the PING sent behind the blocked XREAD must not be lost by the disconnection watch
+	client := startConnection(t, e)
+	request := "*6\r\n$5\r\nXREAD\r\n$5\r\nBLOCK\r\n$2\r\n50\r\n$7\r\nSTREAMS\r\n$1\r\ns\r\n$1\r\n$\r\n*1\r\n$4\r\nPING\r\n"
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+	if res, err := dec.Read(); err != nil || !res.IsNull {
+		t.Fatalf("XREAD BLOCK: expected a null reply, got %v, %v", res, err)
+	}
+	if res, err := dec.Read(); err != nil || string(res.String) != "PONG" {
+		t.Fatalf("PING: expected PONG, got %v, %v", res, err)
+	}
+}
+
+func TestXReadBlockShutdown(t *testing.T) {
+	e := setupEngine()
+
+	done := make(chan resp.Value)
+	go func() {
+		done <- e.Execute(NewPeer(nil), "XREAD", makeCommand("XREAD", "BLOCK", "0", "STREAMS", "s", "$"))
+	}()
+	waitBlocked(t, e, 1)
+
+	e.Shutdown()
+	select {
+	case res := <-done:
+		if !res.IsNull {
+			t.Errorf("XREAD BLOCK: expected a null reply, got %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREAD BLOCK was not woken by Shutdown")
+	}
+	waitBlocked(t, e, 0)
+}
+
+func TestXReadBlockInTransaction(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	e.Execute(peer, "MULTI", nil)
+	e.Execute(peer, "XREAD", makeCommand("XREAD", "BLOCK", "0", "STREAMS", "s", "$"))
+
+	done := make(chan resp.Value)
+	go func() { done <- e.Execute(peer, "EXEC", nil) }()
+
+	select {
+	case res := <-done:
+		if len(res.Array) != 1 || !res.Array[0].IsNull {
+			t.Errorf("EXEC: expected a null XREAD reply, got %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREAD BLOCK blocked inside EXEC")
+	}
+}
+
+func TestXAddAOF(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	id := string(e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", "*", "f", "v")).String)
+	e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", "0-*", "f", "v")) // rejected, must not reach the AOF
+	e.Shutdown()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// the generated ID is written to the AOF, so the replay recreates the same entry
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	res := e.Execute(mockPeer, "XRANGE", makeCommand("XRANGE", "s", "-", "+"))
+	if entryIDs(res) != id {
+		t.Errorf("replayed stream holds %q, want %q", entryIDs(res), id)
+	}
+}
+
+// groupRead returns the IDs delivered by XREADGROUP from a single stream
+func groupRead(t *testing.T, e *Engine, args ...string) string {
+	t.Helper()
+
+	res := e.Execute(mockPeer, "XREADGROUP", makeCommand("XREADGROUP", args...))
+	if res.Type == resp.TypeError {
+		t.Fatalf("XREADGROUP %v: %s", args, res.String)
+	}
+	if res.IsNull {
+		return ""
+	}
+	return entryIDs(res.Array[0].Array[1])
+}
+
+func TestStreamConsumerGroups(t *testing.T) {
+	e := setupEngine()
+	for i := 1; i <= 5; i++ {
+		e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", strconv.Itoa(i)+"-0", "n", strconv.Itoa(i)))
+	}
+
+	if res := e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "CREATE", "s", "g", "0")); string(res.String) != "OK" {
+		t.Fatalf("XGROUP CREATE: unexpected reply %v", res)
+	}
+	if res := e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "CREATE", "s", "g", "$")); !strings.HasPrefix(string(res.String), "BUSYGROUP") {
+		t.Errorf("XGROUP CREATE of an existing group: expected BUSYGROUP, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "CREATE", "missing", "g", "$")); !strings.HasPrefix(string(res.String), "ERR The XGROUP subcommand requires the key to exist") {
+		t.Errorf("XGROUP CREATE without MKSTREAM: unexpected reply %v", res)
+	}
+
+	// every entry is delivered to one consumer only
+	if ids := groupRead(t, e, "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">"); ids != "1-0,2-0" {
+		t.Errorf("alice: expected 1-0,2-0, got %q", ids)
+	}
+	if ids := groupRead(t, e, "GROUP", "g", "bob", "COUNT", "2", "STREAMS", "s", ">"); ids != "3-0,4-0" {
+		t.Errorf("bob: expected 3-0,4-0, got %q", ids)
+	}
+	if ids := groupRead(t, e, "GROUP", "g", "alice", "STREAMS", "s", ">"); ids != "5-0" {
+		t.Errorf("alice: expected 5-0, got %q", ids)
+	}
+	if ids := groupRead(t, e, "GROUP", "g", "bob", "STREAMS", "s", ">"); ids != "" {
+		t.Errorf("bob: expected nothing new, got %q", ids)
+	}
+
+	res := e.Execute(mockPeer, "XPENDING", makeCommand("XPENDING", "s", "g"))
+	if len(res.Array) != 4 || res.Array[0].Integer != 5 || string(res.Array[1].String) != "1-0" || string(res.Array[2].String) != "5-0" {
+		t.Fatalf("XPENDING: unexpected summary %v", res)
+	}
+	if perConsumer := res.Array[3].Array; len(perConsumer) != 2 ||
+		string(perConsumer[0].Array[0].String) != "alice" || string(perConsumer[0].Array[1].String) != "3" ||
+		string(perConsumer[1].Array[0].String) != "bob" || string(perConsumer[1].Array[1].String) != "2" {
+		t.Errorf("XPENDING: unexpected consumers %v", res.Array[3])
+	}
+
+	if res := e.Execute(mockPeer, "XACK", makeCommand("XACK", "s", "g", "1-0", "2-0", "9-0")); res.Integer != 2 {
+		t.Errorf("XACK: expected 2, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "XACK", makeCommand("XACK", "s", "g", "1-0")); res.Integer != 0 {
+		t.Errorf("XACK of an acknowledged entry: expected 0, got %v", res)
+	}
+
+	// the history of a consumer holds its unacknowledged entries only
+	if ids := groupRead(t, e, "GROUP", "g", "alice", "STREAMS", "s", "0"); ids != "5-0" {
+		t.Errorf("alice history: expected 5-0, got %q", ids)
+	}
+	if ids := groupRead(t, e, "GROUP", "g", "bob", "STREAMS", "s", "3-0"); ids != "4-0" {
+		t.Errorf("bob history after 3-0: expected 4-0, got %q", ids)
+	}
+
+	// bob fails, his entries are claimed by alice once they are idle long enough
+	res = e.Execute(mockPeer, "XCLAIM", makeCommand("XCLAIM", "s", "g", "alice", "3600000", "3-0", "4-0"))
+	if res.Type != resp.TypeArray || len(res.Array) != 0 {
+		t.Errorf("XCLAIM of entries that are not idle: expected nothing, got %v", res)
+	}
+	time.Sleep(20 * time.Millisecond)
+	res = e.Execute(mockPeer, "XCLAIM", makeCommand("XCLAIM", "s", "g", "alice", "10", "3-0", "4-0", "7-0"))
+	if entryIDs(res) != "3-0,4-0" || string(res.Array[0].Array[1].Array[1].String) != "3" {
+		t.Errorf("XCLAIM: expected the entries 3-0 and 4-0, got %v", res)
+	}
+	if ids := groupRead(t, e, "GROUP", "g", "bob", "STREAMS", "s", "0"); ids != "" {
+		t.Errorf("bob history after XCLAIM: expected nothing, got %q", ids)
+	}
+
+	res = e.Execute(mockPeer, "XPENDING", makeCommand("XPENDING", "s", "g", "-", "+", "10", "alice"))
+	if len(res.Array) != 3 {
+		t.Fatalf("XPENDING extended: expected 3 entries, got %v", res)
+	}
+	// 3-0: delivered to bob and claimed by alice, bob's history read after 3-0 skipped it
+	if entry := res.Array[0].Array; string(entry[0].String) != "3-0" || string(entry[1].String) != "alice" || entry[3].Integer != 2 {
+		t.Errorf("XPENDING extended: unexpected entry %v", entry)
+	}
+
+	res = e.Execute(mockPeer, "XCLAIM", makeCommand("XCLAIM", "s", "g", "bob", "0", "5-0", "JUSTID", "RETRYCOUNT", "7"))
+	if len(res.Array) != 1 || string(res.Array[0].String) != "5-0" {
+		t.Errorf("XCLAIM JUSTID: expected 5-0, got %v", res)
+	}
+	res = e.Execute(mockPeer, "XPENDING", makeCommand("XPENDING", "s", "g", "IDLE", "0", "5", "5", "1"))
+	if len(res.Array) != 1 || string(res.Array[0].Array[1].String) != "bob" || res.Array[0].Array[3].Integer != 7 {
+		t.Errorf("XPENDING after RETRYCOUNT: unexpected reply %v", res)
+	}
+
+	for _, tt := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"XREADGROUP", "GROUP", "nope", "c", "STREAMS", "s", ">"}, "NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option"},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "s", "$"}, "ERR The $ ID is meaningless"},
+		{[]string{"XREADGROUP", "COUNT", "1", "COUNT", "2", "STREAMS", "s", ">"}, "ERR Missing GROUP option for XREADGROUP"},
+		{[]string{"XPENDING", "s", "nope"}, "NOGROUP No such key 's' or consumer group 'nope'"},
+		{[]string{"XCLAIM", "missing", "g", "c", "0", "1-0"}, "NOGROUP No such key 'missing' or consumer group 'g'"},
+		{[]string{"XCLAIM", "s", "g", "c", "0", "1-0", "LASTID", "1-0"}, "ERR Unrecognized XCLAIM option 'LASTID'"},
+		{[]string{"XGROUP", "BOGUS"}, "ERR unknown subcommand 'bogus'. Try XGROUP HELP."},
+	} {
+		res := e.Execute(mockPeer, tt.cmd[0], makeCommand(tt.cmd[0], tt.cmd[1:]...))
+		if !strings.HasPrefix(string(res.String), tt.want) {
+			t.Errorf("%v: expected %q, got %v", tt.cmd, tt.want, res)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "DESTROY", "s", "g")); res.Integer != 1 {
+		t.Errorf("XGROUP DESTROY: expected 1, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "DESTROY", "s", "g")); res.Integer != 0 {
+		t.Errorf("XGROUP DESTROY of a missing group: expected 0, got %v", res)
+	}
+}
+
+func TestXReadGroupBlock(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM"))
+
+	done := make(chan resp.Value)
+	go func() {
+		done <- e.Execute(NewPeer(nil), "XREADGROUP", makeCommand("XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", "s", ">"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", "1-0", "f", "v"))
+
+	select {
+	case res := <-done:
+		if len(res.Array) != 1 || entryIDs(res.Array[0].Array[1]) != "1-0" {
+			t.Errorf("XREADGROUP BLOCK: expected 1-0, got %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREADGROUP BLOCK was not woken by XADD")
+	}
+
+	// a history read never blocks
+	res := e.Execute(mockPeer, "XREADGROUP", makeCommand("XREADGROUP", "GROUP", "g", "other", "BLOCK", "0", "STREAMS", "s", "0"))
+	if len(res.Array) != 1 || len(res.Array[0].Array[1].Array) != 0 {
+		t.Errorf("XREADGROUP history: expected an empty history, got %v", res)
+	}
+}
+
+func TestStreamConsumerGroupsAOF(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "XGROUP", makeCommand("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM"))
+	for i := 1; i <= 4; i++ {
+		e.Execute(mockPeer, "XADD", makeCommand("XADD", "s", strconv.Itoa(i)+"-0", "f", "v"))
+	}
+	e.Execute(mockPeer, "XREADGROUP", makeCommand("XREADGROUP", "GROUP", "g", "a", "COUNT", "3", "STREAMS", "s", ">"))
+	e.Execute(mockPeer, "XACK", makeCommand("XACK", "s", "g", "1-0"))
+	e.Execute(mockPeer, "XCLAIM", makeCommand("XCLAIM", "s", "g", "b", "0", "3-0"))
+	e.Shutdown()
+
+	time.Sleep(200 * time.Millisecond)
+
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	res := e.Execute(mockPeer, "XPENDING", makeCommand("XPENDING", "s", "g", "-", "+", "10"))
+	var got []string
+	for _, entry := range res.Array {
+		got = append(got, string(entry.Array[0].String)+":"+string(entry.Array[1].String))
+	}
+	if strings.Join(got, ",") != "2-0:a,3-0:b" {
+		t.Errorf("replayed pending entries: expected 2-0:a,3-0:b, got %v", got)
+	}
+	if ids := groupRead(t, e, "GROUP", "g", "a", "STREAMS", "s", ">"); ids != "4-0" {
+		t.Errorf("replayed group must continue after 3-0, got %q", ids)
+	}
+}
@@ -1,15 +1,24 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/eternalApril/moonlight/internal/config"
 	"github.com/eternalApril/moonlight/internal/logger"
+	"github.com/eternalApril/moonlight/internal/persistence"
 	"github.com/eternalApril/moonlight/internal/resp"
 	"github.com/eternalApril/moonlight/internal/storage"
+	"github.com/eternalApril/moonlight/internal/version"
+	"go.uber.org/zap"
 )
 
 var (
@@ -43,6 +52,15 @@ func makeCommand(_ string, args ...string) []resp.Value {
 	return vals
 }
 
+// pairsToMap converts the flat array of fields and values of a RESP2 HGETALL reply
+func pairsToMap(res resp.Value) map[string]string {
+	m := make(map[string]string, len(res.Array)/2)
+	for i := 0; i+1 < len(res.Array); i += 2 {
+		m[string(res.Array[i].String)] = string(res.Array[i+1].String)
+	}
+	return m
+}
+
 func TestPing(t *testing.T) {
 	e := setupEngine()
 
@@ -144,6 +162,196 @@ func TestSetNX_XX(t *testing.T) {
 	}
 }
 
+func TestSetOverwritesAnyType(t *testing.T) {
+	e := setupEngine()
+
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v", "g", "v"))
+	e.Execute(mockPeer, "HEXPIRE", makeCommand("HEXPIRE", "h", "100", "FIELDS", "1", "f"))
+	e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "l", "a"))
+	e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "l", "100"))
+
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "h", "NX-value", "NX")); !res.IsNull {
+		t.Errorf("SET NX over a hash: expected nil, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "h", "string")); string(res.String) != "OK" {
+		t.Fatalf("SET over a hash: expected OK, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "h")); string(res.String) != "string" {
+		t.Errorf("GET after SET over a hash: expected string, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "TYPE", makeCommand("TYPE", "h")); string(res.String) != "string" {
+		t.Errorf("TYPE after SET over a hash: expected string, got %v", res)
+	}
+
+	// XX requires only that the key exists, KEEPTTL keeps the expiration of the list
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "l", "string", "XX", "KEEPTTL")); string(res.String) != "OK" {
+		t.Fatalf("SET XX KEEPTTL over a list: expected OK, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "TYPE", makeCommand("TYPE", "l")); string(res.String) != "string" {
+		t.Errorf("TYPE after SET over a list: expected string, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "l")); res.Integer <= 0 {
+		t.Errorf("TTL after SET KEEPTTL over a list: expected a TTL, got %v", res)
+	}
+}
+
+// TestSetNilOnlyOnCondition is a regression test: SET over a hash used to reply nil like a failed NX
+func TestSetNilOnlyOnCondition(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+		args  []string
+		isNil bool
+	}{
+		{"plain over a hash", []string{"HSET", "k", "f", "v"}, []string{"k", "v"}, false},
+		{"plain over a list", []string{"RPUSH", "k", "a"}, []string{"k", "v"}, false},
+		{"plain over a stream", []string{"XADD", "k", "1-0", "f", "v"}, []string{"k", "v"}, false},
+		{"XX over a hash", []string{"HSET", "k", "f", "v"}, []string{"k", "v", "XX"}, false},
+		{"NX over a hash", []string{"HSET", "k", "f", "v"}, []string{"k", "v", "NX"}, true},
+		{"NX over a string", []string{"SET", "k", "old"}, []string{"k", "v", "NX"}, true},
+		{"XX over a missing key", nil, []string{"k", "v", "XX"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := setupEngine()
+			if tt.setup != nil {
+				e.Execute(mockPeer, tt.setup[0], makeCommand(tt.setup[0], tt.setup[1:]...))
+			}
+
+			res := e.Execute(mockPeer, "SET", makeCommand("SET", tt.args...))
+			if tt.isNil {
+				if !res.IsNull {
+					t.Errorf("expected nil, got %v", res)
+				}
+				return
+			}
+			if res.Type != resp.TypeSimpleString || string(res.String) != "OK" {
+				t.Fatalf("expected OK, got %v", res)
+			}
+			if res := e.Execute(mockPeer, "GET", makeCommand("GET", "k")); string(res.String) != "v" {
+				t.Errorf("GET: expected v, got %v", res)
+			}
+		})
+	}
+}
+
+func TestTTLReplies(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "persistent", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "volatile", "v", "EX", "100"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "short", "v", "PX", "1800"))
+
+	tests := []struct {
+		name     string
+		cmd      string
+		key      string
+		min, max int64
+	}{
+		{"TTL missing", "TTL", "missing", -2, -2},
+		{"TTL no timeout", "TTL", "persistent", -1, -1},
+		{"TTL active", "TTL", "volatile", 100, 100},
+		{"TTL active is rounded", "TTL", "short", 2, 2},
+		{"PTTL missing", "PTTL", "missing", -2, -2},
+		{"PTTL no timeout", "PTTL", "persistent", -1, -1},
+		{"PTTL active", "PTTL", "volatile", 99_000, 100_000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := e.Execute(mockPeer, tt.cmd, makeCommand(tt.cmd, tt.key))
+			if res.Type != resp.TypeInteger || res.Integer < tt.min || res.Integer > tt.max {
+				t.Errorf("got %v, want [%d, %d]", res, tt.min, tt.max)
+			}
+		})
+	}
+
+	// the wire codes must not follow a renumbering of storage.ExpiryStatus
+	if ttlNotFound != -2 || ttlNoTimeout != -1 {
+		t.Errorf("TTL wire codes changed: %d %d", ttlNotFound, ttlNoTimeout)
+	}
+}
+
+func TestExpireOverflow(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+
+	// 9300000000 seconds is in 2264, past the last Unix nanosecond an int64 holds
+	overflowing := [][]string{
+		{"SET", "k", "v", "EXAT", "9300000000"},
+		{"SET", "k", "v", "PXAT", "9300000000000"},
+		{"SET", "k", "v", "EX", "9223372036854775807"},
+		{"SET", "k", "v", "PX", "9223372036854775"},
+		{"GETEX", "k", "EXAT", "9300000000"},
+		{"GETEX", "k", "PX", "9223372036854775807"},
+		{"EXPIRE", "k", "9223372036854775807"},
+		{"EXPIRE", "k", "-9223372036854775807"},
+		{"PEXPIRE", "k", "9223372036854775"},
+		{"EXPIREAT", "k", "9300000000"},
+		{"PEXPIREAT", "k", "9300000000000"},
+		{"HSETEX", "h", "9223372036854775807", "FIELDS", "1", "f", "v"},
+		{"HEXPIRE", "h", "9223372036854775807", "FIELDS", "1", "f"},
+	}
+
+	for _, args := range overflowing {
+		res := e.Execute(mockPeer, args[0], makeCommand(args[0], args[1:]...))
+		if res.Type != resp.TypeError || !strings.Contains(string(res.String), "invalid expire time") {
+			t.Errorf("%v: expected an invalid expire time error, got %v", args, res)
+		}
+	}
+
+	dump := e.Execute(mockPeer, "DUMP", makeCommand("DUMP", "k"))
+	res := e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "k2", "9300000000000", string(dump.String), "ABSTTL"))
+	if res.Type != resp.TypeError || !strings.Contains(string(res.String), "invalid expire time") {
+		t.Errorf("RESTORE ABSTTL: expected an invalid expire time error, got %v", res)
+	}
+
+	// the failed commands must not have touched the keys
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "k")); res.Integer != -1 {
+		t.Errorf("TTL of k: expected -1, got %d", res.Integer)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f")); string(res.String) != "v" {
+		t.Errorf("HGET h f: expected v, got %v", res)
+	}
+
+	// 9000000000 seconds is in 2255 and still fits
+	if res := e.Execute(mockPeer, "EXPIREAT", makeCommand("EXPIREAT", "k", "9000000000")); res.Integer != 1 {
+		t.Fatalf("EXPIREAT in 2255: expected 1, got %v", res)
+	}
+	want := 9000000000 - time.Now().Unix()
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "k")); res.Integer < want-1 || res.Integer > want+1 {
+		t.Errorf("TTL after EXPIREAT in 2255: expected ~%d, got %d", want, res.Integer)
+	}
+}
+
+func TestTTLMatchesPTTL(t *testing.T) {
+	durations := []time.Duration{
+		999 * time.Millisecond,
+		1499*time.Millisecond + 600*time.Microsecond, // rounds to 1500ms, so 2s and not 1s
+		1499*time.Millisecond + 400*time.Microsecond,
+		1500 * time.Millisecond,
+		2500 * time.Millisecond,
+		100*time.Second + 250*time.Millisecond,
+	}
+
+	for _, d := range durations {
+		ms := roundTTL(d, time.Millisecond)
+		if seconds := roundTTL(d, time.Second); seconds != (ms+500)/1000 {
+			t.Errorf("%v: TTL %d does not match PTTL %d", d, seconds, ms)
+		}
+	}
+
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v", "PX", "100250"))
+
+	seconds := e.Execute(mockPeer, "TTL", makeCommand("TTL", "k")).Integer
+	ms := e.Execute(mockPeer, "PTTL", makeCommand("PTTL", "k")).Integer
+	if seconds != (ms+500)/1000 {
+		t.Errorf("TTL %d does not match PTTL %d", seconds, ms)
+	}
+}
+
 func TestSetTTL(t *testing.T) {
 	e := setupEngine()
 
@@ -300,3 +508,2046 @@ func TestSetSyntaxErrors(t *testing.T) {
 		})
 	}
 }
+
+// setupAOFEngine creates an engine that persists write commands to the given AOF file
+func setupAOFEngine(t *testing.T, filename string) *Engine {
+	t.Helper()
+
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	eng, err := NewEngine(s, &config.Config{
+		GC: config.GCConfig{Enabled: false},
+		Persistence: config.PersistenceConfig{
+			AOF: config.AOFConfig{
+				Enabled:  true,
+				Filename: filename,
+				Fsync:    "always",
+			},
+		},
+	}, logger.New("debug", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	return eng
+}
+
+func TestExpire(t *testing.T) {
+	e := setupEngine()
+
+	// missing key -> 0
+	res := e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "missing", "10"))
+	if res.Integer != 0 {
+		t.Errorf("expected 0 for missing key, got %d", res.Integer)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	res = e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "k", "100"))
+	if res.Integer != 1 {
+		t.Errorf("expected 1, got %d", res.Integer)
+	}
+
+	pttl := e.Execute(mockPeer, "PTTL", makeCommand("PTTL", "k"))
+	if pttl.Integer <= 99_000 || pttl.Integer > 100_000 {
+		t.Errorf("expected PTTL ~100000ms, got %d", pttl.Integer)
+	}
+
+	// timestamp in the past deletes the key
+	res = e.Execute(mockPeer, "PEXPIREAT", makeCommand("PEXPIREAT", "k", "1"))
+	if res.Integer != 1 {
+		t.Errorf("expected 1, got %d", res.Integer)
+	}
+
+	res = e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	if res.IsNull != true {
+		t.Errorf("key should have expired")
+	}
+
+	res = e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "k", "abc"))
+	if res.Type != resp.TypeError {
+		t.Errorf("expected error for non-integer seconds, got %v", res.Type)
+	}
+}
+
+func TestAOFRelativeExpiryRewrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k_set", "v", "EX", "100"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k_expire", "v"))
+	e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "k_expire", "100"))
+	payload := e.Execute(mockPeer, "DUMP", makeCommand("DUMP", "k_expire"))
+	e.Execute(mockPeer, "RESTORE", makeCommand("RESTORE", "k_restore", "100000", string(payload.String)))
+	e.Shutdown()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// restart from the AOF
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	for _, key := range []string{"k_set", "k_expire", "k_restore"} {
+		pttl := e.Execute(mockPeer, "PTTL", makeCommand("PTTL", key))
+		if pttl.Integer <= 0 || pttl.Integer > 99_850 {
+			t.Errorf("%s: TTL was reset on replay, got PTTL %d", key, pttl.Integer)
+		}
+	}
+}
+
+func TestAOFSetRelativeTTLRegression(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k_ex", "v", "EX", "100"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k_px", "v", "PX", "100000"))
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+
+	// relative TTL must never reach the AOF
+	if strings.Contains(string(data), "$2\r\nEX\r\n") || strings.Contains(string(data), "$2\r\nPX\r\n") {
+		t.Errorf("AOF contains relative TTL: %q", data)
+	}
+	if !strings.Contains(string(data), "$4\r\nPXAT\r\n") {
+		t.Errorf("AOF does not contain PXAT: %q", data)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	for _, key := range []string{"k_ex", "k_px"} {
+		pttl := e.Execute(mockPeer, "PTTL", makeCommand("PTTL", key))
+		if pttl.Integer <= 0 || pttl.Integer > 99_850 {
+			t.Errorf("%s: TTL was reset on replay, got PTTL %d", key, pttl.Integer)
+		}
+	}
+}
+
+func TestAOFExpireMissingKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	e := setupAOFEngine(t, filename)
+
+	peer := NewPeer(nil)
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "missing"))
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "other", "v"))
+
+	for _, name := range []string{"EXPIRE", "PEXPIRE"} {
+		if res := e.Execute(mockPeer, name, makeCommand(name, "missing", "100")); res.Integer != 0 {
+			t.Errorf("%s of a missing key: expected 0, got %v", name, res)
+		}
+	}
+
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); res.IsNull {
+		t.Errorf("an EXPIRE that changed nothing invalidated the watch")
+	}
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	if strings.Contains(string(data), "PEXPIREAT") {
+		t.Errorf("an EXPIRE that changed nothing reached the AOF: %q", data)
+	}
+}
+
+func TestAOFRelativeExpireUsesStoredDeadline(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "k", "100"))
+
+	remaining, _ := (*e.storage).RemainingTTL("k")
+	stored := time.Now().Add(remaining).UnixMilli()
+
+	// a stale now must not move the deadline written to the AOF
+	ctx := &context{args: makeCommand("", "k", "100"), storage: e.storage, peer: mockPeer}
+	name, args := rewriteForAOF("EXPIRE", ctx, time.Now().Add(-time.Hour))
+	if name != "PEXPIREAT" {
+		t.Fatalf("expected PEXPIREAT, got %s", name)
+	}
+
+	deadline, err := strconv.ParseInt(string(args[1].String), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid deadline %q: %v", args[1].String, err)
+	}
+	if diff := deadline - stored; diff < -50 || diff > 50 {
+		t.Errorf("expected deadline ~%d, got %d", stored, deadline)
+	}
+}
+
+func TestAOFPropagatesWriteFlag(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f1", "v1", "f2", "v2"))
+	e.Execute(mockPeer, "HDEL", makeCommand("HDEL", "h", "f2"))
+	e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f1"))
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+
+	for _, name := range []string{"HSET", "HDEL"} {
+		if !isWriteCommand(name) {
+			t.Errorf("%s must be a write command", name)
+		}
+		if !strings.Contains(string(data), "\r\n"+name+"\r\n") {
+			t.Errorf("%s is missing from the AOF: %q", name, data)
+		}
+	}
+	if strings.Contains(string(data), "HGET\r\n") {
+		t.Errorf("read command was appended to the AOF: %q", data)
+	}
+}
+
+func TestAOFHashSurvivesRestart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f1", "v1", "f2", "v2", "f3", "v3"))
+	e.Execute(mockPeer, "HDEL", makeCommand("HDEL", "h", "f3"))
+	e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "h", "100", "FIELDS", "1", "f4", "v4"))
+	e.Execute(mockPeer, "HEXPIRE", makeCommand("HEXPIRE", "h", "100", "FIELDS", "1", "f2"))
+	e.Execute(mockPeer, "EXPIRE", makeCommand("EXPIRE", "h", "100"))
+	e.Shutdown()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// restart from the AOF
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	res := e.Execute(mockPeer, "HGETALL", makeCommand("HGETALL", "h"))
+	want := map[string]string{"f1": "v1", "f2": "v2", "f4": "v4"}
+	got := pairsToMap(res)
+	if len(got) != len(want) {
+		t.Fatalf("expected %v after restart, got %v", want, got)
+	}
+	for field, value := range want {
+		if got := got[field]; got != value {
+			t.Errorf("%s: expected %q, got %q", field, value, got)
+		}
+	}
+
+	if ttl := e.Execute(mockPeer, "TTL", makeCommand("TTL", "h")); ttl.Integer <= 0 {
+		t.Errorf("expected the key TTL to survive the restart, got %d", ttl.Integer)
+	}
+
+	// the field TTLs keep their deadlines instead of restarting on replay
+	res = e.Execute(mockPeer, "HPTTL", makeCommand("HPTTL", "h", "FIELDS", "3", "f1", "f2", "f4"))
+	if len(res.Array) != 3 || res.Array[0].Integer != -1 {
+		t.Fatalf("HPTTL after restart: unexpected reply %v", res)
+	}
+	for i, field := range []string{"f2", "f4"} {
+		if pttl := res.Array[i+1].Integer; pttl <= 0 || pttl > 99_850 {
+			t.Errorf("%s: field TTL was reset on replay, got HPTTL %d", field, pttl)
+		}
+	}
+}
+
+func TestAOFHashFieldTTLRewrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "h", "100", "FIELDS", "1", "f1", "v1"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f2", "v2"))
+	e.Execute(mockPeer, "HEXPIRE", makeCommand("HEXPIRE", "h", "100", "NX", "FIELDS", "1", "f2"))
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+
+	// relative field TTLs must never reach the AOF
+	if strings.Contains(string(data), "$3\r\n100\r\n") || strings.Contains(string(data), "HEXPIRE\r\n") {
+		t.Errorf("AOF contains a relative field TTL: %q", data)
+	}
+	if !strings.Contains(string(data), "$4\r\nPXAT\r\n") || !strings.Contains(string(data), "HPEXPIREAT\r\n") {
+		t.Errorf("AOF does not contain the absolute deadlines: %q", data)
+	}
+	if !strings.Contains(string(data), "$2\r\nNX\r\n") {
+		t.Errorf("the HEXPIRE condition was dropped: %q", data)
+	}
+}
+
+func TestAOFHSetExCondition(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f1", "v1"))
+
+	// blocked writes
+	if res := e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "h", "FNX", "100", "FIELDS", "2", "f1", "x", "f2", "x")); res.Integer != 0 {
+		t.Errorf("HSETEX FNX with an existing field: expected 0, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "h", "FXX", "100", "FIELDS", "2", "f1", "x", "f2", "x")); res.Integer != 0 {
+		t.Errorf("HSETEX FXX with a missing field: expected 0, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f1")); string(res.String) != "v1" {
+		t.Errorf("a blocked HSETEX changed the hash, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "h", "FXX", "100", "FIELDS", "1", "f1", "v2")); res.Integer != 1 {
+		t.Errorf("HSETEX FXX with an existing field: expected 1, got %v", res)
+	}
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	if n := strings.Count(string(data), "HSETEX"); n != 1 {
+		t.Errorf("expected only the HSETEX that set a field in the AOF, got %d: %q", n, data)
+	}
+	if !strings.Contains(string(data), "$3\r\nFXX\r\n$4\r\nPXAT\r\n") {
+		t.Errorf("the HSETEX condition was dropped: %q", data)
+	}
+
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f1")); string(res.String) != "v2" {
+		t.Errorf("after replay: expected v2, got %v", res)
+	}
+}
+
+func TestHPExpireAt(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f1", "v1", "f2", "v2"))
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	res := e.Execute(mockPeer, "HPEXPIREAT", makeCommand("HPEXPIREAT", "h", future, "FIELDS", "2", "f1", "missing"))
+	if len(res.Array) != 2 || res.Array[0].Integer != 1 || res.Array[1].Integer != -2 {
+		t.Errorf("HPEXPIREAT: unexpected reply %v", res)
+	}
+
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	e.Execute(mockPeer, "HPEXPIREAT", makeCommand("HPEXPIREAT", "h", past, "FIELDS", "1", "f2"))
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f2")); !res.IsNull {
+		t.Errorf("a deadline in the past must expire the field, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f1")); string(res.String) != "v1" {
+		t.Errorf("a deadline in the future must keep the field, got %v", res)
+	}
+
+	e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "p", "PXAT", future, "FIELDS", "1", "f", "v"))
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "p", "f")); string(res.String) != "v" {
+		t.Errorf("HSETEX PXAT: expected v, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "p", "PXAT", "0", "FIELDS", "1", "f", "v")); res.Type != resp.TypeError {
+		t.Errorf("HSETEX PXAT 0: expected an error, got %v", res)
+	}
+}
+
+func TestAOFGetDelGetEx(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "SET", makeCommand("SET", "del", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "read", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "ex", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "persist", "v", "EX", "100"))
+
+	if res := e.Execute(mockPeer, "GETDEL", makeCommand("GETDEL", "del")); string(res.String) != "v" {
+		t.Errorf("GETDEL: expected v, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "GETDEL", makeCommand("GETDEL", "missing")); !res.IsNull {
+		t.Errorf("GETDEL on a missing key: expected nil, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "GETEX", makeCommand("GETEX", "read")); string(res.String) != "v" {
+		t.Errorf("GETEX: expected v, got %v", res)
+	}
+	e.Execute(mockPeer, "GETEX", makeCommand("GETEX", "ex", "EX", "100"))
+	e.Execute(mockPeer, "GETEX", makeCommand("GETEX", "persist", "PERSIST"))
+	e.Execute(mockPeer, "GETEX", makeCommand("GETEX", "missing", "EX", "100"))
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	aof := string(data)
+
+	for _, want := range []string{
+		"*2\r\n$3\r\nDEL\r\n$3\r\ndel\r\n",
+		"*3\r\n$9\r\nPEXPIREAT\r\n$2\r\nex\r\n",
+		"*2\r\n$7\r\nPERSIST\r\n$7\r\npersist\r\n",
+	} {
+		if !strings.Contains(aof, want) {
+			t.Errorf("AOF is missing %q: %q", want, aof)
+		}
+	}
+	for _, unwanted := range []string{"GETDEL", "GETEX", "missing"} {
+		if strings.Contains(aof, unwanted) {
+			t.Errorf("AOF must not contain %q: %q", unwanted, aof)
+		}
+	}
+
+	// restart from the AOF
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "del")); res.Integer != 0 {
+		t.Errorf("GETDEL key survived the restart")
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "ex")); res.Integer <= 0 || res.Integer > 100 {
+		t.Errorf("expected the GETEX TTL after restart, got %d", res.Integer)
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "persist")); res.Integer != -1 {
+		t.Errorf("expected no TTL after GETEX PERSIST and restart, got %d", res.Integer)
+	}
+}
+
+func TestGetEx(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	for _, args := range [][]string{
+		{"k", "EX", "0"},
+		{"k", "PX", "-1"},
+		{"k", "EX", "abc"},
+		{"k", "FOO", "1"},
+		{"k", "PERSIST", "EX", "1"},
+	} {
+		if res := e.Execute(mockPeer, "GETEX", makeCommand("GETEX", args...)); res.Type != resp.TypeError {
+			t.Errorf("GETEX %v: expected error, got %v", args, res)
+		}
+	}
+
+	res := e.Execute(mockPeer, "GETEX", makeCommand("GETEX", "k", "PX", "100000"))
+	if string(res.String) != "v" {
+		t.Fatalf("expected v, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "PTTL", makeCommand("PTTL", "k")); res.Integer <= 0 {
+		t.Errorf("expected a TTL after GETEX PX, got %d", res.Integer)
+	}
+
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	if res := e.Execute(mockPeer, "GETEX", makeCommand("GETEX", "k", "PXAT", past)); string(res.String) != "v" {
+		t.Errorf("expected v, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "k")); res.Integer != 0 {
+		t.Errorf("key must be deleted by a past GETEX deadline")
+	}
+
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+	for _, name := range []string{"GETDEL", "GETEX"} {
+		if res := e.Execute(mockPeer, name, makeCommand(name, "h")); res.Type != resp.TypeError {
+			t.Errorf("%s against a hash: expected WRONGTYPE, got %v", name, res)
+		}
+	}
+}
+
+func TestAOFIncrByFloatPropagatesValue(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	e.Execute(mockPeer, "SET", makeCommand("SET", "f", "10.5", "EX", "100"))
+	if res := e.Execute(mockPeer, "INCRBYFLOAT", makeCommand("INCRBYFLOAT", "f", "0.1")); string(res.String) != "10.6" {
+		t.Fatalf("expected 10.6, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "INCRBYFLOAT", makeCommand("INCRBYFLOAT", "f", "5.0e3")); string(res.String) != "5010.6" {
+		t.Fatalf("expected 5010.6, got %v", res)
+	}
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	if strings.Contains(string(data), "INCRBYFLOAT") {
+		t.Errorf("INCRBYFLOAT must be propagated as SET: %q", data)
+	}
+	if !strings.Contains(string(data), "$6\r\n5010.6\r\n$7\r\nKEEPTTL\r\n") {
+		t.Errorf("AOF is missing the computed value: %q", data)
+	}
+
+	// replaying the AOF restores the exact value and keeps the TTL
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "f")); string(res.String) != "5010.6" {
+		t.Errorf("expected 5010.6 after restart, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "f")); res.Integer <= 0 {
+		t.Errorf("expected the TTL to survive the restart, got %d", res.Integer)
+	}
+}
+
+func TestIncrByFloat(t *testing.T) {
+	e := setupEngine()
+
+	if res := e.Execute(mockPeer, "INCRBYFLOAT", makeCommand("INCRBYFLOAT", "new", "-1.5")); string(res.String) != "-1.5" {
+		t.Errorf("expected -1.5 for a missing key, got %v", res)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "str", "abc"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "empty", ""))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "big", "1.7e308"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"str", "1"}, "ERR value is not a valid float"},
+		{[]string{"empty", "1"}, "ERR value is not a valid float"},
+		{[]string{"new", "abc"}, "ERR value is not a valid float"},
+		{[]string{"new", "inf"}, "ERR value is not a valid float"},
+		{[]string{"big", "1.7e308"}, "ERR increment would produce NaN or Infinity"},
+		{[]string{"h", "1"}, "WRONGTYPE"},
+	}
+	for _, tt := range tests {
+		res := e.Execute(mockPeer, "INCRBYFLOAT", makeCommand("INCRBYFLOAT", tt.args...))
+		if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), tt.want) {
+			t.Errorf("INCRBYFLOAT %v: expected %q, got %v", tt.args, tt.want, res)
+		}
+	}
+}
+
+func TestAOFMultiCommandPropagation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	// a handler persisting its effect as several commands, like a pop of random members would
+	commandRegistry["TESTEFFECT"] = commandMetadata{2, []string{"write"}, 1, 1, 1}
+	defer delete(commandRegistry, "TESTEFFECT")
+	e.register("TESTEFFECT", commandFunc(func(ctx *context) resp.Value {
+		ctx.propagate("SET", ctx.args[0], resp.MakeBulkString("1"))
+		ctx.propagate("PERSIST", ctx.args[0])
+		return resp.MakeSimpleString("OK")
+	}))
+	e.Execute(mockPeer, "TESTEFFECT", makeCommand("TESTEFFECT", "k"))
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	want := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\n1\r\n*2\r\n$7\r\nPERSIST\r\n$1\r\nk\r\n"
+	if string(data) != want {
+		t.Errorf("expected AOF %q, got %q", want, data)
+	}
+}
+
+func TestPersistenceDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data", "moonlight")
+	cfg := &config.Config{
+		GC: config.GCConfig{Enabled: false},
+		Persistence: config.PersistenceConfig{
+			Dir: dir,
+			AOF: config.AOFConfig{Enabled: true, Filename: "appendonly.aof", Fsync: "always"},
+			RDB: config.RDBConfig{Enabled: true, Filename: "dump.rdb"},
+		},
+	}
+
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	e, err := NewEngine(s, cfg, logger.New("debug", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	e.Execute(mockPeer, "SAVE", makeCommand("SAVE"))
+	e.Shutdown()
+
+	for _, name := range []string{"appendonly.aof", "dump.rdb"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s is not in the persistence dir: %v", name, err)
+		}
+	}
+
+	// a regular file cannot be used as the directory, the engine must not start
+	file := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	cfg.Persistence.Dir = file
+
+	s, _ = storage.NewShardedMapStorage(1) //nolint:errcheck
+	if _, err := NewEngine(s, cfg, logger.New("debug", "console")); err == nil {
+		t.Error("expected an error for an unusable persistence dir")
+	}
+}
+
+func TestReloadRDBInterval(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		GC: config.GCConfig{Enabled: false},
+		Persistence: config.PersistenceConfig{
+			Dir: dir,
+			RDB: config.RDBConfig{Enabled: true, Filename: "dump.rdb"},
+		},
+	}
+
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	e, err := NewEngine(s, cfg, logger.New("debug", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	defer e.Shutdown()
+
+	reloaded := *cfg
+	reloaded.Persistence.RDB.Interval = "20ms"
+	reloaded.Server.Port = "7000" // needs a restart, only logged
+	e.Reload(&reloaded)
+
+	dump := filepath.Join(dir, "dump.rdb")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(dump); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reloaded auto-save interval was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if e.cfg.Server.Port != "" {
+		t.Errorf("server.port must not change on reload, got %q", e.cfg.Server.Port)
+	}
+
+	if e.scheduleAutoSave("20ms") {
+		t.Error("the loop must not restart when the interval is unchanged")
+	}
+}
+
+func TestAppendSetRange(t *testing.T) {
+	e := setupEngine()
+	(*e.storage).(*storage.ShardedMapStorage).SetMaxStringLen(8)
+
+	tests := []struct {
+		cmd     string
+		args    []string
+		want    int64
+		wantErr string
+	}{
+		{"APPEND", []string{"k", "hello"}, 5, ""},
+		{"APPEND", []string{"k", "!!!"}, 8, ""},
+		{"APPEND", []string{"k", "?"}, 0, "ERR string exceeds maximum allowed size"},
+		{"SETRANGE", []string{"k", "0", "J"}, 8, ""},
+		{"SETRANGE", []string{"k", "7", "xy"}, 0, "ERR string exceeds maximum allowed size"},
+		{"SETRANGE", []string{"k", "-1", "x"}, 0, "ERR offset is out of range"},
+		{"SETRANGE", []string{"k", "9223372036854775807", "x"}, 0, "ERR string exceeds maximum allowed size"},
+		{"SETRANGE", []string{"k", "x", "x"}, 0, "ERR value is not an integer or out of range"},
+		{"SETRANGE", []string{"k", "9223372036854775807", ""}, 8, ""},
+		{"SET", []string{"k", "123456789"}, 0, "ERR string exceeds maximum allowed size"},
+	}
+
+	for _, tt := range tests {
+		res := e.Execute(mockPeer, tt.cmd, makeCommand(tt.cmd, tt.args...))
+		if tt.wantErr != "" {
+			if res.Type != resp.TypeError || string(res.String) != tt.wantErr {
+				t.Errorf("%s %v: got %q, want error %q", tt.cmd, tt.args, res.String, tt.wantErr)
+			}
+			continue
+		}
+		if res.Integer != tt.want {
+			t.Errorf("%s %v: got %v, want %d", tt.cmd, tt.args, res, tt.want)
+		}
+	}
+
+	res := e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	if string(res.String) != "Jello!!!" {
+		t.Errorf("got %q, want Jello!!!", res.String)
+	}
+}
+
+func TestCopyErrors(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"k", "k"}, "ERR source and destination objects are the same"},
+		{[]string{"k", "k", "REPLACE"}, "ERR source and destination objects are the same"},
+		{[]string{"k", "dst", "BOGUS"}, "ERR syntax error"},
+	}
+	for _, tt := range tests {
+		res := e.Execute(mockPeer, "COPY", makeCommand("COPY", tt.args...))
+		if res.Type != resp.TypeError || string(res.String) != tt.want {
+			t.Errorf("COPY %v: got %v, want %q", tt.args, res, tt.want)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "COPY", makeCommand("COPY", "k", "dst")); res.Integer != 1 {
+		t.Errorf("COPY k dst: expected 1, got %v", res)
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	e := setupEngine()
+
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "hash", "f", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "str", "v"))
+
+	tests := []struct {
+		name string
+		cmd  string
+		args []string
+	}{
+		{"GET against hash", "GET", []string{"hash"}},
+		{"HSET against string", "HSET", []string{"str", "f", "v"}},
+		{"APPEND against hash", "APPEND", []string{"hash", "v"}},
+		{"HSETEX against string", "HSETEX", []string{"str", "10", "FIELDS", "1", "f", "v"}},
+		{"HGET against string", "HGET", []string{"str", "f"}},
+		{"HGETALL against string", "HGETALL", []string{"str"}},
+		{"HDEL against string", "HDEL", []string{"str", "f"}},
+		{"HEXISTS against string", "HEXISTS", []string{"str", "f"}},
+		{"HLEN against string", "HLEN", []string{"str"}},
+		{"HKEYS against string", "HKEYS", []string{"str"}},
+		{"HVALS against string", "HVALS", []string{"str"}},
+		{"HRANDFIELD against string", "HRANDFIELD", []string{"str"}},
+	}
+
+	want := string(resp.MakeErrorWrongType().String)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := e.Execute(mockPeer, tt.cmd, makeCommand(tt.cmd, tt.args...))
+			if res.Type != resp.TypeError || string(res.String) != want {
+				t.Errorf("got %q, want %q", res.String, want)
+			}
+		})
+	}
+}
+
+func TestHSetEx(t *testing.T) {
+	e := setupEngine()
+
+	res := e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", "h", "1", "FIELDS", "2", "f1", "v1", "f2", "v2"))
+	if res.Integer != 2 {
+		t.Fatalf("expected 2 fields set, got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f1"))
+	if string(res.String) != "v1" {
+		t.Errorf("expected v1, got %q", res.String)
+	}
+
+	// fields with a future TTL are visible to every reader
+	if res = e.Execute(mockPeer, "HLEN", makeCommand("HLEN", "h")); res.Integer != 2 {
+		t.Errorf("HLEN: expected 2, got %v", res)
+	}
+	if res = e.Execute(mockPeer, "HKEYS", makeCommand("HKEYS", "h")); len(res.Array) != 2 {
+		t.Errorf("HKEYS: expected 2 fields, got %v", res)
+	}
+	if res = e.Execute(mockPeer, "HVALS", makeCommand("HVALS", "h")); len(res.Array) != 2 {
+		t.Errorf("HVALS: expected 2 values, got %v", res)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	res = e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f2"))
+	if !res.IsNull {
+		t.Errorf("expected field to expire, got %q", res.String)
+	}
+	if res = e.Execute(mockPeer, "HLEN", makeCommand("HLEN", "h")); res.Integer != 0 {
+		t.Errorf("HLEN after expiry: expected 0, got %v", res)
+	}
+	if res = e.Execute(mockPeer, "HKEYS", makeCommand("HKEYS", "h")); len(res.Array) != 0 {
+		t.Errorf("HKEYS after expiry: expected no fields, got %v", res)
+	}
+
+	errCases := [][]string{
+		{"h", "0", "FIELDS", "1", "f", "v"},
+		{"h", "10", "FIELD", "1", "f", "v"},
+		{"h", "10", "FIELDS", "2", "f", "v"},
+	}
+	for _, args := range errCases {
+		res = e.Execute(mockPeer, "HSETEX", makeCommand("HSETEX", args...))
+		if res.Type != resp.TypeError {
+			t.Errorf("HSETEX %v: expected error, got %v", args, res)
+		}
+	}
+}
+
+func TestUnknownCommandError(t *testing.T) {
+	e := setupEngine()
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"No args", nil, "ERR unknown command 'NOPE', with args beginning with: "},
+		{"With args", []string{"arg1", "arg2"}, "ERR unknown command 'NOPE', with args beginning with: 'arg1' 'arg2' "},
+		{"Newlines", []string{"a\r\nb"}, "ERR unknown command 'NOPE', with args beginning with: 'a  b' "},
+		{"Long args", []string{strings.Repeat("x", 100), strings.Repeat("y", 100), "z"},
+			"ERR unknown command 'NOPE', with args beginning with: '" + strings.Repeat("x", 100) + "' '" +
+				strings.Repeat("y", 25) + "' "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := e.Execute(mockPeer, "NOPE", makeCommand("NOPE", tt.args...))
+			if res.Type != resp.TypeError || string(res.String) != tt.want {
+				t.Errorf("got %q, want %q", res.String, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Storage.ShardCount = 8
+
+	res := e.Execute(mockPeer, "INFO", makeCommand("INFO"))
+	if res.Type != resp.TypeBulkString {
+		t.Fatalf("expected bulk string, got %v", res.Type)
+	}
+	if !strings.Contains(string(res.String), "# Server\r\n") {
+		t.Errorf("missing Server section: %q", res.String)
+	}
+	if !strings.Contains(string(res.String), "storage_shards:8\r\n") {
+		t.Errorf("missing resolved shard count: %q", res.String)
+	}
+
+	res = e.Execute(mockPeer, "INFO", makeCommand("INFO", "unknown"))
+	if len(res.String) != 0 {
+		t.Errorf("expected empty reply for unknown section, got %q", res.String)
+	}
+}
+
+func TestInfoServerBuildInfo(t *testing.T) {
+	res := setupEngine().Execute(mockPeer, "INFO", makeCommand("INFO", "server"))
+
+	fields := []string{
+		"moonlight_version:" + version.Version + "\r\n",
+		"git_sha:" + version.GitSHA + "\r\n",
+		"build_date:" + version.BuildDate + "\r\n",
+		"go_version:" + runtime.Version() + "\r\n",
+		"os:" + runtime.GOOS + "\r\n",
+		"arch:" + runtime.GOARCH + "\r\n",
+		"process_id:",
+		"uptime_in_seconds:",
+	}
+	for _, field := range fields {
+		if !strings.Contains(string(res.String), field) {
+			t.Errorf("missing %q in %q", field, res.String)
+		}
+	}
+}
+
+func TestCommandStats(t *testing.T) {
+	e := setupEngine()
+
+	for range 3 {
+		e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	}
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	res := e.Execute(mockPeer, "INFO", makeCommand("INFO", "commandstats"))
+	if !strings.Contains(string(res.String), "cmdstat_get:calls=3,usec=") ||
+		!strings.Contains(string(res.String), "cmdstat_set:calls=1,") {
+		t.Errorf("unexpected Commandstats section: %q", res.String)
+	}
+	if strings.Contains(string(res.String), "cmdstat_del") {
+		t.Errorf("commands that were never called must be omitted: %q", res.String)
+	}
+
+	res = e.Execute(mockPeer, "INFO", makeCommand("INFO"))
+	if strings.Contains(string(res.String), "# Commandstats") {
+		t.Error("Commandstats must not be part of the default sections")
+	}
+
+	e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+
+	res = e.Execute(mockPeer, "COMMAND", makeCommand("COMMAND", "STATS"))
+	if res.Type != resp.TypeArray {
+		t.Fatalf("expected array, got %v", res)
+	}
+	for i := 0; i < len(res.Array); i += 2 {
+		if string(res.Array[i].String) != "get" {
+			continue
+		}
+		usage := res.Array[i+1].Array
+		if string(usage[0].String) != "calls" || usage[1].Integer != 4 {
+			t.Errorf("expected 4 GET calls, got %v", usage)
+		}
+		return
+	}
+	t.Errorf("get is missing from COMMAND STATS: %v", res)
+}
+
+func TestCommandRegistryComplete(t *testing.T) {
+	e := setupEngine()
+
+	for name := range e.commands {
+		if _, ok := commandRegistry[name]; !ok {
+			t.Errorf("%s is missing from commandRegistry", name)
+		}
+		if _, ok := commandDocsRegistry[name]; !ok {
+			t.Errorf("%s is missing from commandDocsRegistry", name)
+		}
+	}
+}
+
+func TestCommandSubcommands(t *testing.T) {
+	e := setupEngine()
+	command := func(args ...string) resp.Value {
+		return e.Execute(mockPeer, "COMMAND", makeCommand("COMMAND", args...))
+	}
+
+	if res := command(); res.Type != resp.TypeArray || len(res.Array) != len(commandRegistry) {
+		t.Errorf("COMMAND: expected %d entries, got %v", len(commandRegistry), res)
+	}
+
+	if res := command("COUNT"); res.Integer != int64(len(commandRegistry)) {
+		t.Errorf("COMMAND COUNT: expected %d, got %v", len(commandRegistry), res)
+	}
+	if res := command("count", "extra"); res.Type != resp.TypeError {
+		t.Errorf("COMMAND COUNT extra: expected an error, got %v", res)
+	}
+
+	res := command("LIST")
+	names := make(map[string]bool)
+	for _, name := range res.Array {
+		names[string(name.String)] = true
+	}
+	if len(res.Array) != len(commandRegistry) || !names["get"] || !names["hrandfield"] {
+		t.Errorf("COMMAND LIST: unexpected reply %v", res)
+	}
+
+	res = command("INFO", "get", "nosuchcommand")
+	if len(res.Array) != 2 || string(res.Array[0].Array[0].String) != "GET" || res.Array[0].Array[1].Integer != 2 {
+		t.Fatalf("COMMAND INFO: unexpected reply %v", res)
+	}
+	if res.Array[1].Type != resp.TypeArray || !res.Array[1].IsNull {
+		t.Errorf("COMMAND INFO of an unknown command: expected nil, got %v", res.Array[1])
+	}
+
+	if res := command("DOCS", "GET"); res.Type == resp.TypeSimpleString || len(res.Array) != 2 {
+		t.Errorf("COMMAND DOCS: unexpected reply %v", res)
+	}
+
+	res = command("GETKEYS", "COPY", "src", "dst", "REPLACE")
+	if len(res.Array) != 2 || string(res.Array[0].String) != "src" || string(res.Array[1].String) != "dst" {
+		t.Errorf("COMMAND GETKEYS COPY: unexpected reply %v", res)
+	}
+	res = command("GETKEYS", "DEL", "a", "b", "c")
+	if len(res.Array) != 3 {
+		t.Errorf("COMMAND GETKEYS DEL: unexpected reply %v", res)
+	}
+	res = command("GETKEYS", "WATCH", "a", "b")
+	if len(res.Array) != 2 || string(res.Array[1].String) != "b" {
+		t.Errorf("COMMAND GETKEYS WATCH: unexpected reply %v", res)
+	}
+	for _, name := range []string{"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH"} {
+		if res := command("INFO", name); len(res.Array) != 1 || res.Array[0].IsNull {
+			t.Errorf("COMMAND INFO %s: unexpected reply %v", name, res)
+		}
+	}
+	getKeysErrors := [][]string{
+		{"GETKEYS", "NOSUCHCOMMAND", "k"},
+		{"GETKEYS", "GET"},
+		{"GETKEYS", "PING"},
+		{"GETKEYS"},
+	}
+	for _, args := range getKeysErrors {
+		if res := command(args...); res.Type != resp.TypeError {
+			t.Errorf("COMMAND %v: expected an error, got %v", args, res)
+		}
+	}
+
+	if res := command("STATS"); res.Type != resp.TypeArray {
+		t.Errorf("COMMAND STATS: unexpected reply %v", res)
+	}
+
+	res = command("BOGUS")
+	if res.Type != resp.TypeError || string(res.String) != "ERR unknown subcommand 'bogus'. Try COMMAND HELP." {
+		t.Errorf("unknown subcommand: unexpected reply %v", res)
+	}
+}
+
+func TestKeyspaceHitsMisses(t *testing.T) {
+	e := setupEngine()
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+
+	e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	e.Execute(mockPeer, "GET", makeCommand("GET", "missing"))
+	e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f"))
+	e.Execute(mockPeer, "HGETALL", makeCommand("HGETALL", "missing"))
+
+	res := e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats"))
+	for _, field := range []string{"keyspace_hits:3\r\n", "keyspace_misses:2\r\n"} {
+		if !strings.Contains(string(res.String), field) {
+			t.Errorf("missing %q in %q", field, res.String)
+		}
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	res := e.Execute(mockPeer, "CONFIG", makeCommand("CONFIG", "SET", "read-only", "yes"))
+	if string(res.String) != "OK" {
+		t.Fatalf("CONFIG SET read-only yes: got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "SET", makeCommand("SET", "k", "other"))
+	if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "READONLY") {
+		t.Errorf("expected READONLY error for SET, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v")); res.Type != resp.TypeError {
+		t.Errorf("expected READONLY error for HSET, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "k")); string(res.String) != "v" {
+		t.Errorf("GET must work in read-only mode, got %v", res)
+	}
+
+	// a write queued in a transaction aborts the EXEC
+	peer := NewPeer(nil)
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "tx"))
+	res = e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "EXECABORT") {
+		t.Errorf("expected EXECABORT, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "CONFIG", makeCommand("CONFIG", "SET", "read-only", "maybe")); res.Type != resp.TypeError {
+		t.Errorf("expected error for an invalid value, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "CONFIG", makeCommand("CONFIG", "SET", "nope", "1")); res.Type != resp.TypeError {
+		t.Errorf("expected error for an unknown parameter, got %v", res)
+	}
+
+	e.Execute(mockPeer, "CONFIG", makeCommand("CONFIG", "SET", "read-only", "no"))
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "k", "other")); string(res.String) != "OK" {
+		t.Errorf("SET must work after leaving read-only mode, got %v", res)
+	}
+}
+
+func TestConfigResetStat(t *testing.T) {
+	e := setupEngine()
+
+	e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	e.Execute(mockPeer, "SCAN", makeCommand("SCAN", "0"))
+	e.stats.recordGCCycle(0.5, 3)
+	e.stats.evictedKeys.Add(2)
+
+	res := e.Execute(mockPeer, "CONFIG", makeCommand("CONFIG", "RESETSTAT"))
+	if res.Type != resp.TypeSimpleString || string(res.String) != "OK" {
+		t.Fatalf("expected OK, got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats", "commandstats"))
+	for _, field := range []string{
+		"expired_keys:0\r\n", "active_expire_cycles:0\r\n", "scan_calls:0\r\n", "keyspace_misses:0\r\n",
+		"evicted_keys:0\r\n",
+	} {
+		if !strings.Contains(string(res.String), field) {
+			t.Errorf("missing %q in %q", field, res.String)
+		}
+	}
+
+	// CONFIG RESETSTAT itself is counted after the reset, the earlier commands are not
+	if strings.Contains(string(res.String), "cmdstat_get") || strings.Contains(string(res.String), "cmdstat_scan") {
+		t.Errorf("command stats were not reset: %q", res.String)
+	}
+}
+
+func TestInfoPersistence(t *testing.T) {
+	res := setupEngine().Execute(mockPeer, "INFO", makeCommand("INFO", "persistence"))
+	if string(res.String) != "# Persistence\r\naof_enabled:0\r\n" {
+		t.Errorf("unexpected reply without AOF: %q", res.String)
+	}
+
+	e := setupAOFEngine(t, filepath.Join(t.TempDir(), "info.aof"))
+	defer e.Shutdown()
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	res = e.Execute(mockPeer, "INFO", makeCommand("INFO", "persistence"))
+	for _, field := range []string{"aof_enabled:1", "aof_last_fsync_microseconds:", "aof_delayed_fsync:0"} {
+		if !strings.Contains(string(res.String), field) {
+			t.Errorf("missing %q in %q", field, res.String)
+		}
+	}
+}
+
+// failingWriter is an AOF target whose writes always fail
+type failingWriter struct{}
+
+func (failingWriter) Write(_ []byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriter) Sync() error                 { return nil }
+
+func TestAOFWriteErrorRejectsWrites(t *testing.T) {
+	e := setupEngine()
+	e.aof = persistence.NewAOFWriter(failingWriter{}, "always", 0, "stop", zap.NewNop())
+	defer e.Shutdown()
+
+	// the first write is accepted, its propagation fails
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+
+	deadline := time.Now().Add(time.Second)
+	for e.aof.WriteError() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	res := e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v2"))
+	if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "MISCONF") {
+		t.Errorf("expected MISCONF error, got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	if string(res.String) != "v" {
+		t.Errorf("reads must keep working, got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "INFO", makeCommand("INFO", "persistence"))
+	if !strings.Contains(string(res.String), "aof_last_write_status:err") {
+		t.Errorf("INFO must report the write error: %q", res.String)
+	}
+}
+
+func TestInfoExpiredKeys(t *testing.T) {
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	e, err := NewEngine(s, &config.Config{
+		GC: config.GCConfig{
+			Enabled:         true,
+			Interval:        10 * time.Millisecond,
+			SamplesPerCheck: 20,
+			MatchThreshold:  0.25,
+		},
+	}, logger.New("info", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	defer e.Shutdown()
+
+	for i := range 5 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("k%d", i), "v", "PX", "1"))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	res := e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats"))
+	if !strings.Contains(string(res.String), "expired_keys:5\r\n") {
+		t.Errorf("expired keys were not counted: %q", res.String)
+	}
+	if strings.Contains(string(res.String), "active_expire_cycles:0\r\n") {
+		t.Errorf("GC cycles were not counted: %q", res.String)
+	}
+}
+
+func TestGCExpireIndex(t *testing.T) {
+	s, _ := storage.NewShardedMapStorage(4) //nolint:errcheck
+	s.SetExpireIndex(true)
+	e, err := NewEngine(s, &config.Config{
+		// a single sample per shard would take many cycles to find the due keys among the others
+		GC: config.GCConfig{
+			Enabled:         true,
+			Interval:        10 * time.Millisecond,
+			SamplesPerCheck: 1,
+			MatchThreshold:  0.25,
+		},
+		Storage: config.StorageConfig{ExpireIndex: true},
+	}, logger.New("info", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	defer e.Shutdown()
+
+	for i := range 1000 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("later%d", i), "v", "EX", "100"))
+	}
+	for i := range 5 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("k%d", i), "v", "PX", "1"))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if n := s.Len(); n != 1000 {
+		t.Errorf("expected only the keys that are not due to remain, got %d keys", n)
+	}
+	res := e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats"))
+	if !strings.Contains(string(res.String), "expired_keys:5\r\n") {
+		t.Errorf("expired keys were not counted: %q", res.String)
+	}
+}
+
+func TestGCRepeatsOverThreshold(t *testing.T) {
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	e, err := NewEngine(s, &config.Config{
+		GC: config.GCConfig{
+			Enabled:         true,
+			Interval:        50 * time.Millisecond,
+			SamplesPerCheck: 20,
+			MatchThreshold:  0.25,
+			MaxRepeats:      100,
+		},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	defer e.Shutdown()
+
+	const keys = 5000
+	for i := range keys {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("k%d", i), "v", "PX", "1"))
+	}
+
+	// 20 samples per tick would need 12.5s to reclaim all keys without immediate repeats
+	deadline := time.Now().Add(2 * time.Second)
+	for e.stats.expiredKeys.Load() < keys && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := e.stats.expiredKeys.Load(); got != keys {
+		t.Errorf("expected %d reclaimed keys, got %d", keys, got)
+	}
+}
+
+func TestGCReclaimsWithinOneTick(t *testing.T) {
+	const interval = 200 * time.Millisecond
+
+	s, _ := storage.NewShardedMapStorage(4) //nolint:errcheck
+	created := time.Now()
+	e, err := NewEngine(s, &config.Config{
+		GC: config.GCConfig{
+			Enabled:         true,
+			Interval:        interval,
+			SamplesPerCheck: 20,
+			MatchThreshold:  0.25,
+			MaxRepeats:      1000,
+		},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	defer e.Shutdown()
+
+	const keys = 2000
+	for i := range keys {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("k%d", i), "v", "PX", "1"))
+	}
+
+	// the first tick fires one interval after the engine was created
+	time.Sleep(time.Until(created.Add(interval * 3 / 2)))
+
+	if got := e.stats.expiredKeys.Load(); got != keys {
+		t.Errorf("expected %d keys reclaimed by the first tick, got %d", keys, got)
+	}
+}
+
+func TestScanStats(t *testing.T) {
+	e := setupEngine()
+
+	for i := 0; i < 30; i++ {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("k%d", i), "v"))
+	}
+
+	stat := func(field string) int {
+		t.Helper()
+		res := e.Execute(mockPeer, "INFO", makeCommand("INFO", "stats"))
+		for _, line := range strings.Split(string(res.String), "\r\n") {
+			if v, ok := strings.CutPrefix(line, field+":"); ok {
+				n, _ := strconv.Atoi(v) //nolint:errcheck
+				return n
+			}
+		}
+		t.Fatalf("field %s not found in INFO", field)
+		return 0
+	}
+
+	seen := 0
+	cursor := "0"
+	for {
+		res := e.Execute(mockPeer, "SCAN", makeCommand("SCAN", cursor, "COUNT", "10"))
+		if res.Type != resp.TypeArray || len(res.Array) != 2 {
+			t.Fatalf("unexpected SCAN reply %v", res)
+		}
+		seen += len(res.Array[1].Array)
+		cursor = string(res.Array[0].String)
+
+		if examined := stat("scan_examined_entries"); examined < seen {
+			t.Errorf("scan_examined_entries = %d, less than %d keys returned", examined, seen)
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if seen != 30 {
+		t.Errorf("SCAN returned %d keys, want 30", seen)
+	}
+
+	calls, examined := stat("scan_calls"), stat("scan_examined_entries")
+	e.Execute(mockPeer, "SCAN", makeCommand("SCAN", "0", "MATCH", "k1*"))
+	if stat("scan_calls") != calls+1 || stat("scan_examined_entries") <= examined {
+		t.Errorf("scan counters did not increase")
+	}
+}
+
+func TestScanReverse(t *testing.T) {
+	s, _ := storage.NewShardedMapStorage(8) //nolint:errcheck
+
+	e, _ := NewEngine(s, &config.Config{GC: config.GCConfig{Enabled: false}}, logger.New("debug", "console")) //nolint:errcheck
+	for i := range 100 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", "key:"+strconv.Itoa(i), "v"))
+	}
+
+	walk := func(options ...string) []string {
+		var keys []string
+		cursor := "0"
+		for {
+			res := e.Execute(mockPeer, "SCAN", makeCommand("SCAN", append([]string{cursor, "COUNT", "1"}, options...)...))
+			if res.Type != resp.TypeArray || len(res.Array) != 2 {
+				t.Fatalf("unexpected SCAN reply %v", res)
+			}
+			for _, key := range res.Array[1].Array {
+				keys = append(keys, string(key.String))
+			}
+			if cursor = string(res.Array[0].String); cursor == "0" {
+				return keys
+			}
+		}
+	}
+
+	forward := walk()
+	backward := walk("REVERSE")
+	if len(forward) != 100 || len(backward) != 100 {
+		t.Fatalf("expected 100 keys in both directions, got %d and %d", len(forward), len(backward))
+	}
+	for i := range forward {
+		if forward[i] != backward[len(backward)-1-i] {
+			t.Fatalf("REVERSE must return the keys of a forward scan backwards")
+		}
+	}
+
+	if res := e.Execute(mockPeer, "SCAN", makeCommand("SCAN", "0", "REVERSE", "MATCH", "key:1*")); len(res.Array) != 2 {
+		t.Errorf("REVERSE combined with MATCH: unexpected reply %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "SCAN", makeCommand("SCAN", "0", "COUNT", "x")); string(res.String) != "ERR value is not an integer or out of range" {
+		t.Errorf("SCAN COUNT x: unexpected reply %v", res)
+	}
+}
+
+func TestScanHugeCount(t *testing.T) {
+	e := setupEngine()
+	for i := range 10 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", "k"+strconv.Itoa(i), "v"))
+	}
+
+	res := e.Execute(mockPeer, "SCAN", makeCommand("SCAN", "0", "COUNT", "9000000000000000000"))
+	if res.Type != resp.TypeArray || len(res.Array) != 2 {
+		t.Fatalf("unexpected SCAN reply %v", res)
+	}
+	if cursor := string(res.Array[0].String); cursor != "0" || len(res.Array[1].Array) != 10 {
+		t.Errorf("expected the 10 keys and cursor 0, got cursor %s with %d keys", cursor, len(res.Array[1].Array))
+	}
+}
+
+func TestKeys(t *testing.T) {
+	e := setupEngine()
+	for i := range 30 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", "k"+strconv.Itoa(i), "v"))
+	}
+	e.Execute(mockPeer, "SET", makeCommand("SET", "other", "v"))
+
+	res := e.Execute(mockPeer, "KEYS", makeCommand("KEYS", "k1*"))
+	if res.Type != resp.TypeArray || len(res.Array) != 11 {
+		t.Fatalf("KEYS k1*: expected 11 keys, got %v", res)
+	}
+
+	res = e.Execute(mockPeer, "KEYS", makeCommand("KEYS", "missing*"))
+	if res.Type != resp.TypeArray || res.IsNull || len(res.Array) != 0 {
+		t.Errorf("KEYS missing*: expected an empty array, got %v", res)
+	}
+
+	// the cap truncates the reply to the configured number of keys
+	e.cfg.Server.KeysMaxResults = 5
+	res = e.Execute(mockPeer, "KEYS", makeCommand("KEYS", "*"))
+	if len(res.Array) != 5 {
+		t.Errorf("KEYS * with keys_max_results=5: got %d keys", len(res.Array))
+	}
+
+	res = e.Execute(mockPeer, "KEYS", makeCommand("KEYS", "oth*"))
+	if len(res.Array) != 1 || string(res.Array[0].String) != "other" {
+		t.Errorf("KEYS below the cap: got %v", res)
+	}
+}
+
+func TestDelPattern(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	e := setupAOFEngine(t, filename)
+
+	// enough sessions to span several scan batches
+	sessions := 3 * keysBatch
+	for i := range sessions {
+		e.Execute(mockPeer, "SET", makeCommand("SET", "session:"+strconv.Itoa(i), "v"))
+	}
+	survivors := []string{"user:1", "sessions", "xsession:1", "session"}
+	for _, key := range survivors {
+		e.Execute(mockPeer, "SET", makeCommand("SET", key, "v"))
+	}
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "session:hash", "f", "v"))
+
+	peer := NewPeer(nil)
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "session:7"))
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "user:1", "changed"))
+
+	woken := e.waiters.wait([]string{"session:42"})
+	defer e.waiters.done([]string{"session:42"}, woken)
+
+	if res := e.Execute(mockPeer, "DELPATTERN", makeCommand("DELPATTERN", "session:*")); res.Integer != int64(sessions+1) {
+		t.Fatalf("DELPATTERN: expected %d, got %v", sessions+1, res)
+	}
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); !res.IsNull {
+		t.Errorf("EXEC after DELPATTERN deleted a watched key: expected nil, got %v", res)
+	}
+	select {
+	case <-woken:
+	default:
+		t.Errorf("DELPATTERN did not wake the client blocked on a deleted key")
+	}
+
+	check := func(e *Engine) {
+		t.Helper()
+		if res := e.Execute(mockPeer, "KEYS", makeCommand("KEYS", "session:*")); len(res.Array) != 0 {
+			t.Errorf("KEYS session:* after DELPATTERN: got %d keys", len(res.Array))
+		}
+		for _, key := range survivors {
+			if res := e.Execute(mockPeer, "GET", makeCommand("GET", key)); string(res.String) != "v" {
+				t.Errorf("%s must survive DELPATTERN, got %v", key, res)
+			}
+		}
+	}
+	check(e)
+
+	if res := e.Execute(mockPeer, "DELPATTERN", makeCommand("DELPATTERN", "session:*")); res.Integer != 0 {
+		t.Errorf("DELPATTERN without matches: expected 0, got %v", res)
+	}
+
+	e.Shutdown()
+	time.Sleep(200 * time.Millisecond)
+
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+	check(e)
+}
+
+func TestTTLRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   [][]string
+		cmd     []string
+		key     string
+		wantTTL int64
+	}{
+		{"SET clears", [][]string{{"SET", "k", "v", "EX", "100"}}, []string{"SET", "k", "v2"}, "k", -1},
+		{"SET KEEPTTL keeps", [][]string{{"SET", "k", "v", "EX", "100"}}, []string{"SET", "k", "v2", "KEEPTTL"}, "k", 100},
+		{"APPEND keeps", [][]string{{"SET", "k", "v", "EX", "100"}}, []string{"APPEND", "k", "x"}, "k", 100},
+		{"SETRANGE keeps", [][]string{{"SET", "k", "v", "EX", "100"}}, []string{"SETRANGE", "k", "0", "x"}, "k", 100},
+		{"HSET keeps", [][]string{{"HSET", "h", "f", "v"}, {"EXPIRE", "h", "100"}}, []string{"HSET", "h", "f2", "v"}, "h", 100},
+		{"HDEL keeps", [][]string{{"HSET", "h", "f", "v", "f2", "v"}, {"EXPIRE", "h", "100"}}, []string{"HDEL", "h", "f"}, "h", 100},
+		{"HDEL of the last field deletes", [][]string{{"HSET", "h", "f", "v"}, {"EXPIRE", "h", "100"}}, []string{"HDEL", "h", "f"}, "h", -2},
+		{"COPY carries", [][]string{{"SET", "k", "v", "EX", "100"}}, []string{"COPY", "k", "dst"}, "dst", 100},
+		{"RENAME carries", [][]string{{"SET", "k", "v", "EX", "100"}, {"SET", "dst", "old"}}, []string{"RENAME", "k", "dst"}, "dst", 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := setupEngine()
+			for _, cmd := range append(tt.setup, tt.cmd) {
+				if res := e.Execute(mockPeer, cmd[0], makeCommand(cmd[0], cmd[1:]...)); res.Type == resp.TypeError {
+					t.Fatalf("%v: %s", cmd, res.String)
+				}
+			}
+
+			if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", tt.key)); res.Integer != tt.wantTTL {
+				t.Errorf("TTL %s = %d, want %d", tt.key, res.Integer, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestExpiredKeyTreatedAsAbsent(t *testing.T) {
+	e := setupEngine()
+
+	// GC is disabled in tests, so the keys stay in the storage after their deadline
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "v", "PX", "10"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "nx", "v", "PX", "10"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "p", "v", "PX", "10"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "old"))
+	e.Execute(mockPeer, "PEXPIRE", makeCommand("PEXPIRE", "h", "10"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "hs", "f", "v"))
+	e.Execute(mockPeer, "PEXPIRE", makeCommand("PEXPIRE", "hs", "10"))
+	time.Sleep(20 * time.Millisecond)
+
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "s", "new", "XX")); !res.IsNull {
+		t.Errorf("SET XX on an expired key: expected nil, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "s")); !res.IsNull {
+		t.Errorf("SET XX created an expired key: %q", res.String)
+	}
+
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "nx", "new", "NX")); string(res.String) != "OK" {
+		t.Errorf("SET NX on an expired key: expected OK, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "HSETNX", makeCommand("HSETNX", "h", "f", "new")); res.Integer != 1 {
+		t.Errorf("HSETNX on an expired hash: expected 1, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f")); string(res.String) != "new" {
+		t.Errorf("HGET after HSETNX: got %q, want new", res.String)
+	}
+	if res := e.Execute(mockPeer, "TTL", makeCommand("TTL", "h")); res.Integer != -1 {
+		t.Errorf("the hash recreated by HSETNX inherited the old TTL %d", res.Integer)
+	}
+
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "hs", "str", "NX")); string(res.String) != "OK" {
+		t.Errorf("SET NX over an expired hash: expected OK, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "PERSIST", makeCommand("PERSIST", "p")); res.Integer != 0 {
+		t.Errorf("PERSIST on an expired key: expected 0, got %d", res.Integer)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "p")); !res.IsNull {
+		t.Errorf("PERSIST brought an expired key back: %q", res.String)
+	}
+}
+
+func TestHSetNX(t *testing.T) {
+	e := setupEngine()
+
+	if res := e.Execute(mockPeer, "HSETNX", makeCommand("HSETNX", "h", "f", "v1")); res.Integer != 1 {
+		t.Errorf("expected 1, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HSETNX", makeCommand("HSETNX", "h", "f", "v2")); res.Integer != 0 {
+		t.Errorf("expected 0 for an existing field, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f")); string(res.String) != "v1" {
+		t.Errorf("HSETNX overwrote the field: %q", res.String)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "v"))
+	if res := e.Execute(mockPeer, "HSETNX", makeCommand("HSETNX", "s", "f", "v")); res.Type != resp.TypeError {
+		t.Errorf("expected WRONGTYPE, got %v", res)
+	}
+}
+
+func TestHRandField(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "a", "1", "b", "2", "c", "3"))
+
+	// a negative count samples with replacement, more fields than the hash holds means repetitions
+	res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "h", "-10"))
+	if len(res.Array) != 10 {
+		t.Fatalf("negative count: expected 10 fields, got %d", len(res.Array))
+	}
+	seen := make(map[string]int)
+	for _, v := range res.Array {
+		seen[string(v.String)]++
+	}
+	if len(seen) > 3 {
+		t.Errorf("negative count: unexpected fields %v", seen)
+	}
+	if len(seen) == len(res.Array) {
+		t.Errorf("negative count: expected repeated fields, got %v", seen)
+	}
+
+	// a positive count returns distinct fields capped at the size of the hash
+	for _, tt := range []struct {
+		count string
+		want  int
+	}{{"2", 2}, {"3", 3}, {"10", 3}} {
+		res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "h", tt.count))
+		distinct := make(map[string]struct{})
+		for _, v := range res.Array {
+			distinct[string(v.String)] = struct{}{}
+		}
+		if len(res.Array) != tt.want || len(distinct) != tt.want {
+			t.Errorf("count %s: expected %d distinct fields, got %v", tt.count, tt.want, res.Array)
+		}
+	}
+
+	res = e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "h", "-4", "WITHVALUES"))
+	if len(res.Array) != 8 {
+		t.Fatalf("WITHVALUES: expected 8 elements, got %d", len(res.Array))
+	}
+	for i := 0; i < len(res.Array); i += 2 {
+		field, value := string(res.Array[i].String), string(res.Array[i+1].String)
+		if value != map[string]string{"a": "1", "b": "2", "c": "3"}[field] {
+			t.Errorf("WITHVALUES: field %q paired with %q", field, value)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "h")); res.Type != resp.TypeBulkString || res.IsNull {
+		t.Errorf("without count: expected a field, got %v", res)
+	}
+
+	// without count every field is equally likely
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "u", "a", "1", "b", "2", "c", "3", "d", "4", "e", "5", "f", "6"))
+	picks := make(map[string]int)
+	const draws = 6000
+	for range draws {
+		picks[string(e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "u")).String)]++
+	}
+	for _, field := range []string{"a", "b", "c", "d", "e", "f"} {
+		if n := picks[field]; n < draws/6*7/10 || n > draws/6*13/10 {
+			t.Errorf("without count: field %s picked %d times out of %d, not uniform: %v", field, n, draws, picks)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "missing")); !res.IsNull {
+		t.Errorf("missing key: expected nil, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "missing", "-3")); len(res.Array) != 0 {
+		t.Errorf("missing key: expected an empty array, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "h", "-2000000000")); string(res.String) != "ERR value is out of range" {
+		t.Errorf("huge negative count: expected an out of range error, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "HRANDFIELD", makeCommand("HRANDFIELD", "h", "1", "VALUES")); res.Type != resp.TypeError {
+		t.Errorf("expected a syntax error, got %v", res)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	e := setupEngine()
+
+	if res := e.Execute(mockPeer, "SET", makeCommand("SET", "k", "")); string(res.String) != "OK" {
+		t.Fatalf("SET of an empty value: unexpected reply %v", res)
+	}
+
+	res := e.Execute(mockPeer, "GET", makeCommand("GET", "k"))
+	if res.Type != resp.TypeBulkString || res.IsNull || len(res.String) != 0 {
+		t.Errorf("GET of an empty value: expected an empty bulk string, got %v", res)
+	}
+
+	var buf bytes.Buffer
+	enc := resp.NewEncoder(&buf)
+	enc.Write(res) //nolint:errcheck
+	enc.Flush()    //nolint:errcheck
+	if buf.String() != "$0\r\n\r\n" {
+		t.Errorf("empty value encoded as %q", buf.String())
+	}
+
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "k")); res.Integer != 1 {
+		t.Errorf("EXISTS of an empty value: expected 1, got %d", res.Integer)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "missing")); !res.IsNull {
+		t.Errorf("GET of a missing key: expected nil, got %v", res)
+	}
+}
+
+func TestExists(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "a", "1"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "expired", "v", "PX", "10"))
+	time.Sleep(20 * time.Millisecond)
+
+	res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "a", "h", "a", "missing", "expired"))
+	if res.Integer != 3 {
+		t.Errorf("expected 3, got %v", res)
+	}
+}
+
+func TestDBSize(t *testing.T) {
+	e := setupEngine()
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "a", "1"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "b", "2"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+	e.Execute(mockPeer, "DEL", makeCommand("DEL", "a"))
+
+	res := e.Execute(mockPeer, "DBSIZE", makeCommand("DBSIZE"))
+	if res.Integer != 2 {
+		t.Errorf("expected 2 keys, got %d", res.Integer)
+	}
+
+	res = e.Execute(mockPeer, "INFO", makeCommand("INFO", "keyspace"))
+	if !strings.Contains(string(res.String), "db0:keys=2\r\n") {
+		t.Errorf("unexpected keyspace section: %q", res.String)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	e, err := NewEngine(s, &config.Config{
+		Log: config.LogConfig{
+			Format:        "json",
+			AccessLog:     true,
+			AccessLogPath: path,
+		},
+	}, logger.New("info", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "secret-value"))
+	e.accessLog.Sync() //nolint:errcheck
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read access log: %v", err)
+	}
+
+	line := string(data)
+	if !strings.Contains(line, `"cmd":"SET"`) || !strings.Contains(line, `"args_count":2`) {
+		t.Errorf("access log line is missing fields: %q", line)
+	}
+	if strings.Contains(line, "secret-value") {
+		t.Errorf("access log must not contain argument values: %q", line)
+	}
+}
+
+func TestGetRangeStrlen(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "This is a string"))
+
+	tests := []struct {
+		start, end string
+		want       string
+	}{
+		{"0", "3", "This"},
+		{"-3", "-1", "ing"},
+		{"0", "-1", "This is a string"},
+		{"10", "100", "string"},
+		{"5", "3", ""},
+		{"-100", "1", "Th"},
+	}
+	for _, tt := range tests {
+		res := e.Execute(mockPeer, "GETRANGE", makeCommand("GETRANGE", "k", tt.start, tt.end))
+		if string(res.String) != tt.want {
+			t.Errorf("GETRANGE k %s %s: got %q, want %q", tt.start, tt.end, res.String, tt.want)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "GETRANGE", makeCommand("GETRANGE", "missing", "0", "-1")); res.IsNull || len(res.String) != 0 {
+		t.Errorf("expected empty string for missing key, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "STRLEN", makeCommand("STRLEN", "k")); res.Integer != 16 {
+		t.Errorf("expected STRLEN 16, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "STRLEN", makeCommand("STRLEN", "missing")); res.Integer != 0 {
+		t.Errorf("expected STRLEN 0 for missing key, got %v", res)
+	}
+
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+	for _, cmd := range [][]string{{"STRLEN", "h"}, {"GETRANGE", "h", "0", "1"}} {
+		if res := e.Execute(mockPeer, cmd[0], makeCommand(cmd[0], cmd[1:]...)); !strings.HasPrefix(string(res.String), "WRONGTYPE") {
+			t.Errorf("%v: expected WRONGTYPE, got %v", cmd, res)
+		}
+	}
+}
+
+func TestBinarySafeStrings(t *testing.T) {
+	binary := "a\x00b\xff\xfe\r\n$3\r\n\x00"
+
+	aofFile := filepath.Join(t.TempDir(), "binary.aof")
+	e := setupAOFEngine(t, aofFile)
+
+	client := startConnection(t, e)
+	client.SetDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	enc := resp.NewEncoder(client)
+	dec := resp.NewDecoder(client)
+
+	send := func(args ...string) resp.Value {
+		t.Helper()
+		if err := enc.Write(resp.MakeArray(makeCommand("", args...))); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		return res
+	}
+
+	send("SET", "k", binary)
+	if res := send("GET", "k"); string(res.String) != binary {
+		t.Fatalf("GET returned %q, want %q", res.String, binary)
+	}
+
+	send("APPEND", "k", "\x00\x01")
+	send("SETRANGE", "k", "1", "\xff")
+	want := "a\xffb\xff\xfe\r\n$3\r\n\x00\x00\x01"
+
+	if res := send("GET", "k"); string(res.String) != want {
+		t.Errorf("GET after APPEND/SETRANGE returned %q, want %q", res.String, want)
+	}
+	if res := send("STRLEN", "k"); res.Integer != int64(len(want)) {
+		t.Errorf("STRLEN returned %d, want %d", res.Integer, len(want))
+	}
+	if res := send("GETRANGE", "k", "-3", "-1"); string(res.String) != "\x00\x00\x01" {
+		t.Errorf("GETRANGE returned %q", res.String)
+	}
+
+	e.Shutdown()
+
+	// replaying the AOF restores the exact bytes
+	restored := setupAOFEngine(t, aofFile)
+	defer restored.Shutdown()
+
+	if res := restored.Execute(mockPeer, "GET", makeCommand("GET", "k")); string(res.String) != want {
+		t.Errorf("GET after AOF replay returned %q, want %q", res.String, want)
+	}
+}
+
+func TestList(t *testing.T) {
+	e := setupEngine()
+
+	if res := e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "l", "b", "c")); res.Integer != 2 {
+		t.Fatalf("RPUSH: expected 2, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "LPUSH", makeCommand("LPUSH", "l", "a", "z")); res.Integer != 4 {
+		t.Fatalf("LPUSH: expected 4, got %v", res)
+	}
+
+	res := e.Execute(mockPeer, "LRANGE", makeCommand("LRANGE", "l", "0", "-1"))
+	var got []string
+	for _, v := range res.Array {
+		got = append(got, string(v.String))
+	}
+	if strings.Join(got, ",") != "z,a,b,c" {
+		t.Errorf("LRANGE: expected z,a,b,c, got %v", got)
+	}
+
+	if res := e.Execute(mockPeer, "LTRIM", makeCommand("LTRIM", "l", "1", "2")); string(res.String) != "OK" {
+		t.Errorf("LTRIM: unexpected reply %v", res)
+	}
+	if res := e.Execute(mockPeer, "LLEN", makeCommand("LLEN", "l")); res.Integer != 2 {
+		t.Errorf("LLEN after LTRIM: expected 2, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "OBJECT", makeCommand("OBJECT", "ENCODING", "l")); string(res.String) != "listpack" {
+		t.Errorf("OBJECT ENCODING: expected listpack, got %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "LRANGE", makeCommand("LRANGE", "l", "a", "1")); res.Type != resp.TypeError {
+		t.Errorf("LRANGE with a non-integer offset: expected error, got %v", res)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "v"))
+	for _, name := range []string{"LPUSH", "RPUSH"} {
+		if res := e.Execute(mockPeer, name, makeCommand(name, "s", "x")); res.Type != resp.TypeError {
+			t.Errorf("%s against a string: expected WRONGTYPE, got %v", name, res)
+		}
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "l")); res.Type != resp.TypeError {
+		t.Errorf("GET against a list: expected WRONGTYPE, got %v", res)
+	}
+}
+
+func TestListMaxLen(t *testing.T) {
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	s.SetMaxListLen(3)
+	e, _ := NewEngine(s, &config.Config{GC: config.GCConfig{Enabled: false}}, logger.New("debug", "console")) //nolint:errcheck
+
+	for i := range 10 {
+		res := e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "queue", strconv.Itoa(i)))
+		if res.Integer > 3 {
+			t.Fatalf("list exceeded the cap: length %d", res.Integer)
+		}
+	}
+
+	res := e.Execute(mockPeer, "LRANGE", makeCommand("LRANGE", "queue", "0", "-1"))
+	if len(res.Array) != 3 || string(res.Array[0].String) != "7" || string(res.Array[2].String) != "9" {
+		t.Errorf("RPUSH must keep the newest elements 7..9, got %v", res.Array)
+	}
+
+	e.Execute(mockPeer, "LPUSH", makeCommand("LPUSH", "stack", "1", "2", "3", "4"))
+	res = e.Execute(mockPeer, "LRANGE", makeCommand("LRANGE", "stack", "0", "-1"))
+	if len(res.Array) != 3 || string(res.Array[0].String) != "4" || string(res.Array[2].String) != "2" {
+		t.Errorf("LPUSH must drop the right end, got %v", res.Array)
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	e := setupEngine()
+
+	if res := e.Execute(mockPeer, "RANDOMKEY", makeCommand("RANDOMKEY")); !res.IsNull {
+		t.Fatalf("RANDOMKEY on an empty keyspace: expected nil, got %v", res)
+	}
+
+	for i := range 50 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", "expired:"+strconv.Itoa(i), "v", "PX", "1"))
+	}
+	for i := range 10 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", "live:"+strconv.Itoa(i), "v"))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	for range 100 {
+		res := e.Execute(mockPeer, "RANDOMKEY", makeCommand("RANDOMKEY"))
+		if res.IsNull || !strings.HasPrefix(string(res.String), "live:") {
+			t.Fatalf("RANDOMKEY must return only live keys, got %v", res)
+		}
+	}
+
+	if res := e.Execute(mockPeer, "RANDOMKEY", makeCommand("RANDOMKEY", "extra")); res.Type != resp.TypeError {
+		t.Errorf("RANDOMKEY with arguments: expected error, got %v", res)
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	e := setupEngine()
+
+	if res := e.Execute(mockPeer, "PFADD", makeCommand("PFADD", "empty")); res.Integer != 1 {
+		t.Errorf("PFADD without elements must create the key, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "empty")); res.Integer != 0 {
+		t.Errorf("PFCOUNT of an empty HyperLogLog: expected 0, got %v", res)
+	}
+
+	args := []string{"a"}
+	for i := range 1000 {
+		args = append(args, "a"+strconv.Itoa(i))
+	}
+	if res := e.Execute(mockPeer, "PFADD", makeCommand("PFADD", args...)); res.Integer != 1 {
+		t.Fatalf("PFADD: expected 1, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "PFADD", makeCommand("PFADD", "a", "a0", "a1")); res.Integer != 0 {
+		t.Errorf("PFADD of known elements: expected 0, got %v", res)
+	}
+
+	args = []string{"b"}
+	for i := 500; i < 1500; i++ {
+		args = append(args, "a"+strconv.Itoa(i))
+	}
+	e.Execute(mockPeer, "PFADD", makeCommand("PFADD", args...))
+
+	if res := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "a")); res.Integer < 970 || res.Integer > 1030 {
+		t.Errorf("PFCOUNT: expected about 1000, got %v", res.Integer)
+	}
+	if res := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "a", "b", "missing")); res.Integer < 1455 || res.Integer > 1545 {
+		t.Errorf("PFCOUNT of the union: expected about 1500, got %v", res.Integer)
+	}
+
+	if res := e.Execute(mockPeer, "PFMERGE", makeCommand("PFMERGE", "u", "a", "b")); string(res.String) != "OK" {
+		t.Fatalf("PFMERGE: unexpected reply %v", res)
+	}
+	union := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "a", "b")).Integer
+	if res := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "u")); res.Integer != union {
+		t.Errorf("PFCOUNT of the merged key: expected %d, got %v", union, res.Integer)
+	}
+
+	// the sketch is a plain string, a copy made with GET and SET is still a HyperLogLog
+	value := e.Execute(mockPeer, "GET", makeCommand("GET", "u"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "copy", string(value.String)))
+	if res := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "copy")); res.Integer != union {
+		t.Errorf("PFCOUNT of a copy: expected %d, got %v", union, res.Integer)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "not a sketch"))
+	e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "l", "x"))
+	for _, cmd := range [][]string{{"PFADD", "s", "x"}, {"PFCOUNT", "a", "s"}, {"PFMERGE", "s", "a"}, {"PFMERGE", "u", "s"}} {
+		res := e.Execute(mockPeer, cmd[0], makeCommand(cmd[0], cmd[1:]...))
+		if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "WRONGTYPE Key is not a valid HyperLogLog") {
+			t.Errorf("%v: expected the invalid HyperLogLog error, got %v", cmd, res)
+		}
+	}
+	if res := e.Execute(mockPeer, "PFCOUNT", makeCommand("PFCOUNT", "l")); string(res.String) != string(resp.MakeErrorWrongType().String) {
+		t.Errorf("PFCOUNT of a list: expected WRONGTYPE, got %v", res)
+	}
+}
+
+func TestBitField(t *testing.T) {
+	e := setupEngine()
+
+	// bitfield runs BITFIELD on key and formats the replies, a nil reply as "nil"
+	bitfield := func(key string, args ...string) string {
+		t.Helper()
+		res := e.Execute(mockPeer, "BITFIELD", makeCommand("BITFIELD", append([]string{key}, args...)...))
+		if res.Type == resp.TypeError {
+			t.Fatalf("BITFIELD %v: %s", args, res.String)
+		}
+		out := make([]string, len(res.Array))
+		for i, v := range res.Array {
+			out[i] = strconv.FormatInt(v.Integer, 10)
+			if v.IsNull {
+				out[i] = "nil"
+			}
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"u8 wrap", []string{"INCRBY", "u8", "0", "200", "INCRBY", "u8", "0", "100", "INCRBY", "u8", "0", "-50"}, "200,44,250"},
+		{"u8 sat", []string{"OVERFLOW", "SAT", "INCRBY", "u8", "8", "200", "INCRBY", "u8", "8", "100", "INCRBY", "u8", "8", "-300"}, "200,255,0"},
+		{"u8 fail", []string{"SET", "u8", "16", "250", "OVERFLOW", "FAIL", "INCRBY", "u8", "16", "10", "GET", "u8", "16"}, "0,nil,250"},
+		{"negative i8", []string{"SET", "i8", "#3", "-100", "GET", "i8", "#3", "GET", "u8", "#3", "INCRBY", "i8", "#3", "-30"}, "0,-100,156,126"},
+		{"i8 sat", []string{"OVERFLOW", "SAT", "SET", "i8", "32", "-128", "INCRBY", "i8", "32", "-1", "SET", "i8", "32", "1000"}, "0,-128,-128"},
+		{"i8 fail set", []string{"OVERFLOW", "FAIL", "SET", "i8", "32", "128", "GET", "i8", "32"}, "nil,127"},
+		{"unaligned", []string{"SET", "u4", "44", "15", "GET", "u12", "40", "GET", "i1", "47"}, "0,240,-1"},
+		{"i64", []string{"SET", "i64", "64", "9223372036854775807", "INCRBY", "i64", "64", "1", "OVERFLOW", "SAT", "INCRBY", "i64", "64", "-1"}, "0,-9223372036854775808,-9223372036854775808"},
+	}
+	for _, tt := range tests {
+		if got := bitfield("k", tt.args...); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	if got := bitfield("missing", "GET", "u8", "0", "GET", "i16", "100"); got != "0,0" {
+		t.Errorf("GET of a missing key: expected 0,0, got %s", got)
+	}
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "missing")); res.Integer != 0 {
+		t.Error("BITFIELD with GET only must not create the key")
+	}
+
+	// a rejected write still creates the key padded to the field
+	bitfield("padded", "OVERFLOW", "FAIL", "SET", "u8", "16", "-1")
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "padded")); string(res.String) != "\x00\x00\x00" {
+		t.Errorf("padded string: expected three zero bytes, got %q", res.String)
+	}
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "A"))
+	if got := bitfield("s", "GET", "u8", "0", "SET", "u1", "6", "1", "GET", "u8", "0"); got != "65,0,67" {
+		t.Errorf("BITFIELD of a string: expected 65,0,67, got %s", got)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "s")); string(res.String) != "C" {
+		t.Errorf("GET after BITFIELD: expected C, got %q", res.String)
+	}
+
+	e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "l", "x"))
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"k", "GET", "u64", "0"}, "ERR Invalid bitfield type"},
+		{[]string{"k", "GET", "i65", "0"}, "ERR Invalid bitfield type"},
+		{[]string{"k", "GET", "x8", "0"}, "ERR Invalid bitfield type"},
+		{[]string{"k", "GET", "u8", "-1"}, "ERR bit offset is not an integer or out of range"},
+		{[]string{"k", "SET", "u8", "0", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"k", "OVERFLOW", "MAYBE"}, "ERR Invalid OVERFLOW type specified"},
+		{[]string{"k", "INCRBY", "u8", "0"}, "ERR syntax error"},
+		{[]string{"k", "DECRBY", "u8", "0", "1"}, "ERR syntax error"},
+		{[]string{"k", "SET", "u8", "#9999999999999", "1"}, "ERR string exceeds maximum allowed size"},
+		{[]string{"l", "GET", "u8", "0"}, "WRONGTYPE"},
+	} {
+		res := e.Execute(mockPeer, "BITFIELD", makeCommand("BITFIELD", tt.args...))
+		if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), tt.want) {
+			t.Errorf("BITFIELD %v: expected %q, got %v", tt.args, tt.want, res)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/version"
+)
+
+// mapEntry is a single key-value pair of a reply that depends on the protocol version
+type mapEntry struct {
+	key   string
+	value resp.Value
+}
+
+// makeProtocolMap returns a map for RESP3 clients and a flat array of alternating keys and values for RESP2 clients.
+// The array keeps the order of the entries
+func makeProtocolMap(protocol int, entries []mapEntry) resp.Value {
+	if protocol >= 3 {
+		m := make(map[string]resp.Value, len(entries))
+		for _, entry := range entries {
+			m[entry.key] = entry.value
+		}
+		return resp.MakeMapValues(m)
+	}
+
+	flat := make([]resp.Value, 0, len(entries)*2)
+	for _, entry := range entries {
+		flat = append(flat, resp.MakeBulkString(entry.key), entry.value)
+	}
+	return resp.MakeArray(flat)
+}
+
+// hello HELLO [protover [AUTH username password]] switches the protocol version and returns the server properties
+func (e *Engine) hello(ctx *context) resp.Value {
+	protocol := ctx.peer.protocol
+
+	if len(ctx.args) > 0 {
+		version, err := strconv.Atoi(string(ctx.args[0].String))
+		if err != nil {
+			return resp.MakeError("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return resp.MakeError("NOPROTO unsupported protocol version")
+		}
+		protocol = version
+	}
+
+	authenticated := ctx.peer.authenticated
+	for i := 1; i < len(ctx.args); i++ {
+		switch strings.ToUpper(string(ctx.args[i].String)) {
+		case "AUTH":
+			if i+2 >= len(ctx.args) {
+				return resp.MakeError("ERR Syntax error in HELLO option 'auth'")
+			}
+			if e.password == "" {
+				return resp.MakeError("ERR Client sent AUTH, but no password is set")
+			}
+
+			user, pass := string(ctx.args[i+1].String), string(ctx.args[i+2].String)
+			if user != "default" || pass != e.password {
+				return resp.MakeError("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			authenticated = true
+			i += 2
+		default:
+			return resp.MakeError("ERR Syntax error in HELLO option '" + string(ctx.args[i].String) + "'")
+		}
+	}
+
+	if e.password != "" && !authenticated {
+		return resp.MakeError("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client " +
+			"and select the RESP protocol version at the same time")
+	}
+
+	ctx.peer.authenticated = authenticated
+	ctx.peer.protocol = protocol
+
+	return makeProtocolMap(protocol, []mapEntry{
+		{"server", resp.MakeBulkString("moonlight")},
+		{"version", resp.MakeBulkString(version.Version)},
+		{"proto", resp.MakeInteger(int64(protocol))},
+		{"id", resp.MakeInteger(ctx.peer.id)},
+		{"mode", resp.MakeBulkString("standalone")},
+		{"role", resp.MakeBulkString("master")},
+		{"run_id", resp.MakeBulkString(e.runID)},
+	})
+}
+
+// newRunID returns 40 random hex characters identifying the process, like the run_id of Redis
+func newRunID() string {
+	b := make([]byte, 20)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
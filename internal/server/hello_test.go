@@ -0,0 +1,190 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+func TestCommandDocs_RESP2(t *testing.T) {
+	e := setupEngine()
+
+	res := e.Execute(NewPeer(nil), "COMMAND", makeCommand("COMMAND", "DOCS", "GET"))
+	if res.Type != resp.TypeArray || len(res.Array) != 2 {
+		t.Fatalf("expected flat array of name and docs, got %v", res)
+	}
+	if string(res.Array[0].String) != "GET" {
+		t.Errorf("expected GET, got %q", res.Array[0].String)
+	}
+
+	props := res.Array[1].Array
+	if len(props) != 8 || string(props[0].String) != "summary" {
+		t.Errorf("unexpected docs layout %v", props)
+	}
+}
+
+func TestCommandDocs_RESP3(t *testing.T) {
+	e := setupEngine()
+	client := startConnection(t, e)
+
+	go client.Write([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n" + //nolint:errcheck
+		"*3\r\n$7\r\nCOMMAND\r\n$4\r\nDOCS\r\n$3\r\nGET\r\n"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+
+	hello, err := dec.Read()
+	if err != nil {
+		t.Fatalf("read HELLO reply failed: %v", err)
+	}
+	if hello.Type != resp.TypeMap || hello.Map["proto"].Integer != 3 {
+		t.Fatalf("expected RESP3 HELLO map, got %v", hello)
+	}
+
+	docs, err := dec.Read()
+	if err != nil {
+		t.Fatalf("read COMMAND DOCS reply failed: %v", err)
+	}
+	if docs.Type != resp.TypeMap {
+		t.Fatalf("expected map, got type %q", docs.Type)
+	}
+
+	get, ok := docs.Map["GET"]
+	if !ok || get.Type != resp.TypeMap {
+		t.Fatalf("expected nested map for GET, got %v", docs.Map)
+	}
+	if summary := string(get.Map["summary"].String); summary == "" {
+		t.Errorf("summary is missing in %v", get.Map)
+	}
+}
+
+func TestHello(t *testing.T) {
+	e := setupEngine()
+	e.password = "secret"
+	peer := NewPeer(nil)
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"Unsupported version", []string{"4"}, "NOPROTO unsupported protocol version"},
+		{"Not authenticated", []string{"3"}, "NOAUTH"},
+		{"Wrong password", []string{"3", "AUTH", "default", "wrong"}, "WRONGPASS"},
+		{"Authenticate", []string{"3", "AUTH", "default", "secret"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := e.Execute(peer, "HELLO", makeCommand("HELLO", tt.args...))
+			if tt.wantErr == "" {
+				if res.Type == resp.TypeError {
+					t.Fatalf("unexpected error %q", res.String)
+				}
+				return
+			}
+			if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), tt.wantErr) {
+				t.Errorf("got %q, want prefix %q", res.String, tt.wantErr)
+			}
+		})
+	}
+
+	if !peer.authenticated || peer.protocol != 3 {
+		t.Errorf("HELLO AUTH must authenticate and switch to RESP3, got authenticated=%v protocol=%d", peer.authenticated, peer.protocol)
+	}
+}
+
+func TestHelloServerProperties(t *testing.T) {
+	e := setupEngine()
+	client := startConnection(t, e)
+
+	go client.Write([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n" + //nolint:errcheck
+		"*2\r\n$5\r\nHELLO\r\n$1\r\n2\r\n"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+
+	resp3, err := dec.Read()
+	if err != nil {
+		t.Fatalf("read RESP3 HELLO reply failed: %v", err)
+	}
+	if resp3.Type != resp.TypeMap {
+		t.Fatalf("expected a map for RESP3, got %v", resp3)
+	}
+	if role := string(resp3.Map["role"].String); role != "master" {
+		t.Errorf("expected role master, got %q", role)
+	}
+	if mode := string(resp3.Map["mode"].String); mode != "standalone" {
+		t.Errorf("expected mode standalone, got %q", mode)
+	}
+	if runID := string(resp3.Map["run_id"].String); len(runID) != 40 || runID != e.runID {
+		t.Errorf("unexpected run_id %q", runID)
+	}
+	if resp3.Map["id"].Integer <= 0 {
+		t.Errorf("expected a positive client id, got %v", resp3.Map["id"])
+	}
+
+	resp2, err := dec.Read()
+	if err != nil {
+		t.Fatalf("read RESP2 HELLO reply failed: %v", err)
+	}
+	if resp2.Type != resp.TypeArray || len(resp2.Array)%2 != 0 {
+		t.Fatalf("expected a flat array for RESP2, got %v", resp2)
+	}
+
+	props := make(map[string]resp.Value)
+	for i := 0; i < len(resp2.Array); i += 2 {
+		props[string(resp2.Array[i].String)] = resp2.Array[i+1]
+	}
+	if string(props["role"].String) != "master" || string(props["mode"].String) != "standalone" {
+		t.Errorf("unexpected RESP2 HELLO reply %v", props)
+	}
+
+	// the run id and the client id are stable across calls
+	if string(props["run_id"].String) != e.runID || props["id"].Integer != resp3.Map["id"].Integer {
+		t.Errorf("run_id or id changed between calls: %v", props)
+	}
+}
+
+func TestHGetAllProtocol(t *testing.T) {
+	e := setupEngine()
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "a", "1"))
+
+	resp3 := NewPeer(nil)
+	resp3.protocol = 3
+	if res := e.Execute(resp3, "HGETALL", makeCommand("HGETALL", "h")); res.Type != resp.TypeMap ||
+		string(res.Map["a"].String) != "1" {
+		t.Errorf("RESP3: expected a map, got %v", res)
+	}
+	if res := e.Execute(NewPeer(nil), "HGETALL", makeCommand("HGETALL", "h")); res.Type != resp.TypeArray ||
+		len(res.Array) != 2 || string(res.Array[0].String) != "a" || string(res.Array[1].String) != "1" {
+		t.Errorf("RESP2: expected a flat array, got %v", res)
+	}
+
+	// the streamed reply follows the protocol negotiated by HELLO
+	client := startConnection(t, e)
+	go client.Write([]byte("*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n" + //nolint:errcheck
+		"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n" +
+		"*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+	dec := resp.NewDecoder(client)
+
+	var replies []resp.Value
+	for range 3 {
+		res, err := dec.Read()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		replies = append(replies, res)
+	}
+
+	if res := replies[0]; res.Type != resp.TypeArray || len(res.Array) != 2 {
+		t.Errorf("streamed RESP2: expected a flat array, got %v", res)
+	}
+	if res := replies[2]; res.Type != resp.TypeMap || string(res.Map["a"].String) != "1" {
+		t.Errorf("streamed RESP3: expected a map, got %v", res)
+	}
+}
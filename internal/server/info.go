@@ -0,0 +1,163 @@
+package server
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/version"
+)
+
+// infoField is a single "key:value" line of the INFO reply
+type infoField struct {
+	key   string
+	value string
+}
+
+// infoSection describes one "# Name" block of the INFO reply
+type infoSection struct {
+	name   string
+	fields func(e *Engine) []infoField
+	extra  bool // printed only when requested by name or with "all"/"everything", not by default
+}
+
+// infoSections lists the INFO sections in the order they are printed
+var infoSections = []infoSection{
+	{name: "Server", fields: serverInfo},
+	{name: "Persistence", fields: persistenceInfo},
+	{name: "Stats", fields: statsInfo},
+	{name: "Commandstats", fields: commandstatsInfo, extra: true},
+	{name: "Keyspace", fields: keyspaceInfo},
+}
+
+// serverInfo reports the build information and general information about the server process
+func serverInfo(e *Engine) []infoField {
+	return []infoField{
+		{"moonlight_version", version.Version},
+		{"git_sha", version.GitSHA},
+		{"build_date", version.BuildDate},
+		{"go_version", runtime.Version()},
+		{"os", runtime.GOOS},
+		{"arch", runtime.GOARCH},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"run_id", e.runID},
+		{"tcp_port", e.cfg.Server.Port},
+		{"uptime_in_seconds", strconv.FormatInt(int64(time.Since(e.startedAt).Seconds()), 10)},
+		{"storage_shards", strconv.FormatUint(uint64(e.cfg.Storage.ShardCount), 10)},
+	}
+}
+
+// persistenceInfo reports the state of the AOF, fsync metrics are present only when the AOF is enabled
+func persistenceInfo(e *Engine) []infoField {
+	if e.aof == nil {
+		return []infoField{{"aof_enabled", "0"}}
+	}
+
+	status := "ok"
+	if e.aof.WriteError() != nil {
+		status = "err"
+	}
+
+	return []infoField{
+		{"aof_enabled", "1"},
+		{"aof_last_write_status", status},
+		{"aof_last_fsync_microseconds", strconv.FormatInt(e.aof.LastFsyncMicroseconds(), 10)},
+		{"aof_delayed_fsync", strconv.FormatInt(e.aof.DelayedFsyncs(), 10)},
+	}
+}
+
+// info INFO [section [section ...]]. Without arguments the default sections are returned, "all" adds Commandstats
+func (e *Engine) info(ctx *context) resp.Value {
+	requested := make(map[string]bool, len(ctx.args))
+	for _, arg := range ctx.args {
+		requested[strings.ToLower(string(arg.String))] = true
+	}
+	all := requested["all"] || requested["everything"]
+	def := all || len(requested) == 0 || requested["default"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		show := def
+		if section.extra {
+			show = all
+		}
+		if !show && !requested[strings.ToLower(section.name)] {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + section.name + "\r\n")
+		for _, f := range section.fields(e) {
+			b.WriteString(f.key + ":" + f.value + "\r\n")
+		}
+	}
+
+	return resp.MakeBulkString(b.String())
+}
+
+// statsInfo reports the general statistics of the engine
+func statsInfo(e *Engine) []infoField {
+	return []infoField{
+		{"expired_keys", strconv.FormatInt(e.stats.expiredKeys.Load(), 10)},
+		{"active_expire_cycles", strconv.FormatInt(e.stats.activeExpireCycles.Load(), 10)},
+		{"expired_stale_perc", strconv.FormatFloat(e.stats.expiredRatio()*100, 'f', 2, 64)},
+		{"evicted_keys", strconv.FormatInt(e.stats.evictedKeys.Load(), 10)},
+		{"scan_calls", strconv.FormatInt(e.stats.scanCalls.Load(), 10)},
+		{"scan_examined_entries", strconv.FormatInt(e.stats.scanExamined.Load(), 10)},
+		{"scan_returned_keys", strconv.FormatInt(e.stats.scanReturned.Load(), 10)},
+		{"keyspace_hits", strconv.FormatInt(e.stats.keyspaceHits.Load(), 10)},
+		{"keyspace_misses", strconv.FormatInt(e.stats.keyspaceMisses.Load(), 10)},
+		{"reaped_connections", strconv.FormatInt(e.stats.reapedConnections.Load(), 10)},
+	}
+}
+
+// keyspaceInfo reports the number of keys, the database is omitted when empty
+func keyspaceInfo(e *Engine) []infoField {
+	keys := (*e.storage).Len()
+	if keys == 0 {
+		return nil
+	}
+	return []infoField{
+		{"db0", "keys=" + strconv.FormatInt(keys, 10)},
+	}
+}
+
+// commandstatsInfo reports the usage of every command called at least once
+func commandstatsInfo(e *Engine) []infoField {
+	names := e.cmdStats.called()
+	fields := make([]infoField, 0, len(names))
+
+	for _, name := range names {
+		calls, usec, perCall := e.cmdStats.usage(name)
+		fields = append(fields, infoField{
+			"cmdstat_" + strings.ToLower(name),
+			"calls=" + strconv.FormatInt(calls, 10) +
+				",usec=" + strconv.FormatInt(usec, 10) +
+				",usec_per_call=" + strconv.FormatFloat(perCall, 'f', 2, 64),
+		})
+	}
+
+	return fields
+}
+
+// commandStatsReply COMMAND STATS returns the usage of every command called at least once
+func (e *Engine) commandStatsReply(protocol int) resp.Value {
+	names := e.cmdStats.called()
+	entries := make([]mapEntry, 0, len(names))
+
+	for _, name := range names {
+		calls, usec, perCall := e.cmdStats.usage(name)
+		entries = append(entries, mapEntry{strings.ToLower(name), makeProtocolMap(protocol, []mapEntry{
+			{"calls", resp.MakeInteger(calls)},
+			{"usec", resp.MakeInteger(usec)},
+			{"usec_per_call", resp.MakeBulkString(strconv.FormatFloat(perCall, 'f', 2, 64))},
+		})})
+	}
+
+	return makeProtocolMap(protocol, entries)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	stdcontext "context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Listen creates the TCP listener of the server. With reusePort the socket is bound with SO_REUSEPORT,
+// so a new instance can bind the same address while the old one drains its connections
+func Listen(address string, reusePort bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		if err := setReusePort(&lc); err != nil {
+			return nil, err
+		}
+	}
+
+	return lc.Listen(stdcontext.Background(), "tcp", address)
+}
+
+// ListenAll creates a listener for every address, like the bind directive of Redis.
+// With failFast the first address that cannot be bound closes the listeners created so far and fails.
+// Otherwise it is logged and skipped, an error is returned only if no address could be bound
+func ListenAll(addresses []string, reusePort, failFast bool, log *zap.Logger) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addresses))
+	var errs []error
+
+	for _, address := range addresses {
+		listener, err := Listen(address, reusePort)
+		if err != nil {
+			err = fmt.Errorf("bind %s: %w", address, err)
+			if failFast {
+				for _, l := range listeners {
+					l.Close() //nolint:errcheck
+				}
+				return nil, err
+			}
+
+			log.Warn("address skipped, it cannot be bound", zap.Error(err))
+			errs = append(errs, err)
+			continue
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.Join(append(errs, errors.New("no address could be bound"))...)
+	}
+
+	return listeners, nil
+}
+
+// Serve accepts connections on every listener and passes each one to handle in its own goroutine tracked by wg.
+// It returns once all listeners are closed, the connections may still be served
+func Serve(listeners []net.Listener, wg *sync.WaitGroup, handle func(net.Conn), log *zap.Logger) {
+	var accepting sync.WaitGroup
+	accepting.Add(len(listeners))
+
+	for _, listener := range listeners {
+		go func() {
+			defer accepting.Done()
+
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					log.Error("Accept error", zap.Error(err))
+					continue
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					handle(conn)
+				}()
+			}
+		}()
+	}
+
+	accepting.Wait()
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort makes the listener set SO_REUSEPORT on its socket before binding
+func setReusePort(lc *net.ListenConfig) error {
+	lc.Control = func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"go.uber.org/zap"
+)
+
+func TestListen_ReusePort(t *testing.T) {
+	first, err := Listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("first listen failed: %v", err)
+	}
+	defer first.Close() //nolint:errcheck
+
+	second, err := Listen(first.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("second listen on %s with reuseport failed: %v", first.Addr(), err)
+	}
+	second.Close() //nolint:errcheck
+
+	if l, err := Listen(first.Addr().String(), false); err == nil {
+		l.Close() //nolint:errcheck
+		t.Errorf("listen without reuseport must fail on a bound address")
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	listeners, err := ListenAll([]string{"127.0.0.1:0", "127.0.0.2:0"}, false, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	e := setupEngine()
+	e.logger = zap.NewNop()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		Serve(listeners, &wg, e.HandleConnection, zap.NewNop())
+		close(done)
+	}()
+
+	for _, listener := range listeners {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %s failed: %v", listener.Addr(), err)
+		}
+
+		if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second)) //nolint:errcheck
+		res, err := resp.NewDecoder(conn).Read()
+		if err != nil || string(res.String) != "PONG" {
+			t.Errorf("%s: got %q, %v, want PONG", listener.Addr(), res.String, err)
+		}
+		conn.Close() //nolint:errcheck
+	}
+
+	for _, listener := range listeners {
+		listener.Close() //nolint:errcheck
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after the listeners were closed")
+	}
+	wg.Wait()
+}
+
+func TestListenAll_BindFailure(t *testing.T) {
+	bound, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer bound.Close() //nolint:errcheck
+
+	addresses := []string{"127.0.0.2:0", bound.Addr().String()}
+
+	if _, err := ListenAll(addresses, false, true, zap.NewNop()); err == nil {
+		t.Errorf("fail fast must fail on a bound address")
+	}
+
+	listeners, err := ListenAll(addresses, false, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("the bound address must be skipped: %v", err)
+	}
+	if len(listeners) != 1 {
+		t.Errorf("got %d listeners, want 1", len(listeners))
+	}
+	for _, listener := range listeners {
+		listener.Close() //nolint:errcheck
+	}
+
+	if _, err := ListenAll([]string{bound.Addr().String()}, false, false, zap.NewNop()); err == nil {
+		t.Errorf("no bound address must fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// setReusePort is only supported on Linux
+func setReusePort(_ *net.ListenConfig) error {
+	return errors.New("server.reuse_port is only supported on linux")
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/version"
+)
+
+const (
+	lolwutCols = 40
+	lolwutRows = 16
+)
+
+// drawMoon renders the moon in the given phase as ASCII art. The same phase always gives the same picture
+func drawMoon(phase int) string {
+	phase %= 8
+	if phase < 0 {
+		phase += 8
+	}
+
+	// the shadow is a disc of the same size sliding over the moon from right to left
+	radius := float64(lolwutRows) / 2
+	shadowShift := (float64(phase) - 4) / 2 * radius
+
+	var b strings.Builder
+	for row := 0; row < lolwutRows; row++ {
+		for col := 0; col < lolwutCols; col++ {
+			// characters are twice as tall as wide
+			x := (float64(col)-float64(lolwutCols)/2)/2 + 0.25
+			y := float64(row) - radius + 0.5
+
+			inMoon := x*x+y*y <= radius*radius
+			inShadow := (x-shadowShift)*(x-shadowShift)+y*y <= radius*radius
+
+			switch {
+			case inMoon && !inShadow:
+				b.WriteByte('#')
+			case inMoon:
+				b.WriteByte('.')
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+// lolwut LOLWUT [VERSION version] returns an ASCII art moon and the server version.
+// The version selects the phase of the moon
+func lolwut(ctx *context) resp.Value {
+	phase := 0
+
+	switch len(ctx.args) {
+	case 0:
+	case 2:
+		if strings.ToUpper(string(ctx.args[0].String)) != "VERSION" {
+			return resp.MakeError("ERR syntax error")
+		}
+
+		v, err := strconv.Atoi(string(ctx.args[1].String))
+		if err != nil {
+			return resp.MakeError("ERR value is not an integer or out of range")
+		}
+		phase = v
+	default:
+		return resp.MakeError("ERR syntax error")
+	}
+
+	return resp.MakeBulkString(drawMoon(phase) + "\nMoonlight ver. " + version.Version + "\n")
+}
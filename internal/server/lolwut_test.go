@@ -0,0 +1,36 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/version"
+)
+
+func TestLolwut(t *testing.T) {
+	e := setupEngine()
+
+	res := e.Execute(mockPeer, "LOLWUT", makeCommand("LOLWUT"))
+	if res.Type != resp.TypeBulkString {
+		t.Fatalf("expected bulk string, got %v", res.Type)
+	}
+	if !strings.Contains(string(res.String), "Moonlight ver. "+version.Version) {
+		t.Errorf("reply does not contain the version: %q", res.String)
+	}
+
+	again := e.Execute(mockPeer, "LOLWUT", makeCommand("LOLWUT"))
+	if string(again.String) != string(res.String) {
+		t.Error("art is not deterministic")
+	}
+
+	phase := e.Execute(mockPeer, "LOLWUT", makeCommand("LOLWUT", "VERSION", "4"))
+	if phase.Type != resp.TypeBulkString || string(phase.String) == string(res.String) {
+		t.Errorf("VERSION should change the art, got %q", phase.String)
+	}
+
+	bad := e.Execute(mockPeer, "LOLWUT", makeCommand("LOLWUT", "VERSION", "x"))
+	if bad.Type != resp.TypeError {
+		t.Errorf("expected error for non-integer version, got %v", bad.Type)
+	}
+}
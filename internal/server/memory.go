@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// memoryTypes is the order in which the per-type breakdown of MEMORY STATS is reported
+var memoryTypes = []storage.DataType{
+	storage.TypeString, storage.TypeList, storage.TypeSet, storage.TypeHash, storage.TypeZSet,
+	storage.TypeStream,
+}
+
+// memory MEMORY STATS reports an estimate of the memory used by the dataset
+func memory(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("MEMORY")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "STATS":
+		if len(ctx.args) != 1 {
+			return resp.MakeErrorWrongNumberOfArguments("MEMORY|STATS")
+		}
+
+		stats := (*ctx.storage).MemoryStats()
+
+		sampled := int64(0)
+		if stats.Sampled {
+			sampled = 1
+		}
+
+		entries := []mapEntry{
+			{"keys.count", resp.MakeInteger(stats.Keys)},
+			{"dataset.bytes", resp.MakeInteger(stats.DatasetBytes)},
+			{"overhead.total", resp.MakeInteger(stats.OverheadBytes)},
+			{"total.allocated", resp.MakeInteger(stats.DatasetBytes + stats.OverheadBytes)},
+			{"shards", resp.MakeInteger(int64(stats.Shards))},
+			{"sampled", resp.MakeInteger(sampled)},
+		}
+
+		for _, t := range memoryTypes {
+			mem, ok := stats.Types[t]
+			if !ok {
+				continue
+			}
+			entries = append(entries,
+				mapEntry{t.String() + ".keys", resp.MakeInteger(mem.Keys)},
+				mapEntry{t.String() + ".bytes", resp.MakeInteger(mem.Bytes)},
+			)
+		}
+
+		return makeProtocolMap(ctx.peer.protocol, entries)
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try MEMORY HELP.", strings.ToLower(sub)))
+}
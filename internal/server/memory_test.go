@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+func TestMemoryStats(t *testing.T) {
+	e := setupEngine()
+
+	for i := range 50 {
+		e.Execute(mockPeer, "SET", makeCommand("SET", fmt.Sprintf("s%d", i), "value"))
+	}
+	for i := range 10 {
+		e.Execute(mockPeer, "HSET", makeCommand("HSET", fmt.Sprintf("h%d", i), "f1", "v1", "f2", "v2"))
+	}
+
+	res := e.Execute(mockPeer, "MEMORY", makeCommand("MEMORY", "STATS"))
+	if res.Type != resp.TypeArray || len(res.Array)%2 != 0 {
+		t.Fatalf("expected flat array, got %v", res)
+	}
+
+	stats := make(map[string]int64)
+	for i := 0; i < len(res.Array); i += 2 {
+		stats[string(res.Array[i].String)] = res.Array[i+1].Integer
+	}
+
+	dbsize := e.Execute(mockPeer, "DBSIZE", makeCommand("DBSIZE"))
+	if stats["keys.count"] != dbsize.Integer {
+		t.Errorf("keys.count %d does not match DBSIZE %d", stats["keys.count"], dbsize.Integer)
+	}
+
+	if stats["string.keys"] != 50 || stats["hash.keys"] != 10 {
+		t.Errorf("unexpected per-type key counts: %v", stats)
+	}
+	if stats["dataset.bytes"] != stats["string.bytes"]+stats["hash.bytes"] {
+		t.Errorf("per-type bytes do not add up to dataset.bytes: %v", stats)
+	}
+	if stats["overhead.total"] <= 0 || stats["sampled"] != 0 {
+		t.Errorf("unexpected overhead or sampling: %v", stats)
+	}
+
+	res = e.Execute(mockPeer, "MEMORY", makeCommand("MEMORY", "NOPE"))
+	if res.Type != resp.TypeError {
+		t.Errorf("expected error for unknown subcommand, got %v", res)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// inspectCommands must not update the access time of the key: they read key metadata,
+// set the access time themselves like RESTORE IDLETIME, or do not read the key at all like WATCH
+var inspectCommands = map[string]bool{
+	"OBJECT":  true,
+	"DEBUG":   true,
+	"EXISTS":  true,
+	"TYPE":    true,
+	"RESTORE": true,
+	"WATCH":   true,
+}
+
+// embstrSizeLimit is the longest string Redis stores with the embstr encoding
+const embstrSizeLimit = 44
+
+// listpackListSizeLimit is the size in bytes up to which Redis keeps a list in a single listpack,
+// the default list-max-listpack-size of -2
+const listpackListSizeLimit = 8 * 1024
+
+// isIntEncodable reports whether Redis would store the string as an int64: a decimal integer in range
+// written in its canonical form, without a plus sign, leading zeros or spaces
+func isIntEncodable(s string) bool {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == s
+}
+
+// objectEncoding reports the Redis encoding matching the entity.
+// Moonlight always uses Go maps, the small/large distinction only mirrors what Redis would report
+func (e *Engine) objectEncoding(entity storage.Entity) string {
+	switch entity.Type {
+	case storage.TypeString:
+		if isIntEncodable(entity.Value.(string)) {
+			return "int"
+		}
+		if len(entity.Value.(string)) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case storage.TypeHash:
+		hash := entity.Value.(map[string]storage.HashField)
+		if len(hash) > e.cfg.Storage.HashMaxListpackEntries {
+			return "hashtable"
+		}
+		for field, v := range hash {
+			if len(field) > e.cfg.Storage.HashMaxListpackValue || len(v.Value) > e.cfg.Storage.HashMaxListpackValue {
+				return "hashtable"
+			}
+		}
+		return "listpack"
+	case storage.TypeList:
+		var size int
+		for _, element := range entity.Value.([]string) {
+			size += len(element)
+		}
+		if size > listpackListSizeLimit {
+			return "quicklist"
+		}
+		return "listpack"
+	case storage.TypeStream:
+		return "stream"
+	}
+
+	return "unknown"
+}
+
+// keyType TYPE key returns the name of the type of the value stored at key, none if the key does not exist
+func keyType(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("TYPE")
+	}
+
+	var t storage.DataType
+	if !(*ctx.storage).View(string(ctx.args[0].String), func(entity storage.Entity) { t = entity.Type }) {
+		return resp.MakeSimpleString("none")
+	}
+
+	return resp.MakeSimpleString(t.String())
+}
+
+// object OBJECT ENCODING|IDLETIME key inspects the internals of the value stored at key
+func (e *Engine) object(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("OBJECT")
+	}
+
+	sub := strings.ToUpper(string(ctx.args[0].String))
+	switch sub {
+	case "ENCODING":
+		if len(ctx.args) != 2 {
+			return resp.MakeErrorWrongNumberOfArguments("OBJECT|ENCODING")
+		}
+
+		var encoding string
+		ok := (*ctx.storage).View(string(ctx.args[1].String), func(entity storage.Entity) {
+			encoding = e.objectEncoding(entity)
+		})
+		if !ok {
+			return resp.MakeNilBulkString()
+		}
+
+		return resp.MakeBulkString(encoding)
+	case "IDLETIME":
+		if len(ctx.args) != 2 {
+			return resp.MakeErrorWrongNumberOfArguments("OBJECT|IDLETIME")
+		}
+
+		var idle time.Duration
+		ok := (*ctx.storage).View(string(ctx.args[1].String), func(entity storage.Entity) {
+			idle = entity.IdleTime()
+		})
+		if !ok {
+			return resp.MakeNilBulkString()
+		}
+
+		return resp.MakeInteger(int64(idle / time.Second))
+	}
+
+	return resp.MakeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", strings.ToLower(sub)))
+}
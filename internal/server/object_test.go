@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/config"
+	"github.com/eternalApril/moonlight/internal/persistence"
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestObjectEncoding(t *testing.T) {
+	eng := setupEngine()
+	eng.cfg.Storage.HashMaxListpackEntries = 2
+	eng.cfg.Storage.HashMaxListpackValue = 8
+
+	encoding := func(key string) string {
+		t.Helper()
+		res := eng.Execute(mockPeer, "OBJECT", makeCommand("", "ENCODING", key))
+		return string(res.String)
+	}
+
+	for i := 0; i < 2; i++ {
+		eng.Execute(mockPeer, "HSET", makeCommand("", "h", fmt.Sprintf("f%d", i), "v"))
+	}
+	if got := encoding("h"); got != "listpack" {
+		t.Errorf("expected listpack at the entries threshold, got %q", got)
+	}
+
+	eng.Execute(mockPeer, "HSET", makeCommand("", "h", "f2", "v"))
+	if got := encoding("h"); got != "hashtable" {
+		t.Errorf("expected hashtable past the entries threshold, got %q", got)
+	}
+
+	eng.Execute(mockPeer, "HSET", makeCommand("", "small", "f", strings.Repeat("x", 8)))
+	if got := encoding("small"); got != "listpack" {
+		t.Errorf("expected listpack at the value threshold, got %q", got)
+	}
+
+	eng.Execute(mockPeer, "HSET", makeCommand("", "small", "f", strings.Repeat("x", 9)))
+	if got := encoding("small"); got != "hashtable" {
+		t.Errorf("expected hashtable past the value threshold, got %q", got)
+	}
+
+	eng.Execute(mockPeer, "SET", makeCommand("", "s", "short"))
+	if got := encoding("s"); got != "embstr" {
+		t.Errorf("expected embstr, got %q", got)
+	}
+
+	eng.Execute(mockPeer, "SET", makeCommand("", "s", strings.Repeat("x", 45)))
+	if got := encoding("s"); got != "raw" {
+		t.Errorf("expected raw, got %q", got)
+	}
+
+	for value, want := range map[string]string{
+		"12345":                 "int",
+		"-42":                   "int",
+		"0":                     "int",
+		"9223372036854775807":   "int",
+		"9223372036854775808":   "embstr", // out of int64 range
+		"007":                   "embstr", // leading zeros
+		"+1":                    "embstr",
+		" 1":                    "embstr",
+		"-0":                    "embstr",
+		strings.Repeat("1", 45): "raw",
+	} {
+		eng.Execute(mockPeer, "SET", makeCommand("", "n", value))
+		if got := encoding("n"); got != want {
+			t.Errorf("%q: expected %s, got %q", value, want, got)
+		}
+	}
+
+	res := eng.Execute(mockPeer, "OBJECT", makeCommand("", "ENCODING", "missing"))
+	if !res.IsNull {
+		t.Errorf("expected nil for missing key, got %v", res)
+	}
+}
+
+func TestType(t *testing.T) {
+	eng := setupEngine()
+
+	for _, cmd := range [][]string{
+		{"SET", "string", "v"},
+		{"SET", "int", "42"},
+		{"PFADD", "hll", "a"},
+		{"BITFIELD", "bits", "SET", "u8", "0", "1"},
+		{"RPUSH", "list", "a"},
+		{"HSET", "hash", "f", "v"},
+		{"XADD", "stream", "1-0", "f", "v"},
+		{"XGROUP", "CREATE", "group", "g", "$", "MKSTREAM"},
+		{"SET", "expired", "v", "PX", "1"},
+	} {
+		if res := eng.Execute(mockPeer, cmd[0], makeCommand(cmd[0], cmd[1:]...)); res.Type == resp.TypeError {
+			t.Fatalf("%v: %s", cmd, res.String)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	for key, want := range map[string]string{
+		"string":  "string",
+		"int":     "string",
+		"hll":     "string",
+		"bits":    "string",
+		"list":    "list",
+		"hash":    "hash",
+		"stream":  "stream",
+		"group":   "stream",
+		"expired": "none",
+		"missing": "none",
+	} {
+		res := eng.Execute(mockPeer, "TYPE", makeCommand("TYPE", key))
+		if res.Type != resp.TypeSimpleString || string(res.String) != want {
+			t.Errorf("TYPE %s: expected %s, got %v", key, want, res)
+		}
+	}
+}
+
+func TestDebugObject(t *testing.T) {
+	eng := setupEngine()
+
+	res := eng.Execute(mockPeer, "DEBUG", makeCommand("", "OBJECT", "h"))
+	if res.Type != resp.TypeError {
+		t.Fatalf("expected DEBUG to be disabled by default, got %v", res)
+	}
+
+	eng.cfg.Server.EnableDebugCommand = true
+	eng.cfg.Storage.HashMaxListpackEntries = 128
+	eng.cfg.Storage.HashMaxListpackValue = 64
+
+	eng.Execute(mockPeer, "HSET", makeCommand("", "h", "f1", "v1", "f2", "v2"))
+
+	res = eng.Execute(mockPeer, "DEBUG", makeCommand("", "OBJECT", "h"))
+	info := string(res.String)
+	if res.Type != resp.TypeSimpleString {
+		t.Fatalf("expected simple string, got %v", res)
+	}
+
+	if !strings.Contains(info, "type:hash") || !strings.Contains(info, "elements:2") {
+		t.Errorf("unexpected DEBUG OBJECT reply %q", info)
+	}
+
+	var length int
+	for _, field := range strings.Fields(info) {
+		if v, ok := strings.CutPrefix(field, "serializedlength:"); ok {
+			length, _ = strconv.Atoi(v) //nolint:errcheck
+		}
+	}
+	if length <= 0 {
+		t.Errorf("expected non-zero serializedlength, got %q", info)
+	}
+
+	res = eng.Execute(mockPeer, "DEBUG", makeCommand("", "OBJECT", "missing"))
+	if res.Type != resp.TypeError {
+		t.Errorf("expected error for missing key, got %v", res)
+	}
+}
+
+func TestDebugStringMatchLen(t *testing.T) {
+	eng := setupEngine()
+
+	res := eng.Execute(mockPeer, "DEBUG", makeCommand("", "STRINGMATCH-LEN", "*", "a"))
+	if res.Type != resp.TypeError {
+		t.Fatalf("expected DEBUG to be disabled by default, got %v", res)
+	}
+
+	eng.cfg.Server.EnableDebugCommand = true
+
+	tests := []struct {
+		pattern string
+		input   string
+		want    int64
+	}{
+		{"h[a-c]llo", "hbllo", 1},
+		{"h[a-c]llo", "hdllo", 0},
+		{"h[^e]llo", "hallo", 1},
+		{"h[^e]llo", "hello", 0},
+		{"h\\[a\\]llo", "h[a]llo", 1},
+		{"h\\[a\\]llo", "hallo", 0},
+		{"[\\]]", "]", 1},
+		{"*", "", 1},
+		{"a*b*c", "axxbyyc", 1},
+		{"a*b*c", "axxbyy", 0},
+		{"h?llo", "hllo", 0},
+	}
+
+	for _, tt := range tests {
+		res := eng.Execute(mockPeer, "DEBUG", makeCommand("", "STRINGMATCH-LEN", tt.pattern, tt.input))
+		if res.Type != resp.TypeInteger || res.Integer != tt.want {
+			t.Errorf("STRINGMATCH-LEN %q %q: expected %d, got %v", tt.pattern, tt.input, tt.want, res)
+		}
+	}
+
+	res = eng.Execute(mockPeer, "DEBUG", makeCommand("", "STRINGMATCH-LEN", "*"))
+	if res.Type != resp.TypeError {
+		t.Errorf("expected wrong number of arguments error, got %v", res)
+	}
+}
+
+func TestDebugSleep(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.EnableDebugCommand = true
+
+	sleeper := startConnection(t, e)
+	go sleeper.Write([]byte("*3\r\n$5\r\nDEBUG\r\n$5\r\nSLEEP\r\n$3\r\n0.5\r\n")) //nolint:errcheck
+
+	slept := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		resp.NewDecoder(sleeper).Read() //nolint:errcheck
+		slept <- time.Since(start)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a second connection, including a transaction, is served while the first one sleeps
+	other := startConnection(t, e)
+	other.SetDeadline(time.Now().Add(200 * time.Millisecond))           //nolint:errcheck
+	go other.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n" + //nolint:errcheck
+		"*1\r\n$5\r\nMULTI\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*1\r\n$4\r\nEXEC\r\n"))
+
+	dec := resp.NewDecoder(other)
+	var res resp.Value
+	for range 4 {
+		var err error
+		if res, err = dec.Read(); err != nil {
+			t.Fatalf("second connection was blocked by DEBUG SLEEP: %v", err)
+		}
+	}
+	if res.Type != resp.TypeArray || len(res.Array) != 1 || string(res.Array[0].String) != "v" {
+		t.Errorf("unexpected EXEC reply %v", res)
+	}
+
+	if d := <-slept; d < 400*time.Millisecond {
+		t.Errorf("DEBUG SLEEP 0.5 returned after %v", d)
+	}
+
+	for _, arg := range []string{"-1", "abc", "inf", "nan"} {
+		if res := e.Execute(mockPeer, "DEBUG", makeCommand("", "SLEEP", arg)); res.Type != resp.TypeError {
+			t.Errorf("DEBUG SLEEP %s: expected error, got %v", arg, res)
+		}
+	}
+}
+
+func TestClientNoTouch(t *testing.T) {
+	eng := setupEngine()
+	peer := NewPeer(nil)
+
+	eng.Execute(peer, "SET", makeCommand("", "k", "v"))
+	time.Sleep(1100 * time.Millisecond)
+
+	res := eng.Execute(peer, "CLIENT", makeCommand("", "NO-TOUCH", "on"))
+	if string(res.String) != "OK" {
+		t.Fatalf("CLIENT NO-TOUCH on: got %v", res)
+	}
+
+	eng.Execute(peer, "GET", makeCommand("", "k"))
+	res = eng.Execute(peer, "OBJECT", makeCommand("", "IDLETIME", "k"))
+	if res.Integer < 1 {
+		t.Errorf("read under NO-TOUCH must not reset idle time, got %d", res.Integer)
+	}
+
+	eng.Execute(peer, "CLIENT", makeCommand("", "NO-TOUCH", "off"))
+	eng.Execute(peer, "GET", makeCommand("", "k"))
+	res = eng.Execute(peer, "OBJECT", makeCommand("", "IDLETIME", "k"))
+	if res.Integer != 0 {
+		t.Errorf("read must reset idle time, got %d", res.Integer)
+	}
+
+	res = eng.Execute(peer, "CLIENT", makeCommand("", "NO-EVICT", "maybe"))
+	if res.Type != resp.TypeError {
+		t.Errorf("expected syntax error, got %v", res)
+	}
+}
+
+func TestDebugPopulate(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.EnableDebugCommand = true
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "key:0", "mine"))
+
+	res := e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "1000"))
+	if res.Type != resp.TypeSimpleString || string(res.String) != "OK" {
+		t.Fatalf("DEBUG POPULATE: unexpected reply %v", res)
+	}
+
+	if res := e.Execute(mockPeer, "DBSIZE", makeCommand("DBSIZE")); res.Integer != 1000 {
+		t.Errorf("DBSIZE = %d, want 1000", res.Integer)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "key:999")); string(res.String) != "value:999" {
+		t.Errorf("GET key:999 = %q, want value:999", res.String)
+	}
+	// existing keys are not overwritten
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "key:0")); string(res.String) != "mine" {
+		t.Errorf("GET key:0 = %q, want mine", res.String)
+	}
+
+	e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "2", "bench", "10"))
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "bench:1")); string(res.String) != "value:1\x00\x00\x00" {
+		t.Errorf("GET bench:1 = %q, want a 10 byte value", res.String)
+	}
+
+	res = e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "2", "huge", "1000000000000"))
+	if res.Type != resp.TypeError || !strings.Contains(string(res.String), "maximum allowed size") {
+		t.Errorf("expected an error for a size above proto_max_string_len, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "huge:0")); res.Integer != 0 {
+		t.Errorf("DEBUG POPULATE with a too large size created keys")
+	}
+
+	if res := e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "-1")); res.Type != resp.TypeError {
+		t.Errorf("expected an error for a negative count, got %v", res)
+	}
+}
+
+func TestDebugPopulateIsolation(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.EnableDebugCommand = true
+
+	// a key created by POPULATE aborts the transaction watching it
+	peer := NewPeer(nil)
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "key:5"))
+	e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "10"))
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "key:5", "mine"))
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); !res.IsNull {
+		t.Errorf("expected the watched key created by POPULATE to abort EXEC, got %v", res)
+	}
+
+	// POPULATE waits for a running EXEC instead of writing in the middle of it
+	e.txMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "10", "tx"))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Errorf("DEBUG POPULATE ran while a transaction held txMu")
+	case <-time.After(50 * time.Millisecond):
+	}
+	e.txMu.Unlock()
+	<-done
+
+	e.readOnly.Store(true)
+	defer e.readOnly.Store(false)
+	res := e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "10", "ro"))
+	if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "READONLY") {
+		t.Errorf("expected READONLY in read-only mode, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "ro:0")); res.Integer != 0 {
+		t.Errorf("DEBUG POPULATE wrote in read-only mode")
+	}
+}
+
+func TestDebugShardInfo(t *testing.T) {
+	s, _ := storage.NewShardedMapStorage(8) //nolint:errcheck
+	e, err := NewEngine(s, &config.Config{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cfg.Server.EnableDebugCommand = true
+
+	e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "POPULATE", "1000"))
+
+	res := e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "SHARDINFO"))
+	if res.Type != resp.TypeBulkString {
+		t.Fatalf("unexpected reply %v", res)
+	}
+
+	var shards, sum int64
+	for _, line := range strings.Split(strings.TrimSpace(string(res.String)), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !strings.HasPrefix(name, "shard_") || err != nil {
+			continue
+		}
+		shards++
+		sum += n
+	}
+
+	if shards != 8 {
+		t.Errorf("expected 8 shards, got %d in %q", shards, res.String)
+	}
+	if dbsize := e.Execute(mockPeer, "DBSIZE", makeCommand("DBSIZE")); sum != dbsize.Integer {
+		t.Errorf("shard counts sum to %d, DBSIZE is %d", sum, dbsize.Integer)
+	}
+	if !strings.Contains(string(res.String), "keys:1000\r\n") {
+		t.Errorf("missing total in %q", res.String)
+	}
+}
+
+func TestShardInfo(t *testing.T) {
+	got := shardInfo([]int64{2, 4, 4, 4, 5, 5, 7, 9})
+	for _, want := range []string{"min:2\r\n", "max:9\r\n", "spread:7\r\n", "stddev:2.00\r\n", "shard_7:9\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+}
+
+func TestDebugQuicksave(t *testing.T) {
+	e := setupEngine()
+	e.cfg.Server.EnableDebugCommand = true
+	e.cfg.Server.DebugQuicksaveMaxSize = 1024 * 1024
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "s", "value", "EX", "100"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f1", "v1", "f2", "v2"))
+	e.Execute(mockPeer, "RPUSH", makeCommand("RPUSH", "l", "a", "b", "c"))
+
+	res := e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "QUICKSAVE"))
+	if res.Type != resp.TypeBulkString {
+		t.Fatalf("unexpected reply %v", res)
+	}
+
+	restored, _ := storage.NewShardedMapStorage(4) //nolint:errcheck
+	if err := persistence.LoadFrom(bytes.NewReader(res.String), restored); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	if n := restored.Len(); n != 3 {
+		t.Errorf("restored %d keys, want 3", n)
+	}
+	if v, ok, _ := restored.Get("s"); !ok || v != "value" {
+		t.Errorf("s = %q, %v, want value", v, ok)
+	}
+	if ttl, status := restored.RemainingTTL("s"); status != storage.ExpActive || ttl <= 0 {
+		t.Errorf("the TTL of s was lost, got %v", ttl)
+	}
+	if h, _ := restored.HGetAll("h"); h["f1"] != "v1" || h["f2"] != "v2" {
+		t.Errorf("h = %v", h)
+	}
+	if l, err := restored.LRange("l", 0, -1); err != nil || strings.Join(l, ",") != "a,b,c" {
+		t.Errorf("l = %v, %v, want a,b,c", l, err)
+	}
+
+	e.cfg.Server.DebugQuicksaveMaxSize = 16
+	if res := e.Execute(mockPeer, "DEBUG", makeCommand("DEBUG", "QUICKSAVE")); res.Type != resp.TypeError {
+		t.Errorf("expected an error past the size limit, got %v", res)
+	}
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/eternalApril/moonlight/internal/resp"
 )
@@ -10,21 +15,52 @@ import (
 // Peer represents a connected client.
 // It wraps a network connection and provides synchronized methods for reading and writing RESP-encoded data
 type Peer struct {
+	id            int64 // unique client id, reported by HELLO
 	conn          net.Conn
 	reader        *resp.Decoder
 	writer        *resp.Encoder
 	mu            sync.Mutex
 	authenticated bool
+	channels      map[string]struct{}   // channels subscribed with SUBSCRIBE
+	patterns      map[string]struct{}   // patterns subscribed with PSUBSCRIBE
+	shardChannels map[string]struct{}   // shard channels subscribed with SSUBSCRIBE
+	multi         bool                  // true between MULTI and EXEC/DISCARD
+	multiErr      bool                  // a command failed to queue, EXEC must abort
+	queued        []queuedCommand       // commands queued by MULTI
+	inExec        bool                  // EXEC is running the queued commands, their AOF payload goes to execAOF
+	execAOF       []byte                // AOF payload of the commands run by the current EXEC
+	watched       map[string]watchState // keys watched with WATCH
+	noTouch       bool                  // CLIENT NO-TOUCH, reads do not update the access time of keys
+	noEvict       bool                  // CLIENT NO-EVICT, accepted for compatibility
+	protocol      int                   // RESP version negotiated with HELLO
+	streaming     bool                  // large replies may be written straight to the connection, set by HandleConnection
+	limiter       rateLimiter           // throttles the connection, see server.client_max_commands_per_sec
+	rate          commandRate           // commands per second, reported by CLIENT LIST
+
+	lastInteraction atomic.Int64 // Unix nanoseconds of the last received command, read by the idle reaper
+	subscribed      atomic.Bool  // the peer has Pub/Sub subscriptions, the idle reaper keeps it
+	blocked         atomic.Bool  // the peer waits in XREAD BLOCK, the idle reaper keeps it
 }
 
+// peerIDs hands out the client ids, they are never reused during the lifetime of the process
+var peerIDs atomic.Int64
+
 // NewPeer initializes a new client peer from a network connection
 func NewPeer(conn net.Conn) *Peer {
-	return &Peer{
+	peer := &Peer{
+		id:            peerIDs.Add(1),
 		conn:          conn,
 		reader:        resp.NewDecoder(conn),
 		writer:        resp.NewEncoder(conn),
 		authenticated: false,
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
+		watched:       make(map[string]watchState),
+		protocol:      2,
 	}
+	peer.lastInteraction.Store(time.Now().UnixNano())
+	return peer
 }
 
 // Send encodes and writes a RESP value to the client.
@@ -35,11 +71,27 @@ func (p *Peer) Send(v resp.Value) error {
 	return p.writer.Write(v)
 }
 
+// Stream calls fn with the peer's encoder, so a large reply is written without building a Value.
+// The writer lock is held until fn returns, other messages cannot interleave with the reply
+func (p *Peer) Stream(fn func(enc *resp.Encoder) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fn(p.writer)
+}
+
 // ReadCommand reads and decodes the next RESP value from the client's input stream
 func (p *Peer) ReadCommand() (resp.Value, error) {
 	return p.reader.Read()
 }
 
+// Addr returns the remote address of the client, empty if the peer has no connection
+func (p *Peer) Addr() string {
+	if p.conn == nil {
+		return ""
+	}
+	return p.conn.RemoteAddr().String()
+}
+
 // Close terminates the underlying network connection
 func (p *Peer) Close() error {
 	return p.conn.Close()
@@ -56,3 +108,53 @@ func (p *Peer) Flush() error {
 func (p *Peer) InputBuffered() int {
 	return p.reader.Buffered()
 }
+
+// watchDisconnect reports the client closing its connection while a command blocks, the connection is not read
+// during the command otherwise. The returned channel is closed when the connection fails. Data sent meanwhile
+// stays in the input buffer, once it is full the disconnection is not detected anymore.
+// stop must return before the peer reads again
+func (p *Peer) watchDisconnect() (gone <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	if p.conn == nil {
+		return ch, func() {}
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			err := p.reader.Peek(p.reader.Buffered() + 1)
+			if err == nil {
+				continue
+			}
+			// stop interrupts the wait with a read deadline, and a full buffer ends the watch
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, bufio.ErrBufferFull) {
+				close(ch)
+			}
+			return
+		}
+	}()
+
+	return ch, func() {
+		p.conn.SetReadDeadline(time.Now()) //nolint:errcheck
+		<-exited
+		p.conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+	}
+}
+
+// subscriptions returns the total number of channels and patterns the peer is subscribed to
+func (p *Peer) subscriptions() int {
+	return len(p.channels) + len(p.patterns)
+}
+
+// inSubscribeMode reports whether the peer has any channel, pattern or shard channel subscription
+func (p *Peer) inSubscribeMode() bool {
+	return p.subscriptions() > 0 || len(p.shardChannels) > 0
+}
+
+// resetMulti leaves the transaction state
+func (p *Peer) resetMulti() {
+	p.multi = false
+	p.multiErr = false
+	p.queued = nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// propagation holds the commands a handler wants written to the AOF instead of the executed one.
+// Handlers of non-deterministic commands use it to persist the effect, so replaying the AOF gives the same result.
+// No commands means nothing is written
+type propagation struct {
+	commands []propagatedCommand
+}
+
+// propagatedCommand is a single command written to the AOF
+type propagatedCommand struct {
+	name string
+	args []resp.Value
+}
+
+// propagate appends name with args to the commands written to the AOF instead of the executed command
+func (ctx *context) propagate(name string, args ...resp.Value) {
+	if ctx.propagation == nil {
+		ctx.propagation = &propagation{}
+	}
+	ctx.propagation.commands = append(ctx.propagation.commands, propagatedCommand{name: name, args: args})
+}
+
+// noPropagate keeps the executed command out of the AOF, for calls that did not change the keyspace.
+// Nothing propagated also means the watches of the keys are not invalidated and no blocked client is woken
+func (ctx *context) noPropagate() {
+	ctx.propagation = &propagation{}
+}
+
+// unchanged reports whether the handler declared with noPropagate that the call did not change the keyspace
+func (ctx *context) unchanged() bool {
+	return ctx.propagation != nil && len(ctx.propagation.commands) == 0
+}
+
+// aofRewriter converts an executed command into the form that is written to the AOF
+type aofRewriter func(ctx *context, now time.Time) (string, []resp.Value)
+
+// aofRewriters translates commands with a relative expiration into their absolute-timestamp equivalents,
+// so replaying the AOF later reproduces the original deadline instead of restarting the TTL
+var aofRewriters = map[string]aofRewriter{
+	"EXPIRE":  rewriteRelativeExpire(time.Second),
+	"PEXPIRE": rewriteRelativeExpire(time.Millisecond),
+	"SET":     rewriteSet,
+	"RESTORE": rewriteRestore,
+	"HSETEX":  rewriteHSetEx,
+	"HEXPIRE": rewriteHExpire,
+}
+
+// rewriteForAOF returns the command name and arguments that must be written to the AOF.
+// now is the moment the command was executed
+func rewriteForAOF(name string, ctx *context, now time.Time) (string, []resp.Value) {
+	rewrite, ok := aofRewriters[name]
+	if !ok {
+		return name, ctx.args
+	}
+	return rewrite(ctx, now)
+}
+
+// aofCommands returns the commands that must be written to the AOF for an executed write command:
+// the ones the handler propagated, otherwise the command itself passed through rewriteForAOF
+func aofCommands(name string, ctx *context, now time.Time) []propagatedCommand {
+	if ctx.propagation != nil {
+		return ctx.propagation.commands
+	}
+
+	aofName, aofArgs := rewriteForAOF(name, ctx, now)
+	return []propagatedCommand{{name: aofName, args: aofArgs}}
+}
+
+// rewriteRelativeExpire builds a rewriter that turns EXPIRE/PEXPIRE into PEXPIREAT.
+// Like rewriteSet, it takes the deadline from the storage, so the AOF holds the expiration the key received
+func rewriteRelativeExpire(unit time.Duration) aofRewriter {
+	return func(ctx *context, now time.Time) (string, []resp.Value) {
+		args := ctx.args
+		if len(args) != 2 {
+			return "PEXPIREAT", args
+		}
+
+		n, err := strconv.ParseInt(string(args[1].String), 10, 64)
+		if err != nil {
+			return "PEXPIREAT", args
+		}
+
+		deadline := now.Add(time.Duration(n) * unit).UnixMilli()
+		if remaining, status := (*ctx.storage).RemainingTTL(string(args[0].String)); status == storage.ExpActive {
+			deadline = time.Now().Add(remaining).UnixMilli()
+		}
+
+		return "PEXPIREAT", []resp.Value{
+			args[0],
+			resp.MakeBulkString(strconv.FormatInt(deadline, 10)),
+		}
+	}
+}
+
+// rewriteSet replaces the EX and PX options of SET with PXAT.
+// The deadline is taken from the storage, so the AOF holds exactly the expiration the key received
+func rewriteSet(ctx *context, now time.Time) (string, []resp.Value) {
+	args := ctx.args
+	rewritten := make([]resp.Value, len(args))
+	copy(rewritten, args)
+
+	for i := 2; i+1 < len(rewritten); i++ {
+		var unit time.Duration
+
+		switch strings.ToUpper(string(rewritten[i].String)) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		case "EXAT", "PXAT":
+			i++
+			continue
+		default:
+			continue
+		}
+
+		n, err := strconv.ParseInt(string(rewritten[i+1].String), 10, 64)
+		if err != nil {
+			return "SET", args
+		}
+
+		deadline := now.Add(time.Duration(n) * unit).UnixMilli()
+		if remaining, status := (*ctx.storage).RemainingTTL(string(args[0].String)); status == storage.ExpActive {
+			deadline = time.Now().Add(remaining).UnixMilli()
+		}
+
+		rewritten[i] = resp.MakeBulkString("PXAT")
+		rewritten[i+1] = resp.MakeBulkString(strconv.FormatInt(deadline, 10))
+		i++
+	}
+
+	return "SET", rewritten
+}
+
+// rewriteRestore turns the relative ttl of RESTORE into an ABSTTL timestamp
+func rewriteRestore(ctx *context, now time.Time) (string, []resp.Value) {
+	args := ctx.args
+
+	ttl, err := strconv.ParseInt(string(args[1].String), 10, 64)
+	if err != nil || ttl == 0 {
+		return "RESTORE", args
+	}
+	for _, arg := range args[3:] {
+		if strings.EqualFold(string(arg.String), "ABSTTL") {
+			return "RESTORE", args
+		}
+	}
+
+	rewritten := make([]resp.Value, len(args), len(args)+1)
+	copy(rewritten, args)
+	rewritten[1] = resp.MakeBulkString(strconv.FormatInt(now.Add(time.Duration(ttl)*time.Millisecond).UnixMilli(), 10))
+
+	return "RESTORE", append(rewritten, resp.MakeBulkString("ABSTTL"))
+}
+
+// rewriteHSetEx turns the relative seconds of HSETEX into the PXAT form, keeping the condition
+func rewriteHSetEx(ctx *context, now time.Time) (string, []resp.Value) {
+	args := ctx.args
+
+	// the seconds follow the FNX or FXX condition
+	at := 1
+	if cond := strings.ToUpper(string(args[1].String)); cond == "FNX" || cond == "FXX" {
+		at = 2
+	}
+
+	seconds, err := strconv.ParseInt(string(args[at].String), 10, 64)
+	if err != nil {
+		return "HSETEX", args // already the PXAT form
+	}
+
+	deadline := now.Add(time.Duration(seconds) * time.Second).UnixMilli()
+
+	rewritten := make([]resp.Value, 0, len(args)+1)
+	rewritten = append(rewritten, args[:at]...)
+	rewritten = append(rewritten, resp.MakeBulkString("PXAT"), resp.MakeBulkString(strconv.FormatInt(deadline, 10)))
+	return "HSETEX", append(rewritten, args[at+1:]...)
+}
+
+// rewriteHExpire turns HEXPIRE into HPEXPIREAT, keeping the condition and the fields
+func rewriteHExpire(ctx *context, now time.Time) (string, []resp.Value) {
+	args := ctx.args
+
+	seconds, err := strconv.ParseInt(string(args[1].String), 10, 64)
+	if err != nil {
+		return "HEXPIRE", args
+	}
+
+	rewritten := make([]resp.Value, len(args))
+	copy(rewritten, args)
+	rewritten[1] = resp.MakeBulkString(strconv.FormatInt(now.Add(time.Duration(seconds)*time.Second).UnixMilli(), 10))
+
+	return "HPEXPIREAT", rewritten
+}
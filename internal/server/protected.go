@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net"
+
+	"github.com/eternalApril/moonlight/internal/config"
+)
+
+// protectedModeError is the reply to clients refused by protected mode, the connection is then closed
+const protectedModeError = "DENIED Moonlight is running in protected mode because protected mode is enabled and " +
+	"no password is set. In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers you may adopt one of the following solutions: " +
+	"1) Set server.requirepass in the config file or MOONLIGHT_SERVER_REQUIREPASS and restart the server. " +
+	"2) Bind the server to loopback addresses only with server.host or server.bind. " +
+	"3) Disable protected mode by setting server.protected_mode to false in the config file " +
+	"or MOONLIGHT_SERVER_PROTECTED_MODE=false, and restart the server. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside."
+
+// protectedMode reports whether external clients must be refused: protected mode is enabled,
+// no password is set and the server listens on at least one non-loopback address
+func protectedMode(cfg *config.Config) bool {
+	if !cfg.Server.ProtectedMode || cfg.Server.RequirePass != "" {
+		return false
+	}
+
+	hosts := cfg.Server.Bind
+	if len(hosts) == 0 {
+		hosts = []string{cfg.Server.Host}
+	}
+
+	for _, host := range hosts {
+		if host == "localhost" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback reports whether addr is a loopback TCP address. Other kinds of addresses,
+// e.g. unix sockets or in-memory pipes, can only be local and are accepted too
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return tcp.IP.IsLoopback()
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/eternalApril/moonlight/internal/glob"
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// broker routes published messages to the subscribed peers
+type broker struct {
+	mu            sync.RWMutex
+	channels      map[string]map[*Peer]struct{} // channel - subscribers
+	patterns      map[string]map[*Peer]struct{} // pattern - subscribers
+	shardChannels map[string]map[*Peer]struct{} // shard channel - subscribers, sharding is a no-op on a single node
+}
+
+// newBroker creates an empty broker
+func newBroker() *broker {
+	return &broker{
+		channels:      make(map[string]map[*Peer]struct{}),
+		patterns:      make(map[string]map[*Peer]struct{}),
+		shardChannels: make(map[string]map[*Peer]struct{}),
+	}
+}
+
+// addSubscriber registers the peer in the namespace under name
+func (b *broker) addSubscriber(namespace map[string]map[*Peer]struct{}, name string, peer *Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := namespace[name]
+	if !ok {
+		subs = make(map[*Peer]struct{})
+		namespace[name] = subs
+	}
+	subs[peer] = struct{}{}
+}
+
+// removeSubscriber removes the peer from the namespace under name
+func (b *broker) removeSubscriber(namespace map[string]map[*Peer]struct{}, name string, peer *Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := namespace[name]
+	if !ok {
+		return
+	}
+	delete(subs, peer)
+	if len(subs) == 0 {
+		delete(namespace, name)
+	}
+}
+
+// delivery is a message addressed to a single subscriber
+type delivery struct {
+	peer    *Peer
+	payload resp.Value
+}
+
+// publish delivers the message to every subscriber of the channel and every matching pattern.
+// Returns the number of peers that received the message
+func (b *broker) publish(channel, message string) int64 {
+	b.mu.RLock()
+	deliveries := make([]delivery, 0, len(b.channels[channel]))
+	for peer := range b.channels[channel] {
+		deliveries = append(deliveries, delivery{peer, resp.MakeArray([]resp.Value{
+			resp.MakeBulkString("message"),
+			resp.MakeBulkString(channel),
+			resp.MakeBulkString(message),
+		})})
+	}
+	for pattern, subs := range b.patterns {
+		if !glob.Match(pattern, channel) {
+			continue
+		}
+		for peer := range subs {
+			deliveries = append(deliveries, delivery{peer, resp.MakeArray([]resp.Value{
+				resp.MakeBulkString("pmessage"),
+				resp.MakeBulkString(pattern),
+				resp.MakeBulkString(channel),
+				resp.MakeBulkString(message),
+			})})
+		}
+	}
+	b.mu.RUnlock()
+
+	return deliver(deliveries)
+}
+
+// spublish delivers the message to every subscriber of the shard channel.
+// Shard channels are not matched against patterns. Returns the number of peers that received the message
+func (b *broker) spublish(channel, message string) int64 {
+	b.mu.RLock()
+	deliveries := make([]delivery, 0, len(b.shardChannels[channel]))
+	for peer := range b.shardChannels[channel] {
+		deliveries = append(deliveries, delivery{peer, resp.MakeArray([]resp.Value{
+			resp.MakeBulkString("smessage"),
+			resp.MakeBulkString(channel),
+			resp.MakeBulkString(message),
+		})})
+	}
+	b.mu.RUnlock()
+
+	return deliver(deliveries)
+}
+
+// deliver sends the messages outside the broker lock, a slow subscriber must not block the broker.
+// Returns the number of deliveries
+func deliver(deliveries []delivery) int64 {
+	for _, d := range deliveries {
+		if err := d.peer.Send(d.payload); err != nil {
+			continue
+		}
+		d.peer.Flush() //nolint:errcheck
+	}
+
+	return int64(len(deliveries))
+}
+
+// activeChannels returns the sorted names in the namespace that have subscribers and match the pattern.
+// An empty pattern matches every name
+func (b *broker) activeChannels(namespace map[string]map[*Peer]struct{}, pattern string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	names := make([]string, 0, len(namespace))
+	for name := range namespace {
+		if pattern == "" || glob.Match(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// numSubscribers returns the number of subscribers of name in the namespace
+func (b *broker) numSubscribers(namespace map[string]map[*Peer]struct{}, name string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(namespace[name])
+}
+
+// unsubscribeAll drops every subscription of the peer, used when the client disconnects
+func (b *broker) unsubscribeAll(peer *Peer) {
+	for channel := range peer.channels {
+		b.removeSubscriber(b.channels, channel, peer)
+		delete(peer.channels, channel)
+	}
+	for pattern := range peer.patterns {
+		b.removeSubscriber(b.patterns, pattern, peer)
+		delete(peer.patterns, pattern)
+	}
+	for channel := range peer.shardChannels {
+		b.removeSubscriber(b.shardChannels, channel, peer)
+		delete(peer.shardChannels, channel)
+	}
+}
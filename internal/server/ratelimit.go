@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled with limit tokens per second and holding at most limit tokens,
+// so a client may burst one second worth of commands. It is only used by the goroutine serving the connection
+type rateLimiter struct {
+	tokens float64
+	last   int64 // Unix nanoseconds of the last refill, 0 before the first command
+}
+
+// allow takes a token for a command received at now, false if the bucket is empty
+func (l *rateLimiter) allow(limit int, now int64) bool {
+	if l.last == 0 {
+		l.tokens = float64(limit)
+	} else {
+		l.tokens = min(float64(limit), l.tokens+float64(now-l.last)*float64(limit)/float64(time.Second))
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// commandRate counts the commands of a connection per wall-clock second. It is written by the goroutine serving
+// the connection and read by CLIENT LIST from other connections, the fields are atomic but not updated together,
+// which is fine for a figure meant to be read by humans
+type commandRate struct {
+	second   atomic.Int64 // Unix second being counted
+	count    atomic.Int64 // commands received during second
+	previous atomic.Int64 // commands received during the second before
+}
+
+// record counts a command received at now, in Unix nanoseconds
+func (r *commandRate) record(now int64) {
+	s := now / int64(time.Second)
+	if current := r.second.Load(); s != current {
+		previous := int64(0)
+		if s == current+1 {
+			previous = r.count.Load()
+		}
+		r.previous.Store(previous)
+		r.count.Store(0)
+		r.second.Store(s)
+	}
+	r.count.Add(1)
+}
+
+// perSecond returns the number of commands received during the last complete second before now
+func (r *commandRate) perSecond(now int64) int64 {
+	switch r.second.Load() {
+	case now/int64(time.Second) - 1:
+		return r.count.Load()
+	case now / int64(time.Second):
+		return r.previous.Load()
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// clientRegistry keeps the peers served by HandleConnection, keyed by their id
+type clientRegistry struct {
+	mu    sync.Mutex
+	peers map[int64]*Peer
+}
+
+// newClientRegistry creates an empty registry
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{peers: make(map[int64]*Peer)}
+}
+
+// add registers a connected peer
+func (r *clientRegistry) add(peer *Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.peers[peer.id] = peer
+}
+
+// remove forgets the peer, it is a no-op if the peer was already reaped
+func (r *clientRegistry) remove(peer *Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.peers, peer.id)
+}
+
+// startReaperLoop closes the connections idle for longer than server.reap_idle_after,
+// checking every server.reap_interval
+func (e *Engine) startReaperLoop() {
+	ticker := time.NewTicker(e.cfg.Server.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			e.reapIdle(now)
+		case <-e.stopReap:
+			return
+		}
+	}
+}
+
+// reapIdle closes the connections whose last command was received more than server.reap_idle_after before now.
+// Pub/Sub subscribers and clients blocked by XREAD are waiting for the server, so they are never reaped, like
+// in Redis. Closing the connection makes HandleConnection return and release the peer.
+// Returns the number of reaped connections
+func (e *Engine) reapIdle(now time.Time) int {
+	threshold := now.Add(-e.cfg.Server.ReapIdleAfter).UnixNano()
+
+	e.clients.mu.Lock()
+	var idle []*Peer
+	for id, peer := range e.clients.peers {
+		if peer.subscribed.Load() || peer.blocked.Load() {
+			continue
+		}
+		if peer.lastInteraction.Load() < threshold {
+			idle = append(idle, peer)
+			delete(e.clients.peers, id)
+		}
+	}
+	e.clients.mu.Unlock()
+
+	for _, peer := range idle {
+		e.logger.Info("closing idle connection", zap.Int64("id", peer.id), zap.String("addr", peer.Addr()))
+		peer.conn.Close() //nolint:errcheck
+		e.stats.reapedConnections.Add(1)
+	}
+
+	return len(idle)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+// redactedArg replaces a secret argument wherever commands are logged
+const redactedArg = "(redacted)"
+
+// sensitiveArgs reports, for commands that carry secrets, the indexes of the arguments to hide
+var sensitiveArgs = map[string]func(args []resp.Value) []int{
+	"AUTH":  allArgs,
+	"HELLO": helloAuthArgs,
+}
+
+// allArgs marks every argument as sensitive
+func allArgs(args []resp.Value) []int {
+	idx := make([]int, len(args))
+	for i := range args {
+		idx[i] = i
+	}
+	return idx
+}
+
+// helloAuthArgs marks the username and password of HELLO [protover [AUTH username password]]
+func helloAuthArgs(args []resp.Value) []int {
+	for i, arg := range args {
+		if strings.EqualFold(string(arg.String), "AUTH") {
+			var idx []int
+			for j := i + 1; j <= i+2 && j < len(args); j++ {
+				idx = append(idx, j)
+			}
+			return idx
+		}
+	}
+	return nil
+}
+
+// redactArgs renders the arguments of the command for logging, with secrets replaced by "(redacted)"
+func redactArgs(name string, args []resp.Value) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = string(arg.String)
+	}
+
+	if sensitive, ok := sensitiveArgs[name]; ok {
+		for _, i := range sensitive(args) {
+			out[i] = redactedArg
+		}
+	}
+
+	return out
+}
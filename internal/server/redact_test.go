@@ -0,0 +1,71 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eternalApril/moonlight/internal/config"
+	"github.com/eternalApril/moonlight/internal/logger"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		args []string
+		want []string
+	}{
+		{"AUTH password", "AUTH", []string{"secret"}, []string{redactedArg}},
+		{"AUTH user password", "AUTH", []string{"user", "secret"}, []string{redactedArg, redactedArg}},
+		{"HELLO AUTH", "HELLO", []string{"3", "AUTH", "user", "secret", "SETNAME", "c"},
+			[]string{"3", "AUTH", redactedArg, redactedArg, "SETNAME", "c"}},
+		{"HELLO without AUTH", "HELLO", []string{"3"}, []string{"3"}},
+		{"Regular command", "SET", []string{"k", "v"}, []string{"k", "v"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactArgs(tt.cmd, makeCommand(tt.cmd, tt.args...))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogRedactsAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	s, _ := storage.NewShardedMapStorage(1) //nolint:errcheck
+	e, err := NewEngine(s, &config.Config{
+		Server: config.ServerConfig{RequirePass: "topsecret"},
+		Log: config.LogConfig{
+			Format:        "json",
+			AccessLog:     true,
+			AccessLogPath: path,
+			AccessLogArgs: true,
+		},
+	}, logger.New("info", "console"))
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+
+	e.Execute(NewPeer(nil), "AUTH", makeCommand("AUTH", "topsecret"))
+	e.accessLog.Sync() //nolint:errcheck
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read access log: %v", err)
+	}
+
+	if strings.Contains(string(data), "topsecret") {
+		t.Errorf("password leaked into the access log: %q", data)
+	}
+	if !strings.Contains(string(data), redactedArg) {
+		t.Errorf("expected redacted argument in the access log: %q", data)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"slices"
+
+	"github.com/eternalApril/moonlight/internal/config"
+	"go.uber.org/zap"
+)
+
+// Reload applies the settings of cfg that can change at runtime, currently persistence.rdb.interval.
+// Settings that need a restart keep their current value and are logged with a warning.
+// The log level belongs to the logger and is reloaded by its owner
+func (e *Engine) Reload(cfg *config.Config) {
+	restart := []struct {
+		name    string
+		changed bool
+	}{
+		{"server.host", cfg.Server.Host != e.cfg.Server.Host},
+		{"server.port", cfg.Server.Port != e.cfg.Server.Port},
+		{"server.bind", !slices.Equal(cfg.Server.Bind, e.cfg.Server.Bind)},
+		{"server.bind_fail_fast", cfg.Server.BindFailFast != e.cfg.Server.BindFailFast},
+		{"server.requirepass", cfg.Server.RequirePass != e.cfg.Server.RequirePass},
+		{"server.protected_mode", cfg.Server.ProtectedMode != e.cfg.Server.ProtectedMode},
+		{"server.reap_idle_after", cfg.Server.ReapIdleAfter != e.cfg.Server.ReapIdleAfter},
+		{"server.reap_interval", cfg.Server.ReapInterval != e.cfg.Server.ReapInterval},
+		{"storage.shards", cfg.Storage.ShardCount != e.cfg.Storage.ShardCount},
+		{"storage.hash_func", cfg.Storage.HashFunc != e.cfg.Storage.HashFunc},
+		{"storage.list_max_len", cfg.Storage.ListMaxLen != e.cfg.Storage.ListMaxLen},
+		{"storage.expire_index", cfg.Storage.ExpireIndex != e.cfg.Storage.ExpireIndex},
+		{"log.format", cfg.Log.Format != e.cfg.Log.Format},
+		{"persistence.dir", cfg.Persistence.Dir != e.cfg.Persistence.Dir},
+		{"persistence.aof.enabled", cfg.Persistence.AOF.Enabled != e.cfg.Persistence.AOF.Enabled},
+		{"persistence.aof.filename", cfg.Persistence.AOF.Filename != e.cfg.Persistence.AOF.Filename},
+		{"persistence.rdb.enabled", cfg.Persistence.RDB.Enabled != e.cfg.Persistence.RDB.Enabled},
+		{"persistence.rdb.filename", cfg.Persistence.RDB.Filename != e.cfg.Persistence.RDB.Filename},
+	}
+	for _, setting := range restart {
+		if setting.changed {
+			e.logger.Warn("setting cannot be reloaded, restart the server to apply it", zap.String("setting", setting.name))
+		}
+	}
+
+	if e.rdb != nil && e.scheduleAutoSave(cfg.Persistence.RDB.Interval) {
+		e.logger.Info("RDB auto-save interval reloaded", zap.String("interval", cfg.Persistence.RDB.Interval))
+	}
+}
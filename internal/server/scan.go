@@ -0,0 +1,168 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/eternalApril/moonlight/internal/glob"
+	"github.com/eternalApril/moonlight/internal/resp"
+	"go.uber.org/zap"
+)
+
+// defaultScanCount is the COUNT used when SCAN is called without it
+const defaultScanCount = 10
+
+// keysBatch is the number of keys DELPATTERN deletes and propagates per step
+const keysBatch = 1024
+
+// keys KEYS pattern returns all keys matching the glob pattern.
+// A positive server.keys_max_results truncates the reply and logs a warning, SCAN should be used instead
+func (e *Engine) keys(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("KEYS")
+	}
+
+	pattern := string(ctx.args[0].String)
+	limit := e.cfg.Server.KeysMaxResults
+
+	// one more key than the cap tells whether the reply is truncated
+	wanted := 0
+	if limit > 0 {
+		wanted = limit + 1
+	}
+	keys := (*ctx.storage).Keys(func(key string) bool {
+		return glob.Match(pattern, key)
+	}, wanted)
+
+	if limit > 0 && len(keys) > limit {
+		e.logger.Warn("KEYS reply truncated, use SCAN to iterate large keyspaces",
+			zap.String("pattern", pattern), zap.Int("keys_max_results", limit))
+		keys = keys[:limit]
+	}
+
+	result := make([]resp.Value, len(keys))
+	for i, key := range keys {
+		result[i] = resp.MakeBulkString(key)
+	}
+	return resp.MakeArray(result)
+}
+
+// delpattern DELPATTERN pattern deletes all keys matching the glob pattern and returns their number.
+// The keyspace is walked with the SCAN cursor keysBatch keys at a time and the matching keys of a step are deleted
+// before the next one is taken, so no lock is held for the whole command and the matches are never all in memory.
+// The deletions of every batch are propagated as a DEL, invalidate the watches and wake the blocked clients of the
+// keys. No keyspace notifications are emitted, the server has none
+func (e *Engine) delpattern(ctx *context) resp.Value {
+	if len(ctx.args) != 1 {
+		return resp.MakeErrorWrongNumberOfArguments("DELPATTERN")
+	}
+
+	pattern := string(ctx.args[0].String)
+	ctx.noPropagate()
+
+	var deleted int64
+	var cursor uint64
+	for {
+		keys, next, _ := (*ctx.storage).Scan(cursor, keysBatch, false)
+
+		var batch []string
+		for _, key := range keys {
+			if glob.Match(pattern, key) && (*ctx.storage).Delete(key) {
+				batch = append(batch, key)
+			}
+		}
+
+		if len(batch) > 0 {
+			deleted += int64(len(batch))
+			// the keys are not arguments of the command, so call cannot invalidate the watches itself
+			e.watches.touch(batch)
+			e.waiters.signal(batch)
+
+			args := make([]resp.Value, len(batch))
+			for i, key := range batch {
+				args[i] = resp.MakeBulkString(key)
+			}
+			ctx.propagate("DEL", args...)
+		}
+
+		if cursor = next; cursor == 0 {
+			return resp.MakeInteger(deleted)
+		}
+	}
+}
+
+// randomkey RANDOMKEY returns a random live key, or nil when the keyspace is empty or the attempts
+// found only expired keys. Expired keys picked on the way are deleted
+func randomkey(ctx *context) resp.Value {
+	if len(ctx.args) != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("RANDOMKEY")
+	}
+
+	key, ok := (*ctx.storage).RandomKey(0)
+	if !ok {
+		return resp.MakeNilBulkString()
+	}
+
+	return resp.MakeBulkString(key)
+}
+
+// scan SCAN cursor [MATCH pattern] [COUNT count] [REVERSE] iterates the keyspace, REVERSE walks it backwards
+// and must be given on every call of the iteration. The work done by every call is accumulated in the
+// Stats section of INFO
+func (e *Engine) scan(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("SCAN")
+	}
+
+	cursor, err := strconv.ParseUint(string(ctx.args[0].String), 10, 64)
+	if err != nil {
+		return resp.MakeError("ERR invalid cursor")
+	}
+
+	count := defaultScanCount
+	pattern := ""
+	reverse := false
+
+	for i := 1; i < len(ctx.args); i++ {
+		opt := strings.ToUpper(string(ctx.args[i].String))
+		if opt == "REVERSE" {
+			reverse = true
+			continue
+		}
+		if i+1 >= len(ctx.args) {
+			return resp.MakeError("ERR syntax error")
+		}
+
+		switch opt {
+		case "MATCH":
+			pattern = string(ctx.args[i+1].String)
+		case "COUNT":
+			count, err = strconv.Atoi(string(ctx.args[i+1].String))
+			if err != nil {
+				return resp.MakeError("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return resp.MakeError("ERR syntax error")
+			}
+		default:
+			return resp.MakeError("ERR syntax error")
+		}
+		i++
+	}
+
+	keys, next, examined := (*ctx.storage).Scan(cursor, count, reverse)
+	e.stats.recordScan(examined, len(keys))
+
+	result := make([]resp.Value, 0, len(keys))
+	for _, key := range keys {
+		if pattern != "" && !glob.Match(pattern, key) {
+			continue
+		}
+		result = append(result, resp.MakeBulkString(key))
+	}
+
+	return resp.MakeArray([]resp.Value{
+		resp.MakeBulkString(strconv.FormatUint(next, 10)),
+		resp.MakeArray(result),
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"math"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// engineStats holds the counters reported in the Stats section of INFO.
+// All fields are updated with atomics, so reading them never blocks the writers
+type engineStats struct {
+	expiredKeys        atomic.Int64  // keys reclaimed by the active expiration
+	activeExpireCycles atomic.Int64  // number of GC cycles run
+	lastExpiredRatio   atomic.Uint64 // expired/checked ratio of the last GC cycle, stored as float64 bits
+	scanCalls          atomic.Int64  // number of SCAN calls
+	scanExamined       atomic.Int64  // entries examined by SCAN
+	scanReturned       atomic.Int64  // keys returned by SCAN before MATCH filtering
+	keyspaceHits       atomic.Int64  // reads that found the key
+	keyspaceMisses     atomic.Int64  // reads of missing keys
+	reapedConnections  atomic.Int64  // idle connections closed by the reaper
+	evictedKeys        atomic.Int64  // keys removed to stay under maxmemory, there is no eviction yet so it stays 0
+}
+
+// recordGCCycle accumulates the result of a single GC cycle
+func (s *engineStats) recordGCCycle(ratio float64, expired int) {
+	s.activeExpireCycles.Add(1)
+	s.expiredKeys.Add(int64(expired))
+	s.lastExpiredRatio.Store(math.Float64bits(ratio))
+}
+
+// expiredRatio returns the expired/checked ratio of the last GC cycle
+func (s *engineStats) expiredRatio() float64 {
+	return math.Float64frombits(s.lastExpiredRatio.Load())
+}
+
+// recordLookup counts a read of a key as a hit or a miss
+func (s *engineStats) recordLookup(found bool) {
+	if found {
+		s.keyspaceHits.Add(1)
+	} else {
+		s.keyspaceMisses.Add(1)
+	}
+}
+
+// reset zeroes all counters
+func (s *engineStats) reset() {
+	s.expiredKeys.Store(0)
+	s.activeExpireCycles.Store(0)
+	s.lastExpiredRatio.Store(0)
+	s.scanCalls.Store(0)
+	s.scanExamined.Store(0)
+	s.scanReturned.Store(0)
+	s.keyspaceHits.Store(0)
+	s.keyspaceMisses.Store(0)
+	s.reapedConnections.Store(0)
+	s.evictedKeys.Store(0)
+}
+
+// recordScan accumulates the work done by a single SCAN call
+func (s *engineStats) recordScan(examined, returned int) {
+	s.scanCalls.Add(1)
+	s.scanExamined.Add(int64(examined))
+	s.scanReturned.Add(int64(returned))
+}
+
+// commandStat holds the call counters of a single command
+type commandStat struct {
+	calls atomic.Int64
+	nanos atomic.Int64 // total execution time
+}
+
+// commandStats counts the calls of every registered command, keyed by the command name.
+// Entries are added only while registering commands, so afterward the counters are updated without locking
+type commandStats map[string]*commandStat
+
+// record accumulates a single call of the command
+func (s commandStats) record(name string, elapsed time.Duration) {
+	if stat, ok := s[name]; ok {
+		stat.calls.Add(1)
+		stat.nanos.Add(int64(elapsed))
+	}
+}
+
+// reset zeroes the counters of all commands
+func (s commandStats) reset() {
+	for _, stat := range s {
+		stat.calls.Store(0)
+		stat.nanos.Store(0)
+	}
+}
+
+// called returns the names of the commands called at least once, sorted
+func (s commandStats) called() []string {
+	var names []string
+	for name, stat := range s {
+		if stat.calls.Load() > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// usage returns the number of calls, the total execution time and the mean time per call of the command in microseconds
+func (s commandStats) usage(name string) (calls, usec int64, usecPerCall float64) {
+	stat := s[name]
+	calls = stat.calls.Load()
+	nanos := stat.nanos.Load()
+	if calls > 0 {
+		usecPerCall = float64(nanos) / float64(calls) / 1000
+	}
+	return calls, nanos / 1000, usecPerCall
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/storage"
+)
+
+// queuedCommand is a command accumulated between MULTI and EXEC
+type queuedCommand struct {
+	name string
+	args []resp.Value
+}
+
+// watchState is what WATCH remembers about a key to detect modifications before EXEC
+type watchState struct {
+	version  uint64 // version of the key at WATCH time
+	deadline int64  // expiration of the key at WATCH time in Unix nanoseconds, 0 if none
+}
+
+// watchRegistry keeps a version counter for every watched key.
+// The version is bumped each time a write command touches the key
+type watchRegistry struct {
+	mu       sync.Mutex
+	versions map[string]uint64 // key - version
+	watchers map[string]int    // key - number of peers watching it
+	watched  atomic.Int64      // number of watched keys, lets touch skip the lock when nobody watches
+}
+
+// newWatchRegistry creates an empty registry
+func newWatchRegistry() *watchRegistry {
+	return &watchRegistry{
+		versions: make(map[string]uint64),
+		watchers: make(map[string]int),
+	}
+}
+
+// watch starts tracking the key and returns its current version
+func (w *watchRegistry) watch(key string) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watchers[key] == 0 {
+		w.watched.Add(1)
+	}
+	w.watchers[key]++
+
+	return w.versions[key]
+}
+
+// unwatch stops tracking the key for one peer
+func (w *watchRegistry) unwatch(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.watchers[key]--
+	if w.watchers[key] <= 0 {
+		delete(w.watchers, key)
+		delete(w.versions, key)
+		w.watched.Add(-1)
+	}
+}
+
+// touch bumps the version of the watched keys
+func (w *watchRegistry) touch(keys []string) {
+	if w.watched.Load() == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := w.watchers[key]; ok {
+			w.versions[key]++
+		}
+	}
+}
+
+// version returns the current version of the key
+func (w *watchRegistry) version(key string) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.versions[key]
+}
+
+// movableKeys extracts the keys of the commands whose key positions depend on their other arguments
+var movableKeys = map[string]func(args []resp.Value) []string{
+	"XREAD":      xreadKeys,
+	"XREADGROUP": xreadGroupKeys,
+}
+
+// commandKeys extracts the key arguments of the command using its key specification from commandRegistry
+func commandKeys(name string, args []resp.Value) []string {
+	if extract, ok := movableKeys[name]; ok {
+		return extract(args)
+	}
+
+	meta, ok := commandRegistry[name]
+	if !ok || meta.firstKey <= 0 {
+		return nil
+	}
+
+	last := meta.lastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	step := meta.step
+	if step <= 0 {
+		step = 1
+	}
+
+	keys := make([]string, 0, 1)
+	// key positions are 1-based and count the command name
+	for i := meta.firstKey; i <= last && i-1 < len(args); i += step {
+		keys = append(keys, string(args[i-1].String))
+	}
+
+	return keys
+}
+
+// unwatchAll drops all watched keys of the peer
+func (e *Engine) unwatchAll(peer *Peer) {
+	for key := range peer.watched {
+		e.watches.unwatch(key)
+		delete(peer.watched, key)
+	}
+}
+
+// watchedKeysChanged reports whether any watched key was modified or expired since WATCH
+func (e *Engine) watchedKeysChanged(peer *Peer) bool {
+	now := time.Now().UnixNano()
+
+	for key, state := range peer.watched {
+		if e.watches.version(key) != state.version {
+			return true
+		}
+
+		// an expired key counts as modified, even if it was not reclaimed yet
+		if state.deadline > 0 && now > state.deadline {
+			return true
+		}
+	}
+
+	return false
+}
+
+// multi MULTI marks the start of a transaction block
+func (e *Engine) multi(ctx *context) resp.Value {
+	if len(ctx.args) != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("MULTI")
+	}
+	if ctx.peer.multi {
+		return resp.MakeError("ERR MULTI calls can not be nested")
+	}
+
+	ctx.peer.multi = true
+	ctx.peer.multiErr = false
+	ctx.peer.queued = ctx.peer.queued[:0]
+
+	return resp.MakeSimpleString("OK")
+}
+
+// discard DISCARD flushes all previously queued commands in a transaction
+func (e *Engine) discard(ctx *context) resp.Value {
+	if len(ctx.args) != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("DISCARD")
+	}
+	if !ctx.peer.multi {
+		return resp.MakeError("ERR DISCARD without MULTI")
+	}
+
+	ctx.peer.resetMulti()
+	e.unwatchAll(ctx.peer)
+
+	return resp.MakeSimpleString("OK")
+}
+
+// exec EXEC executes all queued commands atomically. Returns a null array if a watched key was modified, and
+// discards the transaction if it writes while the server is read-only
+func (e *Engine) exec(ctx *context) resp.Value {
+	if len(ctx.args) != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("EXEC")
+	}
+	if !ctx.peer.multi {
+		return resp.MakeError("ERR EXEC without MULTI")
+	}
+
+	peer := ctx.peer
+	queued := peer.queued
+	failed := peer.multiErr
+	peer.resetMulti()
+	defer e.unwatchAll(peer)
+
+	if failed {
+		return resp.MakeError("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	// no other command runs until the transaction is finished
+	e.txMu.Lock()
+	defer e.txMu.Unlock()
+
+	// read-only mode may have been switched on since the commands were queued
+	if e.readOnly.Load() {
+		for _, q := range queued {
+			if isWriteCommand(q.name) {
+				return resp.MakeError("EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.")
+			}
+		}
+	}
+
+	if e.watchedKeysChanged(peer) {
+		return resp.Value{Type: resp.TypeArray, IsNull: true}
+	}
+
+	results := make([]resp.Value, 0, len(queued))
+	peer.inExec = true
+	for _, q := range queued {
+		results = append(results, e.call(peer, e.commands[q.name], q.name, q.args, false))
+	}
+	peer.inExec = false
+
+	e.propagateTransaction(peer)
+
+	return resp.MakeArray(results)
+}
+
+// propagateTransaction writes the AOF payload collected by EXEC wrapped in MULTI and EXEC,
+// so replaying the AOF applies the transaction as a whole or, if the file was cut, not at all
+func (e *Engine) propagateTransaction(peer *Peer) {
+	payload := peer.execAOF
+	peer.execAOF = nil
+	if e.aof == nil || len(payload) == 0 {
+		return
+	}
+
+	multi, _ := resp.SerializeCommand("MULTI", nil) //nolint:errcheck
+	exec, _ := resp.SerializeCommand("EXEC", nil)   //nolint:errcheck
+
+	wrapped := make([]byte, 0, len(multi)+len(payload)+len(exec))
+	wrapped = append(wrapped, multi...)
+	wrapped = append(wrapped, payload...)
+	e.aof.Write(append(wrapped, exec...))
+}
+
+// watch WATCH key [key ...] marks the keys to be watched for conditional execution of a transaction
+func (e *Engine) watch(ctx *context) resp.Value {
+	if len(ctx.args) < 1 {
+		return resp.MakeErrorWrongNumberOfArguments("WATCH")
+	}
+	if ctx.peer.multi {
+		return resp.MakeError("ERR WATCH inside MULTI is not allowed")
+	}
+
+	for _, arg := range ctx.args {
+		key := string(arg.String)
+		if _, ok := ctx.peer.watched[key]; ok {
+			continue
+		}
+
+		state := watchState{version: e.watches.watch(key)}
+		if ttl, status := (*ctx.storage).RemainingTTL(key); status == storage.ExpActive {
+			state.deadline = time.Now().Add(ttl).UnixNano()
+		}
+		ctx.peer.watched[key] = state
+	}
+
+	return resp.MakeSimpleString("OK")
+}
+
+// unwatch UNWATCH forgets about all watched keys
+func (e *Engine) unwatch(ctx *context) resp.Value {
+	if len(ctx.args) != 0 {
+		return resp.MakeErrorWrongNumberOfArguments("UNWATCH")
+	}
+
+	e.unwatchAll(ctx.peer)
+
+	return resp.MakeSimpleString("OK")
+}
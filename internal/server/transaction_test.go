@@ -0,0 +1,323 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/resp"
+)
+
+func TestMultiExec(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+
+	res := e.Execute(peer, "SET", makeCommand("SET", "k", "v"))
+	if string(res.String) != "QUEUED" {
+		t.Fatalf("expected QUEUED, got %q", res.String)
+	}
+
+	// not executed until EXEC
+	if res = e.Execute(mockPeer, "GET", makeCommand("GET", "k")); !res.IsNull {
+		t.Errorf("queued command was executed before EXEC")
+	}
+
+	e.Execute(peer, "GET", makeCommand("GET", "k"))
+
+	res = e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	if res.Type != resp.TypeArray || len(res.Array) != 2 {
+		t.Fatalf("expected array of 2 results, got %v", res)
+	}
+	if string(res.Array[0].String) != "OK" || string(res.Array[1].String) != "v" {
+		t.Errorf("unexpected results %q, %q", res.Array[0].String, res.Array[1].String)
+	}
+}
+
+// TestDoHasNoConnectionState checks that every call of Do runs on its own peer,
+// so a MULTI issued by one embedded caller does not queue the commands of the others
+func TestDoHasNoConnectionState(t *testing.T) {
+	e := setupEngine()
+
+	e.Do("MULTI")
+	if res := e.Do("SET", "k", "v"); string(res.String) != "OK" {
+		t.Fatalf("SET after MULTI in another call: expected OK, got %v", res)
+	}
+	if res := e.Do("EXEC"); res.Type != resp.TypeError {
+		t.Errorf("EXEC without MULTI in the same call: expected an error, got %v", res)
+	}
+}
+
+func TestMultiErrors(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); res.Type != resp.TypeError {
+		t.Errorf("EXEC without MULTI must fail")
+	}
+	if res := e.Execute(peer, "DISCARD", makeCommand("DISCARD")); res.Type != resp.TypeError {
+		t.Errorf("DISCARD without MULTI must fail")
+	}
+
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	if res := e.Execute(peer, "MULTI", makeCommand("MULTI")); res.Type != resp.TypeError {
+		t.Errorf("nested MULTI must fail")
+	}
+
+	// unknown command aborts the transaction
+	e.Execute(peer, "NOPE", makeCommand("NOPE"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "v"))
+	res := e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	if res.Type != resp.TypeError || string(res.String[:9]) != "EXECABORT" {
+		t.Errorf("expected EXECABORT, got %q", res.String)
+	}
+	if res = e.Execute(peer, "GET", makeCommand("GET", "k")); !res.IsNull {
+		t.Errorf("aborted transaction was executed")
+	}
+
+	// DISCARD drops the queue
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "v"))
+	e.Execute(peer, "DISCARD", makeCommand("DISCARD"))
+	if res = e.Execute(peer, "GET", makeCommand("GET", "k")); !res.IsNull {
+		t.Errorf("discarded transaction was executed")
+	}
+}
+
+func TestWatchModified(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "k"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "other"))
+
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "mine"))
+	res := e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	if res.Type != resp.TypeArray || !res.IsNull {
+		t.Errorf("expected null array, got %v", res)
+	}
+
+	if res = e.Execute(peer, "GET", makeCommand("GET", "k")); string(res.String) != "other" {
+		t.Errorf("aborted transaction changed the value: %q", res.String)
+	}
+
+	// watches are cleared after EXEC
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "mine"))
+	if res = e.Execute(peer, "EXEC", makeCommand("EXEC")); res.IsNull {
+		t.Errorf("transaction aborted by a stale watch")
+	}
+}
+
+func TestWatchUnchanged(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "other", "v"))
+	e.Execute(mockPeer, "HSET", makeCommand("HSET", "h", "f", "v"))
+
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "k", "h", "other"))
+
+	// writes refused by their condition leave the keys as they were
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "new", "NX"))
+	e.Execute(mockPeer, "SET", makeCommand("SET", "missing", "new", "XX"))
+	e.Execute(mockPeer, "HSETNX", makeCommand("HSETNX", "h", "f", "new"))
+	e.Execute(mockPeer, "RENAMENX", makeCommand("RENAMENX", "k", "other"))
+
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "mine"))
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); res.IsNull {
+		t.Errorf("transaction aborted by a write that changed nothing")
+	}
+
+	// a successful conditional write still invalidates the watch
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "h"))
+	e.Execute(mockPeer, "HSETNX", makeCommand("HSETNX", "h", "g", "new"))
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "k", "mine"))
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); !res.IsNull {
+		t.Errorf("expected null array after HSETNX added a field, got %v", res)
+	}
+}
+
+func TestWatchExpired(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	e.Execute(mockPeer, "SET", makeCommand("SET", "k", "v", "PX", "50"))
+	e.Execute(peer, "WATCH", makeCommand("WATCH", "k"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "other", "v"))
+	res := e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	if res.Type != resp.TypeArray || !res.IsNull {
+		t.Errorf("expected null array after watched key expired, got %v", res)
+	}
+}
+
+func TestWatchRename(t *testing.T) {
+	for _, watched := range []string{"src", "dst"} {
+		e := setupEngine()
+		peer := NewPeer(nil)
+
+		e.Execute(mockPeer, "SET", makeCommand("SET", "src", "v"))
+		e.Execute(peer, "WATCH", makeCommand("WATCH", watched))
+
+		// another client renames into the destination
+		if res := e.Execute(mockPeer, "RENAME", makeCommand("RENAME", "src", "dst")); string(res.String) != "OK" {
+			t.Fatalf("RENAME failed: %v", res)
+		}
+
+		e.Execute(peer, "MULTI", makeCommand("MULTI"))
+		e.Execute(peer, "SET", makeCommand("SET", "dst", "mine"))
+		res := e.Execute(peer, "EXEC", makeCommand("EXEC"))
+		if res.Type != resp.TypeArray || !res.IsNull {
+			t.Errorf("watching %s: expected the transaction to abort, got %v", watched, res)
+		}
+
+		if res = e.Execute(peer, "GET", makeCommand("GET", "dst")); string(res.String) != "v" {
+			t.Errorf("watching %s: aborted transaction changed the value: %q", watched, res.String)
+		}
+	}
+}
+
+func TestExecReadOnlySwitched(t *testing.T) {
+	e := setupEngine()
+	peer := NewPeer(nil)
+
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "a", "1"))
+	e.Execute(mockPeer, "CONFIG", makeCommand("CONFIG", "SET", "read-only", "yes"))
+
+	res := e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	if res.Type != resp.TypeError || !strings.HasPrefix(string(res.String), "EXECABORT") ||
+		!strings.Contains(string(res.String), "READONLY") {
+		t.Fatalf("expected EXECABORT with READONLY, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "a")); !res.IsNull {
+		t.Errorf("aborted transaction wrote the key: %v", res)
+	}
+
+	// a transaction without writes still runs
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "GET", makeCommand("GET", "a"))
+	if res := e.Execute(peer, "EXEC", makeCommand("EXEC")); res.Type != resp.TypeArray || len(res.Array) != 1 {
+		t.Errorf("read-only transaction: expected one reply, got %v", res)
+	}
+}
+
+func TestAOFTransaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	e := setupAOFEngine(t, filename)
+	peer := NewPeer(nil)
+	e.Execute(peer, "SET", makeCommand("SET", "before", "1"))
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "SET", makeCommand("SET", "a", "1"))
+	e.Execute(peer, "GET", makeCommand("GET", "a"))
+	e.Execute(peer, "HSET", makeCommand("HSET", "h", "f", "v"))
+	e.Execute(peer, "INCRBYFLOAT", makeCommand("INCRBYFLOAT", "n", "1.5"))
+	e.Execute(peer, "EXEC", makeCommand("EXEC"))
+
+	// a read-only transaction writes nothing
+	e.Execute(peer, "MULTI", makeCommand("MULTI"))
+	e.Execute(peer, "GET", makeCommand("GET", "a"))
+	e.Execute(peer, "EXEC", makeCommand("EXEC"))
+	e.Shutdown()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	aof := string(data)
+	multi := strings.Index(aof, "*1\r\n$5\r\nMULTI\r\n")
+	exec := strings.Index(aof, "*1\r\n$4\r\nEXEC\r\n")
+	if multi < 0 || exec < multi || strings.Count(aof, "MULTI") != 1 {
+		t.Fatalf("expected a single MULTI ... EXEC block, got %q", aof)
+	}
+	for _, key := range []string{"$1\r\na\r\n", "$1\r\nh\r\n", "$1\r\nn\r\n"} {
+		if i := strings.Index(aof, key); i < multi || i > exec {
+			t.Errorf("%q must be written inside the transaction: %q", key, aof)
+		}
+	}
+
+	// restart from the AOF
+	e = setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	for key, want := range map[string]string{"before": "1", "a": "1", "n": "1.5"} {
+		if res := e.Execute(mockPeer, "GET", makeCommand("GET", key)); string(res.String) != want {
+			t.Errorf("GET %s after restart: expected %q, got %v", key, want, res)
+		}
+	}
+	if res := e.Execute(mockPeer, "HGET", makeCommand("HGET", "h", "f")); string(res.String) != "v" {
+		t.Errorf("HGET after restart: expected v, got %v", res)
+	}
+}
+
+func TestAOFIncompleteTransaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	// the process died in the middle of writing a transaction
+	aof := "*3\r\n$3\r\nSET\r\n$6\r\nbefore\r\n$1\r\n1\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1"
+	if err := os.WriteFile(filename, []byte(aof), 0644); err != nil {
+		t.Fatalf("failed to write AOF: %v", err)
+	}
+
+	e := setupAOFEngine(t, filename)
+	defer e.Shutdown()
+
+	if res := e.Execute(mockPeer, "GET", makeCommand("GET", "before")); string(res.String) != "1" {
+		t.Errorf("commands before the transaction must be restored, got %v", res)
+	}
+	if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "a", "b")); res.Integer != 0 {
+		t.Errorf("incomplete transaction must not be applied, %d keys restored", res.Integer)
+	}
+}
+
+func TestAOFIncompleteTailRestartTwice(t *testing.T) {
+	before := "*3\r\n$3\r\nSET\r\n$6\r\nbefore\r\n$1\r\n1\r\n"
+	tails := map[string]string{
+		"incomplete command":     "*3\r\n$3\r\nSET\r\n$1",
+		"incomplete transaction": "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n",
+	}
+
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(filename, []byte(before+tail), 0644); err != nil {
+				t.Fatalf("failed to write AOF: %v", err)
+			}
+
+			// every restart acknowledges a write, which must survive all the following restarts
+			keys := []string{"before"}
+			for _, key := range []string{"first", "second"} {
+				e := setupAOFEngine(t, filename)
+				e.Execute(mockPeer, "SET", makeCommand("SET", key, "1"))
+				e.Shutdown()
+				keys = append(keys, key)
+			}
+
+			e := setupAOFEngine(t, filename)
+			defer e.Shutdown()
+
+			for _, key := range keys {
+				if res := e.Execute(mockPeer, "GET", makeCommand("GET", key)); string(res.String) != "1" {
+					t.Errorf("%s was lost after the restarts, got %v", key, res)
+				}
+			}
+			if res := e.Execute(mockPeer, "EXISTS", makeCommand("EXISTS", "a")); res.Integer != 0 {
+				t.Errorf("the incomplete transaction must not be applied")
+			}
+		})
+	}
+}
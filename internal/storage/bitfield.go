@@ -0,0 +1,206 @@
+package storage
+
+import "math"
+
+// BitFieldKind is the operation of a BITFIELD subcommand
+type BitFieldKind int
+
+const (
+	BitFieldGet BitFieldKind = iota
+	BitFieldSet
+	BitFieldIncrBy
+)
+
+// BitFieldOverflow tells how SET and INCRBY handle a result that does not fit the field
+type BitFieldOverflow int
+
+const (
+	// BitFieldWrap keeps the low bits of the result, the default
+	BitFieldWrap BitFieldOverflow = iota
+	// BitFieldSat clamps the result to the minimum or the maximum of the field
+	BitFieldSat
+	// BitFieldFail leaves the field untouched and reports the failure
+	BitFieldFail
+)
+
+// BitFieldOp is a single BITFIELD subcommand. Bits is 1-64 for signed fields and 1-63 for unsigned ones,
+// Offset is the position of the most significant bit of the field, bit 0 being the highest bit of the first byte
+type BitFieldOp struct {
+	Kind     BitFieldKind
+	Signed   bool
+	Bits     uint
+	Offset   uint64
+	Value    int64 // the new value of SET or the increment of INCRBY
+	Overflow BitFieldOverflow
+}
+
+// BitFieldResult is the reply of a BitFieldOp: the value read for GET, the previous value for SET and the new
+// value for INCRBY. Failed is set when BitFieldFail rejected the operation
+type BitFieldResult struct {
+	Value  int64
+	Failed bool
+}
+
+// BitField runs the operations in order against the string stored at key, treated as an array of bits.
+// Bits past the end of the string read as zero. If any operation writes, the string is created or padded
+// with zero bytes to hold every written field, even those rejected by BitFieldFail, and the TTL is kept.
+// Returns ErrStringTooLong if the string would exceed the maximum length
+func (m *MapStorage) BitField(key string, ops []BitFieldOp) ([]BitFieldResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, err := m.stringLocked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	for _, op := range ops {
+		if op.Kind != BitFieldGet {
+			size = max(size, (op.Offset+uint64(op.Bits)+7)/8)
+		}
+	}
+	if size > uint64(m.maxStringLen) {
+		return nil, ErrStringTooLong
+	}
+
+	// only a call that writes copies the string, GET-only calls read it in place
+	var buf []byte
+	if size > 0 {
+		buf = []byte(current)
+		if uint64(len(buf)) < size {
+			buf = append(buf, make([]byte, size-uint64(len(buf)))...)
+		}
+	}
+
+	results := make([]BitFieldResult, len(ops))
+	for i, op := range ops {
+		var old uint64
+		if size > 0 {
+			old = getBits(buf, op.Offset, op.Bits)
+		} else {
+			old = getBits(current, op.Offset, op.Bits)
+		}
+		if op.Signed {
+			old = signExtend(old, op.Bits)
+		}
+
+		switch op.Kind {
+		case BitFieldGet:
+			results[i] = BitFieldResult{Value: int64(old)}
+		case BitFieldSet:
+			value, ok := fitBitField(op, op.Value, 0)
+			if !ok {
+				results[i] = BitFieldResult{Failed: true}
+				continue
+			}
+			setBits(buf, op.Offset, op.Bits, value)
+			results[i] = BitFieldResult{Value: int64(old)}
+		case BitFieldIncrBy:
+			value, ok := fitBitField(op, int64(old), op.Value)
+			if !ok {
+				results[i] = BitFieldResult{Failed: true}
+				continue
+			}
+			setBits(buf, op.Offset, op.Bits, value)
+			if op.Signed {
+				value = signExtend(value, op.Bits)
+			}
+			results[i] = BitFieldResult{Value: int64(value)}
+		}
+	}
+
+	if size > 0 {
+		m.storeStringLocked(key, string(buf))
+	}
+
+	return results, nil
+}
+
+// getBits reads the unsigned field of the given width at the bit offset, bits past the end of buf are zero
+func getBits[T string | []byte](buf T, offset uint64, bits uint) uint64 {
+	var value uint64
+	for i := uint64(0); i < uint64(bits); i++ {
+		pos := offset + i
+		value <<= 1
+		if pos/8 < uint64(len(buf)) && buf[pos/8]&(0x80>>(pos%8)) != 0 {
+			value |= 1
+		}
+	}
+	return value
+}
+
+// setBits writes the low bits of value as a field at the bit offset, buf must be long enough
+func setBits(buf []byte, offset uint64, bits uint, value uint64) {
+	for i := uint64(0); i < uint64(bits); i++ {
+		pos := offset + i
+		mask := byte(0x80 >> (pos % 8))
+		if value&(1<<(uint64(bits)-1-i)) != 0 {
+			buf[pos/8] |= mask
+		} else {
+			buf[pos/8] &^= mask
+		}
+	}
+}
+
+// signExtend interprets the low bits of value as a two's complement number
+func signExtend(value uint64, bits uint) uint64 {
+	if bits < 64 && value&(1<<(bits-1)) != 0 {
+		value |= math.MaxUint64 << bits
+	}
+	return value
+}
+
+// fitBitField adds incr to value and fits the sum into the field of op according to its overflow mode.
+// Returns the bits to store, false if the sum does not fit and the mode is BitFieldFail
+func fitBitField(op BitFieldOp, value, incr int64) (uint64, bool) {
+	wrapped := uint64(value) + uint64(incr)
+	if op.Bits < 64 {
+		wrapped &= 1<<op.Bits - 1
+	}
+
+	var overflow, underflow bool
+	var maxValue, minValue uint64
+	if op.Signed {
+		hi := int64(math.MaxInt64 >> (64 - op.Bits))
+		lo := -hi - 1
+		maxValue, minValue = uint64(hi), uint64(lo)
+		switch {
+		case value > hi:
+			overflow = true
+		case value < lo:
+			underflow = true
+		// the differences to the limits overflow only for 64 bit fields, where a value of the
+		// opposite sign cannot overflow anyway
+		case incr > 0:
+			overflow = (value >= 0 || op.Bits < 64) && incr > hi-value
+		case incr < 0:
+			underflow = (value < 0 || op.Bits < 64) && incr < lo-value
+		}
+	} else {
+		hi := uint64(1)<<op.Bits - 1
+		maxValue = hi
+		// SET of a negative number is an overflow of its two's complement
+		u := uint64(value)
+		switch {
+		case u > hi:
+			overflow = true
+		case incr > 0:
+			overflow = uint64(incr) > hi-u
+		case incr < 0:
+			underflow = uint64(^incr)+1 > u
+		}
+	}
+
+	switch {
+	case !overflow && !underflow:
+		return wrapped, true
+	case op.Overflow == BitFieldFail:
+		return 0, false
+	case op.Overflow == BitFieldSat && overflow:
+		return maxValue, true
+	case op.Overflow == BitFieldSat:
+		return minValue, true
+	}
+	return wrapped, true
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// dumpVersion is the version of the DUMP payload format, RESTORE rejects payloads of other versions
+const dumpVersion = 1
+
+// ErrBadDump is returned by ParseDump when the payload is truncated, corrupted or of another version
+var ErrBadDump = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// Dump serializes the value of the entity for RESTORE: [Type][Value][Version][CRC32].
+// The value is encoded as in a snapshot, the checksum covers everything before it
+func Dump(entity Entity) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(entity.Type))
+	_ = writeValue(&buf, entity) // bytes.Buffer never fails
+
+	binary.Write(&buf, binary.LittleEndian, uint16(dumpVersion))             //nolint:errcheck
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes())) //nolint:errcheck
+
+	return buf.Bytes()
+}
+
+// ParseDump deserializes a payload created by Dump. The payload comes from the client, so every length and count
+// in it is checked against the bytes left before allocating, and a string value longer than maxStringLen is rejected
+func ParseDump(payload []byte, maxStringLen int64) (Entity, error) {
+	// type, version and checksum
+	if len(payload) < 1+2+4 {
+		return Entity{}, ErrBadDump
+	}
+
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return Entity{}, ErrBadDump
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) != dumpVersion {
+		return Entity{}, ErrBadDump
+	}
+
+	valueType := DataType(body[0])
+	if valueType != TypeString && valueType != TypeHash && valueType != TypeList && valueType != TypeStream {
+		return Entity{}, ErrBadDump
+	}
+
+	value := body[1 : len(body)-2]
+	if valueType == TypeString && len(value) >= 4 && int64(binary.LittleEndian.Uint32(value)) > maxStringLen {
+		return Entity{}, ErrBadDump
+	}
+
+	r := bytes.NewReader(value)
+	parsed, err := readValue(r, valueType)
+	if err != nil || r.Len() != 0 {
+		return Entity{}, ErrBadDump
+	}
+
+	return Entity{Type: valueType, Value: parsed}, nil
+}
@@ -1,5 +1,11 @@
 package storage
 
+import (
+	"maps"
+	"sync/atomic"
+	"time"
+)
+
 type DataType byte
 
 const (
@@ -8,12 +14,62 @@ const (
 	TypeSet
 	TypeHash
 	TypeZSet
+	TypeStream
 )
 
+// String returns the type name as reported by TYPE
+func (t DataType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeHash:
+		return "hash"
+	case TypeZSet:
+		return "zset"
+	case TypeStream:
+		return "stream"
+	}
+
+	return "none"
+}
+
 // Entity generic container for value
 type Entity struct {
 	Type  DataType
 	Value interface{}
+
+	access *accessMeta // shared by all copies of the stored entity, set when the entity is stored
+}
+
+// accessMeta tracks the last access of an entity. It is updated atomically, so readers can touch
+// the entity while holding only the read lock
+type accessMeta struct {
+	lastAccess atomic.Int64 // Unix nanoseconds
+}
+
+func newAccessMeta() *accessMeta {
+	a := &accessMeta{}
+	a.lastAccess.Store(time.Now().UnixNano())
+	return a
+}
+
+// touch records an access to the entity
+func (e Entity) touch() {
+	if e.access != nil {
+		e.access.lastAccess.Store(time.Now().UnixNano())
+	}
+}
+
+// IdleTime returns the time elapsed since the last access to the entity
+func (e Entity) IdleTime() time.Duration {
+	if e.access == nil {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - e.access.lastAccess.Load())
 }
 
 // HashField represents a single field inside a Hash with its own TTL
@@ -21,3 +77,45 @@ type HashField struct {
 	Value    string
 	ExpireAt int64 // Unix nanoseconds. 0 means no TTL
 }
+
+// clone returns a deep copy of the entity, so the copy never shares backing structures with the original.
+// Expired hash fields are not copied, the copy gets its own access metadata when it is stored
+func (e Entity) clone() Entity {
+	e.access = nil
+
+	switch e.Type {
+	case TypeHash:
+		src := e.Value.(map[string]HashField)
+		dst := make(map[string]HashField, len(src))
+		now := time.Now().UnixNano()
+		for f, v := range src {
+			if v.ExpireAt > 0 && now > v.ExpireAt {
+				continue
+			}
+			dst[f] = v
+		}
+		return Entity{Type: TypeHash, Value: dst}
+	case TypeList:
+		return Entity{Type: TypeList, Value: append([]string(nil), e.Value.([]string)...)}
+	case TypeSet:
+		//TODO Set
+	case TypeZSet:
+		//TODO ZSet
+	case TypeStream:
+		src := e.Value.(*Stream)
+		dst := &Stream{Entries: append([]StreamEntry(nil), src.Entries...), LastID: src.LastID}
+		if src.Groups != nil {
+			dst.Groups = make(map[string]*StreamGroup, len(src.Groups))
+			for name, g := range src.Groups {
+				dst.Groups[name] = &StreamGroup{
+					LastDelivered: g.LastDelivered,
+					Pending:       maps.Clone(g.Pending),
+					Consumers:     maps.Clone(g.Consumers),
+				}
+			}
+		}
+		return Entity{Type: TypeStream, Value: dst}
+	}
+
+	return e
+}
@@ -0,0 +1,97 @@
+package storage
+
+import "container/heap"
+
+// expireIndex orders the keys of a shard with a TTL by deadline, so the keys that are due are found without
+// sampling. It mirrors the expires map of the shard: every change of a deadline goes through setExpireLocked
+// and clearExpireLocked, which update both
+type expireIndex struct {
+	heap  expireHeap
+	items map[string]*expireItem // key - its heap item, for updates and removals in O(log n)
+}
+
+// expireItem is a key of the index with its deadline in Unix nanoseconds
+type expireItem struct {
+	key      string
+	deadline int64
+	index    int // position in the heap, maintained by expireHeap
+}
+
+// newExpireIndex builds the index of the deadlines
+func newExpireIndex(expires map[string]int64) *expireIndex {
+	idx := &expireIndex{
+		heap:  make(expireHeap, 0, len(expires)),
+		items: make(map[string]*expireItem, len(expires)),
+	}
+	for key, deadline := range expires {
+		item := &expireItem{key: key, deadline: deadline, index: len(idx.heap)}
+		idx.heap = append(idx.heap, item)
+		idx.items[key] = item
+	}
+	heap.Init(&idx.heap)
+
+	return idx
+}
+
+// set adds the key or moves it to its new deadline
+func (idx *expireIndex) set(key string, deadline int64) {
+	if item, ok := idx.items[key]; ok {
+		item.deadline = deadline
+		heap.Fix(&idx.heap, item.index)
+		return
+	}
+
+	item := &expireItem{key: key, deadline: deadline}
+	heap.Push(&idx.heap, item)
+	idx.items[key] = item
+}
+
+// remove drops the key if it is indexed
+func (idx *expireIndex) remove(key string) {
+	item, ok := idx.items[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&idx.heap, item.index)
+	delete(idx.items, key)
+}
+
+// peek returns the key with the earliest deadline, false if the index is empty
+func (idx *expireIndex) peek() (string, int64, bool) {
+	if len(idx.heap) == 0 {
+		return "", 0, false
+	}
+	return idx.heap[0].key, idx.heap[0].deadline, true
+}
+
+// len returns the number of indexed keys
+func (idx *expireIndex) len() int {
+	return len(idx.heap)
+}
+
+// expireHeap is a min-heap of expireItem by deadline implementing heap.Interface
+type expireHeap []*expireItem
+
+func (h expireHeap) Len() int           { return len(h) }
+func (h expireHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+
+func (h expireHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expireHeap) Push(x interface{}) {
+	item := x.(*expireItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expireHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
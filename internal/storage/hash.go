@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"hash/maphash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// HashFunc maps a key to the hash that selects its shard
+type HashFunc func(key string) uint32
+
+// ParseHashFunc converts the storage.hash_func value ("fnv", "maphash" or "xxhash") to a HashFunc.
+// The maphash seed is chosen once here, so a key maps to the same shard for the lifetime of the storage
+func ParseHashFunc(name string) (HashFunc, error) {
+	switch name {
+	case "fnv":
+		return fnv32a, nil
+	case "maphash":
+		seed := maphash.MakeSeed()
+		return func(key string) uint32 {
+			return uint32(maphash.String(seed, key))
+		}, nil
+	case "xxhash":
+		return func(key string) uint32 {
+			return uint32(xxhash.Sum64String(key))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown hash function %q", name)
+}
+
+// fnv32a is the 32-bit FNV-1a hash of the key, computed without allocating a hash.Hash32
+func fnv32a(key string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+	return hash
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/eternalApril/moonlight/internal/hll"
+)
+
+// HyperLogLogs are plain strings holding a dense sketch, so GET, DUMP and the snapshots handle them as any
+// other string
+
+var ErrNotHLL = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+
+// loadHLLLocked parses the sketch stored at key. Returns ErrNotHLL if the string is not a sketch.
+// Caller must hold the write lock
+func (m *MapStorage) loadHLLLocked(key string) (*hll.Sketch, bool, error) {
+	entity, found, err := m.getTyped(key, TypeString)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	sk, err := hll.Parse(entity.Value.(string))
+	if err != nil {
+		return nil, false, ErrNotHLL
+	}
+
+	return sk, true, nil
+}
+
+// PFAdd adds the elements to the sketch stored at key, creating the key if it does not exist.
+// Returns true if the estimated cardinality may have changed or the key was created
+func (m *MapStorage) PFAdd(key string, elements []string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sk, found, err := m.loadHLLLocked(key)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		sk = hll.New()
+	}
+
+	changed := !found
+	for _, element := range elements {
+		if sk.Add(element) {
+			changed = true
+		}
+	}
+
+	if changed {
+		m.storeStringLocked(key, sk.Bytes())
+	}
+
+	return changed, nil
+}
+
+// loadHLL returns the sketch stored at key, nil if the key does not exist
+func (m *MapStorage) loadHLL(key string) (*hll.Sketch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sk, _, err := m.loadHLLLocked(key)
+	return sk, err
+}
+
+// mergeHLLs returns the union of the sketches stored at keys, missing keys count as empty sketches
+func mergeHLLs(keys []string, shardOf func(key string) *MapStorage) (*hll.Sketch, error) {
+	union := hll.New()
+	for _, key := range keys {
+		sk, err := shardOf(key).loadHLL(key)
+		if err != nil {
+			return nil, err
+		}
+		if sk != nil {
+			union.Merge(sk)
+		}
+	}
+
+	return union, nil
+}
+
+// storeHLL merges sk into the sketch stored at dest, creating dest if it does not exist
+func (m *MapStorage) storeHLL(dest string, sk *hll.Sketch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, found, err := m.loadHLLLocked(dest)
+	if err != nil {
+		return err
+	}
+	if found {
+		sk.Merge(current)
+	}
+
+	m.storeStringLocked(dest, sk.Bytes())
+
+	return nil
+}
+
+// PFCount returns the estimated cardinality of the union of the sketches stored at keys
+func (m *MapStorage) PFCount(keys []string) (int64, error) {
+	union, err := mergeHLLs(keys, func(string) *MapStorage { return m })
+	if err != nil {
+		return 0, err
+	}
+
+	return union.Count(), nil
+}
+
+// PFMerge stores the union of the sketches stored at dest and srcs at dest
+func (m *MapStorage) PFMerge(dest string, srcs []string) error {
+	union, err := mergeHLLs(srcs, func(string) *MapStorage { return m })
+	if err != nil {
+		return err
+	}
+
+	return m.storeHLL(dest, union)
+}
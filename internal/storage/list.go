@@ -0,0 +1,127 @@
+package storage
+
+// Lists are stored as a []string with the head at index 0. Pushing to the head copies the list,
+// which is fine for the short lists and bounded queues they are meant for
+
+// Push inserts values at the head (left) or at the tail of the list stored at key, creating the list if needed.
+// Values pushed to the head end up in reverse order, like LPUSH. With a max list length set, the list is then
+// trimmed from the opposite end. Returns the length of the list after the push
+func (m *MapStorage) Push(key string, values []string, left bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeList)
+	if err != nil {
+		return 0, err
+	}
+
+	var list []string
+	if found {
+		list = entity.Value.([]string)
+	}
+
+	if left {
+		head := make([]string, len(values), len(values)+len(list))
+		for i, v := range values {
+			head[len(values)-1-i] = v
+		}
+		list = append(head, list...)
+	} else {
+		list = append(list, values...)
+	}
+
+	if m.maxListLen > 0 && int64(len(list)) > m.maxListLen {
+		if left {
+			clear(list[m.maxListLen:])
+			list = list[:m.maxListLen]
+		} else {
+			list = list[int64(len(list))-m.maxListLen:]
+		}
+	}
+
+	entity.Type = TypeList
+	entity.Value = list
+	m.storeLocked(key, entity)
+
+	return int64(len(list)), nil
+}
+
+// LLen returns the length of the list stored at key, 0 if the key does not exist
+func (m *MapStorage) LLen(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeList)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	return int64(len(entity.Value.([]string))), nil
+}
+
+// LRange returns the elements of the list stored at key between start and stop inclusive.
+// Negative offsets count from the end of the list
+func (m *MapStorage) LRange(key string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeList)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	list := entity.Value.([]string)
+	start, stop, ok := listRange(int64(len(list)), start, stop)
+	if !ok {
+		return []string{}, nil
+	}
+
+	return append([]string(nil), list[start:stop+1]...), nil
+}
+
+// LTrim keeps only the elements of the list stored at key between start and stop inclusive,
+// the key is deleted when nothing remains. Negative offsets count from the end of the list
+func (m *MapStorage) LTrim(key string, start, stop int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeList)
+	if err != nil || !found {
+		return err
+	}
+
+	list := entity.Value.([]string)
+	start, stop, ok := listRange(int64(len(list)), start, stop)
+	if !ok {
+		m.removeLocked(key)
+		return nil
+	}
+
+	entity.Value = append([]string(nil), list[start:stop+1]...)
+	m.storeLocked(key, entity)
+
+	return nil
+}
+
+// listRange converts start and stop offsets, possibly negative, into valid indexes of a list of length n.
+// Returns false if the range is empty
+func listRange(n, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// SetMaxListLen sets the length lists are trimmed to on push, 0 means unlimited.
+// Must not be called concurrently with writes
+func (m *MapStorage) SetMaxListLen(n int64) {
+	m.maxListLen = n
+}
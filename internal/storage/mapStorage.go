@@ -4,136 +4,258 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// defaultMaxStringLen is the maximum length of a string value unless changed with SetMaxStringLen
+const defaultMaxStringLen = 512 * 1024 * 1024
+
 var (
-	ErrWrongType = errors.New("WRONGTYPE")
+	ErrWrongType     = errors.New("WRONGTYPE")
+	ErrStringTooLong = errors.New("ERR string exceeds maximum allowed size")
+	ErrNoSuchKey     = errors.New("ERR no such key")
+	ErrNotFloat      = errors.New("ERR value is not a valid float")
+	ErrFloatOverflow = errors.New("ERR increment would produce NaN or Infinity")
 )
 
 // MapStorage is a thread-safe key-value storage.
 type MapStorage struct {
-	data    map[string]Entity // key - value
-	expires map[string]int64  // key - expires time nanoseconds
-	mu      sync.RWMutex
+	data        map[string]Entity // key - value
+	expires     map[string]int64  // key - expires time nanoseconds
+	expireIndex *expireIndex      // the expires ordered by deadline, nil unless enabled with SetExpireIndex
+	scanIndex   *scanIndex        // the keys in the buckets walked by Scan
+	mu          sync.RWMutex
+	keys        atomic.Int64 // number of keys in data, read without the lock
+
+	snapshotMode SnapshotMode
+	expireJitter float64 // fraction of a relative TTL by which the deadline is randomized
+	maxStringLen int64   // maximum length of a string value
+	maxListLen   int64   // lists are trimmed to this length on push, 0 means unlimited
 }
 
 // NewMapStorage creates a new instance oа MapStorage.
 func NewMapStorage() *MapStorage {
 	return &MapStorage{
-		data:    make(map[string]Entity),
-		expires: make(map[string]int64),
-		mu:      sync.RWMutex{},
+		data:      make(map[string]Entity),
+		expires:   make(map[string]int64),
+		scanIndex: newScanIndex(),
+		mu:        sync.RWMutex{},
+
+		maxStringLen: defaultMaxStringLen,
+	}
+}
+
+// storeLocked writes the entity and keeps the key counter in sync. Caller must hold the write lock
+func (m *MapStorage) storeLocked(key string, entity Entity) {
+	if _, exists := m.data[key]; !exists {
+		m.keys.Add(1)
+		m.scanIndex.add(key)
+	}
+	if entity.access == nil {
+		entity.access = newAccessMeta()
+	}
+	m.data[key] = entity
+}
+
+// removeLocked deletes the key with its expiration and keeps the key counter in sync.
+// Caller must hold the write lock. Returns true if the key existed
+func (m *MapStorage) removeLocked(key string) bool {
+	if _, exists := m.data[key]; !exists {
+		return false
+	}
+	delete(m.data, key)
+	m.scanIndex.remove(key)
+	m.clearExpireLocked(key)
+	m.keys.Add(-1)
+	return true
+}
+
+// setExpireLocked sets the deadline of the key in Unix nanoseconds. Caller must hold the write lock
+func (m *MapStorage) setExpireLocked(key string, deadline int64) {
+	m.expires[key] = deadline
+	if m.expireIndex != nil {
+		m.expireIndex.set(key, deadline)
 	}
 }
 
+// clearExpireLocked removes the deadline of the key. Caller must hold the write lock
+func (m *MapStorage) clearExpireLocked(key string) {
+	delete(m.expires, key)
+	if m.expireIndex != nil {
+		m.expireIndex.remove(key)
+	}
+}
+
+// Len returns the number of keys, including expired keys that were not reclaimed yet. O(1)
+func (m *MapStorage) Len() int64 {
+	return m.keys.Load()
+}
+
+// ShardLens reports the map as a single shard
+func (m *MapStorage) ShardLens() []int64 {
+	return []int64{m.Len()}
+}
+
 // Get returns the value and true if the key is found. Otherwise, "", false
 func (m *MapStorage) Get(key string) (string, bool, error) {
 	m.mu.RLock()
-	exp, hasExp := m.expires[key]
-	entity, ok := m.data[key]
+	entity, found, expired, err := m.lookupTyped(key, TypeString)
 	m.mu.RUnlock()
 
+	if expired {
+		m.mu.Lock()
+		// checking again, can be changed while waiting for the lock
+		entity, found, err = m.getTyped(key, TypeString)
+		m.mu.Unlock()
+	}
+
+	if err != nil || !found {
+		return "", false, err
+	}
+
+	return entity.Value.(string), true, nil
+}
+
+// lookupTyped returns the entity stored at key if it is alive and holds the wanted type, ErrWrongType otherwise.
+// An expired key is reported as missing with expired set, it must be deleted by a caller holding the write lock.
+// Caller must hold at least the read lock
+func (m *MapStorage) lookupTyped(key string, want DataType) (entity Entity, found, expired bool, err error) {
+	entity, ok := m.data[key]
 	if !ok {
-		return "", false, nil
+		return Entity{}, false, false, nil
 	}
 
-	if entity.Type != TypeString {
-		return "", false, ErrWrongType
+	if exp, hasExp := m.expires[key]; hasExp && time.Now().UnixNano() > exp {
+		return Entity{}, false, true, nil
 	}
 
-	if hasExp && time.Now().UnixNano() > exp {
-		m.mu.Lock()
-		defer m.mu.Unlock()
+	if entity.Type != want {
+		return Entity{}, false, false, ErrWrongType
+	}
 
-		// checking again, can be changed while waiting for the lock
-		exp, hasExp = m.expires[key]
-		if hasExp && time.Now().UnixNano() > exp {
-			delete(m.data, key)
-			delete(m.expires, key)
-			return "", false, nil
-		}
+	return entity, true, false, nil
+}
 
-		entity, ok = m.data[key]
-		if ok && entity.Type != TypeString {
-			return "", false, ErrWrongType
-		}
-		if ok {
-			return entity.Value.(string), true, nil
-		}
-		return "", false, nil
+// getTyped is lookupTyped that deletes the expired key. Caller must hold the write lock
+func (m *MapStorage) getTyped(key string, want DataType) (Entity, bool, error) {
+	entity, found, expired, err := m.lookupTyped(key, want)
+	if expired {
+		m.removeLocked(key)
 	}
 
-	return entity.Value.(string), true, nil
+	return entity, found, err
 }
 
-// Set writes the value based on the options. Returns true if recording has been performed
-func (m *MapStorage) Set(key, value string, options SetOptions) bool {
+// Set writes the value based on the options. A value of any type is replaced by the string, together with
+// the TTLs of its hash fields. Returns true if recording has been performed.
+// Returns ErrStringTooLong if the value exceeds the maximum string length
+func (m *MapStorage) Set(key, value string, options SetOptions) (bool, error) {
+	if int64(len(value)) > m.maxStringLen {
+		return false, ErrStringTooLong
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	val, exists := m.data[key]
+	_, exists := m.data[key]
 	if exists {
-		if val.Type != TypeString {
-			return false
-		}
-
 		exp, hasExp := m.expires[key]
 
 		// key exists but is expired, clean it up now so logic below treats it as new
 		if hasExp && time.Now().UnixNano() > exp {
-			delete(m.data, key)
-			delete(m.expires, key)
+			m.removeLocked(key)
 			exists = false
 		}
 	}
 
 	if options.NX && exists {
-		return false
+		return false, nil
 	}
 
 	if options.XX && !exists {
-		return false
+		return false, nil
 	}
 
-	m.data[key] = Entity{
+	m.storeLocked(key, Entity{
 		Type:  TypeString,
 		Value: value,
-	}
+	})
 
 	if options.KeepTTL {
 		// if KEEPTTL is set, we do nothing to m.expires (retain existing)
 		// however, if the key is new (freshly created), KEEPTTL behaves like no TTL
 		if !exists {
-			delete(m.expires, key)
+			m.clearExpireLocked(key)
 		}
 	} else {
 		if options.TTL == 0 {
 			// no TTL provided (and not KEEPTTL), so we remove any existing expiration (persist)
-			delete(m.expires, key)
+			m.clearExpireLocked(key)
 		} else {
-			m.expires[key] = time.Now().Add(options.TTL).UnixNano()
+			ttl := options.TTL
+			if !options.Absolute {
+				ttl = m.jitter(ttl)
+			}
+			m.setExpireLocked(key, time.Now().Add(ttl).UnixNano())
 		}
 	}
 
-	return true
+	return true, nil
+}
+
+// GetDel returns the string stored at key and deletes the key
+func (m *MapStorage) GetDel(key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeString)
+	if err != nil || !found {
+		return "", false, err
+	}
+
+	m.removeLocked(key)
+	return entity.Value.(string), true, nil
+}
+
+// GetEx returns the string stored at key and changes its expiration. A positive expireAt (Unix nanoseconds)
+// sets the deadline and a deadline in the past deletes the key, persist removes the expiration
+func (m *MapStorage) GetEx(key string, expireAt int64, persist bool) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeString)
+	if err != nil || !found {
+		return "", false, err
+	}
+
+	switch {
+	case persist:
+		m.clearExpireLocked(key)
+	case expireAt > 0 && time.Now().UnixNano() > expireAt:
+		m.removeLocked(key)
+	case expireAt > 0:
+		m.setExpireLocked(key, expireAt)
+	}
+
+	return entity.Value.(string), true, nil
 }
 
 // Delete deletes the key. Returns true if the key existed and was deleted
 func (m *MapStorage) Delete(key string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.data[key]; ok {
-		delete(m.data, key)
-		delete(m.expires, key)
-		return true
-	}
-	return false
+
+	return m.removeLocked(key)
 }
 
-// Expiry returns the remaining lifetime and status as expiryStatus
-func (m *MapStorage) Expiry(key string) (time.Duration, ExpiryStatus) {
+// RemainingTTL returns the remaining lifetime of the key and its ExpiryStatus
+func (m *MapStorage) RemainingTTL(key string) (time.Duration, ExpiryStatus) {
 	m.mu.RLock()
 
 	_, ok := m.data[key]
@@ -170,8 +292,7 @@ func (m *MapStorage) Expiry(key string) (time.Duration, ExpiryStatus) {
 
 		// key expired
 		if now > exp {
-			delete(m.data, key)
-			delete(m.expires, key)
+			m.removeLocked(key)
 			return 0, ExpNotFound
 		}
 
@@ -182,7 +303,7 @@ func (m *MapStorage) Expiry(key string) (time.Duration, ExpiryStatus) {
 }
 
 // Persist removes the expiration date of the key, making it eternal.
-// Returns 1 if successful, 0 if the key was not found or had no TTL
+// Returns 1 if successful, 0 if the key was not found, is expired or had no TTL
 func (m *MapStorage) Persist(key string) int64 {
 	m.mu.RLock()
 
@@ -196,28 +317,300 @@ func (m *MapStorage) Persist(key string) int64 {
 	}
 
 	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	_, ok = m.data[key]
-	_, hasExp = m.expires[key]
+	exp, hasExp := m.expires[key]
 
 	if !ok || !hasExp {
 		return 0
 	}
 
-	delete(m.expires, key)
+	// the deadline has passed, the key must not come back to life
+	if time.Now().UnixNano() > exp {
+		m.removeLocked(key)
+		return 0
+	}
 
-	m.mu.Unlock()
+	m.clearExpireLocked(key)
 
 	return 1
 }
 
-// DeleteExpired randomly selects a limit of keys from each shard and delete if his TTL has expired
-func (m *MapStorage) DeleteExpired(limit int) float64 {
+// ExpireAt sets an absolute expiration deadline on the key. A deadline in the past deletes the key.
+// Returns 1 if the timeout was set, 0 if the key does not exist
+func (m *MapStorage) ExpireAt(key string, at time.Time) int64 {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if len(m.expires) == 0 {
-		return 0.0
+	if _, ok := m.data[key]; !ok {
+		return 0
+	}
+
+	now := time.Now().UnixNano()
+
+	// key already expired, treat it as missing
+	if exp, hasExp := m.expires[key]; hasExp && now > exp {
+		m.removeLocked(key)
+		return 0
+	}
+
+	deadline := at.UnixNano()
+	if deadline <= now {
+		m.removeLocked(key)
+		return 1
+	}
+
+	m.setExpireLocked(key, deadline)
+
+	return 1
+}
+
+// Copy copies the value stored at src to dst together with its TTL.
+// Returns true if the key was copied
+func (m *MapStorage) Copy(src, dst string, replace bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copyLocked(m, m, src, dst, replace)
+}
+
+// copyLocked stores a deep copy of src from one storage at dst in another one, which may be the same.
+// If replace is false, an existing live dst is left untouched. Caller must hold the write locks of both
+func copyLocked(from, to *MapStorage, src, dst string, replace bool) bool {
+	now := time.Now().UnixNano()
+
+	entity, ok := from.data[src]
+	exp, hasExp := from.expires[src]
+	if !ok || (hasExp && now > exp) {
+		return false
+	}
+
+	if _, exists := to.data[dst]; exists && !replace {
+		if dstExp, dstHasExp := to.expires[dst]; !dstHasExp || now <= dstExp {
+			return false
+		}
+	}
+
+	to.storeLocked(dst, entity.clone())
+	if hasExp {
+		to.setExpireLocked(dst, exp)
+	} else {
+		to.clearExpireLocked(dst)
+	}
+
+	return true
+}
+
+// Rename moves the value stored at src to dst together with its TTL.
+// Returns ErrNoSuchKey if src does not exist
+func (m *MapStorage) Rename(src, dst string, nx bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return moveLocked(m, m, src, dst, nx)
+}
+
+// moveLocked moves src from one storage to dst in another one, which may be the same.
+// If nx is true, an existing live dst is left untouched. Caller must hold the write locks of both
+func moveLocked(from, to *MapStorage, src, dst string, nx bool) (bool, error) {
+	now := time.Now().UnixNano()
+
+	entity, ok := from.data[src]
+	exp, hasExp := from.expires[src]
+	if !ok || (hasExp && now > exp) {
+		return false, ErrNoSuchKey
+	}
+
+	if src == dst && from == to {
+		return !nx, nil
+	}
+
+	if _, exists := to.data[dst]; exists && nx {
+		if dstExp, dstHasExp := to.expires[dst]; !dstHasExp || now <= dstExp {
+			return false, nil
+		}
+	}
+
+	from.removeLocked(src)
+	to.storeLocked(dst, entity)
+	if hasExp {
+		to.setExpireLocked(dst, exp)
+	} else {
+		to.clearExpireLocked(dst)
+	}
+
+	return true, nil
+}
+
+// RestoreKey stores the entity at key with the absolute expiration (0 for none) and the idle time reported by
+// OBJECT IDLETIME. A deadline in the past only removes the existing key.
+// Returns false if replace is false and the key exists
+func (m *MapStorage) RestoreKey(key string, entity Entity, expireAt int64, idle time.Duration, replace bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	if _, ok := m.data[key]; ok && !replace {
+		if exp, hasExp := m.expires[key]; !hasExp || now <= exp {
+			return false
+		}
+	}
+
+	if expireAt > 0 && now > expireAt {
+		m.removeLocked(key)
+		return true
+	}
+
+	entity.access = newAccessMeta()
+	entity.access.lastAccess.Store(now - int64(idle))
+	m.storeLocked(key, entity)
+	if expireAt > 0 {
+		m.setExpireLocked(key, expireAt)
+	} else {
+		m.clearExpireLocked(key)
+	}
+
+	return true
+}
+
+// StoreResult overwrites dest with the result of a *STORE command, whatever type dest held before.
+// An empty result deletes dest instead of leaving an empty collection. The TTL of dest is discarded.
+// Returns true if dest holds the result
+func (m *MapStorage) StoreResult(dest string, entity Entity, empty bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if empty {
+		m.removeLocked(dest)
+		return false
+	}
+
+	m.storeLocked(dest, entity)
+	m.clearExpireLocked(dest)
+
+	return true
+}
+
+// View calls fn with the live entity stored at key while holding the read lock.
+// fn must not modify the entity or retain references to it. Returns false if the key does not exist
+func (m *MapStorage) View(key string, fn func(entity Entity)) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entity, ok := m.data[key]
+	if !ok {
+		return false
+	}
+
+	if exp, hasExp := m.expires[key]; hasExp && time.Now().UnixNano() > exp {
+		return false
+	}
+
+	fn(entity)
+
+	return true
+}
+
+// Touch updates the last access time of the existing keys
+func (m *MapStorage) Touch(keys []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range keys {
+		if entity, ok := m.data[key]; ok {
+			entity.touch()
+		}
+	}
+}
+
+// Scan returns about count keys starting at cursor, the cursor to continue from (0 when the iteration is complete)
+// and the number of entries examined. Expired keys are skipped but count as examined
+func (m *MapStorage) Scan(cursor uint64, count int, reverse bool) ([]string, uint64, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	keys := make([]string, 0, min(count, len(m.data)))
+
+	next, examined := m.scanIndex.scan(cursor, count, reverse, func(key string) bool {
+		if exp, hasExp := m.expires[key]; hasExp && now > exp {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+
+	return keys, next, examined
+}
+
+// Keys returns the live keys for which match returns true, at most limit of them if limit is positive.
+// The shard is walked once under the read lock
+func (m *MapStorage) Keys(match func(key string) bool, limit int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var keys []string
+
+	for key := range m.data {
+		if exp, hasExp := m.expires[key]; hasExp && now > exp {
+			continue
+		}
+		if !match(key) {
+			continue
+		}
+
+		keys = append(keys, key)
+		if limit > 0 && len(keys) == limit {
+			break
+		}
+	}
+
+	return keys
+}
+
+// randomKeyTries bounds the number of candidates RandomKey examines, so a shard full of expired keys
+// or of keys of other types cannot make it run for long
+const randomKeyTries = 100
+
+// RandomKey returns a random live key of type typ, any type if typ is 0. Expired candidates are deleted.
+// Returns false if no such key was found within randomKeyTries candidates
+func (m *MapStorage) RandomKey(typ DataType) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	tries := 0
+
+	// go map iteration is randomized by design
+	for key, entity := range m.data {
+		if tries++; tries > randomKeyTries {
+			break
+		}
+
+		if exp, hasExp := m.expires[key]; hasExp && now > exp {
+			m.removeLocked(key)
+			continue
+		}
+		if typ != 0 && entity.Type != typ {
+			continue
+		}
+
+		return key, true
+	}
+
+	return "", false
+}
+
+// DeleteExpired randomly selects a limit of keys and delete if his TTL has expired.
+// Returns the ratio of expired keys among the checked ones and the number of deleted keys
+func (m *MapStorage) DeleteExpired(limit int) (float64, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.expires) == 0 || limit <= 0 {
+		return 0.0, 0
 	}
 
 	checked := 0
@@ -228,8 +621,7 @@ func (m *MapStorage) DeleteExpired(limit int) float64 {
 	for key, expTime := range m.expires {
 		checked++
 		if now > expTime {
-			delete(m.data, key)
-			delete(m.expires, key)
+			m.removeLocked(key)
 			expired++
 		}
 
@@ -238,7 +630,51 @@ func (m *MapStorage) DeleteExpired(limit int) float64 {
 		}
 	}
 
-	return float64(expired) / float64(checked)
+	if checked == 0 {
+		return 0.0, 0
+	}
+
+	return float64(expired) / float64(checked), expired
+}
+
+// ExpireDue deletes the keys whose deadline is before now, at most limit of them, and returns their number and
+// whether due keys are left. With the expire index the due keys are popped in deadline order in O(log n) each,
+// otherwise the expirations are walked
+func (m *MapStorage) ExpireDue(now time.Time, limit int) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deadline := now.UnixNano()
+	expired := 0
+
+	if m.expireIndex == nil {
+		for key, expTime := range m.expires {
+			if deadline <= expTime {
+				continue
+			}
+			if expired == limit {
+				return expired, true
+			}
+			m.removeLocked(key)
+			expired++
+		}
+		return expired, false
+	}
+
+	for {
+		key, expTime, ok := m.expireIndex.peek()
+		if !ok || deadline <= expTime {
+			return expired, false
+		}
+		if expired == limit {
+			return expired, true
+		}
+		// popped first, so a key missing from the data cannot stay at the top of the index
+		m.clearExpireLocked(key)
+		if m.removeLocked(key) {
+			expired++
+		}
+	}
 }
 
 // writeString helper for writing a string with length
@@ -260,9 +696,25 @@ func readString(r io.Reader) (string, error) {
 	if _, err := io.ReadFull(r, lenBuf); err != nil {
 		return "", err
 	}
-	strLen := binary.LittleEndian.Uint32(lenBuf)
+	return readBytes(r, binary.LittleEndian.Uint32(lenBuf))
+}
 
-	buf := make([]byte, strLen)
+// readBytes reads n bytes as a string. n comes from the input, so it is checked against the bytes left
+// before anything is allocated, and a reader that cannot tell them gets a buffer growing as the bytes arrive
+func readBytes(r io.Reader, n uint32) (string, error) {
+	if err := checkCount(r, n, 1); err != nil {
+		return "", err
+	}
+
+	if _, ok := r.(lenReader); !ok && n > maxPrealloc {
+		var sb strings.Builder
+		if _, err := io.CopyN(&sb, r, int64(n)); err != nil {
+			return "", io.ErrUnexpectedEOF
+		}
+		return sb.String(), nil
+	}
+
+	buf := make([]byte, n)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", err
 	}
@@ -270,172 +722,254 @@ func readString(r io.Reader) (string, error) {
 }
 
 // Snapshot serializes the shard data in Writer.
+// Depending on the snapshot mode the lock is held either for the whole write or only while copying the shard
 func (m *MapStorage) Snapshot(w io.Writer) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	header := make([]byte, 13)
 
-	for key, value := range m.data {
-		exp, hasExp := m.expires[key]
-		if !hasExp {
-			exp = 0
+	if m.snapshotMode == SnapshotLowMemory {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		for key, value := range m.data {
+			if err := writeEntry(w, header, key, m.expires[key], value); err != nil {
+				return err
+			}
 		}
 
-		binary.LittleEndian.PutUint32(header[0:4], uint32(len(key)))
-		binary.LittleEndian.PutUint64(header[4:12], uint64(exp))
-		header[12] = byte(value.Type)
+		return nil
+	}
 
-		// header
-		if _, err := w.Write(header); err != nil {
+	for _, entry := range m.snapshotEntries() {
+		if err := writeEntry(w, header, entry.key, entry.expire, entry.entity); err != nil {
 			return err
 		}
+	}
 
-		// key
-		if _, err := io.WriteString(w, key); err != nil {
-			return err
-		}
+	return nil
+}
 
-		// value
-		switch value.Type {
-		case TypeString:
-			if err := writeString(w, value.Value.(string)); err != nil {
-				return err
-			}
-		case TypeHash:
-			// [Count][KeyLen][Key][ValLen][Val]...
-			h := value.Value.(map[string]HashField)
-			if err := binary.Write(w, binary.LittleEndian, uint32(len(h))); err != nil {
-				return err
-			}
+// snapshotEntries copies every key of the shard under the read lock.
+// Values are deep-copied because writers mutate hashes in place
+func (m *MapStorage) snapshotEntries() []snapshotEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-			now := time.Now().UnixNano()
+	entries := make([]snapshotEntry, 0, len(m.data))
+	for key, value := range m.data {
+		entries = append(entries, snapshotEntry{
+			key:    key,
+			expire: m.expires[key],
+			entity: value.clone(),
+		})
+	}
 
-			for field, val := range h {
-				if val.ExpireAt > 0 && now > val.ExpireAt {
-					continue
-				}
+	return entries
+}
 
-				if err := writeString(w, field); err != nil {
-					return err
-				}
-				if err := writeString(w, val.Value); err != nil {
-					return err
-				}
-				if err := binary.Write(w, binary.LittleEndian, val.ExpireAt); err != nil {
-					return err
-				}
-			}
+// Append appends value to the string stored at key, creating the key if it does not exist.
+// Returns the length of the string after the append
+func (m *MapStorage) Append(key, value string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		case TypeList:
-			//TODO List
-		case TypeSet:
-			//TODO Set
-		case TypeZSet:
-			//TODO ZSet
-		}
+	current, err := m.stringLocked(key)
+	if err != nil {
+		return 0, err
+	}
 
+	if int64(len(current))+int64(len(value)) > m.maxStringLen {
+		return 0, ErrStringTooLong
 	}
 
-	return nil
+	m.storeStringLocked(key, current+value)
+
+	return int64(len(current) + len(value)), nil
 }
 
-// Restore reads the stream and fills the map
-func (m *MapStorage) Restore(r io.Reader) error {
+// IncrByFloat adds delta to the float stored at key, a missing key counts as 0. The TTL is kept.
+// Returns the new value formatted the way it is stored
+func (m *MapStorage) IncrByFloat(key string, delta float64) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	header := make([]byte, 13)
+	entity, found, err := m.getTyped(key, TypeString)
+	if err != nil {
+		return "", err
+	}
 
-	for {
-		_, err := io.ReadFull(r, header)
-		if err == io.EOF {
-			return nil // end of stream
-		}
-		if err != nil {
-			return err
+	var value float64
+	if found {
+		value, err = strconv.ParseFloat(entity.Value.(string), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", ErrNotFloat
 		}
+	}
 
-		keyLen := binary.LittleEndian.Uint32(header[0:4])
-		exp := int64(binary.LittleEndian.Uint64(header[4:12]))
-		valueType := DataType(header[12])
+	value += delta
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", ErrFloatOverflow
+	}
 
-		// read key
-		keyBuf := make([]byte, keyLen)
-		if _, err := io.ReadFull(r, keyBuf); err != nil {
-			return err
-		}
-		key := string(keyBuf)
+	result := strconv.FormatFloat(value, 'f', -1, 64)
+	m.storeStringLocked(key, result)
 
-		// read value
-		var value interface{}
+	return result, nil
+}
 
-		switch valueType {
-		case TypeString:
-			val, err := readString(r)
-			if err != nil {
-				return err
-			}
-			value = val
-		case TypeHash:
-			var count uint32
-			if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
-				return err
-			}
+// SetRange overwrites the string stored at key starting at offset, padding it with zero bytes if needed.
+// Returns the length of the string after the modification
+func (m *MapStorage) SetRange(key string, offset int64, value string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-			h := make(map[string]HashField, count)
+	current, err := m.stringLocked(key)
+	if err != nil {
+		return 0, err
+	}
 
-			for range count {
-				field, err := readString(r)
-				if err != nil {
-					return err
-				}
+	if len(value) == 0 {
+		return int64(len(current)), nil
+	}
 
-				val, err := readString(r)
-				if err != nil {
-					return err
-				}
+	if offset > m.maxStringLen-int64(len(value)) {
+		return 0, ErrStringTooLong
+	}
+	end := offset + int64(len(value))
 
-				var expireAt int64
-				if err := binary.Read(r, binary.LittleEndian, &expireAt); err != nil {
-					return err
-				}
+	buf := []byte(current)
+	if int64(len(buf)) < end {
+		buf = append(buf, make([]byte, end-int64(len(buf)))...)
+	}
+	copy(buf[offset:], value)
 
-				h[field] = HashField{Value: val, ExpireAt: expireAt}
-			}
-			value = h
+	m.storeStringLocked(key, string(buf))
 
-		case TypeList:
-			//TODO List
-		case TypeSet:
-			//TODO Set
-		case TypeZSet:
-			//TODO ZSet
-		}
+	return int64(len(buf)), nil
+}
+
+// stringLocked returns the string stored at key, an empty string if the key does not exist or is expired.
+// Caller must hold the write lock
+func (m *MapStorage) stringLocked(key string) (string, error) {
+	entity, found, err := m.getTyped(key, TypeString)
+	if err != nil || !found {
+		return "", err
+	}
+
+	return entity.Value.(string), nil
+}
+
+// storeStringLocked replaces the string stored at key keeping its TTL and access metadata.
+// Caller must hold the write lock
+func (m *MapStorage) storeStringLocked(key, value string) {
+	entity := m.data[key]
+	entity.Type = TypeString
+	entity.Value = value
+	m.storeLocked(key, entity)
+}
+
+// SetMaxStringLen sets the maximum length of a string value. Must not be called concurrently with writes
+func (m *MapStorage) SetMaxStringLen(n int64) {
+	m.maxStringLen = n
+}
+
+// MaxStringLen returns the maximum length of a string value
+func (m *MapStorage) MaxStringLen() int64 {
+	return m.maxStringLen
+}
+
+// SetExpireJitter sets the percentage by which relative TTLs given to Set are randomized in both directions.
+// Must not be called concurrently with Set
+func (m *MapStorage) SetExpireJitter(percent float64) {
+	m.expireJitter = percent / 100
+}
 
-		if exp > 0 && time.Now().UnixNano() > exp {
+// SetExpireIndex enables or disables the index of the expirations used by ExpireDue. The index costs
+// O(log n) on every change of a TTL and about the size of the expires map in memory
+func (m *MapStorage) SetExpireIndex(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !enabled {
+		m.expireIndex = nil
+		return
+	}
+	if m.expireIndex == nil {
+		m.expireIndex = newExpireIndex(m.expires)
+	}
+}
+
+// jitter returns ttl randomized within +/- the expire jitter band
+func (m *MapStorage) jitter(ttl time.Duration) time.Duration {
+	band := int64(float64(ttl) * m.expireJitter)
+	if band <= 0 {
+		return ttl
+	}
+
+	return ttl + time.Duration(rand.Int63n(2*band+1)-band)
+}
+
+// SetSnapshotMode selects how the shard is locked during Snapshot. Must not be called concurrently with Snapshot
+func (m *MapStorage) SetSnapshotMode(mode SnapshotMode) {
+	m.snapshotMode = mode
+}
+
+// Restore reads the stream and fills the map
+func (m *MapStorage) Restore(r io.Reader) error {
+	entries, err := readEntries(r)
+	if err != nil {
+		return err
+	}
+
+	m.BulkLoad(entries)
+
+	return nil
+}
+
+// BulkLoad inserts the entries under a single write lock, overwriting existing keys.
+// Entries that are already expired are skipped. Returns the number of loaded entries
+func (m *MapStorage) BulkLoad(entries []Entry) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	loaded := 0
+
+	for _, entry := range entries {
+		if entry.ExpireAt > 0 && now > entry.ExpireAt {
 			continue
 		}
 
-		m.data[key] = Entity{
-			Type:  valueType,
-			Value: value,
-		}
-		if exp > 0 {
-			m.expires[key] = exp
+		m.storeLocked(entry.Key, entry.Entity)
+		if entry.ExpireAt > 0 {
+			m.setExpireLocked(entry.Key, entry.ExpireAt)
+		} else {
+			m.clearExpireLocked(entry.Key)
 		}
+		loaded++
 	}
+
+	return loaded
 }
 
 // Hash
 
-// getHash safely obtains the hash and results in the desired type
-func (m *MapStorage) getHash(key string) (map[string]HashField, bool) {
-	entry, exists := m.data[key]
-	if !exists || entry.Type != TypeHash || entry.Value == nil {
-		return nil, false
+// getHash returns the hash stored at key, false if the key is missing or expired and ErrWrongType if it
+// holds another type. An expired key is deleted. Caller must hold the write lock
+func (m *MapStorage) getHash(key string) (map[string]HashField, bool, error) {
+	entity, found, err := m.getTyped(key, TypeHash)
+	if err != nil || !found || entity.Value == nil {
+		return nil, false, err
 	}
-	return entry.Value.(map[string]HashField), true
+	return entity.Value.(map[string]HashField), true, nil
+}
+
+// peekHash is getHash for callers holding only the read lock, an expired key is reported as missing but kept
+func (m *MapStorage) peekHash(key string) (map[string]HashField, bool, error) {
+	entity, found, _, err := m.lookupTyped(key, TypeHash)
+	if err != nil || !found || entity.Value == nil {
+		return nil, false, err
+	}
+	return entity.Value.(map[string]HashField), true, nil
 }
 
 // checkFieldLocked checks the TTL of the field. If it has expired, it deletes it
@@ -443,7 +977,7 @@ func (m *MapStorage) getHash(key string) (map[string]HashField, bool) {
 func (m *MapStorage) checkFieldLocked(hash map[string]HashField, field string) (int, bool) {
 	val, ok := hash[field]
 	if !ok {
-		return 0, false
+		return len(hash), false
 	}
 
 	if val.ExpireAt > 0 && time.Now().UnixNano() > val.ExpireAt {
@@ -458,18 +992,75 @@ func (m *MapStorage) HSet(key string, fields map[string]string) int64 {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	entity, ok := m.data[key]
-	if ok && entity.Type != TypeHash {
+	return m.hsetLocked(key, fields, 0)
+}
+
+// HSetEx sets the specified fields and their TTL under a single lock. Returns the number of fields set,
+// 0 if the FNX or FXX condition blocked the write or -1 if key holds a value of another type
+func (m *MapStorage) HSetEx(key string, fields map[string]string, ttl time.Duration, opts HSetExOptions) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if opts.FNX || opts.FXX {
+		hash, ok, err := m.getHash(key)
+		if err != nil {
+			return -1
+		}
+
+		existing := 0
+		if ok {
+			for f := range fields {
+				if _, exists := m.checkFieldLocked(hash, f); exists {
+					existing++
+				}
+			}
+			if len(hash) == 0 {
+				m.removeLocked(key)
+			}
+		}
+
+		if (opts.FNX && existing > 0) || (opts.FXX && existing < len(fields)) {
+			return 0
+		}
+	}
+
+	if m.hsetLocked(key, fields, time.Now().Add(ttl).UnixNano()) < 0 {
+		return -1
+	}
+
+	return int64(len(fields))
+}
+
+// HSetNX sets field only if it does not exist in the hash stored at key.
+// Returns 1 if the field was set, 0 if it exists or -1 if key holds a value of another type
+func (m *MapStorage) HSetNX(key, field, value string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if hash, ok, _ := m.getHash(key); ok {
+		if _, exists := m.checkFieldLocked(hash, field); exists {
+			return 0
+		}
+	}
+
+	return m.hsetLocked(key, map[string]string{field: value}, 0)
+}
+
+// hsetLocked writes the fields with the given field expiration, 0 means no TTL.
+// Returns the number of created fields or -1 on wrong type. Caller must hold the write lock
+func (m *MapStorage) hsetLocked(key string, fields map[string]string, expireAt int64) int64 {
+	entity, ok, err := m.getTyped(key, TypeHash)
+	if err != nil {
 		return -1 // wrong type
 	}
 
 	var hash map[string]HashField
 	if !ok || entity.Value == nil {
 		hash = make(map[string]HashField)
-		m.data[key] = Entity{
+		m.storeLocked(key, Entity{
 			Type:  TypeHash,
 			Value: hash,
-		}
+		})
 	} else {
 		hash = entity.Value.(map[string]HashField)
 	}
@@ -481,43 +1072,45 @@ func (m *MapStorage) HSet(key string, fields map[string]string) int64 {
 		if _, ok = hash[f]; !ok {
 			created++
 		}
-		hash[f] = HashField{Value: v, ExpireAt: 0}
+		hash[f] = HashField{Value: v, ExpireAt: expireAt}
 	}
 
 	return created
 }
 
-// HGet returns the value associated with field in the hash stored at key
-func (m *MapStorage) HGet(key, field string) (string, bool) {
+// HGet returns the value associated with field in the hash stored at key.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HGet(key, field string) (string, bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.getHash(key)
 	if !ok {
-		return "", false
+		return "", false, err
 	}
 
 	lenHash, ok := m.checkFieldLocked(hash, field)
 	if lenHash == 0 {
-		delete(m.data, key)
-		return "", false
+		m.removeLocked(key)
+		return "", false, nil
 	}
 
 	if !ok {
-		return "", false
+		return "", false, nil
 	}
 
-	return hash[field].Value, true
+	return hash[field].Value, true, nil
 }
 
-// HGetAll returns all fields and values of the hash stored at key
-func (m *MapStorage) HGetAll(key string) map[string]string {
+// HGetAll returns all fields and values of the hash stored at key.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HGetAll(key string) (map[string]string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.getHash(key)
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	result := make(map[string]string, len(hash))
@@ -533,21 +1126,22 @@ func (m *MapStorage) HGetAll(key string) map[string]string {
 	}
 
 	if len(hash) == 0 {
-		delete(m.data, key)
-		return nil
+		m.removeLocked(key)
+		return nil, nil
 	}
 
-	return result
+	return result, nil
 }
 
-// HDel removes the specified fields from the map stored at key
-func (m *MapStorage) HDel(key string, fields []string) int64 {
+// HDel removes the specified fields from the map stored at key.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HDel(key string, fields []string) (int64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.getHash(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	var deleted int64
@@ -561,103 +1155,106 @@ func (m *MapStorage) HDel(key string, fields []string) int64 {
 	}
 
 	if len(hash) == 0 {
-		delete(m.data, key)
-		delete(m.expires, key)
+		m.removeLocked(key)
 	}
 
-	return deleted
+	return deleted, nil
 }
 
-// HExists returns 1 if field exist, 0 otherwise
-func (m *MapStorage) HExists(key, field string) int64 {
+// HExists returns 1 if field exist, 0 otherwise.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HExists(key, field string) (int64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.getHash(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	lenHash, ok := m.checkFieldLocked(hash, field)
 	if lenHash == 0 {
-		delete(m.data, key)
-		return 0
+		m.removeLocked(key)
+		return 0, nil
 	}
 
 	if !ok {
-		return 0
+		return 0, nil
 	}
 
-	return 1
+	return 1, nil
 }
 
-// HLen returns the number of fields contained in the hash stored at key
-func (m *MapStorage) HLen(key string) int64 {
+// HLen returns the number of fields contained in the hash stored at key.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HLen(key string) (int64, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.peekHash(key)
 	if !ok {
-		return 0
+		return 0, err
 	}
 
 	now := time.Now().UnixNano()
 	var cnt int64
 
 	for _, v := range hash {
-		if v.ExpireAt > now {
+		if v.ExpireAt > 0 && v.ExpireAt <= now {
 			continue
 		}
 		cnt++
 	}
 
-	return cnt
+	return cnt, nil
 }
 
-// HKeys returns all field names in the hash stored at key
-func (m *MapStorage) HKeys(key string) []string {
+// HKeys returns all field names in the hash stored at key.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HKeys(key string) ([]string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.peekHash(key)
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	now := time.Now().UnixNano()
 	response := make([]string, 0, len(hash))
 
 	for f, v := range hash {
-		if v.ExpireAt > now {
+		if v.ExpireAt > 0 && v.ExpireAt <= now {
 			continue
 		}
 		response = append(response, f)
 	}
 
-	return response
+	return response, nil
 }
 
-// HVals returns all values in the hash stored at key
-func (m *MapStorage) HVals(key string) []string {
+// HVals returns all values in the hash stored at key.
+// Returns ErrWrongType if key holds a value of another type
+func (m *MapStorage) HVals(key string) ([]string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, err := m.peekHash(key)
 	if !ok {
-		return nil
+		return nil, err
 	}
 
 	now := time.Now().UnixNano()
 	response := make([]string, 0, len(hash))
 
 	for _, v := range hash {
-		if v.ExpireAt > now {
+		if v.ExpireAt > 0 && v.ExpireAt <= now {
 			continue
 		}
 		response = append(response, v.Value)
 	}
 
-	return response
+	return response, nil
 }
 
 // HExpire set an expiration on one or more fields of a given hash key
@@ -665,7 +1262,7 @@ func (m *MapStorage) HExpire(key string, ttl time.Duration, opts ExpireOptions,
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	hash, ok := m.getHash(key)
+	hash, ok, _ := m.getHash(key)
 	if !ok {
 		return nil, false
 	}
@@ -721,3 +1318,31 @@ func (m *MapStorage) HExpire(key string, ttl time.Duration, opts ExpireOptions,
 
 	return results, true
 }
+
+// HPTTL returns the remaining time to live of the fields in milliseconds, -1 for a field without a TTL
+// and -2 for a missing one. Returns false if the key does not hold a hash
+func (m *MapStorage) HPTTL(key string, fields []string) ([]int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hash, ok, _ := m.peekHash(key)
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now().UnixNano()
+	results := make([]int64, len(fields))
+	for i, f := range fields {
+		val, exists := hash[f]
+		switch {
+		case !exists || (val.ExpireAt > 0 && now > val.ExpireAt):
+			results[i] = -2
+		case val.ExpireAt == 0:
+			results[i] = -1
+		default:
+			results[i] = time.Duration(val.ExpireAt - now).Milliseconds()
+		}
+	}
+
+	return results, true
+}
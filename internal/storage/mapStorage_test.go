@@ -1,8 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -46,6 +54,41 @@ func TestMapStorage_Concurrency(t *testing.T) {
 	wg.Wait()
 }
 
+// TestHPTTL_ExpiringKeyConcurrent runs HPTTL on expiring hashes next to other readers, run it with -race
+func TestHPTTL_ExpiringKeyConcurrent(t *testing.T) {
+	s := NewMapStorage()
+	const keys = 50
+
+	for i := range keys {
+		key := "h" + strconv.Itoa(i)
+		s.HSet(key, map[string]string{"f": "v"})
+		s.ExpireAt(key, time.Now().Add(time.Duration(i%5)*time.Millisecond))
+	}
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for j := range 2000 {
+				key := "h" + strconv.Itoa(j%keys)
+				if workerID%2 == 0 {
+					s.HPTTL(key, []string{"f"})
+				} else {
+					s.HLen(key)
+					s.HKeys(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	time.Sleep(5 * time.Millisecond)
+	if ttls, ok := s.HPTTL("h1", []string{"f"}); ok {
+		t.Errorf("HPTTL of an expired hash = %v, want missing", ttls)
+	}
+}
+
 func FuzzMapStorage(f *testing.F) {
 	s := NewMapStorage()
 
@@ -66,3 +109,1117 @@ func FuzzMapStorage(f *testing.F) {
 		}
 	})
 }
+
+func TestHash_MissingFieldKeepsHash(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.HSet("h", map[string]string{"f": "v"})
+
+			if _, ok, _ := s.HGet("h", "missing"); ok {
+				t.Errorf("HGET of a missing field reported it present")
+			}
+			if n, _ := s.HExists("h", "missing"); n != 0 {
+				t.Errorf("HEXISTS of a missing field reported it present")
+			}
+
+			if n, _ := s.HLen("h"); n != 1 {
+				t.Errorf("hash lost its fields after a missing field lookup, HLEN = %d", n)
+			}
+			if v, ok, _ := s.HGet("h", "f"); !ok || v != "v" {
+				t.Errorf("HGET h f = %q, %v, want \"v\", true", v, ok)
+			}
+		})
+	}
+}
+
+func TestHash_WrongType(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.Set("s", "v", SetOptions{}) //nolint:errcheck
+
+			_, _, errGet := s.HGet("s", "f")
+			_, errGetAll := s.HGetAll("s")
+			_, errDel := s.HDel("s", []string{"f"})
+			_, errExists := s.HExists("s", "f")
+			_, errLen := s.HLen("s")
+			_, errKeys := s.HKeys("s")
+			_, errVals := s.HVals("s")
+
+			for i, err := range []error{errGet, errGetAll, errDel, errExists, errLen, errKeys, errVals} {
+				if !errors.Is(err, ErrWrongType) {
+					t.Errorf("call %d: got %v, want ErrWrongType", i, err)
+				}
+			}
+
+			if v, ok, _ := s.Get("s"); !ok || v != "v" {
+				t.Errorf("the string was changed by a hash command")
+			}
+		})
+	}
+}
+
+func TestCopy_HashNoAliasing(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.HSet("src", map[string]string{"f1": "v1", "f2": "v2"})
+			s.HExpire("src", time.Hour, ExpireOptions{}, []string{"f2"})
+
+			if !s.Copy("src", "dst", false) {
+				t.Fatalf("Copy returned false")
+			}
+
+			// mutate the copy
+			s.HSet("dst", map[string]string{"f1": "changed", "f3": "new"})
+			s.HDel("dst", []string{"f2"}) //nolint:errcheck
+
+			if v, _, _ := s.HGet("src", "f1"); v != "v1" {
+				t.Errorf("original field changed through copy: got %q", v)
+			}
+			if n, _ := s.HExists("src", "f2"); n != 1 {
+				t.Errorf("original field deleted through copy")
+			}
+			if n, _ := s.HExists("src", "f3"); n != 0 {
+				t.Errorf("field added to copy appeared in original")
+			}
+
+			// field TTL is carried over
+			s.Copy("src", "dst2", false)
+			codes, _ := s.HExpire("dst2", time.Hour, ExpireOptions{NX: true}, []string{"f2"})
+			if len(codes) != 1 || codes[0] != 0 {
+				t.Errorf("field TTL was not copied, got %v", codes)
+			}
+
+			// existing destination without REPLACE
+			if s.Copy("src", "dst", false) {
+				t.Errorf("Copy overwrote existing key without replace")
+			}
+			if !s.Copy("src", "dst", true) {
+				t.Errorf("Copy with replace failed")
+			}
+		})
+	}
+}
+
+func TestMapStorage_DeleteExpiredNoNaN(t *testing.T) {
+	s := NewMapStorage()
+
+	// empty expires
+	if ratio, expired := s.DeleteExpired(20); ratio != 0.0 || expired != 0 {
+		t.Errorf("empty storage: got ratio %v, expired %d", ratio, expired)
+	}
+
+	s.Set("k", "v", SetOptions{TTL: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+
+	// zero limit must not divide by zero
+	ratio, expired := s.DeleteExpired(0)
+	if math.IsNaN(ratio) || ratio != 0.0 || expired != 0 {
+		t.Errorf("zero limit: got ratio %v, expired %d", ratio, expired)
+	}
+
+	sharded, _ := NewShardedMapStorage(4) //nolint:errcheck
+	if ratio, _ = sharded.DeleteExpired(0); math.IsNaN(ratio) || ratio != 0.0 {
+		t.Errorf("sharded zero limit: got ratio %v", ratio)
+	}
+}
+
+func TestStoreResult(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			// empty result deletes the destination
+			s.Set("dest", "v", SetOptions{TTL: time.Hour})
+			if s.StoreResult("dest", Entity{Type: TypeHash, Value: map[string]HashField{}}, true) {
+				t.Errorf("StoreResult with empty result returned true")
+			}
+			if _, status := s.RemainingTTL("dest"); status != ExpNotFound {
+				t.Errorf("destination must be deleted on empty result")
+			}
+
+			// a different type is replaced and the TTL is dropped
+			s.Set("dest", "v", SetOptions{TTL: time.Hour})
+			hash := map[string]HashField{"f": {Value: "v"}}
+			if !s.StoreResult("dest", Entity{Type: TypeHash, Value: hash}, false) {
+				t.Errorf("StoreResult returned false")
+			}
+			if v, ok, _ := s.HGet("dest", "f"); !ok || v != "v" {
+				t.Errorf("destination does not hold the result, got %q", v)
+			}
+			if _, status := s.RemainingTTL("dest"); status != ExpNoTimeout {
+				t.Errorf("destination TTL must be discarded, got status %d", status)
+			}
+
+			// empty result on a missing key
+			if s.StoreResult("missing", Entity{}, true) {
+				t.Errorf("StoreResult with empty result returned true")
+			}
+		})
+	}
+}
+
+func TestHSetEx(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.HSet("h", map[string]string{"keep": "v"})
+
+			if set := s.HSetEx("h", map[string]string{"f1": "v1", "f2": "v2"}, 50*time.Millisecond, HSetExOptions{}); set != 2 {
+				t.Errorf("HSetEx returned %d, want 2", set)
+			}
+
+			// snapshot taken before expiry must keep the field TTLs
+			var buf bytes.Buffer
+			if err := s.Snapshot(&buf); err != nil {
+				t.Fatalf("snapshot failed: %v", err)
+			}
+			restored := NewMapStorage()
+			if err := restored.Restore(&buf); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+
+			if v, ok, _ := s.HGet("h", "f1"); !ok || v != "v1" {
+				t.Errorf("HGet f1 = %q, %v before expiry", v, ok)
+			}
+
+			time.Sleep(60 * time.Millisecond)
+
+			for _, st := range []Storage{s, restored} {
+				if _, ok, _ := st.HGet("h", "f1"); ok {
+					t.Errorf("field f1 must be expired")
+				}
+				if v, ok, _ := st.HGet("h", "keep"); !ok || v != "v" {
+					t.Errorf("field without TTL must survive, got %q", v)
+				}
+			}
+
+			if set := s.HSetEx("h", map[string]string{"keep": "x", "new": "x"}, time.Second, HSetExOptions{FNX: true}); set != 0 {
+				t.Errorf("HSetEx FNX with an existing field returned %d, want 0", set)
+			}
+			if set := s.HSetEx("h", map[string]string{"keep": "x", "new": "x"}, time.Second, HSetExOptions{FXX: true}); set != 0 {
+				t.Errorf("HSetEx FXX with a missing field returned %d, want 0", set)
+			}
+			if _, ok, _ := s.HGet("h", "new"); ok {
+				t.Errorf("a blocked HSetEx created a field")
+			}
+
+			s.Set("str", "v", SetOptions{})
+			if set := s.HSetEx("str", map[string]string{"f": "v"}, time.Second, HSetExOptions{}); set != -1 {
+				t.Errorf("HSetEx on a string returned %d, want -1", set)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			total := 1000
+			for i := 0; i < total; i++ {
+				s.Set(fmt.Sprintf("scan-%d", i), "v", SetOptions{})
+			}
+
+			seen := make(map[string]bool, total)
+			var cursor uint64
+			calls := 0
+			for {
+				keys, next, examined := s.Scan(cursor, 50, false)
+				if examined == 0 {
+					t.Fatalf("Scan examined no entries")
+				}
+
+				// keys added during the iteration may or may not be returned
+				s.Set(fmt.Sprintf("added-%d", calls), "v", SetOptions{})
+
+				for _, k := range keys {
+					seen[k] = true
+				}
+
+				calls++
+				cursor = next
+				if cursor == 0 {
+					break
+				}
+				if calls > total {
+					t.Fatalf("Scan did not terminate")
+				}
+			}
+
+			for i := 0; i < total; i++ {
+				if key := fmt.Sprintf("scan-%d", i); !seen[key] {
+					t.Errorf("key %s was not returned", key)
+				}
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			for i := range 100 {
+				s.Set(fmt.Sprintf("keys-%d", i), "v", SetOptions{}) //nolint:errcheck
+			}
+			s.Set("other", "v", SetOptions{})                                             //nolint:errcheck
+			s.Set("keys-expired", "v", SetOptions{TTL: time.Millisecond, Absolute: true}) //nolint:errcheck
+			time.Sleep(5 * time.Millisecond)
+
+			match := func(key string) bool { return strings.HasPrefix(key, "keys-") }
+
+			keys := s.Keys(match, 0)
+			slices.Sort(keys)
+			if len(keys) != 100 || slices.Contains(keys, "keys-expired") {
+				t.Fatalf("expected the 100 live matching keys, got %d: %v", len(keys), keys)
+			}
+			if keys = slices.Compact(keys); len(keys) != 100 {
+				t.Errorf("keys were returned twice")
+			}
+
+			if keys := s.Keys(match, 7); len(keys) != 7 {
+				t.Errorf("limit 7: got %d keys", len(keys))
+			}
+			if keys := s.Keys(func(string) bool { return false }, 0); len(keys) != 0 {
+				t.Errorf("no match: got %v", keys)
+			}
+		})
+	}
+}
+
+func TestNextScanCursor(t *testing.T) {
+	var order []uint64
+	cursor := uint64(0)
+	for {
+		order = append(order, cursor)
+		if cursor = nextScanCursor(cursor, 7); cursor == 0 {
+			break
+		}
+	}
+	if want := []uint64{0, 4, 2, 6, 1, 5, 3, 7}; !slices.Equal(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+
+	// bits left by a larger table are dropped
+	if next := nextScanCursor(12, 3); next != 2 {
+		t.Errorf("cursor 12 in a table of 4 buckets: got %d, want 2", next)
+	}
+}
+
+// TestScanIndex_Resize grows and shrinks the table between the calls of a scan,
+// no key that stays in the table may be missed
+func TestScanIndex_Resize(t *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		x := newScanIndex()
+		for i := range 64 {
+			x.add("stable-" + strconv.Itoa(i))
+		}
+
+		seen := make(map[string]int)
+		visit := func(key string) bool {
+			seen[key]++
+			return true
+		}
+
+		cursor, _ := x.scan(0, 16, reverse, visit)
+		for i := range 1000 {
+			x.add("grow-" + strconv.Itoa(i))
+		}
+		cursor, _ = x.scan(cursor, 16, reverse, visit)
+		for i := range 1000 {
+			x.remove("grow-" + strconv.Itoa(i))
+		}
+		if len(x.buckets) >= 1024 {
+			t.Fatalf("table of %d buckets did not shrink", len(x.buckets))
+		}
+
+		for cursor != 0 {
+			cursor, _ = x.scan(cursor, 16, reverse, visit)
+		}
+
+		for i := range 64 {
+			if seen["stable-"+strconv.Itoa(i)] == 0 {
+				t.Errorf("reverse=%v: stable-%d was missed", reverse, i)
+			}
+		}
+	}
+}
+
+// TestScan_ExaminedIsBounded checks that a call examines about count entries, not the whole shard,
+// and that a full iteration examines every entry once
+func TestScan_ExaminedIsBounded(t *testing.T) {
+	m := NewMapStorage()
+	const total = 10000
+	for i := range total {
+		m.Set("key-"+strconv.Itoa(i), "v", SetOptions{}) //nolint:errcheck
+	}
+
+	var cursor uint64
+	sum := 0
+	for {
+		keys, next, examined := m.Scan(cursor, 10, false)
+		if examined > 100 {
+			t.Fatalf("a call with COUNT 10 examined %d entries", examined)
+		}
+		if len(keys) != examined {
+			t.Fatalf("returned %d keys out of %d examined live ones", len(keys), examined)
+		}
+		sum += examined
+
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	if sum != total {
+		t.Errorf("full iteration examined %d entries, want %d", sum, total)
+	}
+}
+
+func TestScan_Reverse(t *testing.T) {
+	m := NewMapStorage()
+	for i := range 200 {
+		m.Set(fmt.Sprintf("key-%d", i), "v", SetOptions{}) //nolint:errcheck
+	}
+
+	walk := func(reverse bool) []string {
+		var all []string
+		var cursor uint64
+		for {
+			keys, next, _ := m.Scan(cursor, 1, reverse)
+			all = append(all, keys...)
+			if cursor = next; cursor == 0 {
+				return all
+			}
+		}
+	}
+
+	forward, backward := walk(false), walk(true)
+	slices.Reverse(backward)
+	if !slices.Equal(forward, backward) {
+		t.Errorf("reverse scan must return the forward order backwards")
+	}
+}
+
+// TestScan_Guarantee inserts and deletes keys between the calls of a scan. Every key that exists during
+// the whole iteration must be returned exactly once, in both directions
+func TestScan_Guarantee(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		for _, reverse := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/reverse=%v", name, reverse), func(t *testing.T) {
+				rng := rand.New(rand.NewSource(42))
+
+				const stable, volatile = 500, 500
+				for i := range stable {
+					s.Set(fmt.Sprintf("stable-%d", i), "v", SetOptions{}) //nolint:errcheck
+				}
+				for i := range volatile {
+					s.Set(fmt.Sprintf("volatile-%d", i), "v", SetOptions{}) //nolint:errcheck
+				}
+
+				seen := make(map[string]int)
+				var cursor uint64
+				for calls := 0; ; calls++ {
+					keys, next, _ := s.Scan(cursor, 1+rng.Intn(20), reverse)
+					for _, k := range keys {
+						seen[k]++
+					}
+
+					for range 5 {
+						s.Delete(fmt.Sprintf("volatile-%d", rng.Intn(volatile)))
+						s.Set(fmt.Sprintf("new-%d", rng.Int()), "v", SetOptions{}) //nolint:errcheck
+					}
+
+					if cursor = next; cursor == 0 {
+						break
+					}
+					if calls > 10*(stable+volatile) {
+						t.Fatalf("Scan did not terminate")
+					}
+				}
+
+				for i := range stable {
+					if n := seen[fmt.Sprintf("stable-%d", i)]; n != 1 {
+						t.Errorf("stable-%d returned %d times, want exactly once", i, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := s.RandomKey(0); ok {
+				t.Fatalf("RandomKey on an empty storage must fail")
+			}
+
+			for i := range 500 {
+				s.Set(fmt.Sprintf("expired-%d", i), "v", SetOptions{TTL: time.Nanosecond}) //nolint:errcheck
+			}
+			time.Sleep(time.Millisecond)
+			if key, ok := s.RandomKey(0); ok {
+				t.Fatalf("RandomKey returned the expired key %s", key)
+			}
+
+			for i := range 500 {
+				s.Set(fmt.Sprintf("expired-%d", i), "v", SetOptions{TTL: time.Nanosecond}) //nolint:errcheck
+			}
+			for i := range 50 {
+				s.Set(fmt.Sprintf("live-%d", i), "v", SetOptions{}) //nolint:errcheck
+			}
+			time.Sleep(time.Millisecond)
+
+			for range 200 {
+				key, ok := s.RandomKey(0)
+				if !ok {
+					t.Fatalf("RandomKey found no live key")
+				}
+				if strings.HasPrefix(key, "expired-") {
+					t.Fatalf("RandomKey returned the expired key %s", key)
+				}
+			}
+
+			// fewer keys than attempts, so the only hash is always found
+			for i := range 500 {
+				s.Delete(fmt.Sprintf("expired-%d", i))
+			}
+			s.HSet("hash", map[string]string{"f": "v"})
+			if key, ok := s.RandomKey(TypeHash); !ok || key != "hash" {
+				t.Errorf("RandomKey(TypeHash) = %q, %v, want hash", key, ok)
+			}
+		})
+	}
+}
+
+func TestAppendSetRange_MaxStringLen(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.(interface{ SetMaxStringLen(int64) }).SetMaxStringLen(8)
+
+			if n, err := s.Append("a", "12345"); err != nil || n != 5 {
+				t.Fatalf("Append = %d, %v, want 5", n, err)
+			}
+			if n, err := s.Append("a", "678"); err != nil || n != 8 {
+				t.Fatalf("Append up to the limit = %d, %v, want 8", n, err)
+			}
+			if _, err := s.Append("a", "9"); !errors.Is(err, ErrStringTooLong) {
+				t.Errorf("Append past the limit returned %v", err)
+			}
+			if v, _, _ := s.Get("a"); v != "12345678" {
+				t.Errorf("failed Append must not modify the value, got %q", v)
+			}
+
+			if n, err := s.SetRange("r", 2, "ab"); err != nil || n != 4 {
+				t.Fatalf("SetRange = %d, %v, want 4", n, err)
+			}
+			if v, _, _ := s.Get("r"); v != "\x00\x00ab" {
+				t.Errorf("SetRange must pad with zero bytes, got %q", v)
+			}
+			if _, err := s.SetRange("r", 7, "xy"); !errors.Is(err, ErrStringTooLong) {
+				t.Errorf("SetRange past the limit returned %v", err)
+			}
+
+			if _, err := s.Set("big", "123456789", SetOptions{}); !errors.Is(err, ErrStringTooLong) {
+				t.Errorf("Set past the limit returned %v", err)
+			}
+
+			s.HSet("h", map[string]string{"f": "v"})
+			if _, err := s.Append("h", "x"); !errors.Is(err, ErrWrongType) {
+				t.Errorf("Append on a hash returned %v", err)
+			}
+		})
+	}
+}
+
+func TestPush_MaxListLen(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.(interface{ SetMaxListLen(int64) }).SetMaxListLen(3)
+
+			for i := range 5 {
+				n, err := s.Push("right", []string{strconv.Itoa(i)}, false)
+				if err != nil || n > 3 {
+					t.Fatalf("RPUSH = %d, %v, the list must never exceed the cap", n, err)
+				}
+			}
+			if got, _ := s.LRange("right", 0, -1); !slices.Equal(got, []string{"2", "3", "4"}) {
+				t.Errorf("RPUSH must drop the head, got %v", got)
+			}
+
+			if n, err := s.Push("left", []string{"0", "1", "2", "3", "4"}, true); err != nil || n != 3 {
+				t.Fatalf("LPUSH = %d, %v, want 3", n, err)
+			}
+			if got, _ := s.LRange("left", 0, -1); !slices.Equal(got, []string{"4", "3", "2"}) {
+				t.Errorf("LPUSH must drop the tail, got %v", got)
+			}
+		})
+	}
+}
+
+func TestList_Ranges(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			if n, err := s.Push("l", []string{"c", "b", "a"}, true); err != nil || n != 3 {
+				t.Fatalf("LPUSH = %d, %v, want 3", n, err)
+			}
+			if n, err := s.Push("l", []string{"d", "e"}, false); err != nil || n != 5 {
+				t.Fatalf("RPUSH = %d, %v, want 5", n, err)
+			}
+
+			tests := []struct {
+				start, stop int64
+				want        []string
+			}{
+				{0, -1, []string{"a", "b", "c", "d", "e"}},
+				{1, 2, []string{"b", "c"}},
+				{-2, 100, []string{"d", "e"}},
+				{-100, 0, []string{"a"}},
+				{3, 1, []string{}},
+				{5, 10, []string{}},
+			}
+			for _, tt := range tests {
+				if got, err := s.LRange("l", tt.start, tt.stop); err != nil || !slices.Equal(got, tt.want) {
+					t.Errorf("LRange(%d, %d) = %v, %v, want %v", tt.start, tt.stop, got, err, tt.want)
+				}
+			}
+
+			if err := s.LTrim("l", 1, -2); err != nil {
+				t.Fatalf("LTrim: %v", err)
+			}
+			if got, _ := s.LRange("l", 0, -1); !slices.Equal(got, []string{"b", "c", "d"}) {
+				t.Errorf("after LTrim got %v", got)
+			}
+			if err := s.LTrim("l", 5, 10); err != nil {
+				t.Fatalf("LTrim: %v", err)
+			}
+			if n, _ := s.LLen("l"); n != 0 || s.Len() != 0 {
+				t.Errorf("an empty list must be deleted, LLen %d, keys %d", n, s.Len())
+			}
+
+			s.Set("str", "v", SetOptions{}) //nolint:errcheck
+			if _, err := s.Push("str", []string{"x"}, true); !errors.Is(err, ErrWrongType) {
+				t.Errorf("Push on a string returned %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStats_Sampling(t *testing.T) {
+	m := NewMapStorage()
+
+	const keys = 5 * memoryStatsSamples
+	for i := range keys {
+		m.Set(fmt.Sprintf("key%06d", i), "0123456789", SetOptions{}) //nolint:errcheck
+	}
+
+	stats := m.MemoryStats()
+	if !stats.Sampled {
+		t.Error("expected a sampled estimate")
+	}
+	if stats.Keys != keys {
+		t.Errorf("expected exact key count %d, got %d", keys, stats.Keys)
+	}
+
+	// every key is 9 bytes and every value 10 bytes, so the extrapolation is exact
+	if want := int64(keys * 19); stats.DatasetBytes != want {
+		t.Errorf("expected %d dataset bytes, got %d", want, stats.DatasetBytes)
+	}
+	if got := stats.Types[TypeString].Keys; got != keys {
+		t.Errorf("expected %d string keys, got %d", keys, got)
+	}
+}
+
+func TestGetTyped(t *testing.T) {
+	m := NewMapStorage()
+	m.Set("str", "v", SetOptions{}) //nolint:errcheck
+	m.HSet("hash", map[string]string{"f": "v"})
+	m.Set("expired", "v", SetOptions{TTL: time.Nanosecond}) //nolint:errcheck
+	m.HSet("expired-hash", map[string]string{"f": "v"})
+	m.ExpireAt("expired-hash", time.Now().Add(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		name      string
+		key       string
+		want      DataType
+		wantFound bool
+		wantErr   error
+	}{
+		{"Missing", "missing", TypeString, false, nil},
+		{"Right type", "str", TypeString, true, nil},
+		{"Right type hash", "hash", TypeHash, true, nil},
+		{"Wrong type", "hash", TypeString, false, ErrWrongType},
+		{"Expired", "expired", TypeString, false, nil},
+		{"Expired wrong type", "expired-hash", TypeString, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.mu.Lock()
+			entity, found, err := m.getTyped(tt.key, tt.want)
+			_, stored := m.data[tt.key]
+			m.mu.Unlock()
+
+			if found != tt.wantFound || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got found=%v err=%v, want found=%v err=%v", found, err, tt.wantFound, tt.wantErr)
+			}
+			if found && entity.Type != tt.want {
+				t.Errorf("got type %v, want %v", entity.Type, tt.want)
+			}
+			if strings.HasPrefix(tt.key, "expired") && stored {
+				t.Errorf("expired key %q was not deleted", tt.key)
+			}
+		})
+	}
+
+	if _, ok, _ := m.HGet("expired-hash", "f"); ok {
+		t.Error("HGet must not return fields of an expired hash")
+	}
+}
+
+func TestSet_OverwritesAnyType(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.HSet("hash", map[string]string{"f": "v"})
+			s.HSet("kept", map[string]string{"f": "v"})
+
+			if ok, err := s.Set("kept", "v", SetOptions{NX: true}); ok || err != nil {
+				t.Errorf("Set NX over a hash = %v, %v, want false", ok, err)
+			}
+			if ok, err := s.Set("hash", "v", SetOptions{}); !ok || err != nil {
+				t.Fatalf("Set over a hash = %v, %v, want true", ok, err)
+			}
+			if v, ok, err := s.Get("hash"); v != "v" || !ok || err != nil {
+				t.Errorf("Get after Set over a hash = %q, %v, %v", v, ok, err)
+			}
+			if v, ok, _ := s.HGet("kept", "f"); v != "v" || !ok {
+				t.Errorf("a failed Set NX must keep the hash, HGet = %q, %v", v, ok)
+			}
+		})
+	}
+}
+
+func TestDataType_String(t *testing.T) {
+	for typ, want := range map[DataType]string{
+		TypeString: "string",
+		TypeList:   "list",
+		TypeSet:    "set",
+		TypeHash:   "hash",
+		TypeZSet:   "zset",
+		TypeStream: "stream",
+		0:          "none",
+	} {
+		if got := typ.String(); got != want {
+			t.Errorf("DataType(%d).String() = %q, want %q", typ, got, want)
+		}
+	}
+}
+
+// checkExpireIndex verifies that the expire index of the shard mirrors its expires map
+func checkExpireIndex(t *testing.T, m *MapStorage) {
+	t.Helper()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	idx := m.expireIndex
+	if idx.len() != len(m.expires) || len(idx.items) != len(m.expires) {
+		t.Fatalf("index holds %d keys, expires %d", idx.len(), len(m.expires))
+	}
+	for i, item := range idx.heap {
+		if item.index != i || idx.items[item.key] != item {
+			t.Fatalf("item %q is at %d, recorded at %d", item.key, i, item.index)
+		}
+		if deadline, ok := m.expires[item.key]; !ok || deadline != item.deadline {
+			t.Errorf("index deadline of %q is %d, expires has %d", item.key, item.deadline, deadline)
+		}
+		if parent := (i - 1) / 2; i > 0 && idx.heap[parent].deadline > item.deadline {
+			t.Fatalf("heap order broken at %d", i)
+		}
+	}
+}
+
+func TestExpireIndex(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			// keys with a TTL before the index is enabled are indexed when it is built
+			s.Set("before", "v", SetOptions{TTL: time.Hour}) //nolint:errcheck
+			s.(interface{ SetExpireIndex(bool) }).SetExpireIndex(true)
+
+			shards := []*MapStorage{}
+			switch st := s.(type) {
+			case *MapStorage:
+				shards = append(shards, st)
+			case *ShardedMapStorage:
+				shards = st.shards
+			}
+
+			now := time.Now()
+			for i := range 100 {
+				s.Set("k"+strconv.Itoa(i), "v", SetOptions{TTL: time.Duration(i+1) * time.Minute}) //nolint:errcheck
+			}
+			s.Set("persistent", "v", SetOptions{}) //nolint:errcheck
+
+			s.Persist("k0")
+			s.Delete("k1")
+			s.Set("k2", "v", SetOptions{})              //nolint:errcheck
+			s.Set("k3", "v", SetOptions{KeepTTL: true}) //nolint:errcheck
+			s.ExpireAt("k4", now.Add(2*time.Hour))      // moved later
+			s.ExpireAt("k99", now.Add(30*time.Second))  // moved earlier
+			s.GetEx("k5", 0, true)                      //nolint:errcheck
+			s.Rename("k6", "renamed", false)            //nolint:errcheck
+			s.Rename("k7", "k8", false)                 //nolint:errcheck
+			s.Copy("k9", "copied", false)               //nolint:errcheck
+			s.StoreResult("k10", Entity{Type: TypeString, Value: "v"}, false)
+			s.HSet("hash", map[string]string{"f": "v"})
+			s.ExpireAt("hash", now.Add(time.Minute))
+			s.RestoreKey("restored", Entity{Type: TypeString, Value: "v"}, now.Add(time.Minute).UnixNano(), 0, true)
+
+			for _, shard := range shards {
+				checkExpireIndex(t, shard)
+			}
+
+			// ki expires after i+1 minutes. Due: k99 moved to 30s, hash and restored (1m), k3 keeping its 4m,
+			// renamed with the 7m of k6 and k8 overwritten by k7 (8m). k9 and copied (10m) are not due yet
+			if n, more := s.ExpireDue(now.Add(9*time.Minute+30*time.Second), 100); n != 6 || more {
+				t.Errorf("ExpireDue = %d, %v, want 6, false", n, more)
+			}
+			for _, key := range []string{"k99", "hash", "restored", "k3", "renamed", "k8"} {
+				if s.View(key, func(Entity) {}) {
+					t.Errorf("%s must be expired", key)
+				}
+			}
+			for _, key := range []string{"k0", "k2", "k4", "k5", "k9", "copied", "k10", "k11", "before", "persistent"} {
+				if !s.View(key, func(Entity) {}) {
+					t.Errorf("%s must survive", key)
+				}
+			}
+			for _, shard := range shards {
+				checkExpireIndex(t, shard)
+			}
+
+			// only the keys without a TTL are left: k0, k2, k5, k10 and persistent
+			s.ExpireDue(now.Add(3*time.Hour), 100)
+			if s.Len() != 5 {
+				t.Errorf("%d keys left after expiring everything, want 5", s.Len())
+			}
+			for _, shard := range shards {
+				checkExpireIndex(t, shard)
+			}
+		})
+	}
+}
+
+func TestExpireDue_Limit(t *testing.T) {
+	for _, index := range []bool{false, true} {
+		m := NewMapStorage()
+		m.SetExpireIndex(index)
+		for i := range 10 {
+			m.Set("k"+strconv.Itoa(i), "v", SetOptions{TTL: time.Minute}) //nolint:errcheck
+		}
+
+		later := time.Now().Add(time.Hour)
+		if n, more := m.ExpireDue(later, 4); n != 4 || !more {
+			t.Errorf("index %v: ExpireDue = %d, %v, want 4, true", index, n, more)
+		}
+		if n, more := m.ExpireDue(later, 6); n != 6 || more {
+			t.Errorf("index %v: ExpireDue = %d, %v, want 6, false", index, n, more)
+		}
+		if m.Len() != 0 {
+			t.Errorf("index %v: %d keys left", index, m.Len())
+		}
+	}
+
+	// a due key of the index missing from the data is dropped instead of being found again and again
+	m := NewMapStorage()
+	m.SetExpireIndex(true)
+	m.mu.Lock()
+	m.expireIndex.set("ghost", 1)
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.ExpireDue(time.Now(), 10)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ExpireDue did not return")
+	}
+	if m.expireIndex.len() != 0 {
+		t.Errorf("%d keys left in the index", m.expireIndex.len())
+	}
+}
+
+func TestSnapshotRestore_BinaryValues(t *testing.T) {
+	binary := "a\x00b\xff\xfe\r\n\x00"
+
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			s.Set("k\x00\xff", binary, SetOptions{}) //nolint:errcheck
+			s.HSet("h", map[string]string{"\x00f": binary})
+
+			var buf bytes.Buffer
+			if err := s.Snapshot(&buf); err != nil {
+				t.Fatalf("snapshot failed: %v", err)
+			}
+
+			restored := NewMapStorage()
+			if err := restored.Restore(&buf); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+
+			if v, _, _ := restored.Get("k\x00\xff"); v != binary { //nolint:errcheck
+				t.Errorf("string restored as %q, want %q", v, binary)
+			}
+			if v, _, _ := restored.HGet("h", "\x00f"); v != binary {
+				t.Errorf("hash field restored as %q, want %q", v, binary)
+			}
+		})
+	}
+}
+
+func TestRestore_BadLengths(t *testing.T) {
+	huge := binary.LittleEndian.AppendUint32(nil, 0xffffffff)
+	header := func(keyLen uint32, valueType DataType) []byte {
+		h := binary.LittleEndian.AppendUint32(nil, keyLen)
+		h = binary.LittleEndian.AppendUint64(h, 0)
+		return append(h, byte(valueType))
+	}
+
+	tests := map[string][]byte{
+		"key length":  header(0xffffffff, TypeString),
+		"hash count":  append(append(header(1, TypeHash), 'k'), huge...),
+		"list count":  append(append(header(1, TypeList), 'k'), huge...),
+		"string size": append(append(header(1, TypeString), 'k'), huge...),
+	}
+
+	for name, data := range tests {
+		// a reader hiding its length, as the snapshot file does
+		r := io.MultiReader(bytes.NewReader(data))
+		if err := NewMapStorage().Restore(r); err == nil {
+			t.Errorf("%s: truncated snapshot restored without an error", name)
+		}
+	}
+}
+
+func TestXAdd_IDs(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			add := func(id StreamID, mode StreamIDMode) (StreamID, error) {
+				return s.XAdd("s", id, mode, []string{"f", "v"})
+			}
+
+			if _, err := add(StreamID{}, StreamIDExplicit); !errors.Is(err, ErrStreamIDZero) {
+				t.Errorf("0-0: expected ErrStreamIDZero, got %v", err)
+			}
+			if n, _ := s.XLen("s"); n != 0 {
+				t.Fatalf("a rejected entry must not create the stream, XLEN = %d", n)
+			}
+
+			tests := []struct {
+				id   StreamID
+				mode StreamIDMode
+				want StreamID
+				err  error
+			}{
+				{StreamID{Ms: 0}, StreamIDAutoSeq, StreamID{Ms: 0, Seq: 1}, nil},
+				{StreamID{Ms: 5, Seq: 3}, StreamIDExplicit, StreamID{Ms: 5, Seq: 3}, nil},
+				{StreamID{Ms: 5, Seq: 3}, StreamIDExplicit, StreamID{}, ErrStreamIDTooSmall},
+				{StreamID{Ms: 4, Seq: 9}, StreamIDExplicit, StreamID{}, ErrStreamIDTooSmall},
+				{StreamID{Ms: 5}, StreamIDAutoSeq, StreamID{Ms: 5, Seq: 4}, nil},
+				{StreamID{Ms: 4}, StreamIDAutoSeq, StreamID{}, ErrStreamIDTooSmall},
+				{StreamID{Ms: 7}, StreamIDAutoSeq, StreamID{Ms: 7, Seq: 0}, nil},
+				{StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}, StreamIDExplicit, MaxStreamID, nil},
+				{StreamID{}, StreamIDAuto, StreamID{}, ErrStreamExhausted},
+			}
+			for _, tt := range tests {
+				got, err := add(tt.id, tt.mode)
+				if got != tt.want || !errors.Is(err, tt.err) {
+					t.Errorf("XAdd(%v, %d) = %v, %v, want %v, %v", tt.id, tt.mode, got, err, tt.want, tt.err)
+				}
+			}
+
+			// a generated ID follows the clock, and the last ID when the clock is behind
+			before := uint64(time.Now().UnixMilli())
+			id, err := s.XAdd("clock", StreamID{}, StreamIDAuto, []string{"f", "v"})
+			if err != nil || id.Ms < before || id.Seq != 0 {
+				t.Errorf("XAdd(*) = %v, %v, want the current time", id, err)
+			}
+			s.XAdd("ahead", StreamID{Ms: before + 60_000, Seq: 2}, StreamIDExplicit, []string{"f", "v"}) //nolint:errcheck
+			if id, err := s.XAdd("ahead", StreamID{}, StreamIDAuto, []string{"f", "v"}); err != nil || id != (StreamID{Ms: before + 60_000, Seq: 3}) {
+				t.Errorf("XAdd(*) behind the last ID = %v, %v", id, err)
+			}
+
+			s.Set("str", "v", SetOptions{}) //nolint:errcheck
+			if _, err := s.XAdd("str", StreamID{Ms: 1}, StreamIDExplicit, []string{"f", "v"}); !errors.Is(err, ErrWrongType) {
+				t.Errorf("XAdd on a string: expected ErrWrongType, got %v", err)
+			}
+		})
+	}
+}
+
+func TestXRange(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []StreamID{{1, 0}, {1, 1}, {2, 0}, {3, 5}, {10, 0}} {
+				if _, err := s.XAdd("s", id, StreamIDExplicit, []string{"id", id.String()}); err != nil {
+					t.Fatalf("XAdd(%v): %v", id, err)
+				}
+			}
+
+			ids := func(entries []StreamEntry) []string {
+				out := []string{}
+				for _, e := range entries {
+					out = append(out, e.ID.String())
+				}
+				return out
+			}
+
+			tests := []struct {
+				start, end StreamID
+				count      int
+				want       []string
+			}{
+				{StreamID{}, MaxStreamID, -1, []string{"1-0", "1-1", "2-0", "3-5", "10-0"}},
+				{StreamID{1, 1}, StreamID{3, 5}, -1, []string{"1-1", "2-0", "3-5"}},
+				{StreamID{1, 1}, StreamID{3, 4}, -1, []string{"1-1", "2-0"}},
+				{StreamID{2, 0}, MaxStreamID, 2, []string{"2-0", "3-5"}},
+				{StreamID{}, MaxStreamID, 0, []string{}},
+				{StreamID{4, 0}, StreamID{9, 0}, -1, []string{}},
+				{StreamID{10, 0}, StreamID{1, 0}, -1, []string{}},
+			}
+			for _, tt := range tests {
+				got, err := s.XRange("s", tt.start, tt.end, tt.count)
+				if err != nil || !slices.Equal(ids(got), tt.want) {
+					t.Errorf("XRange(%v, %v, %d) = %v, %v, want %v", tt.start, tt.end, tt.count, ids(got), err, tt.want)
+				}
+			}
+
+			if got, _ := s.XRange("s", StreamID{3, 5}, StreamID{3, 5}, -1); len(got) != 1 || !slices.Equal(got[0].Fields, []string{"id", "3-5"}) {
+				t.Errorf("XRange of a single entry = %v", got)
+			}
+			if got, err := s.XRange("missing", StreamID{}, MaxStreamID, -1); err != nil || len(got) != 0 {
+				t.Errorf("XRange of a missing key = %v, %v", got, err)
+			}
+			if id, _ := s.XLastID("s"); id != (StreamID{10, 0}) {
+				t.Errorf("XLastID = %v, want 10-0", id)
+			}
+
+			var buf bytes.Buffer
+			if err := s.Snapshot(&buf); err != nil {
+				t.Fatalf("snapshot failed: %v", err)
+			}
+			restored := NewMapStorage()
+			if err := restored.Restore(&buf); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+			if got, _ := restored.XRange("s", StreamID{}, MaxStreamID, -1); !slices.Equal(ids(got), tests[0].want) {
+				t.Errorf("restored stream holds %v", ids(got))
+			}
+			if _, err := restored.XAdd("s", StreamID{10, 0}, StreamIDExplicit, []string{"f", "v"}); !errors.Is(err, ErrStreamIDTooSmall) {
+				t.Errorf("the last ID must survive a restore, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseStreamID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want StreamID
+		err  bool
+	}{
+		{"1-2", StreamID{1, 2}, false},
+		{"5", StreamID{5, 7}, false},
+		{"18446744073709551615-18446744073709551615", MaxStreamID, false},
+		{"18446744073709551616", StreamID{}, true},
+		{"1-", StreamID{}, true},
+		{"-1", StreamID{}, true},
+		{"1-2-3", StreamID{}, true},
+		{"abc", StreamID{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStreamID(tt.in, 7)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseStreamID(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestStreamGroups(t *testing.T) {
+	for name, s := range getAllImplementations() {
+		t.Run(name, func(t *testing.T) {
+			for i := uint64(1); i <= 4; i++ {
+				s.XAdd("s", StreamID{i, 0}, StreamIDExplicit, []string{"f", "v"})
+			}
+
+			if err := s.XGroupCreate("missing", "g", StreamID{}, false, false); !errors.Is(err, ErrNoSuchKey) {
+				t.Errorf("XGroupCreate of a missing key = %v, want ErrNoSuchKey", err)
+			}
+			if err := s.XGroupCreate("s", "g", StreamID{}, false, false); err != nil {
+				t.Fatalf("XGroupCreate: %v", err)
+			}
+			if err := s.XGroupCreate("s", "g", StreamID{}, true, false); !errors.Is(err, ErrBusyGroup) {
+				t.Errorf("XGroupCreate of an existing group = %v, want ErrBusyGroup", err)
+			}
+			if _, err := s.XReadGroup("s", "nope", "c", nil, -1, false); !errors.Is(err, ErrNoGroup) {
+				t.Errorf("XReadGroup of a missing group = %v, want ErrNoGroup", err)
+			}
+
+			if got, _ := s.XReadGroup("s", "g", "a", nil, 3, false); len(got) != 3 {
+				t.Fatalf("XReadGroup delivered %d entries, want 3", len(got))
+			}
+			if n, _ := s.XAck("s", "g", []StreamID{{1, 0}, {9, 0}}); n != 1 {
+				t.Errorf("XAck = %d, want 1", n)
+			}
+			if got, _ := s.XClaim("s", "g", "b", 0, []StreamID{{3, 0}, {4, 0}}, XClaimOptions{RetryCount: -1}); len(got) != 1 || got[0].ID != (StreamID{3, 0}) {
+				t.Errorf("XClaim = %v, want the pending entry 3-0 only", got)
+			}
+			if got, _ := s.XClaim("s", "g", "b", 0, []StreamID{{4, 0}}, XClaimOptions{RetryCount: -1, Force: true, JustID: true}); len(got) != 1 {
+				t.Errorf("XClaim with Force = %v, want 4-0", got)
+			}
+
+			var buf bytes.Buffer
+			if err := s.Snapshot(&buf); err != nil {
+				t.Fatalf("snapshot failed: %v", err)
+			}
+			restored := NewMapStorage()
+			if err := restored.Restore(&buf); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+
+			for _, st := range []Storage{s, restored} {
+				summary, err := st.XPending("s", "g")
+				if err != nil || summary.Count != 3 || summary.First != (StreamID{2, 0}) || summary.Last != (StreamID{4, 0}) ||
+					summary.Consumers["a"] != 1 || summary.Consumers["b"] != 2 {
+					t.Errorf("XPending = %+v, %v", summary, err)
+				}
+				infos, _ := st.XPendingRange("s", "g", StreamID{}, MaxStreamID, 10, "b", 0)
+				if len(infos) != 2 || infos[0].Deliveries != 2 || infos[1].Deliveries != 0 {
+					t.Errorf("XPendingRange = %+v", infos)
+				}
+			}
+
+			// the restored group continues after the last delivered entry, a forced claim does not move it
+			restored.XAdd("s", StreamID{5, 0}, StreamIDExplicit, []string{"f", "v"})
+			if got, _ := restored.XReadGroup("s", "g", "a", nil, -1, false); len(got) != 2 || got[0].ID != (StreamID{4, 0}) {
+				t.Errorf("XReadGroup after restore = %v, want 4-0 and 5-0", got)
+			}
+		})
+	}
+}
+
+func TestBitField_GetDoesNotCopy(t *testing.T) {
+	m := NewMapStorage()
+	m.Set("big", strings.Repeat("\xff", 1<<20), SetOptions{}) //nolint:errcheck
+
+	ops := []BitFieldOp{{Kind: BitFieldGet, Bits: 8, Offset: 8 * 1000}}
+	allocs := testing.AllocsPerRun(10, func() {
+		res, err := m.BitField("big", ops)
+		if err != nil || res[0].Value != 255 {
+			t.Fatalf("BitField GET = %v, %v", res, err)
+		}
+	})
+	// the results only, the string is read in place
+	if allocs > 1 {
+		t.Errorf("BitField GET made %v allocations", allocs)
+	}
+}
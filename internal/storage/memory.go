@@ -0,0 +1,134 @@
+package storage
+
+// Approximate sizes of the structures behind every key, used by the memory estimates
+const (
+	keyOverhead         = 64 // map entry: key string header, Entity and access metadata
+	expireOverhead      = 32 // entry of the expires map
+	hashFieldOverhead   = 48 // map entry of a hash field: field string header and HashField
+	listEntryOverhead   = 16 // string header of a list element
+	streamEntryOverhead = 40 // StreamEntry: ID and the header of its field slice
+	pendingOverhead     = 64 // map entry of a consumer group's pending entries list: ID and PendingEntry
+	expireIndexOverhead = 72 // expireItem with its heap slot and its entry in the items map
+)
+
+// memoryStatsSamples is the number of keys per shard examined by MemoryStats.
+// Larger shards are sampled and the result is extrapolated
+const memoryStatsSamples = 1000
+
+// TypeMemory is the memory estimate of all keys of one type
+type TypeMemory struct {
+	Keys  int64
+	Bytes int64
+}
+
+// MemoryStats is an estimate of the memory used by the dataset
+type MemoryStats struct {
+	Keys          int64                   // number of keys, including expired keys that were not reclaimed yet
+	DatasetBytes  int64                   // keys and values
+	OverheadBytes int64                   // map entries, expiration records and metadata
+	Types         map[DataType]TypeMemory // dataset bytes broken down by type
+	Shards        int
+	Sampled       bool // some shards were too large to be examined completely
+}
+
+// add accumulates the estimate of another shard
+func (s *MemoryStats) add(other MemoryStats) {
+	s.Keys += other.Keys
+	s.DatasetBytes += other.DatasetBytes
+	s.OverheadBytes += other.OverheadBytes
+	s.Shards += other.Shards
+	s.Sampled = s.Sampled || other.Sampled
+
+	for t, mem := range other.Types {
+		total := s.Types[t]
+		total.Keys += mem.Keys
+		total.Bytes += mem.Bytes
+		s.Types[t] = total
+	}
+}
+
+// entityMemory estimates the bytes of the value and of the structures holding it
+func entityMemory(entity Entity) (data, overhead int64) {
+	switch entity.Type {
+	case TypeString:
+		return int64(len(entity.Value.(string))), 0
+	case TypeHash:
+		for field, value := range entity.Value.(map[string]HashField) {
+			data += int64(len(field) + len(value.Value))
+			overhead += hashFieldOverhead
+		}
+	case TypeList:
+		for _, value := range entity.Value.([]string) {
+			data += int64(len(value))
+			overhead += listEntryOverhead
+		}
+	case TypeStream:
+		for _, entry := range entity.Value.(*Stream).Entries {
+			for _, value := range entry.Fields {
+				data += int64(len(value))
+				overhead += listEntryOverhead
+			}
+			overhead += streamEntryOverhead
+		}
+		for _, g := range entity.Value.(*Stream).Groups {
+			overhead += int64(len(g.Pending)) * pendingOverhead
+		}
+	}
+
+	return data, overhead
+}
+
+// MemoryStats estimates the memory used by the shard. At most memoryStatsSamples keys are examined
+func (m *MapStorage) MemoryStats() MemoryStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := MemoryStats{
+		Keys:   int64(len(m.data)),
+		Types:  make(map[DataType]TypeMemory),
+		Shards: 1,
+	}
+
+	examined := 0
+	for key, entity := range m.data {
+		if examined == memoryStatsSamples {
+			break
+		}
+		examined++
+
+		data, overhead := entityMemory(entity)
+		data += int64(len(key))
+		overhead += keyOverhead
+
+		stats.DatasetBytes += data
+		stats.OverheadBytes += overhead
+
+		mem := stats.Types[entity.Type]
+		mem.Keys++
+		mem.Bytes += data
+		stats.Types[entity.Type] = mem
+	}
+
+	if examined < len(m.data) {
+		// the map iteration order is random, so the examined keys are a sample of the shard
+		stats.Sampled = true
+		scale := float64(len(m.data)) / float64(examined)
+
+		stats.DatasetBytes = int64(float64(stats.DatasetBytes) * scale)
+		stats.OverheadBytes = int64(float64(stats.OverheadBytes) * scale)
+		for t, mem := range stats.Types {
+			stats.Types[t] = TypeMemory{
+				Keys:  int64(float64(mem.Keys) * scale),
+				Bytes: int64(float64(mem.Bytes) * scale),
+			}
+		}
+	}
+
+	// the expires map is not sampled, its size is known
+	stats.OverheadBytes += int64(len(m.expires)) * expireOverhead
+	if m.expireIndex != nil {
+		stats.OverheadBytes += int64(m.expireIndex.len()) * expireIndexOverhead
+	}
+
+	return stats
+}
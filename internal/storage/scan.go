@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+// Scan walks the keys of a shard with the reversed-bits cursor of Redis. Every shard keeps its keys in a power
+// of two table of buckets, the bucket of a key is selected by the low bits of scanHash. The cursor is a bucket
+// index that is incremented from its most significant bit: when the table doubles, a bucket is split into two
+// buckets that come right after each other in this order, and when it halves two neighbours are merged. So the
+// buckets visited before the resize hold the same keys at any size and a key that exists during the whole
+// iteration is returned, exactly once unless the table shrank between two calls. A call visits buckets until
+// count keys are collected, its work is bounded by count and not by the size of the shard.
+//
+// A reverse scan reads the bucket at the complement of the cursor. For a given table size it is the forward order
+// backwards, and being the forward order of the complemented hash it keeps the same guarantee.
+// The shard index lives in the high bits of the cursor, the number of shards is fixed for the lifetime of the storage
+
+const (
+	// scanShardBits is the number of high cursor bits holding the shard index, enough for 64 shards
+	scanShardBits = 6
+	// scanHashBits is the number of low cursor bits holding the position inside the shard
+	scanHashBits = 64 - scanShardBits
+	// scanHashMask selects the position inside the shard from a cursor
+	scanHashMask = 1<<scanHashBits - 1
+
+	// scanMinBuckets is the size of an empty table, it never shrinks below it
+	scanMinBuckets = 4
+	// scanEmptyVisits bounds the empty buckets a call may visit per requested key, like Redis does,
+	// so a sparse table cannot make a call walk all of it
+	scanEmptyVisits = 10
+)
+
+// scanHash returns the hash selecting the bucket of the key
+func scanHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key)) //nolint:errcheck
+	return h.Sum64()
+}
+
+// scanEntry is a key of the table with its hash, kept so a resize does not hash the keys again
+type scanEntry struct {
+	hash uint64
+	key  string
+}
+
+// scanIndex is the table of buckets Scan walks. The table doubles when it holds more keys than buckets and halves
+// when less than an eighth of the buckets would be used, the keys are moved to their new buckets at once.
+// It is not safe for concurrent use, MapStorage updates it under the write lock together with data
+type scanIndex struct {
+	buckets [][]scanEntry
+	keys    int
+}
+
+// newScanIndex creates an empty table
+func newScanIndex() *scanIndex {
+	return &scanIndex{buckets: make([][]scanEntry, scanMinBuckets)}
+}
+
+// add inserts a key that is not in the table yet
+func (x *scanIndex) add(key string) {
+	if x.keys >= len(x.buckets) {
+		x.resize(len(x.buckets) * 2)
+	}
+
+	h := scanHash(key)
+	b := h & uint64(len(x.buckets)-1)
+	x.buckets[b] = append(x.buckets[b], scanEntry{hash: h, key: key})
+	x.keys++
+}
+
+// remove deletes a key that is in the table
+func (x *scanIndex) remove(key string) {
+	h := scanHash(key)
+	b := h & uint64(len(x.buckets)-1)
+	bucket := x.buckets[b]
+
+	for i := range bucket {
+		if bucket[i].hash != h || bucket[i].key != key {
+			continue
+		}
+
+		last := len(bucket) - 1
+		bucket[i] = bucket[last]
+		bucket[last] = scanEntry{}
+		if last == 0 {
+			bucket = nil // release the memory of emptied buckets
+		} else {
+			bucket = bucket[:last]
+		}
+		x.buckets[b] = bucket
+		x.keys--
+		break
+	}
+
+	if len(x.buckets) > scanMinBuckets && x.keys < len(x.buckets)/8 {
+		x.resize(len(x.buckets) / 2)
+	}
+}
+
+// resize moves the keys into a table of size buckets
+func (x *scanIndex) resize(size int) {
+	buckets := make([][]scanEntry, size)
+	mask := uint64(size - 1)
+
+	for _, bucket := range x.buckets {
+		for _, e := range bucket {
+			buckets[e.hash&mask] = append(buckets[e.hash&mask], e)
+		}
+	}
+
+	x.buckets = buckets
+}
+
+// scan visits the buckets from cursor and calls fn for each of their keys, fn reports whether the key is
+// returned to the client. It stops after the bucket in which count keys were reached, or after
+// scanEmptyVisits empty buckets per requested key. Returns the cursor to continue from, 0 when the table
+// was walked to its end, and the number of keys visited
+func (x *scanIndex) scan(cursor uint64, count int, reverse bool, fn func(key string) bool) (uint64, int) {
+	mask := uint64(len(x.buckets) - 1)
+	returned, examined, empty := 0, 0, 0
+
+	for {
+		b := cursor & mask
+		if reverse {
+			b = ^cursor & mask
+		}
+
+		bucket := x.buckets[b]
+		if len(bucket) == 0 {
+			empty++
+		}
+		for i := range bucket {
+			e := bucket[i]
+			if reverse {
+				e = bucket[len(bucket)-1-i]
+			}
+
+			examined++
+			if fn(e.key) {
+				returned++
+			}
+		}
+
+		cursor = nextScanCursor(cursor, mask)
+		if cursor == 0 || returned >= count || empty/scanEmptyVisits >= count {
+			return cursor, examined
+		}
+	}
+}
+
+// nextScanCursor increments the bucket index in cursor from its most significant bit, for a table of mask+1
+// buckets. The bits above mask are dropped, they are left by a larger table that has shrunk since
+func nextScanCursor(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
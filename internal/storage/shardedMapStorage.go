@@ -2,10 +2,11 @@ package storage
 
 import (
 	"errors"
-	"hash/fnv"
 	"io"
 	"math/bits"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +15,7 @@ import (
 type ShardedMapStorage struct {
 	shards    []*MapStorage
 	shardMask uint32
+	hash      HashFunc // selects the shard of a key, FNV-1a unless set with SetHashFunc
 }
 
 // NewShardedMapStorage creates a new instance of ShardedMapStorage.
@@ -31,6 +33,7 @@ func NewShardedMapStorage(requestedShards uint) (*ShardedMapStorage, error) {
 	s := &ShardedMapStorage{
 		shards:    make([]*MapStorage, requestedShards),
 		shardMask: uint32(requestedShards - 1),
+		hash:      fnv32a,
 	}
 
 	var i uint
@@ -43,10 +46,78 @@ func NewShardedMapStorage(requestedShards uint) (*ShardedMapStorage, error) {
 
 // getShardIndex returns index of shard by key
 func (s *ShardedMapStorage) getShardIndex(key string) uint32 {
-	hash := fnv.New32a()
-	hash.Write([]byte(key)) //nolint:errcheck
+	return s.hash(key) & s.shardMask
+}
+
+// shardOf returns the shard owning the key
+func (s *ShardedMapStorage) shardOf(key string) *MapStorage {
+	return s.shards[s.getShardIndex(key)]
+}
+
+// forEachShard calls fn for every shard in index order. It is the primitive of the keyspace-wide operations,
+// fn takes the locks of the shard itself through the MapStorage methods
+func (s *ShardedMapStorage) forEachShard(fn func(index int, shard *MapStorage)) {
+	s.forEachShardFrom(0, false, func(index int, shard *MapStorage) bool {
+		fn(index, shard)
+		return true
+	})
+}
+
+// forEachShardFrom is forEachShard for the walks that stop early or do not start at the first shard. It calls fn
+// for every shard once, starting at index first and wrapping around, by increasing index or by decreasing index
+// when reverse is set, until fn returns false
+func (s *ShardedMapStorage) forEachShardFrom(first int, reverse bool, fn func(index int, shard *MapStorage) bool) {
+	n := len(s.shards)
+	for i := range n {
+		index := (first + i) % n
+		if reverse {
+			index = (first - i + n) % n
+		}
+
+		if !fn(index, s.shards[index]) {
+			return
+		}
+	}
+}
+
+// forEachShardParallel calls fn for every shard, each in its own goroutine, and waits for all of them.
+// fn must synchronize the state it shares with the other calls
+func (s *ShardedMapStorage) forEachShardParallel(fn func(index int, shard *MapStorage)) {
+	var wg sync.WaitGroup
+	wg.Add(len(s.shards))
+
+	for i, shard := range s.shards {
+		go func() {
+			defer wg.Done()
+			fn(i, shard)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// SetHashFunc selects the hash function that distributes the keys across the shards.
+// Must be called before the first key is stored
+func (s *ShardedMapStorage) SetHashFunc(fn HashFunc) {
+	s.hash = fn
+}
 
-	return hash.Sum32() & s.shardMask
+// Len returns the number of keys by summing the per-shard counters
+func (s *ShardedMapStorage) Len() int64 {
+	var total int64
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		total += shard.Len()
+	})
+	return total
+}
+
+// ShardLens returns the number of keys of every shard
+func (s *ShardedMapStorage) ShardLens() []int64 {
+	lens := make([]int64, len(s.shards))
+	s.forEachShard(func(i int, shard *MapStorage) {
+		lens[i] = shard.Len()
+	})
+	return lens
 }
 
 // Get returns the value and true if the key is found. Otherwise, "", false.
@@ -55,7 +126,7 @@ func (s *ShardedMapStorage) Get(key string) (string, bool, error) {
 }
 
 // Set writes the value based on the options. Returns true if recording has been performed.
-func (s *ShardedMapStorage) Set(key, value string, options SetOptions) bool {
+func (s *ShardedMapStorage) Set(key, value string, options SetOptions) (bool, error) {
 	return s.shards[s.getShardIndex(key)].Set(key, value, options)
 }
 
@@ -64,9 +135,9 @@ func (s *ShardedMapStorage) Delete(key string) bool {
 	return s.shards[s.getShardIndex(key)].Delete(key)
 }
 
-// Expiry returns the remaining lifetime and status as ExpiryStatus
-func (s *ShardedMapStorage) Expiry(key string) (time.Duration, ExpiryStatus) {
-	return s.shards[s.getShardIndex(key)].Expiry(key)
+// RemainingTTL returns the remaining lifetime of the key and its ExpiryStatus
+func (s *ShardedMapStorage) RemainingTTL(key string) (time.Duration, ExpiryStatus) {
+	return s.shards[s.getShardIndex(key)].RemainingTTL(key)
 }
 
 // Persist removes the expiration date of the key, making it eternal.
@@ -75,65 +146,333 @@ func (s *ShardedMapStorage) Persist(key string) int64 {
 	return s.shards[s.getShardIndex(key)].Persist(key)
 }
 
-// DeleteExpired randomly selects a limit of keys from each shard and delete if his TTL has expired
-func (s *ShardedMapStorage) DeleteExpired(limit int) float64 {
-	var wg sync.WaitGroup
-	var totalRatio float64
-	var mu sync.Mutex // protects totalRatio
+// ExpireAt sets an absolute expiration deadline on the key.
+// Returns 1 if the timeout was set, 0 if the key does not exist
+func (s *ShardedMapStorage) ExpireAt(key string, at time.Time) int64 {
+	return s.shards[s.getShardIndex(key)].ExpireAt(key, at)
+}
 
-	shardCount := len(s.shards)
-	wg.Add(shardCount)
+// Copy copies the value stored at src to dst together with its TTL.
+// The shards of both keys are locked in index order, so the copy is atomic even across shards
+func (s *ShardedMapStorage) Copy(src, dst string, replace bool) bool {
+	i, j := s.getShardIndex(src), s.getShardIndex(dst)
+	if i == j {
+		return s.shards[i].Copy(src, dst, replace)
+	}
 
-	for _, shard := range s.shards {
-		go func(m *MapStorage) {
-			ratio := m.DeleteExpired(limit)
+	first, second := s.shards[min(i, j)], s.shards[max(i, j)]
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
 
-			mu.Lock()
-			totalRatio += ratio
-			mu.Unlock()
+	return copyLocked(s.shards[i], s.shards[j], src, dst, replace)
+}
 
-			wg.Done()
-		}(shard)
+// Rename moves the value stored at src to dst together with its TTL.
+// The shards of both keys are locked in index order, so the move is atomic even across shards
+func (s *ShardedMapStorage) Rename(src, dst string, nx bool) (bool, error) {
+	i, j := s.getShardIndex(src), s.getShardIndex(dst)
+	if i == j {
+		return s.shards[i].Rename(src, dst, nx)
 	}
 
-	wg.Wait()
+	first, second := s.shards[min(i, j)], s.shards[max(i, j)]
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	return moveLocked(s.shards[i], s.shards[j], src, dst, nx)
+}
+
+// RestoreKey stores the entity at key with the absolute expiration and the idle time
+func (s *ShardedMapStorage) RestoreKey(key string, entity Entity, expireAt int64, idle time.Duration, replace bool) bool {
+	return s.shards[s.getShardIndex(key)].RestoreKey(key, entity, expireAt, idle, replace)
+}
+
+// StoreResult overwrites dest with the result of a *STORE command under the lock of the dest shard.
+// An empty result deletes dest. Returns true if dest holds the result
+func (s *ShardedMapStorage) StoreResult(dest string, entity Entity, empty bool) bool {
+	return s.shards[s.getShardIndex(dest)].StoreResult(dest, entity, empty)
+}
+
+// View calls fn with the live entity stored at key while holding the read lock of its shard.
+// Returns false if the key does not exist
+func (s *ShardedMapStorage) View(key string, fn func(entity Entity)) bool {
+	return s.shards[s.getShardIndex(key)].View(key, fn)
+}
+
+// Touch updates the last access time of the existing keys
+func (s *ShardedMapStorage) Touch(keys []string) {
+	for _, key := range keys {
+		s.shards[s.getShardIndex(key)].Touch([]string{key})
+	}
+}
+
+// Scan walks the shards in order, or from the last one when reverse is set. The shard index is kept in the
+// high bits of the cursor. Returns the keys, the next cursor (0 when the iteration is complete) and the number
+// of entries examined
+func (s *ShardedMapStorage) Scan(cursor uint64, count int, reverse bool) ([]string, uint64, int) {
+	shards := uint64(len(s.shards))
+	shard := cursor >> scanHashBits
+	pos := cursor & scanHashMask
+	if shard >= shards {
+		return nil, 0, 0
+	}
+
+	first := shard
+	if reverse {
+		first = shards - 1 - shard
+	}
+
+	var keys []string
+	var next uint64 // 0 when the walk reaches the end of the last shard
+	examined := 0
+
+	s.forEachShardFrom(int(first), reverse, func(_ int, m *MapStorage) bool {
+		batch, after, n := m.Scan(pos, count-len(keys), reverse)
+		keys = append(keys, batch...)
+		examined += n
+
+		if after != 0 {
+			next = shard<<scanHashBits | after
+			return false
+		}
+
+		shard++
+		pos = 0
+		if shard == shards {
+			return false
+		}
+		if len(keys) >= count {
+			next = shard << scanHashBits
+			return false
+		}
+		return true
+	})
+
+	return keys, next, examined
+}
+
+// Keys returns the live keys for which match returns true, at most limit of them if limit is positive.
+// Every shard is walked once under its read lock, one shard at a time
+func (s *ShardedMapStorage) Keys(match func(key string) bool, limit int) []string {
+	var keys []string
+	s.forEachShardFrom(0, false, func(_ int, shard *MapStorage) bool {
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - len(keys)
+		}
+
+		keys = append(keys, shard.Keys(match, remaining)...)
+		return limit <= 0 || len(keys) < limit
+	})
+
+	return keys
+}
+
+// RandomKey returns a random live key of type typ, any type if typ is 0. The shard is picked with a probability
+// proportional to its number of keys. If it has no matching key the next shards are tried in turn
+func (s *ShardedMapStorage) RandomKey(typ DataType) (string, bool) {
+	lens := s.ShardLens()
+
+	var total int64
+	for _, n := range lens {
+		total += n
+	}
+	if total == 0 {
+		return "", false
+	}
+
+	first := 0
+	pick := rand.Int63n(total)
+	for i, n := range lens {
+		if pick < n {
+			first = i
+			break
+		}
+		pick -= n
+	}
+
+	var key string
+	var found bool
+	s.forEachShardFrom(first, false, func(index int, shard *MapStorage) bool {
+		if lens[index] == 0 {
+			return true
+		}
+		key, found = shard.RandomKey(typ)
+		return !found
+	})
+
+	return key, found
+}
+
+// DeleteExpired randomly selects a limit of keys from each shard and delete if his TTL has expired.
+// Returns the average ratio of expired keys over the shards and the total number of deleted keys
+func (s *ShardedMapStorage) DeleteExpired(limit int) (float64, int) {
+	var totalRatio float64
+	var totalExpired int
+	var mu sync.Mutex // protects totalRatio and totalExpired
+
+	s.forEachShardParallel(func(_ int, shard *MapStorage) {
+		ratio, expired := shard.DeleteExpired(limit)
+
+		mu.Lock()
+		totalRatio += ratio
+		totalExpired += expired
+		mu.Unlock()
+	})
+
+	return totalRatio / float64(len(s.shards)), totalExpired
+}
+
+// ExpireDue deletes the keys whose deadline is before now, at most limit per shard, each shard is locked only
+// while its keys are expired. Returns the total number of deleted keys and whether any shard has due keys left
+func (s *ShardedMapStorage) ExpireDue(now time.Time, limit int) (int, bool) {
+	var total atomic.Int64
+	var more atomic.Bool
+	s.forEachShardParallel(func(_ int, shard *MapStorage) {
+		expired, left := shard.ExpireDue(now, limit)
+		total.Add(int64(expired))
+		if left {
+			more.Store(true)
+		}
+	})
+
+	return int(total.Load()), more.Load()
+}
+
+// IncrByFloat adds delta to the float stored at key
+func (s *ShardedMapStorage) IncrByFloat(key string, delta float64) (string, error) {
+	return s.shards[s.getShardIndex(key)].IncrByFloat(key, delta)
+}
 
-	return totalRatio / float64(shardCount)
+// Append appends value to the string stored at key
+func (s *ShardedMapStorage) Append(key, value string) (int64, error) {
+	return s.shards[s.getShardIndex(key)].Append(key, value)
+}
+
+// SetRange overwrites the string stored at key starting at offset
+func (s *ShardedMapStorage) SetRange(key string, offset int64, value string) (int64, error) {
+	return s.shards[s.getShardIndex(key)].SetRange(key, offset, value)
+}
+
+// BitField runs the BITFIELD operations against the string stored at key
+func (s *ShardedMapStorage) BitField(key string, ops []BitFieldOp) ([]BitFieldResult, error) {
+	return s.shards[s.getShardIndex(key)].BitField(key, ops)
+}
+
+// SetMaxStringLen sets the maximum length of a string value. Must not be called concurrently with writes
+func (s *ShardedMapStorage) SetMaxStringLen(n int64) {
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		shard.SetMaxStringLen(n)
+	})
+}
+
+// MaxStringLen returns the maximum length of a string value
+func (s *ShardedMapStorage) MaxStringLen() int64 {
+	return s.shards[0].MaxStringLen()
+}
+
+// SetMaxListLen sets the length lists are trimmed to on push, 0 means unlimited.
+// Must not be called concurrently with writes
+func (s *ShardedMapStorage) SetMaxListLen(n int64) {
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		shard.SetMaxListLen(n)
+	})
+}
+
+// SetExpireIndex enables or disables the index of the expirations of every shard used by ExpireDue
+func (s *ShardedMapStorage) SetExpireIndex(enabled bool) {
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		shard.SetExpireIndex(enabled)
+	})
+}
+
+// SetExpireJitter sets the percentage by which relative TTLs given to Set are randomized in both directions.
+// Must not be called concurrently with Set
+func (s *ShardedMapStorage) SetExpireJitter(percent float64) {
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		shard.SetExpireJitter(percent)
+	})
+}
+
+// SetSnapshotMode selects how each shard is locked during Snapshot. Must not be called concurrently with Snapshot
+func (s *ShardedMapStorage) SetSnapshotMode(mode SnapshotMode) {
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		shard.SetSnapshotMode(mode)
+	})
 }
 
 // Snapshot iterates over all shards sequentially to minimize locking time
 func (s *ShardedMapStorage) Snapshot(w io.Writer) error {
-	for _, shard := range s.shards {
-		if err := shard.Snapshot(w); err != nil {
-			return err
+	var err error
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		if err == nil {
+			err = shard.Snapshot(w)
 		}
-	}
-	return nil
+	})
+	return err
+}
+
+// MemoryStats estimates the memory used by all shards
+func (s *ShardedMapStorage) MemoryStats() MemoryStats {
+	stats := MemoryStats{Types: make(map[DataType]TypeMemory)}
+	s.forEachShard(func(_ int, shard *MapStorage) {
+		stats.add(shard.MemoryStats())
+	})
+	return stats
 }
 
 // Restore reads the stream and fills the maps
 func (s *ShardedMapStorage) Restore(r io.Reader) error {
-	tempLoader := NewMapStorage()
-	if err := tempLoader.Restore(r); err != nil {
+	entries, err := readEntries(r)
+	if err != nil {
 		return err
 	}
 
-	tempLoader.mu.RLock()
-	defer tempLoader.mu.RUnlock()
+	s.BulkLoad(entries)
 
-	for key, val := range tempLoader.data {
-		expire := tempLoader.expires[key]
+	return nil
+}
 
-		targetShard := s.shards[s.getShardIndex(key)]
-		targetShard.mu.Lock()
-		targetShard.data[key] = val
-		if expire > 0 {
-			targetShard.expires[key] = expire
-		}
-		targetShard.mu.Unlock()
+// BulkLoad groups the entries by shard and inserts each group under a single write lock of its shard,
+// overwriting existing keys. Entries that are already expired are skipped. Returns the number of loaded entries
+func (s *ShardedMapStorage) BulkLoad(entries []Entry) int {
+	groups := make([][]Entry, len(s.shards))
+	indexes := make([]uint32, len(entries))
+
+	counts := make([]int, len(s.shards))
+	for i, entry := range entries {
+		indexes[i] = s.getShardIndex(entry.Key)
+		counts[indexes[i]]++
+	}
+	for i, count := range counts {
+		groups[i] = make([]Entry, 0, count)
+	}
+	for i, entry := range entries {
+		groups[indexes[i]] = append(groups[indexes[i]], entry)
 	}
 
-	return nil
+	var loaded atomic.Int64
+	s.forEachShardParallel(func(i int, shard *MapStorage) {
+		if len(groups[i]) > 0 {
+			loaded.Add(int64(shard.BulkLoad(groups[i])))
+		}
+	})
+
+	return int(loaded.Load())
+}
+
+// GetDel returns the string stored at key and deletes the key
+func (s *ShardedMapStorage) GetDel(key string) (string, bool, error) {
+	return s.shards[s.getShardIndex(key)].GetDel(key)
+}
+
+// GetEx returns the string stored at key and changes its expiration
+func (s *ShardedMapStorage) GetEx(key string, expireAt int64, persist bool) (string, bool, error) {
+	return s.shards[s.getShardIndex(key)].GetEx(key, expireAt, persist)
 }
 
 // HSet sets the specified fields to their respective values in the hash stored at key
@@ -141,38 +480,48 @@ func (s *ShardedMapStorage) HSet(key string, fields map[string]string) int64 {
 	return s.shards[s.getShardIndex(key)].HSet(key, fields)
 }
 
+// HSetNX sets field only if it does not exist in the hash stored at key
+func (s *ShardedMapStorage) HSetNX(key, field, value string) int64 {
+	return s.shards[s.getShardIndex(key)].HSetNX(key, field, value)
+}
+
+// HSetEx sets the specified fields with a TTL atomically
+func (s *ShardedMapStorage) HSetEx(key string, fields map[string]string, ttl time.Duration, opts HSetExOptions) int64 {
+	return s.shards[s.getShardIndex(key)].HSetEx(key, fields, ttl, opts)
+}
+
 // HGet returns the value associated with field in the hash stored at key
-func (s *ShardedMapStorage) HGet(key, field string) (string, bool) {
+func (s *ShardedMapStorage) HGet(key, field string) (string, bool, error) {
 	return s.shards[s.getShardIndex(key)].HGet(key, field)
 }
 
 // HGetAll returns all fields and values of the hash stored at key
-func (s *ShardedMapStorage) HGetAll(key string) map[string]string {
+func (s *ShardedMapStorage) HGetAll(key string) (map[string]string, error) {
 	return s.shards[s.getShardIndex(key)].HGetAll(key)
 }
 
 // HDel calculate index shard and delegates all the logic of the work to the MapStorage
-func (s *ShardedMapStorage) HDel(key string, fields []string) int64 {
+func (s *ShardedMapStorage) HDel(key string, fields []string) (int64, error) {
 	return s.shards[s.getShardIndex(key)].HDel(key, fields)
 }
 
 // HExists returns if field is an existing field in the hash stored at key
-func (s *ShardedMapStorage) HExists(key, field string) int64 {
+func (s *ShardedMapStorage) HExists(key, field string) (int64, error) {
 	return s.shards[s.getShardIndex(key)].HExists(key, field)
 }
 
 // HLen returns the number of fields contained in the hash stored at key
-func (s *ShardedMapStorage) HLen(key string) int64 {
+func (s *ShardedMapStorage) HLen(key string) (int64, error) {
 	return s.shards[s.getShardIndex(key)].HLen(key)
 }
 
 // HKeys returns all field names in the hash stored at key
-func (s *ShardedMapStorage) HKeys(key string) []string {
+func (s *ShardedMapStorage) HKeys(key string) ([]string, error) {
 	return s.shards[s.getShardIndex(key)].HKeys(key)
 }
 
 // HVals returns all values in the hash stored at key
-func (s *ShardedMapStorage) HVals(key string) []string {
+func (s *ShardedMapStorage) HVals(key string) ([]string, error) {
 	return s.shards[s.getShardIndex(key)].HVals(key)
 }
 
@@ -180,3 +529,110 @@ func (s *ShardedMapStorage) HVals(key string) []string {
 func (s *ShardedMapStorage) HExpire(key string, ttl time.Duration, opts ExpireOptions, fields []string) ([]int, bool) {
 	return s.shards[s.getShardIndex(key)].HExpire(key, ttl, opts, fields)
 }
+
+// HPTTL returns the remaining time to live of the fields in milliseconds
+func (s *ShardedMapStorage) HPTTL(key string, fields []string) ([]int64, bool) {
+	return s.shards[s.getShardIndex(key)].HPTTL(key, fields)
+}
+
+// Push inserts values at the head (left) or at the tail of the list stored at key
+func (s *ShardedMapStorage) Push(key string, values []string, left bool) (int64, error) {
+	return s.shards[s.getShardIndex(key)].Push(key, values, left)
+}
+
+// LLen returns the length of the list stored at key
+func (s *ShardedMapStorage) LLen(key string) (int64, error) {
+	return s.shards[s.getShardIndex(key)].LLen(key)
+}
+
+// LRange returns the elements of the list stored at key between start and stop inclusive
+func (s *ShardedMapStorage) LRange(key string, start, stop int64) ([]string, error) {
+	return s.shards[s.getShardIndex(key)].LRange(key, start, stop)
+}
+
+// LTrim keeps only the elements of the list stored at key between start and stop inclusive
+func (s *ShardedMapStorage) LTrim(key string, start, stop int64) error {
+	return s.shards[s.getShardIndex(key)].LTrim(key, start, stop)
+}
+
+// PFAdd adds the elements to the sketch stored at key
+func (s *ShardedMapStorage) PFAdd(key string, elements []string) (bool, error) {
+	return s.shards[s.getShardIndex(key)].PFAdd(key, elements)
+}
+
+// PFCount returns the estimated cardinality of the union of the sketches stored at keys, which may live in
+// different shards
+func (s *ShardedMapStorage) PFCount(keys []string) (int64, error) {
+	union, err := mergeHLLs(keys, s.shardOf)
+	if err != nil {
+		return 0, err
+	}
+
+	return union.Count(), nil
+}
+
+// PFMerge stores the union of the sketches stored at dest and srcs at dest. The sources are read shard by
+// shard, so the merge is not atomic across shards
+func (s *ShardedMapStorage) PFMerge(dest string, srcs []string) error {
+	union, err := mergeHLLs(srcs, s.shardOf)
+	if err != nil {
+		return err
+	}
+
+	return s.shardOf(dest).storeHLL(dest, union)
+}
+
+// XAdd appends an entry to the stream stored at key
+func (s *ShardedMapStorage) XAdd(key string, id StreamID, mode StreamIDMode, fields []string) (StreamID, error) {
+	return s.shards[s.getShardIndex(key)].XAdd(key, id, mode, fields)
+}
+
+// XLen returns the number of entries of the stream stored at key
+func (s *ShardedMapStorage) XLen(key string) (int64, error) {
+	return s.shards[s.getShardIndex(key)].XLen(key)
+}
+
+// XRange returns the entries of the stream stored at key with IDs between start and end inclusive
+func (s *ShardedMapStorage) XRange(key string, start, end StreamID, count int) ([]StreamEntry, error) {
+	return s.shards[s.getShardIndex(key)].XRange(key, start, end, count)
+}
+
+// XLastID returns the ID of the last entry added to the stream stored at key
+func (s *ShardedMapStorage) XLastID(key string) (StreamID, error) {
+	return s.shards[s.getShardIndex(key)].XLastID(key)
+}
+
+// XGroupCreate creates a consumer group of the stream stored at key
+func (s *ShardedMapStorage) XGroupCreate(key, group string, id StreamID, last, mkStream bool) error {
+	return s.shards[s.getShardIndex(key)].XGroupCreate(key, group, id, last, mkStream)
+}
+
+// XGroupDestroy deletes the consumer group of the stream stored at key
+func (s *ShardedMapStorage) XGroupDestroy(key, group string) (bool, error) {
+	return s.shards[s.getShardIndex(key)].XGroupDestroy(key, group)
+}
+
+// XReadGroup delivers entries of the stream stored at key to a consumer of the group
+func (s *ShardedMapStorage) XReadGroup(key, group, consumer string, after *StreamID, count int, noAck bool) ([]StreamEntry, error) {
+	return s.shards[s.getShardIndex(key)].XReadGroup(key, group, consumer, after, count, noAck)
+}
+
+// XAck acknowledges the pending entries of the group
+func (s *ShardedMapStorage) XAck(key, group string, ids []StreamID) (int64, error) {
+	return s.shards[s.getShardIndex(key)].XAck(key, group, ids)
+}
+
+// XPending returns the summary of the pending entries of the group
+func (s *ShardedMapStorage) XPending(key, group string) (PendingSummary, error) {
+	return s.shards[s.getShardIndex(key)].XPending(key, group)
+}
+
+// XPendingRange returns the pending entries of the group between start and end
+func (s *ShardedMapStorage) XPendingRange(key, group string, start, end StreamID, count int, consumer string, minIdle time.Duration) ([]PendingInfo, error) {
+	return s.shards[s.getShardIndex(key)].XPendingRange(key, group, start, end, count, consumer, minIdle)
+}
+
+// XClaim transfers the pending entries of the group to the consumer
+func (s *ShardedMapStorage) XClaim(key, group, consumer string, minIdle time.Duration, ids []StreamID, opts XClaimOptions) ([]StreamEntry, error) {
+	return s.shards[s.getShardIndex(key)].XClaim(key, group, consumer, minIdle, ids, opts)
+}
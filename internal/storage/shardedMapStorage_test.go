@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -76,6 +78,58 @@ func TestShardedMapStorage_Distribution(t *testing.T) {
 	}
 }
 
+func TestShardedMapStorage_HashFuncDistribution(t *testing.T) {
+	const (
+		shardsCount = 16
+		keys        = 16_000
+	)
+
+	for _, name := range []string{"fnv", "maphash", "xxhash"} {
+		t.Run(name, func(t *testing.T) {
+			fn, err := ParseHashFunc(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store, _ := NewShardedMapStorage(shardsCount) //nolint:errcheck
+			store.SetHashFunc(fn)
+
+			for i := range keys {
+				key := fmt.Sprintf("key-%d", i)
+				store.Set(key, "val", SetOptions{}) //nolint:errcheck
+
+				// the same key must always land in the same shard
+				if first, second := store.getShardIndex(key), store.getShardIndex(key); first != second {
+					t.Fatalf("%s hashed to shards %d and %d", key, first, second)
+				}
+				if _, ok, _ := store.Get(key); !ok { //nolint:errcheck
+					t.Fatalf("%s not found", key)
+				}
+			}
+
+			// every shard gets within 20% of the even share
+			for i, n := range store.ShardLens() {
+				if even := int64(keys / shardsCount); n < even*8/10 || n > even*12/10 {
+					t.Errorf("shard %d holds %d keys, expected about %d", i, n, even)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseHashFunc("crc32"); err == nil {
+		t.Error("expected an error for an unknown hash function")
+	}
+}
+
+func TestFNV32a(t *testing.T) {
+	// reference values of hash/fnv, the shard of a key must not change with the allocation-free implementation
+	for key, want := range map[string]uint32{"": 0x811c9dc5, "a": 0xe40c292c, "foobar": 0xbf9cf968} {
+		if got := fnv32a(key); got != want {
+			t.Errorf("fnv32a(%q) = %#x, want %#x", key, got, want)
+		}
+	}
+}
+
 func TestShardedMapStorage_Concurrent(t *testing.T) {
 	store, _ := NewShardedMapStorage(16) //nolint:errcheck
 	var wg sync.WaitGroup
@@ -133,3 +187,427 @@ func FuzzSharedMapStorage(f *testing.F) {
 		}
 	})
 }
+
+func TestShardedMapStorage_ForEachShard(t *testing.T) {
+	s, _ := NewShardedMapStorage(16) //nolint:errcheck
+
+	iterators := map[string]func(fn func(int, *MapStorage)){
+		"sequential": s.forEachShard,
+		"parallel":   s.forEachShardParallel,
+	}
+	for name, forEach := range iterators {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			visits := make(map[*MapStorage]int)
+			indexes := make(map[int]bool)
+
+			forEach(func(i int, shard *MapStorage) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				visits[shard]++
+				indexes[i] = true
+				if s.shards[i] != shard {
+					t.Errorf("index %d does not match its shard", i)
+				}
+			})
+
+			if len(visits) != len(s.shards) || len(indexes) != len(s.shards) {
+				t.Fatalf("visited %d of %d shards", len(visits), len(s.shards))
+			}
+			for _, n := range visits {
+				if n != 1 {
+					t.Errorf("shard visited %d times, want exactly once", n)
+				}
+			}
+		})
+	}
+}
+
+func TestShardedMapStorage_ForEachShardFrom(t *testing.T) {
+	s, _ := NewShardedMapStorage(4) //nolint:errcheck
+
+	walk := func(first int, reverse bool, stop int) []int {
+		var order []int
+		s.forEachShardFrom(first, reverse, func(i int, shard *MapStorage) bool {
+			if s.shards[i] != shard {
+				t.Errorf("index %d does not match its shard", i)
+			}
+			order = append(order, i)
+			return len(order) != stop
+		})
+		return order
+	}
+
+	tests := []struct {
+		name    string
+		first   int
+		reverse bool
+		stop    int
+		want    []int
+	}{
+		{"from the first", 0, false, 0, []int{0, 1, 2, 3}},
+		{"wraps around", 2, false, 0, []int{2, 3, 0, 1}},
+		{"reverse wraps around", 1, true, 0, []int{1, 0, 3, 2}},
+		{"stops early", 3, false, 2, []int{3, 0}},
+	}
+	for _, tt := range tests {
+		if got := walk(tt.first, tt.reverse, tt.stop); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: visited %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// actualLen counts the keys directly in the shard maps
+func actualLen(s *ShardedMapStorage) int64 {
+	var total int64
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		total += int64(len(shard.data))
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+func TestShardedMapStorage_LenConsistency(t *testing.T) {
+	store, _ := NewShardedMapStorage(8) //nolint:errcheck
+	var wg sync.WaitGroup
+
+	workers := 32
+	ops := 20000
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(id int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+
+			for j := 0; j < ops; j++ {
+				key := fmt.Sprintf("key-%d", r.Intn(200))
+
+				switch r.Intn(7) {
+				case 0:
+					store.Set(key, "v", SetOptions{})
+				case 1:
+					store.Set(key, "v", SetOptions{TTL: time.Duration(r.Intn(100)) * time.Microsecond})
+				case 2:
+					store.Get(key) //nolint:errcheck
+				case 3:
+					store.Delete(key)
+				case 4:
+					store.RemainingTTL(key)
+				case 5:
+					hashKey := "hash-" + key
+					store.HSet(hashKey, map[string]string{"f": "v"})
+					store.HDel(hashKey, []string{"f"}) //nolint:errcheck
+				case 6:
+					store.DeleteExpired(10)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if got, want := store.Len(), actualLen(store); got != want {
+		t.Errorf("Len() = %d, actual keys %d", got, want)
+	}
+
+	// Restore path
+	var buf bytes.Buffer
+	if err := store.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	restored, _ := NewShardedMapStorage(4) //nolint:errcheck
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	if got, want := restored.Len(), actualLen(restored); got != want {
+		t.Errorf("after restore Len() = %d, actual keys %d", got, want)
+	}
+}
+
+func TestShardedMapStorage_SnapshotDuringWrites(t *testing.T) {
+	modes := map[string]SnapshotMode{
+		"LowLatency": SnapshotLowLatency,
+		"LowMemory":  SnapshotLowMemory,
+	}
+
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			store, _ := NewShardedMapStorage(4) //nolint:errcheck
+			store.SetSnapshotMode(mode)
+
+			keys := 500
+			for i := 0; i < keys; i++ {
+				store.Set(fmt.Sprintf("str-%d", i), "v", SetOptions{})
+				store.HSet(fmt.Sprintf("hash-%d", i), map[string]string{"f": "v"})
+			}
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+
+			workers := 8
+			wg.Add(workers)
+			for i := 0; i < workers; i++ {
+				go func(id int) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+
+						n := r.Intn(keys)
+						store.HSet(fmt.Sprintf("hash-%d", n), map[string]string{fmt.Sprintf("f%d", r.Intn(50)): "v"})
+						store.Set(fmt.Sprintf("str-%d", n), fmt.Sprintf("v%d", r.Int()), SetOptions{})
+						store.Set(fmt.Sprintf("new-%d", r.Intn(keys)), "v", SetOptions{})
+					}
+				}(i)
+			}
+
+			for i := 0; i < 20; i++ {
+				var buf bytes.Buffer
+				if err := store.Snapshot(&buf); err != nil {
+					t.Fatalf("snapshot failed: %v", err)
+				}
+
+				restored, _ := NewShardedMapStorage(4) //nolint:errcheck
+				if err := restored.Restore(&buf); err != nil {
+					t.Fatalf("restore of snapshot %d failed: %v", i, err)
+				}
+
+				if got := restored.Len(); got < int64(2*keys) {
+					t.Fatalf("snapshot %d has %d keys, want at least %d", i, got, 2*keys)
+				}
+			}
+
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestShardedMapStorage_ExpireJitter(t *testing.T) {
+	store, _ := NewShardedMapStorage(4) //nolint:errcheck
+	store.SetExpireJitter(20)
+
+	ttl := 10 * time.Second
+	minTTL, maxTTL := ttl, time.Duration(0)
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		store.Set(key, "v", SetOptions{TTL: ttl})
+
+		remaining, status := store.RemainingTTL(key)
+		if status != ExpActive {
+			t.Fatalf("key %s has no TTL", key)
+		}
+		if remaining < 7*time.Second || remaining > 12*time.Second {
+			t.Errorf("TTL %v is outside of the jitter band", remaining)
+		}
+		minTTL = min(minTTL, remaining)
+		maxTTL = max(maxTTL, remaining)
+	}
+
+	if maxTTL-minTTL < time.Second {
+		t.Errorf("deadlines are not spread: min %v, max %v", minTTL, maxTTL)
+	}
+
+	// absolute deadlines are kept as is
+	store.Set("abs", "v", SetOptions{TTL: ttl, Absolute: true})
+	if remaining, _ := store.RemainingTTL("abs"); remaining < ttl-100*time.Millisecond {
+		t.Errorf("absolute TTL was jittered: %v", remaining)
+	}
+}
+
+// makeEntries returns n string and hash entries, every tenth of them already expired
+func makeEntries(n int) []Entry {
+	now := time.Now()
+	entries := make([]Entry, n)
+
+	for i := range entries {
+		entry := Entry{Key: fmt.Sprintf("key%d", i)}
+
+		if i%2 == 0 {
+			entry.Entity = Entity{Type: TypeString, Value: fmt.Sprintf("value%d", i)}
+		} else {
+			entry.Entity = Entity{Type: TypeHash, Value: map[string]HashField{
+				"f": {Value: fmt.Sprintf("value%d", i)},
+			}}
+		}
+
+		switch i % 10 {
+		case 0:
+			entry.ExpireAt = now.Add(-time.Second).UnixNano()
+		case 1:
+			entry.ExpireAt = now.Add(time.Hour).UnixNano()
+		}
+
+		entries[i] = entry
+	}
+
+	return entries
+}
+
+// loadPerKey inserts the entries one by one, locking the shard for every key
+func loadPerKey(s *ShardedMapStorage, entries []Entry) {
+	now := time.Now().UnixNano()
+
+	for _, entry := range entries {
+		if entry.ExpireAt > 0 && now > entry.ExpireAt {
+			continue
+		}
+
+		shard := s.shards[s.getShardIndex(entry.Key)]
+		shard.mu.Lock()
+		shard.storeLocked(entry.Key, entry.Entity)
+		if entry.ExpireAt > 0 {
+			shard.expires[entry.Key] = entry.ExpireAt
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func TestShardedMapStorage_BulkLoad(t *testing.T) {
+	const n = 1000
+	entries := makeEntries(n)
+
+	bulk, _ := NewShardedMapStorage(16)   //nolint:errcheck
+	perKey, _ := NewShardedMapStorage(16) //nolint:errcheck
+
+	if loaded := bulk.BulkLoad(entries); loaded != n-n/10 {
+		t.Errorf("expected %d loaded entries, got %d", n-n/10, loaded)
+	}
+	loadPerKey(perKey, entries)
+
+	if bulk.Len() != perKey.Len() {
+		t.Fatalf("bulk load has %d keys, per-key load has %d", bulk.Len(), perKey.Len())
+	}
+
+	for _, entry := range entries {
+		wantValue, wantOK, _ := perKey.Get(entry.Key) //nolint:errcheck
+		gotValue, gotOK, _ := bulk.Get(entry.Key)     //nolint:errcheck
+		if gotValue != wantValue || gotOK != wantOK {
+			t.Errorf("%s: got %q %v, want %q %v", entry.Key, gotValue, gotOK, wantValue, wantOK)
+		}
+
+		got, _ := bulk.HGetAll(entry.Key)    //nolint:errcheck
+		want, _ := perKey.HGetAll(entry.Key) //nolint:errcheck
+		if len(got) != len(want) || got["f"] != want["f"] {
+			t.Errorf("%s: got hash %v, want %v", entry.Key, got, want)
+		}
+
+		_, gotStatus := bulk.RemainingTTL(entry.Key)
+		_, wantStatus := perKey.RemainingTTL(entry.Key)
+		if gotStatus != wantStatus {
+			t.Errorf("%s: got expiry status %v, want %v", entry.Key, gotStatus, wantStatus)
+		}
+	}
+}
+
+func TestShardedMapStorage_Rename(t *testing.T) {
+	s, _ := NewShardedMapStorage(16) //nolint:errcheck
+
+	// find a destination living in another shard than the source
+	dst := ""
+	for i := 0; dst == ""; i++ {
+		if key := fmt.Sprintf("dst%d", i); s.getShardIndex(key) != s.getShardIndex("src") {
+			dst = key
+		}
+	}
+
+	s.Set("src", "v", SetOptions{TTL: time.Hour}) //nolint:errcheck
+	s.Set(dst, "old", SetOptions{})               //nolint:errcheck
+
+	if moved, err := s.Rename("src", dst, true); moved || err != nil {
+		t.Errorf("RENAMENX over an existing key: got %v, %v", moved, err)
+	}
+
+	if moved, err := s.Rename("src", dst, false); !moved || err != nil {
+		t.Fatalf("rename across shards: got %v, %v", moved, err)
+	}
+	if v, ok, _ := s.Get(dst); !ok || v != "v" { //nolint:errcheck
+		t.Errorf("destination holds %q %v, want v", v, ok)
+	}
+	if _, ok, _ := s.Get("src"); ok { //nolint:errcheck
+		t.Errorf("source still exists after rename")
+	}
+	if _, status := s.RemainingTTL(dst); status != ExpActive {
+		t.Errorf("TTL was not moved with the key")
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected 1 key after rename, got %d", s.Len())
+	}
+
+	if _, err := s.Rename("missing", dst, false); err != ErrNoSuchKey {
+		t.Errorf("rename of a missing key: got %v, want %v", err, ErrNoSuchKey)
+	}
+}
+
+// TestShardedMapStorage_CopyAtomic copies across shards while the source and then the destination are
+// overwritten. An atomic copy either sees the new source or is overwritten by the writer, so both keys end equal
+func TestShardedMapStorage_CopyAtomic(t *testing.T) {
+	s, _ := NewShardedMapStorage(16) //nolint:errcheck
+
+	dst := ""
+	for i := 0; dst == ""; i++ {
+		if key := fmt.Sprintf("dst%d", i); s.getShardIndex(key) != s.getShardIndex("src") {
+			dst = key
+		}
+	}
+
+	const writes = 20000
+	s.Set("src", "0", SetOptions{}) //nolint:errcheck
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.Copy("src", dst, true)
+			}
+		}
+	}()
+
+	for i := 1; i <= writes; i++ {
+		s.Set("src", fmt.Sprint(i), SetOptions{}) //nolint:errcheck
+		s.Set(dst, fmt.Sprint(i), SetOptions{})   //nolint:errcheck
+	}
+	close(done)
+	wg.Wait()
+
+	src, _, _ := s.Get("src")            //nolint:errcheck
+	if v, _, _ := s.Get(dst); v != src { //nolint:errcheck
+		t.Errorf("copy was not atomic: source %s, destination %s", src, v)
+	}
+}
+
+func BenchmarkRestore(b *testing.B) {
+	const n = 1_000_000
+	entries := makeEntries(n)
+
+	b.Run("PerKey", func(b *testing.B) {
+		for b.Loop() {
+			s, _ := NewShardedMapStorage(32) //nolint:errcheck
+			loadPerKey(s, entries)
+		}
+	})
+
+	b.Run("BulkLoad", func(b *testing.B) {
+		for b.Loop() {
+			s, _ := NewShardedMapStorage(32) //nolint:errcheck
+			s.BulkLoad(entries)
+		}
+	})
+}
@@ -0,0 +1,493 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxPrealloc bounds the buffer allocated up front for a length read from a stream that cannot tell how many
+// bytes are left, larger values grow as their bytes arrive
+const maxPrealloc = 64 * 1024
+
+// errBadLength is returned when a length or a count read from the input does not fit in the bytes left
+var errBadLength = errors.New("length exceeds the remaining input")
+
+// lenReader is a reader that knows how many bytes are left, such as *bytes.Reader
+type lenReader interface {
+	Len() int
+}
+
+// checkCount rejects a count of elements taking at least size bytes each that does not fit in what is left of r.
+// Readers that cannot tell it are not checked, callers bound their preallocation instead
+func checkCount(r io.Reader, count uint32, size int) error {
+	if lr, ok := r.(lenReader); ok && uint64(count)*uint64(size) > uint64(lr.Len()) {
+		return errBadLength
+	}
+	return nil
+}
+
+// SnapshotMode selects how a shard is locked while it is being snapshotted
+type SnapshotMode uint8
+
+const (
+	// SnapshotLowLatency copies the shard under the read lock and serializes the copy after releasing it.
+	// Writers are blocked only for the copy, at the cost of briefly holding a second copy of the shard in memory
+	SnapshotLowLatency SnapshotMode = iota
+	// SnapshotLowMemory serializes the shard while holding the read lock, blocking writers for the whole IO
+	SnapshotLowMemory
+)
+
+// ParseSnapshotMode converts the config value ("low-latency" or "low-memory") to a SnapshotMode
+func ParseSnapshotMode(mode string) (SnapshotMode, error) {
+	switch mode {
+	case "low-latency":
+		return SnapshotLowLatency, nil
+	case "low-memory":
+		return SnapshotLowMemory, nil
+	}
+
+	return 0, fmt.Errorf("unknown snapshot mode %q", mode)
+}
+
+// Entry is a single key with its value and absolute expiration, as loaded by BulkLoad
+type Entry struct {
+	Key      string
+	ExpireAt int64 // unix nanoseconds, 0 if the key does not expire
+	Entity   Entity
+}
+
+// readEntries reads all keys written by writeEntry until the end of the stream
+func readEntries(r io.Reader) ([]Entry, error) {
+	header := make([]byte, 13)
+	var entries []Entry
+
+	for {
+		entry, err := readEntry(r, header)
+		if err == io.EOF {
+			return entries, nil // end of stream
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// readEntry deserializes a single key: [KeyLen][Expire][Type][Key][Value].
+// Returns io.EOF if the stream ends before the next key
+func readEntry(r io.Reader, header []byte) (Entry, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Entry{}, err
+	}
+
+	keyLen := binary.LittleEndian.Uint32(header[0:4])
+	exp := int64(binary.LittleEndian.Uint64(header[4:12]))
+	valueType := DataType(header[12])
+
+	key, err := readBytes(r, keyLen)
+	if err != nil {
+		return Entry{}, noEOF(err)
+	}
+
+	value, err := readValue(r, valueType)
+	if err != nil {
+		return Entry{}, noEOF(err)
+	}
+
+	return Entry{
+		Key:      key,
+		ExpireAt: exp,
+		Entity:   Entity{Type: valueType, Value: value},
+	}, nil
+}
+
+// noEOF turns the end of the stream inside a key into io.ErrUnexpectedEOF, so a truncated key is not taken
+// for the end of the snapshot
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readValue deserializes the value of a single entity written by writeValue
+func readValue(r io.Reader, valueType DataType) (interface{}, error) {
+	var value interface{}
+
+	switch valueType {
+	case TypeString:
+		val, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		value = val
+	case TypeHash:
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+
+		// field and value lengths and the expiration
+		if err := checkCount(r, count, 4+4+8); err != nil {
+			return nil, err
+		}
+
+		h := make(map[string]HashField, min(count, 1024))
+
+		for range count {
+			field, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+
+			val, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+
+			var expireAt int64
+			if err := binary.Read(r, binary.LittleEndian, &expireAt); err != nil {
+				return nil, err
+			}
+
+			h[field] = HashField{Value: val, ExpireAt: expireAt}
+		}
+		value = h
+
+	case TypeList:
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+
+		if err := checkCount(r, count, 4); err != nil {
+			return nil, err
+		}
+
+		list := make([]string, 0, min(count, 1024))
+		for range count {
+			val, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		value = list
+
+	case TypeStream:
+		var lastID StreamID
+		if err := binary.Read(r, binary.LittleEndian, &lastID); err != nil {
+			return nil, err
+		}
+
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+
+		// ID and field count
+		if err := checkCount(r, count, 16+4); err != nil {
+			return nil, err
+		}
+
+		stream := &Stream{Entries: make([]StreamEntry, 0, min(count, 1024)), LastID: lastID}
+		for range count {
+			var entry StreamEntry
+			if err := binary.Read(r, binary.LittleEndian, &entry.ID); err != nil {
+				return nil, err
+			}
+
+			var fields uint32
+			if err := binary.Read(r, binary.LittleEndian, &fields); err != nil {
+				return nil, err
+			}
+
+			if err := checkCount(r, fields, 4); err != nil {
+				return nil, err
+			}
+
+			entry.Fields = make([]string, 0, min(fields, 1024))
+			for range fields {
+				val, err := readString(r)
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, val)
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+
+		groups, err := readStreamGroups(r)
+		if err != nil {
+			return nil, err
+		}
+		stream.Groups = groups
+		value = stream
+
+	case TypeSet:
+		//TODO Set
+	case TypeZSet:
+		//TODO ZSet
+	}
+
+	return value, nil
+}
+
+// snapshotEntry is a key copied out of a shard for serialization outside the lock
+type snapshotEntry struct {
+	key    string
+	expire int64
+	entity Entity
+}
+
+// writeEntry serializes a single key: [KeyLen][Expire][Type][Key][Value]
+func writeEntry(w io.Writer, header []byte, key string, expire int64, entity Entity) error {
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(key)))
+	binary.LittleEndian.PutUint64(header[4:12], uint64(expire))
+	header[12] = byte(entity.Type)
+
+	// header
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// key
+	if _, err := io.WriteString(w, key); err != nil {
+		return err
+	}
+
+	return writeValue(w, entity)
+}
+
+// writeValue serializes the value of a single entity without its key
+func writeValue(w io.Writer, entity Entity) error {
+	switch entity.Type {
+	case TypeString:
+		if err := writeString(w, entity.Value.(string)); err != nil {
+			return err
+		}
+	case TypeHash:
+		// [Count][KeyLen][Key][ValLen][Val]...
+		h := entity.Value.(map[string]HashField)
+		now := time.Now().UnixNano()
+
+		// expired fields are skipped, so they must not be counted either
+		var count uint32
+		for _, val := range h {
+			if val.ExpireAt == 0 || now <= val.ExpireAt {
+				count++
+			}
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, count); err != nil {
+			return err
+		}
+
+		for field, val := range h {
+			if val.ExpireAt > 0 && now > val.ExpireAt {
+				continue
+			}
+
+			if err := writeString(w, field); err != nil {
+				return err
+			}
+			if err := writeString(w, val.Value); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, val.ExpireAt); err != nil {
+				return err
+			}
+		}
+
+	case TypeList:
+		// [Count][ValLen][Val]...
+		list := entity.Value.([]string)
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(list))); err != nil {
+			return err
+		}
+
+		for _, val := range list {
+			if err := writeString(w, val); err != nil {
+				return err
+			}
+		}
+
+	case TypeStream:
+		// [LastID][Count][ID][FieldCount][ValLen][Val]...[Groups]
+		stream := entity.Value.(*Stream)
+		if err := binary.Write(w, binary.LittleEndian, stream.LastID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(stream.Entries))); err != nil {
+			return err
+		}
+
+		for _, entry := range stream.Entries {
+			if err := binary.Write(w, binary.LittleEndian, entry.ID); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, uint32(len(entry.Fields))); err != nil {
+				return err
+			}
+			for _, val := range entry.Fields {
+				if err := writeString(w, val); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := writeStreamGroups(w, stream.Groups); err != nil {
+			return err
+		}
+
+	case TypeSet:
+		//TODO Set
+	case TypeZSet:
+		//TODO ZSet
+	}
+
+	return nil
+}
+
+// countingWriter discards the data and counts the written bytes
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// SerializedLength returns the number of bytes the value of the entity occupies in a snapshot
+func SerializedLength(entity Entity) int64 {
+	var c countingWriter
+	_ = writeValue(&c, entity) // countingWriter never fails
+	return c.n
+}
+
+// writeStreamGroups serializes the consumer groups of a stream:
+// [Count]([NameLen][Name][LastDelivered][ConsumerCount]([NameLen][Name][SeenAt])...
+// [PendingCount]([ID][ConsumerLen][Consumer][DeliveredAt][Deliveries])...)...
+func writeStreamGroups(w io.Writer, groups map[string]*StreamGroup) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(groups))); err != nil {
+		return err
+	}
+
+	for name, g := range groups {
+		if err := writeString(w, name); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, g.LastDelivered); err != nil {
+			return err
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(g.Consumers))); err != nil {
+			return err
+		}
+		for consumer, seenAt := range g.Consumers {
+			if err := writeString(w, consumer); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, seenAt); err != nil {
+				return err
+			}
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(g.Pending))); err != nil {
+			return err
+		}
+		for id, pending := range g.Pending {
+			if err := binary.Write(w, binary.LittleEndian, id); err != nil {
+				return err
+			}
+			if err := writeString(w, pending.Consumer); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, [2]int64{pending.DeliveredAt, pending.Deliveries}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readStreamGroups deserializes the consumer groups written by writeStreamGroups, nil if there are none
+func readStreamGroups(r io.Reader) (map[string]*StreamGroup, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	// name length, last delivered ID, consumer and pending counts
+	if err := checkCount(r, count, 4+16+4+4); err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*StreamGroup, min(count, 1024))
+	for range count {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastDelivered StreamID
+		if err := binary.Read(r, binary.LittleEndian, &lastDelivered); err != nil {
+			return nil, err
+		}
+		g := newStreamGroup(lastDelivered)
+
+		var consumers uint32
+		if err := binary.Read(r, binary.LittleEndian, &consumers); err != nil {
+			return nil, err
+		}
+		if err := checkCount(r, consumers, 4+8); err != nil {
+			return nil, err
+		}
+		for range consumers {
+			consumer, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			var seenAt int64
+			if err := binary.Read(r, binary.LittleEndian, &seenAt); err != nil {
+				return nil, err
+			}
+			g.Consumers[consumer] = seenAt
+		}
+
+		var pending uint32
+		if err := binary.Read(r, binary.LittleEndian, &pending); err != nil {
+			return nil, err
+		}
+		if err := checkCount(r, pending, 16+4+16); err != nil {
+			return nil, err
+		}
+		for range pending {
+			var id StreamID
+			if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+				return nil, err
+			}
+			consumer, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			var delivery [2]int64
+			if err := binary.Read(r, binary.LittleEndian, &delivery); err != nil {
+				return nil, err
+			}
+			g.Pending[id] = PendingEntry{Consumer: consumer, DeliveredAt: delivery[0], Deliveries: delivery[1]}
+		}
+
+		groups[name] = g
+	}
+
+	return groups, nil
+}
@@ -21,6 +21,14 @@ type SetOptions struct {
 	KeepTTL bool          // if true, retain the existing TTL (ignore TTL field)
 	NX      bool          // only set if the key does not exist
 	XX      bool          // only set if the key already exists
+
+	Absolute bool // TTL was derived from an absolute timestamp (EXAT/PXAT) and is never jittered
+}
+
+// HSetExOptions are the conditions of HSetEx on the fields that already exist
+type HSetExOptions struct {
+	FNX bool // Set the fields only when none of them exists
+	FXX bool // Set the fields only when all of them exist
 }
 
 type ExpireOptions struct {
@@ -32,24 +40,108 @@ type ExpireOptions struct {
 
 // Storage is a common interface for working with key-value storages
 type Storage interface {
+	// Len returns the number of keys, including expired keys that were not reclaimed yet. O(1)
+	Len() int64
+
+	// ShardLens returns the number of keys of every shard in shard order, counted like Len
+	ShardLens() []int64
+
 	// Get returns the value and true if the key is found. Otherwise, "", false
 	Get(key string) (string, bool, error)
 
-	// Set writes the value based on the options. Returns true if recording has been performed
-	Set(key, value string, options SetOptions) bool
+	// GetDel returns the string stored at key and deletes the key. Returns ErrWrongType for other types
+	GetDel(key string) (string, bool, error)
+
+	// GetEx returns the string stored at key and changes its expiration. A positive expireAt (Unix nanoseconds)
+	// sets the deadline and a deadline in the past deletes the key, persist removes the expiration.
+	// Returns ErrWrongType for other types
+	GetEx(key string, expireAt int64, persist bool) (string, bool, error)
+
+	// Set writes the value based on the options, replacing a value of any type. Returns true if recording
+	// has been performed. Returns ErrStringTooLong if the value exceeds the maximum string length
+	Set(key, value string, options SetOptions) (bool, error)
+
+	// MaxStringLen returns the maximum length of a string value
+	MaxStringLen() int64
+
+	// Append appends value to the string stored at key. Returns the length of the string after the append
+	Append(key, value string) (int64, error)
+
+	// IncrByFloat adds delta to the float stored at key, a missing key counts as 0. Returns the new value,
+	// ErrNotFloat if the current value is not a float and ErrFloatOverflow if the result is not finite
+	IncrByFloat(key string, delta float64) (string, error)
+
+	// SetRange overwrites the string stored at key starting at offset. Returns the length of the string
+	SetRange(key string, offset int64, value string) (int64, error)
+
+	// BitField runs the BITFIELD operations against the string stored at key. Returns a result per operation
+	BitField(key string, ops []BitFieldOp) ([]BitFieldResult, error)
 
 	// Delete deletes the key. Returns true if the key existed and was deleted
 	Delete(key string) bool
 
-	// Expiry returns the remaining lifetime and status as ExpiryStatus
-	Expiry(key string) (time.Duration, ExpiryStatus)
+	// RemainingTTL returns the remaining lifetime of the key and its ExpiryStatus.
+	// It is the single source of the remaining time, commands round it themselves
+	RemainingTTL(key string) (time.Duration, ExpiryStatus)
 
 	// Persist removes the expiration date of the key, making it eternal.
 	// Returns 1 if successful, 0 if the key was not found or had no TTL
 	Persist(key string) int64
 
-	// DeleteExpired randomly selects a limit of keys from each shard and delete if his TTL has expired
-	DeleteExpired(limit int) float64
+	// ExpireAt sets an absolute expiration deadline on the key. A deadline in the past deletes the key.
+	// Returns 1 if the timeout was set, 0 if the key does not exist
+	ExpireAt(key string, at time.Time) int64
+
+	// Copy copies the value stored at src to dst together with its TTL. The copy never shares
+	// underlying structures with the source. If replace is false, an existing dst is not overwritten.
+	// Returns true if the key was copied
+	Copy(src, dst string, replace bool) bool
+
+	// Rename atomically moves the value stored at src to dst together with its TTL, overwriting dst.
+	// If nx is true, an existing dst is not overwritten. Returns true if the key was moved
+	// and ErrNoSuchKey if src does not exist
+	Rename(src, dst string, nx bool) (bool, error)
+
+	// RestoreKey stores an entity created by ParseDump at key. expireAt is the absolute expiration in Unix nanoseconds,
+	// 0 for none, and a deadline in the past only removes the existing key. idle backdates the last access time.
+	// If replace is false, an existing key is not overwritten. Returns true if the key was stored
+	RestoreKey(key string, entity Entity, expireAt int64, idle time.Duration, replace bool) bool
+
+	// StoreResult atomically overwrites dest with the result of a *STORE command (SINTERSTORE, SUNIONSTORE, etc.),
+	// replacing any previous type and TTL. An empty result deletes dest.
+	// Returns true if dest holds the result
+	StoreResult(dest string, entity Entity, empty bool) bool
+
+	// View calls fn with the live entity stored at key while holding the lock.
+	// fn must not modify the entity or retain references to it. Returns false if the key does not exist
+	View(key string, fn func(entity Entity)) bool
+
+	// Scan returns at least count keys starting at cursor, the cursor to continue from (0 when the iteration
+	// is complete) and the number of entries examined. A reverse scan returns the keys in the opposite order,
+	// its cursors are only valid for reverse scans
+	Scan(cursor uint64, count int, reverse bool) ([]string, uint64, int)
+
+	// Keys returns the live keys for which match returns true, at most limit of them if limit is positive.
+	// Unlike Scan it walks every shard only once, holding its read lock for the whole walk
+	Keys(match func(key string) bool, limit int) []string
+
+	// RandomKey returns a random live key of type typ, any type if typ is 0. Expired candidates are deleted.
+	// Returns false if no such key was found within a bounded number of attempts
+	RandomKey(typ DataType) (string, bool)
+
+	// Touch updates the last access time of the existing keys
+	Touch(keys []string)
+
+	// MemoryStats estimates the memory used by the dataset, large datasets are sampled
+	MemoryStats() MemoryStats
+
+	// DeleteExpired randomly selects a limit of keys from each shard and delete if his TTL has expired.
+	// Returns the ratio of expired keys among the checked ones and the number of deleted keys
+	DeleteExpired(limit int) (float64, int)
+
+	// ExpireDue deletes the keys whose deadline is before now, at most limit per shard.
+	// Returns the number of deleted keys and whether due keys are left
+	ExpireDue(now time.Time, limit int) (int, bool)
 
 	// Snapshot writes the entire state of the storage to the writer.
 	// Implementation must ensure consistency (or shard-level consistency)
@@ -58,32 +150,110 @@ type Storage interface {
 	// Restore reads the state from the reader and populates the storage
 	Restore(r io.Reader) error
 
+	// BulkLoad inserts the entries taking each lock once, overwriting existing keys.
+	// Entries that are already expired are skipped. Returns the number of loaded entries
+	BulkLoad(entries []Entry) int
+
 	// HSet sets the specified fields to their respective values in the hash stored at key
 	HSet(key string, fields map[string]string) int64
 
-	// HGet returns the value associated with field in the hash stored at key
-	HGet(key, field string) (string, bool)
+	// HSetNX sets field only if it does not exist in the hash stored at key.
+	// Returns 1 if the field was set, 0 if it exists or -1 if key holds a value of another type
+	HSetNX(key, field, value string) int64
+
+	// HSetEx sets the specified fields with a TTL atomically. Returns the number of fields set,
+	// 0 if the FNX or FXX condition blocked the write or -1 if key holds a value of another type
+	HSetEx(key string, fields map[string]string, ttl time.Duration, opts HSetExOptions) int64
 
-	// HGetAll returns all fields and values of the hash stored at key
-	HGetAll(key string) map[string]string
+	// HGet returns the value associated with field in the hash stored at key. Returns ErrWrongType for other types
+	HGet(key, field string) (string, bool, error)
+
+	// HGetAll returns all fields and values of the hash stored at key. Returns ErrWrongType for other types
+	HGetAll(key string) (map[string]string, error)
 
 	// HDel removes the specified fields from the hash stored at key
 	// Deletes the hash if no fields remain.
 	// If key does not exist, it is treated as an empty hash and this command returns 0.
-	HDel(key string, fields []string) int64
+	// Returns ErrWrongType for other types
+	HDel(key string, fields []string) (int64, error)
 
-	// HExists returns if field is an existing field in the hash stored at key
-	HExists(key, field string) int64
+	// HExists returns if field is an existing field in the hash stored at key. Returns ErrWrongType for other types
+	HExists(key, field string) (int64, error)
 
-	// HLen returns the number of fields contained in the hash stored at key
-	HLen(key string) int64
+	// HLen returns the number of fields contained in the hash stored at key. Returns ErrWrongType for other types
+	HLen(key string) (int64, error)
 
-	// HKeys returns all field names in the hash stored at key
-	HKeys(key string) []string
+	// HKeys returns all field names in the hash stored at key. Returns ErrWrongType for other types
+	HKeys(key string) ([]string, error)
 
-	// HVals returns all values in the hash stored at key
-	HVals(key string) []string
+	// HVals returns all values in the hash stored at key. Returns ErrWrongType for other types
+	HVals(key string) ([]string, error)
 
 	// HExpire set an expiration on one or more fields of a given hash key
 	HExpire(key string, ttl time.Duration, opts ExpireOptions, fields []string) ([]int, bool)
+
+	// HPTTL returns the remaining time to live of the fields in milliseconds, -1 for a field without a TTL
+	// and -2 for a missing one. Returns false if the key does not hold a hash
+	HPTTL(key string, fields []string) ([]int64, bool)
+
+	// Push inserts values at the head (left) or at the tail of the list stored at key, creating the list if needed.
+	// Lists longer than the max list length are trimmed from the opposite end. Returns the length of the list
+	Push(key string, values []string, left bool) (int64, error)
+
+	// LLen returns the length of the list stored at key
+	LLen(key string) (int64, error)
+
+	// LRange returns the elements of the list stored at key between start and stop inclusive
+	LRange(key string, start, stop int64) ([]string, error)
+
+	// LTrim keeps only the elements of the list stored at key between start and stop inclusive
+	LTrim(key string, start, stop int64) error
+
+	// PFAdd adds the elements to the HyperLogLog stored at key, creating the key if needed.
+	// Returns true if the estimated cardinality may have changed and ErrNotHLL if the string is not a sketch
+	PFAdd(key string, elements []string) (bool, error)
+
+	// PFCount returns the estimated cardinality of the union of the HyperLogLogs stored at keys
+	PFCount(keys []string) (int64, error)
+
+	// PFMerge merges the HyperLogLogs stored at srcs into the one stored at dest, creating dest if needed
+	PFMerge(dest string, srcs []string) error
+
+	// XAdd appends an entry with the field value pairs to the stream stored at key, creating the stream if needed.
+	// mode tells which parts of id are generated. Returns the ID of the entry
+	XAdd(key string, id StreamID, mode StreamIDMode, fields []string) (StreamID, error)
+
+	// XLen returns the number of entries of the stream stored at key
+	XLen(key string) (int64, error)
+
+	// XRange returns at most count entries of the stream stored at key with IDs between start and end inclusive.
+	// A negative count means no limit
+	XRange(key string, start, end StreamID, count int) ([]StreamEntry, error)
+
+	// XLastID returns the ID of the last entry added to the stream stored at key, 0-0 if the key does not exist
+	XLastID(key string) (StreamID, error)
+
+	// XGroupCreate creates a consumer group of the stream stored at key that delivers the entries after id,
+	// or after the last entry if last is set. mkStream creates a missing stream, otherwise ErrNoSuchKey is returned
+	XGroupCreate(key, group string, id StreamID, last, mkStream bool) error
+
+	// XGroupDestroy deletes the consumer group. Returns true if it existed
+	XGroupDestroy(key, group string) (bool, error)
+
+	// XReadGroup delivers entries to a consumer of the group: the new entries if after is nil,
+	// the pending entries of the consumer with IDs greater than after otherwise
+	XReadGroup(key, group, consumer string, after *StreamID, count int, noAck bool) ([]StreamEntry, error)
+
+	// XAck acknowledges the pending entries of the group. Returns the number of acknowledged entries
+	XAck(key, group string, ids []StreamID) (int64, error)
+
+	// XPending returns the summary of the pending entries of the group
+	XPending(key, group string) (PendingSummary, error)
+
+	// XPendingRange returns the pending entries of the group between start and end idle for at least minIdle,
+	// optionally only those of a single consumer
+	XPendingRange(key, group string, start, end StreamID, count int, consumer string, minIdle time.Duration) ([]PendingInfo, error)
+
+	// XClaim transfers the pending entries idle for at least minIdle to the consumer. Returns the claimed entries
+	XClaim(key, group, consumer string, minIdle time.Duration, ids []StreamID, opts XClaimOptions) ([]StreamEntry, error)
 }
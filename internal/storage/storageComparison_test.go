@@ -2,7 +2,11 @@ package storage
 
 import (
 	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
 	"testing"
+	"time"
 )
 
 func getAllImplementations() map[string]Storage {
@@ -21,7 +25,10 @@ func getAllImplementations() map[string]Storage {
 func BenchmarkStorage(b *testing.B) {
 	implementations := getAllImplementations()
 
-	for name, s := range implementations {
+	// run in a stable order, so results of different sizes can be compared between runs
+	for _, name := range slices.Sorted(maps.Keys(implementations)) {
+		s := implementations[name]
+
 		b.Run(fmt.Sprintf("%s/ReadOnly", name), func(b *testing.B) {
 			s.Set("bench_key", "value", SetOptions{
 				TTL:     0,
@@ -90,3 +97,130 @@ func BenchmarkStorage(b *testing.B) {
 		})
 	}
 }
+
+// TestImplementationsEquivalent replays the same random operations on every implementation
+// and checks that they all return the same results
+func TestImplementationsEquivalent(t *testing.T) {
+	implementations := getAllImplementations()
+	reference := NewMapStorage()
+	r := rand.New(rand.NewSource(1))
+
+	for step := 0; step < 5000; step++ {
+		key := fmt.Sprintf("key%d", r.Intn(50))
+		other := fmt.Sprintf("key%d", r.Intn(50))
+		field := fmt.Sprintf("f%d", r.Intn(5))
+		value := fmt.Sprintf("v%d", r.Intn(100))
+		op := r.Intn(12)
+
+		apply := func(s Storage) string {
+			switch op {
+			case 0:
+				ok, err := s.Set(key, value, SetOptions{NX: r.Intn(4) == 0})
+				return fmt.Sprint(ok, err)
+			case 1:
+				v, ok, err := s.Get(key)
+				return fmt.Sprint(v, ok, err)
+			case 2:
+				return fmt.Sprint(s.Delete(key))
+			case 3:
+				n, err := s.Append(key, value)
+				return fmt.Sprint(n, err)
+			case 4:
+				return fmt.Sprint(s.HSet(key, map[string]string{field: value}))
+			case 5:
+				v, ok, err := s.HGet(key, field)
+				return fmt.Sprint(v, ok, err)
+			case 6:
+				return fmt.Sprint(s.HDel(key, []string{field}))
+			case 7:
+				return fmt.Sprint(s.HLen(key))
+			case 8:
+				return fmt.Sprint(s.ExpireAt(key, time.Now().Add(time.Hour)))
+			case 9:
+				_, status := s.RemainingTTL(key)
+				return fmt.Sprint(status, s.Persist(key))
+			case 10:
+				return fmt.Sprint(s.Copy(key, other, true))
+			default:
+				return fmt.Sprint(s.Len())
+			}
+		}
+
+		// every implementation must consume the same random values as the reference
+		state := r.Int63()
+		r.Seed(state)
+		want := apply(reference)
+
+		for name, s := range implementations {
+			r.Seed(state)
+			if got := apply(s); got != want {
+				t.Fatalf("step %d op %d on %s: got %q, want %q", step, op, name, got, want)
+			}
+		}
+		r.Seed(state)
+	}
+}
+
+// BenchmarkExpireReclamation measures how long the active expiration takes to delete the due keys of a shard
+// where most keys with a TTL are not due yet: sampling with DeleteExpired until none is left, as the GC does,
+// against popping them from the expire index with ExpireDue
+func BenchmarkExpireReclamation(b *testing.B) {
+	const (
+		ttlKeys = 10_000
+		dueKeys = 100
+		samples = 20 // the default gc.samples_per_check
+	)
+
+	keys := make([]string, ttlKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+
+	// load returns a shard whose first dueKeys keys are due once the returned deadline has passed.
+	// The deadline leaves time for the load, BulkLoad skips the keys that are already expired
+	load := func(indexed bool) (*MapStorage, time.Time) {
+		due := time.Now().Add(20 * time.Millisecond)
+		entries := make([]Entry, ttlKeys)
+		for i, key := range keys {
+			expireAt := due.Add(time.Hour)
+			if i < dueKeys {
+				expireAt = due
+			}
+			entries[i] = Entry{Key: key, ExpireAt: expireAt.UnixNano(), Entity: Entity{Type: TypeString, Value: "v"}}
+		}
+
+		m := NewMapStorage()
+		m.SetExpireIndex(indexed)
+		m.BulkLoad(entries)
+		return m, due
+	}
+
+	b.Run("Sampling", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			m, due := load(false)
+			if m.Len() != ttlKeys {
+				b.Fatalf("loaded %d keys, want %d", m.Len(), ttlKeys)
+			}
+			time.Sleep(time.Until(due) + time.Millisecond)
+			b.StartTimer()
+
+			for m.Len() > ttlKeys-dueKeys {
+				m.DeleteExpired(samples)
+			}
+		}
+	})
+
+	b.Run("Index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			m, due := load(true)
+			time.Sleep(time.Until(due) + time.Millisecond)
+			b.StartTimer()
+
+			if n, _ := m.ExpireDue(time.Now(), dueKeys); n != dueKeys {
+				b.Fatalf("ExpireDue deleted %d keys, want %d", n, dueKeys)
+			}
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streams are stored as a *Stream. Entries are only appended with increasing IDs, so the slice stays
+// ordered by ID and ranges are found with a binary search
+
+var (
+	ErrInvalidStreamID  = errors.New("ERR Invalid stream ID specified as stream command argument")
+	ErrStreamIDZero     = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrStreamExhausted  = errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+)
+
+// StreamID identifies a stream entry: the milliseconds part and a sequence number within the millisecond
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxStreamID is the greatest possible ID, the "+" of XRANGE
+var MaxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// String formats the ID as "ms-seq"
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Less reports whether id is ordered before other
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// Compare returns -1, 0 or +1 depending on whether id is ordered before, equal to or after other
+func (id StreamID) Compare(other StreamID) int {
+	if c := cmp.Compare(id.Ms, other.Ms); c != 0 {
+		return c
+	}
+	return cmp.Compare(id.Seq, other.Seq)
+}
+
+// Next returns the smallest ID greater than id, false if id is MaxStreamID
+func (id StreamID) Next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the greatest ID smaller than id, false if id is 0-0
+func (id StreamID) Prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// ParseStreamID parses "ms-seq" or "ms", the sequence number of the latter is missingSeq.
+// Returns ErrInvalidStreamID if s is not an ID
+func ParseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{Ms: ms, Seq: missingSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// StreamIDMode tells XAdd which parts of the ID of a new entry are generated
+type StreamIDMode int
+
+const (
+	// StreamIDExplicit uses the ID as given ("ms-seq")
+	StreamIDExplicit StreamIDMode = iota
+	// StreamIDAutoSeq generates the sequence number within the given milliseconds ("ms-*")
+	StreamIDAutoSeq
+	// StreamIDAuto generates the whole ID from the clock ("*")
+	StreamIDAuto
+)
+
+// StreamEntry is a single entry of a stream
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // field value pairs in insertion order
+}
+
+// Stream is an append-only log of entries ordered by ID
+type Stream struct {
+	Entries []StreamEntry
+	LastID  StreamID                // ID of the last entry ever added, the ID of a new entry must be greater
+	Groups  map[string]*StreamGroup // consumer groups by name
+}
+
+// nextID returns the ID of a new entry added with mode, id is ignored by StreamIDAuto
+func (s *Stream) nextID(id StreamID, mode StreamIDMode) (StreamID, error) {
+	switch mode {
+	case StreamIDAuto:
+		ms := uint64(time.Now().UnixMilli())
+		if ms > s.LastID.Ms {
+			return StreamID{Ms: ms}, nil
+		}
+		next, ok := s.LastID.Next()
+		if !ok {
+			return StreamID{}, ErrStreamExhausted
+		}
+		return next, nil
+	case StreamIDAutoSeq:
+		switch {
+		case id.Ms > s.LastID.Ms:
+			id.Seq = 0
+		case id.Ms == s.LastID.Ms && s.LastID.Seq < math.MaxUint64:
+			id.Seq = s.LastID.Seq + 1
+		default:
+			return StreamID{}, ErrStreamIDTooSmall
+		}
+		return id, nil
+	}
+
+	if id == (StreamID{}) {
+		return StreamID{}, ErrStreamIDZero
+	}
+	if !s.LastID.Less(id) {
+		return StreamID{}, ErrStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// XAdd appends an entry with the field value pairs to the stream stored at key, creating the stream if needed.
+// Returns the ID of the entry, ErrStreamIDZero or ErrStreamIDTooSmall if the ID is not greater than the top entry
+func (m *MapStorage) XAdd(key string, id StreamID, mode StreamIDMode, fields []string) (StreamID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil {
+		return StreamID{}, err
+	}
+
+	stream := &Stream{}
+	if found {
+		stream = entity.Value.(*Stream)
+	}
+
+	id, err = stream.nextID(id, mode)
+	if err != nil {
+		return StreamID{}, err
+	}
+
+	stream.Entries = append(stream.Entries, StreamEntry{ID: id, Fields: fields})
+	stream.LastID = id
+
+	if !found {
+		entity.Type = TypeStream
+		entity.Value = stream
+		m.storeLocked(key, entity)
+	}
+
+	return id, nil
+}
+
+// XLen returns the number of entries of the stream stored at key, 0 if the key does not exist
+func (m *MapStorage) XLen(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	return int64(len(entity.Value.(*Stream).Entries)), nil
+}
+
+// XRange returns the entries of the stream stored at key with IDs between start and end inclusive,
+// at most count of them. A negative count means no limit
+func (m *MapStorage) XRange(key string, start, end StreamID, count int) ([]StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	entries := entity.Value.(*Stream).Entries
+	from := sort.Search(len(entries), func(i int) bool { return !entries[i].ID.Less(start) })
+	to := sort.Search(len(entries), func(i int) bool { return end.Less(entries[i].ID) })
+	if from >= to {
+		return []StreamEntry{}, nil
+	}
+	if count >= 0 && to-from > count {
+		to = from + count
+	}
+
+	// the entries are never modified after they are added, the copy only detaches the slice
+	return append([]StreamEntry(nil), entries[from:to]...), nil
+}
+
+// XLastID returns the ID of the last entry added to the stream stored at key, 0-0 if the key does not exist
+func (m *MapStorage) XLastID(key string) (StreamID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil || !found {
+		return StreamID{}, err
+	}
+
+	return entity.Value.(*Stream).LastID, nil
+}
@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNoGroup   = errors.New("NOGROUP No such consumer group")
+	ErrBusyGroup = errors.New("BUSYGROUP Consumer Group name already exists")
+)
+
+// StreamGroup is a consumer group of a stream. Every entry delivered to a consumer stays in the pending
+// entries list of the group until it is acknowledged, so a crashed consumer's entries can be claimed by another
+type StreamGroup struct {
+	LastDelivered StreamID                  // ID of the last entry delivered with ">"
+	Pending       map[StreamID]PendingEntry // delivered entries that were not acknowledged yet
+	Consumers     map[string]int64          // consumer - Unix milliseconds it was last seen
+}
+
+// PendingEntry is a delivered entry waiting for XACK
+type PendingEntry struct {
+	Consumer    string // owner of the entry
+	DeliveredAt int64  // Unix milliseconds of the last delivery
+	Deliveries  int64  // number of times the entry was delivered
+}
+
+// PendingInfo describes a single pending entry, as reported by the extended form of XPENDING
+type PendingInfo struct {
+	ID         StreamID
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// PendingSummary is the summary form of XPENDING
+type PendingSummary struct {
+	Count     int64
+	First     StreamID         // smallest pending ID, meaningful only when Count > 0
+	Last      StreamID         // greatest pending ID, meaningful only when Count > 0
+	Consumers map[string]int64 // consumer - number of its pending entries
+}
+
+// XClaimOptions are the options of XClaim
+type XClaimOptions struct {
+	DeliveredAt int64 // Unix milliseconds recorded as the delivery time, 0 means now
+	RetryCount  int64 // delivery counter to set, negative means increment it unless JustID is set
+	Force       bool  // claim entries of the stream that are not pending, as if they were delivered
+	JustID      bool  // return only the IDs and leave the delivery counter untouched
+}
+
+// newStreamGroup creates a group that delivers the entries after lastDelivered
+func newStreamGroup(lastDelivered StreamID) *StreamGroup {
+	return &StreamGroup{
+		LastDelivered: lastDelivered,
+		Pending:       make(map[StreamID]PendingEntry),
+		Consumers:     make(map[string]int64),
+	}
+}
+
+// sortedPending returns the IDs of the pending entries in order
+func (g *StreamGroup) sortedPending() []StreamID {
+	ids := make([]StreamID, 0, len(g.Pending))
+	for id := range g.Pending {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, StreamID.Compare)
+	return ids
+}
+
+// entry returns the entry of the stream with the given ID
+func (s *Stream) entry(id StreamID) (StreamEntry, bool) {
+	i, found := slices.BinarySearchFunc(s.Entries, id, func(e StreamEntry, id StreamID) int {
+		return e.ID.Compare(id)
+	})
+	if !found {
+		return StreamEntry{}, false
+	}
+	return s.Entries[i], true
+}
+
+// groupLocked returns the stream stored at key and its consumer group. Caller must hold the write lock
+func (m *MapStorage) groupLocked(key, group string) (*Stream, *StreamGroup, error) {
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, ErrNoGroup
+	}
+
+	stream := entity.Value.(*Stream)
+	g, ok := stream.Groups[group]
+	if !ok {
+		return nil, nil, ErrNoGroup
+	}
+
+	return stream, g, nil
+}
+
+// XGroupCreate creates a consumer group that delivers the entries after id, or after the last entry if last
+// is set. A missing stream is created empty with mkStream, otherwise ErrNoSuchKey is returned.
+// Returns ErrBusyGroup if the group exists
+func (m *MapStorage) XGroupCreate(key, group string, id StreamID, last, mkStream bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil {
+		return err
+	}
+	if !found && !mkStream {
+		return ErrNoSuchKey
+	}
+
+	stream := &Stream{}
+	if found {
+		stream = entity.Value.(*Stream)
+	}
+	if _, ok := stream.Groups[group]; ok {
+		return ErrBusyGroup
+	}
+
+	if last {
+		id = stream.LastID
+	}
+	if stream.Groups == nil {
+		stream.Groups = make(map[string]*StreamGroup)
+	}
+	stream.Groups[group] = newStreamGroup(id)
+
+	if !found {
+		entity.Type = TypeStream
+		entity.Value = stream
+		m.storeLocked(key, entity)
+	}
+
+	return nil
+}
+
+// XGroupDestroy deletes the consumer group with its pending entries. Returns true if the group existed
+// and ErrNoSuchKey if the stream does not exist
+func (m *MapStorage) XGroupDestroy(key, group string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entity, found, err := m.getTyped(key, TypeStream)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, ErrNoSuchKey
+	}
+
+	stream := entity.Value.(*Stream)
+	if _, ok := stream.Groups[group]; !ok {
+		return false, nil
+	}
+	delete(stream.Groups, group)
+
+	return true, nil
+}
+
+// XReadGroup reads entries of the stream stored at key on behalf of a consumer of the group, at most count
+// of them, a negative count means no limit. With after nil the entries never delivered to the group are
+// returned and become pending for the consumer, unless noAck is set. Otherwise the pending entries of the
+// consumer with IDs greater than after are delivered again. Returns ErrNoGroup if the group does not exist
+func (m *MapStorage) XReadGroup(key, group, consumer string, after *StreamID, count int, noAck bool) ([]StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stream, g, err := m.groupLocked(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	g.Consumers[consumer] = now
+
+	var entries []StreamEntry
+	if after == nil {
+		start, ok := g.LastDelivered.Next()
+		if !ok {
+			return []StreamEntry{}, nil
+		}
+		from := sort.Search(len(stream.Entries), func(i int) bool { return !stream.Entries[i].ID.Less(start) })
+		for _, entry := range stream.Entries[from:] {
+			if count >= 0 && len(entries) == count {
+				break
+			}
+			entries = append(entries, entry)
+			g.LastDelivered = entry.ID
+			if !noAck {
+				g.Pending[entry.ID] = PendingEntry{Consumer: consumer, DeliveredAt: now, Deliveries: 1}
+			}
+		}
+		return entries, nil
+	}
+
+	for _, id := range g.sortedPending() {
+		if count >= 0 && len(entries) == count {
+			break
+		}
+		pending := g.Pending[id]
+		if pending.Consumer != consumer || !after.Less(id) {
+			continue
+		}
+
+		entry, ok := stream.entry(id)
+		if !ok {
+			continue
+		}
+		entries = append(entries, entry)
+		pending.DeliveredAt = now
+		pending.Deliveries++
+		g.Pending[id] = pending
+	}
+
+	return entries, nil
+}
+
+// XAck removes the IDs from the pending entries of the group. Returns the number of acknowledged entries,
+// 0 if the stream or the group does not exist
+func (m *MapStorage) XAck(key, group string, ids []StreamID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, g, err := m.groupLocked(key, group)
+	if errors.Is(err, ErrNoGroup) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var acked int64
+	for _, id := range ids {
+		if _, ok := g.Pending[id]; ok {
+			delete(g.Pending, id)
+			acked++
+		}
+	}
+
+	return acked, nil
+}
+
+// XPending returns the summary of the pending entries of the group. Returns ErrNoGroup if the group does not exist
+func (m *MapStorage) XPending(key, group string) (PendingSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, g, err := m.groupLocked(key, group)
+	if err != nil {
+		return PendingSummary{}, err
+	}
+
+	summary := PendingSummary{Consumers: make(map[string]int64)}
+	for id, pending := range g.Pending {
+		if summary.Count == 0 || id.Less(summary.First) {
+			summary.First = id
+		}
+		if summary.Count == 0 || summary.Last.Less(id) {
+			summary.Last = id
+		}
+		summary.Count++
+		summary.Consumers[pending.Consumer]++
+	}
+
+	return summary, nil
+}
+
+// XPendingRange returns at most count pending entries of the group with IDs between start and end inclusive
+// that are idle for at least minIdle. A non-empty consumer limits the entries to those it owns.
+// Returns ErrNoGroup if the group does not exist
+func (m *MapStorage) XPendingRange(key, group string, start, end StreamID, count int, consumer string, minIdle time.Duration) ([]PendingInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, g, err := m.groupLocked(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	infos := []PendingInfo{}
+	for _, id := range g.sortedPending() {
+		if len(infos) == count {
+			break
+		}
+		if id.Less(start) || end.Less(id) {
+			continue
+		}
+
+		pending := g.Pending[id]
+		idle := time.Duration(now-pending.DeliveredAt) * time.Millisecond
+		if (consumer != "" && pending.Consumer != consumer) || idle < minIdle {
+			continue
+		}
+		infos = append(infos, PendingInfo{ID: id, Consumer: pending.Consumer, Idle: idle, Deliveries: pending.Deliveries})
+	}
+
+	return infos, nil
+}
+
+// XClaim transfers the pending entries idle for at least minIdle to the consumer and records a new delivery.
+// IDs that are not pending are skipped unless opts.Force is set and the entry exists. Returns the claimed
+// entries, with opts.JustID only their IDs are meaningful. Returns ErrNoGroup if the group does not exist
+func (m *MapStorage) XClaim(key, group, consumer string, minIdle time.Duration, ids []StreamID, opts XClaimOptions) ([]StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stream, g, err := m.groupLocked(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	g.Consumers[consumer] = now
+
+	deliveredAt := now
+	if opts.DeliveredAt > 0 {
+		deliveredAt = opts.DeliveredAt
+	}
+
+	claimed := []StreamEntry{}
+	for _, id := range ids {
+		entry, exists := stream.entry(id)
+		pending, ok := g.Pending[id]
+		if !ok {
+			if !opts.Force || !exists {
+				continue
+			}
+			pending = PendingEntry{}
+		} else if time.Duration(now-pending.DeliveredAt)*time.Millisecond < minIdle {
+			continue
+		}
+
+		pending.Consumer = consumer
+		pending.DeliveredAt = deliveredAt
+		switch {
+		case opts.RetryCount >= 0:
+			pending.Deliveries = opts.RetryCount
+		case !opts.JustID:
+			pending.Deliveries++
+		}
+		g.Pending[id] = pending
+
+		if opts.JustID || exists {
+			entry.ID = id
+			claimed = append(claimed, entry)
+		}
+	}
+
+	return claimed, nil
+}
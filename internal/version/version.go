@@ -0,0 +1,16 @@
+// Package version holds the build information of the server.
+// The variables are injected at build time, for example:
+//
+//	go build -ldflags "-X github.com/eternalApril/moonlight/internal/version.Version=1.2.0 \
+//		-X github.com/eternalApril/moonlight/internal/version.GitSHA=$(git rev-parse --short HEAD) \
+//		-X github.com/eternalApril/moonlight/internal/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+// Version is the release version of the server
+var Version = "1.0.0"
+
+// GitSHA is the commit the binary was built from
+var GitSHA = "unknown"
+
+// BuildDate is the UTC time the binary was built at
+var BuildDate = "unknown"
@@ -0,0 +1,187 @@
+// Package moonlight embeds the Moonlight key-value store into a Go program.
+// A DB executes commands in-process through the same engine that serves TCP clients,
+// so embedded callers and network clients share the data, the AOF and the expiration
+package moonlight
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/eternalApril/moonlight/internal/config"
+	"github.com/eternalApril/moonlight/internal/resp"
+	"github.com/eternalApril/moonlight/internal/server"
+	"github.com/eternalApril/moonlight/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Config is the configuration of the server, see LoadConfig
+type Config = config.Config
+
+// LoadConfig reads config.yml from path, applies MOONLIGHT_* environment variables and the defaults
+func LoadConfig(path string) (*Config, error) {
+	return config.Load(path)
+}
+
+// DB is an open Moonlight instance. It is safe for concurrent use
+type DB struct {
+	engine *server.Engine
+}
+
+// Open creates the storage and the engine described by cfg and restores the persisted data
+func Open(cfg *Config, log *zap.Logger) (*DB, error) {
+	db, err := storage.NewShardedMapStorage(cfg.Storage.ShardCount)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotMode, err := storage.ParseSnapshotMode(cfg.Persistence.RDB.Mode)
+	if err != nil {
+		return nil, err
+	}
+	db.SetSnapshotMode(snapshotMode)
+
+	hashFunc, err := storage.ParseHashFunc(cfg.Storage.HashFunc)
+	if err != nil {
+		return nil, err
+	}
+	db.SetHashFunc(hashFunc)
+	db.SetExpireJitter(cfg.Storage.ExpireJitter)
+	db.SetMaxStringLen(cfg.Storage.ProtoMaxStringLen)
+	db.SetMaxListLen(cfg.Storage.ListMaxLen)
+	db.SetExpireIndex(cfg.Storage.ExpireIndex)
+
+	engine, err := server.NewEngine(db, cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{engine: engine}, nil
+}
+
+// HandleConnection serves a RESP client on conn until it disconnects
+func (db *DB) HandleConnection(conn net.Conn) {
+	db.engine.HandleConnection(conn)
+}
+
+// Reload applies the settings of cfg that can change at runtime, see the Configuration section of the README.
+// Settings that need a restart are ignored with a logged warning
+func (db *DB) Reload(cfg *Config) {
+	db.engine.Reload(cfg)
+}
+
+// Close stops the background tasks and flushes the AOF
+func (db *DB) Close() {
+	db.engine.Shutdown()
+}
+
+// Get returns the value of key and false if the key does not exist
+func (db *DB) Get(key string) (string, bool, error) {
+	res := db.engine.Do("GET", key)
+	if err := replyError(res); err != nil {
+		return "", false, err
+	}
+	if res.IsNull {
+		return "", false, nil
+	}
+	return string(res.String), true, nil
+}
+
+// Set stores value at key. A positive ttl sets the expiration, zero keeps the key forever
+func (db *DB) Set(key, value string, ttl time.Duration) error {
+	args := []string{key, value}
+	if ttl > 0 {
+		args = append(args, "PX", milliseconds(ttl))
+	}
+	return replyError(db.engine.Do("SET", args...))
+}
+
+// Del deletes the keys and returns the number of deleted keys
+func (db *DB) Del(keys ...string) (int64, error) {
+	return integerReply(db.engine.Do("DEL", keys...))
+}
+
+// Expire sets a timeout on key. Returns false if the key does not exist
+func (db *DB) Expire(key string, ttl time.Duration) (bool, error) {
+	n, err := integerReply(db.engine.Do("PEXPIRE", key, milliseconds(ttl)))
+	return n == 1, err
+}
+
+// TTL returns the remaining lifetime of key, -1 if the key has no expiration and -2 if the key does not exist,
+// the same as PTTL
+func (db *DB) TTL(key string) (time.Duration, error) {
+	n, err := integerReply(db.engine.Do("PTTL", key))
+	if err != nil || n < 0 {
+		return time.Duration(n), err
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// HSet sets the fields of the hash stored at key and returns the number of added fields
+func (db *DB) HSet(key string, fields map[string]string) (int64, error) {
+	args := make([]string, 0, 1+2*len(fields))
+	args = append(args, key)
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	return integerReply(db.engine.Do("HSET", args...))
+}
+
+// HGet returns the value of field in the hash stored at key and false if it does not exist
+func (db *DB) HGet(key, field string) (string, bool, error) {
+	res := db.engine.Do("HGET", key, field)
+	if err := replyError(res); err != nil {
+		return "", false, err
+	}
+	if res.IsNull {
+		return "", false, nil
+	}
+	return string(res.String), true, nil
+}
+
+// HGetAll returns all fields and values of the hash stored at key
+func (db *DB) HGetAll(key string) (map[string]string, error) {
+	res := db.engine.Do("HGETALL", key)
+	if err := replyError(res); err != nil {
+		return nil, err
+	}
+
+	// the in-process peer speaks RESP2, the reply is a flat array of fields and values
+	fields := make(map[string]string, len(res.Array)/2)
+	for i := 0; i+1 < len(res.Array); i += 2 {
+		fields[string(res.Array[i].String)] = string(res.Array[i+1].String)
+	}
+	return fields, nil
+}
+
+// HDel removes the fields from the hash stored at key and returns the number of removed fields
+func (db *DB) HDel(key string, fields ...string) (int64, error) {
+	return integerReply(db.engine.Do("HDEL", append([]string{key}, fields...)...))
+}
+
+// milliseconds formats ttl as whole milliseconds. A positive ttl below a millisecond is rounded up to one,
+// so it expires the key instead of being read as no expiration by SET or as an immediate one by PEXPIRE
+func milliseconds(ttl time.Duration) string {
+	ms := ttl.Milliseconds()
+	if ttl > 0 && ms == 0 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// replyError converts an error reply into a Go error
+func replyError(res resp.Value) error {
+	if res.Type == resp.TypeError {
+		return errors.New(string(res.String))
+	}
+	return nil
+}
+
+// integerReply returns the integer of the reply or the error it holds
+func integerReply(res resp.Value) (int64, error) {
+	if err := replyError(res); err != nil {
+		return 0, err
+	}
+	return res.Integer, nil
+}
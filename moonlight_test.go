@@ -0,0 +1,199 @@
+package moonlight_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eternalApril/moonlight"
+	"go.uber.org/zap"
+)
+
+func openDB(t *testing.T) *moonlight.DB {
+	t.Helper()
+
+	cfg, err := moonlight.LoadConfig(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	db, err := moonlight.Open(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+// serve runs a listener for db and returns its address
+func serve(t *testing.T, db *moonlight.DB) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() }) //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go db.HandleConnection(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestDB_Strings(t *testing.T) {
+	db := openDB(t)
+
+	if _, ok, err := db.Get("k"); ok || err != nil {
+		t.Fatalf("expected missing key, got %v %v", ok, err)
+	}
+
+	if err := db.Set("k", "v", 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if v, ok, err := db.Get("k"); v != "v" || !ok || err != nil {
+		t.Errorf("Get returned %q %v %v", v, ok, err)
+	}
+
+	if ttl, _ := db.TTL("k"); ttl != -1 { //nolint:errcheck
+		t.Errorf("expected no expiration, got %v", ttl)
+	}
+	if ok, err := db.Expire("k", time.Minute); !ok || err != nil {
+		t.Errorf("Expire returned %v %v", ok, err)
+	}
+	if ttl, _ := db.TTL("k"); ttl <= 0 || ttl > time.Minute { //nolint:errcheck
+		t.Errorf("unexpected TTL %v", ttl)
+	}
+
+	if err := db.Set("short", "v", 10*time.Millisecond); err != nil {
+		t.Fatalf("Set with TTL failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok, _ := db.Get("short"); ok { //nolint:errcheck
+		t.Error("key with TTL did not expire")
+	}
+
+	if n, err := db.Del("k", "missing"); n != 1 || err != nil {
+		t.Errorf("Del returned %d %v", n, err)
+	}
+}
+
+func TestDB_SubMillisecondTTL(t *testing.T) {
+	db := openDB(t)
+
+	if err := db.Set("set", "v", 500*time.Microsecond); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := db.Set("expire", "v", 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if ok, err := db.Expire("expire", 500*time.Microsecond); !ok || err != nil {
+		t.Errorf("Expire returned %v %v", ok, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	for _, key := range []string{"set", "expire"} {
+		if _, ok, _ := db.Get(key); ok { //nolint:errcheck
+			t.Errorf("%s: a sub-millisecond TTL must expire the key", key)
+		}
+	}
+}
+
+func TestDB_Hashes(t *testing.T) {
+	db := openDB(t)
+
+	if n, err := db.HSet("h", map[string]string{"a": "1", "b": "2"}); n != 2 || err != nil {
+		t.Fatalf("HSet returned %d %v", n, err)
+	}
+	if v, ok, err := db.HGet("h", "a"); v != "1" || !ok || err != nil {
+		t.Errorf("HGet returned %q %v %v", v, ok, err)
+	}
+
+	all, err := db.HGetAll("h")
+	if err != nil || len(all) != 2 || all["b"] != "2" {
+		t.Errorf("HGetAll returned %v %v", all, err)
+	}
+
+	if n, err := db.HDel("h", "a", "missing"); n != 1 || err != nil {
+		t.Errorf("HDel returned %d %v", n, err)
+	}
+
+	if _, _, err := db.Get("h"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("expected WRONGTYPE error, got %v", err)
+	}
+}
+
+func TestDB_ConcurrentWithServer(t *testing.T) {
+	db := openDB(t)
+	addr := serve(t, db)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	reader := bufio.NewReader(conn)
+
+	const keys = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+
+	// embedded writers and readers
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				key := fmt.Sprintf("embedded:%d:%d", w, i)
+				if err := db.Set(key, "v", 0); err != nil {
+					errs <- err
+					return
+				}
+				if _, ok, err := db.Get(key); !ok || err != nil {
+					errs <- fmt.Errorf("embedded key %s lost: %v", key, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// a network client writes at the same time
+	for i := range keys {
+		fmt.Fprintf(conn, "*3\r\n$3\r\nSET\r\n$%d\r\ntcp:%d\r\n$1\r\nv\r\n", len(fmt.Sprintf("tcp:%d", i)), i)
+		line, err := reader.ReadString('\n')
+		if err != nil || line != "+OK\r\n" {
+			t.Fatalf("SET over TCP returned %q %v", line, err)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// both sides see each other's writes
+	for i := range keys {
+		if _, ok, _ := db.Get(fmt.Sprintf("tcp:%d", i)); !ok { //nolint:errcheck
+			t.Fatalf("key tcp:%d written over TCP is not visible to the embedded API", i)
+		}
+	}
+
+	fmt.Fprint(conn, "*2\r\n$3\r\nGET\r\n$12\r\nembedded:0:0\r\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "$1\r\n" {
+		t.Errorf("GET over TCP returned %q %v", line, err)
+	}
+}